@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ---------------------- Adaptive Huffman (method adaptive) ----------
+//
+// FGK adaptive Huffman coding: encoder and decoder start from the same
+// empty tree and update it after every byte, so no code table is stored
+// and the data is coded in a single pass. A byte seen for the first time
+// is sent as the code of the NYT ("not yet transmitted") leaf followed by
+// its 8 bits. Method data is just the bit stream; the raw length in the
+// block header says how many bytes to decode.
+
+// ahMaxNodes is the size of a tree over 256 symbols plus NYT.
+const ahMaxNodes = 2*256 + 1
+
+type ahNode struct {
+	weight              uint64
+	parent, left, right int // -1 = none
+	sym                 int // byte value for leaves, -1 otherwise
+}
+
+// adaptiveTree keeps the sibling property: node numbers are ordered by
+// weight, with the root at the highest number.
+type adaptiveTree struct {
+	nodes [ahMaxNodes]ahNode
+	leaf  [256]int // node of each symbol, 0 = not yet seen
+	nyt   int
+}
+
+func newAdaptiveTree() *adaptiveTree {
+	t := &adaptiveTree{nyt: ahMaxNodes - 1}
+	t.nodes[t.nyt] = ahNode{parent: -1, left: -1, right: -1, sym: -1}
+	return t
+}
+
+func (t *adaptiveTree) root() int { return ahMaxNodes - 1 }
+
+// swap exchanges the subtrees at node numbers a and b.
+func (t *adaptiveTree) swap(a, b int) {
+	na, nb := t.nodes[a], t.nodes[b]
+	na.parent, nb.parent = nb.parent, na.parent
+	t.nodes[a], t.nodes[b] = nb, na
+	for _, i := range []int{a, b} {
+		n := t.nodes[i]
+		if n.left >= 0 {
+			t.nodes[n.left].parent = i
+			t.nodes[n.right].parent = i
+		} else if n.sym >= 0 {
+			t.leaf[n.sym] = i
+		} else {
+			t.nyt = i
+		}
+	}
+}
+
+// update adds one occurrence of sym to the tree.
+func (t *adaptiveTree) update(sym byte) {
+	q := t.leaf[sym]
+	if q == 0 {
+		// split NYT into a new NYT (left) and the new leaf (right)
+		p := t.nyt
+		t.nodes[p].left, t.nodes[p].right = p-2, p-1
+		t.nodes[p-1] = ahNode{parent: p, left: -1, right: -1, sym: int(sym)}
+		t.nodes[p-2] = ahNode{parent: p, left: -1, right: -1, sym: -1}
+		t.leaf[sym] = p - 1
+		t.nyt = p - 2
+		q = p - 1
+	}
+	for q >= 0 {
+		w := t.nodes[q].weight
+		leader := q
+		for leader+1 < ahMaxNodes && t.nodes[leader+1].weight == w {
+			leader++
+		}
+		if leader != q && leader != t.nodes[q].parent {
+			t.swap(q, leader)
+			q = leader
+		}
+		t.nodes[q].weight++
+		q = t.nodes[q].parent
+	}
+}
+
+// writeCode writes the code of node n (leaf-to-root path, reversed).
+func (t *adaptiveTree) writeCode(w *bitWriter, n int) {
+	var path [ahMaxNodes]bool
+	depth := 0
+	for n != t.root() {
+		p := t.nodes[n].parent
+		path[depth] = t.nodes[p].right == n
+		depth++
+		n = p
+	}
+	for i := depth - 1; i >= 0; i-- {
+		w.writeBit(path[i])
+	}
+}
+
+func adaptiveEncode(raw []byte) ([]byte, error) {
+	t := newAdaptiveTree()
+	var buf bytes.Buffer
+	w := newBitWriter(&buf)
+	for _, b := range raw {
+		if n := t.leaf[b]; n != 0 {
+			t.writeCode(w, n)
+		} else {
+			t.writeCode(w, t.nyt)
+			for i := 7; i >= 0; i-- {
+				w.writeBit(b>>i&1 == 1)
+			}
+		}
+		t.update(b)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func adaptiveDecode(data []byte, rawLen int) ([]byte, error) {
+	t := newAdaptiveTree()
+	r := newBitReader(bytes.NewReader(data))
+	out := make([]byte, 0, rawLen)
+	for len(out) < rawLen {
+		n := t.root()
+		for t.nodes[n].left >= 0 {
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, errors.New("adaptive Huffman data truncated")
+			}
+			if bit == 1 {
+				n = t.nodes[n].right
+			} else {
+				n = t.nodes[n].left
+			}
+		}
+		var b byte
+		if n == t.nyt {
+			for i := 0; i < 8; i++ {
+				bit, err := r.readBit()
+				if err != nil {
+					return nil, errors.New("adaptive Huffman data truncated")
+				}
+				b = b<<1 | byte(bit)
+			}
+			if t.leaf[b] != 0 {
+				return nil, errors.New("corrupt adaptive Huffman data")
+			}
+		} else {
+			b = byte(t.nodes[n].sym)
+		}
+		out = append(out, b)
+		t.update(b)
+	}
+	return out, nil
+}
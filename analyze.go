@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---------------------- Size estimates (analyze) --------------------
+//
+// "ghzip analyze <path>" predicts the archive size of a tree without
+// writing one. Every block of every file is histogrammed; its order-0
+// entropy is what the default Huffman method gets close to, plus the
+// 256-byte code table. Blocks encodeBlock would store (known compressed
+// formats, high entropy) count in full. The totals are summed per
+// directory, down to -depth levels below the path.
+
+// sizeEstimate sums the files of one directory.
+type sizeEstimate struct {
+	files int
+	raw   int64
+	est   int64
+}
+
+func (s *sizeEstimate) add(o sizeEstimate) {
+	s.files += o.files
+	s.raw += o.raw
+	s.est += o.est
+}
+
+// ratio returns the estimated size as a percentage of the original.
+func (s sizeEstimate) ratio() float64 {
+	if s.raw == 0 {
+		return 100
+	}
+	return 100 * float64(s.est) / float64(s.raw)
+}
+
+// estimateBlock returns the estimated coded size of one block, including
+// its method and length header.
+func estimateBlock(b []byte) int64 {
+	if highEntropy(b) {
+		return int64(5 + len(b))
+	}
+	var freq [256]int
+	for _, c := range b {
+		freq[c]++
+	}
+	bits := 0.0
+	for _, f := range freq {
+		if f > 0 {
+			bits += float64(f) * math.Log2(float64(len(b))/float64(f))
+		}
+	}
+	return 5 + min(256+int64(math.Ceil(bits/8)), int64(len(b)))
+}
+
+// estimateFile reads the file at path block by block and estimates its
+// compressed size.
+func estimateFile(path string, buf []byte) (sizeEstimate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sizeEstimate{}, err
+	}
+	defer f.Close()
+	e := sizeEstimate{files: 1}
+	first := true
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			b := buf[:n]
+			e.raw += int64(n)
+			if first && knownCompressed(b) {
+				// stored whole, no need to read the rest
+				st, err := f.Stat()
+				if err != nil {
+					return e, err
+				}
+				e.raw = st.Size()
+				e.est = st.Size() + 5*(st.Size()/int64(len(buf))+1)
+				return e, nil
+			}
+			e.est += estimateBlock(b)
+		}
+		first = false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return e, nil
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+}
+
+// analyzeTree estimates every regular file below root and sums the
+// results by directory relative to base, cut to depth levels below it.
+func analyzeTree(root, base string, depth int) (map[string]*sizeEstimate, error) {
+	dirs := map[string]*sizeEstimate{}
+	buf := make([]byte, defaultBlockSize)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		e, err := estimateFile(path, buf)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if rel == "." {
+			parts = nil
+		}
+		key := strings.Join(parts[:min(depth, len(parts))], "/")
+		if dirs[key] == nil {
+			dirs[key] = &sizeEstimate{}
+		}
+		dirs[key].add(e)
+		return nil
+	})
+	return dirs, err
+}
+
+// runAnalyze implements "ghzip analyze".
+func runAnalyze(args []string) {
+	cmd := flag.NewFlagSet("analyze", flag.ExitOnError)
+	depth := cmd.Int("depth", 1, "sum directories `n` levels below the path")
+	parseCommand(cmd, args)
+	if cmd.NArg() != 1 {
+		fmt.Println("usage: ghzip analyze [-depth n] <file or directory>")
+		return
+	}
+	if *depth < 0 {
+		fail("-depth must not be negative")
+		return
+	}
+	root := cmd.Arg(0)
+	fi, err := os.Stat(root)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	base := root
+	if !fi.IsDir() {
+		base = filepath.Dir(root)
+	}
+	dirs, err := analyzeTree(root, base, *depth)
+	if err != nil {
+		fail("Analyze failed: %v", err)
+		return
+	}
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total sizeEstimate
+	fmt.Printf("%-40s %7s %14s %14s %7s\n", "Directory", "Files", "Size", "Estimated", "Ratio")
+	for _, name := range names {
+		e := dirs[name]
+		total.add(*e)
+		label := filepath.Join(base, filepath.FromSlash(name))
+		fmt.Printf("%-40s %7d %14d %14d %6.1f%%\n", label, e.files, e.raw, e.est, e.ratio())
+	}
+	fmt.Printf("%-40s %7d %14d %14d %6.1f%%\n", "Total", total.files, total.raw, total.est, total.ratio())
+	fmt.Println("\nEstimates are for the default huffman method; lz77, bwt and the -1 ... -9 levels usually do better.")
+}
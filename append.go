@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------- Appending (-a) -----------------------------
+//
+// "ghzip -a -in newdir -out existing.gha" adds entries to an archive. The
+// archive keeps its ID, key slots and master key, so whatever opened it
+// (passwords, recipients, security keys) still does, but it is written
+// anew next to the old one and renamed over it: the metadata totals are
+// part of what every block authenticates, and the block after the old
+// last one must no longer be marked final. The old blocks are only
+// decrypted and sealed again, not decompressed, so appending costs about
+// one read and write of the archive plus compressing the new files.
+//
+// With -replace the entries of a -per-file archive named like a file
+// being appended are left out of the copy: every entry starts a block of
+// its own, so its blocks are simply not copied. Only the first block of
+// each entry is decoded to find them, and whole entries only when they are
+// chunked, to see which files their shared chunks are read from. An entry
+// kept whose data is that of a replaced one (a hard link, copy or chunked
+// file naming it) makes appending fail, as it would lose its data.
+
+// appendArchive adds inputPath (a file or directory) to the v2 archive at
+// archivePath, opened with password. opts says how to pack the new
+// entries; without -method or -level they are compressed the way the
+// archive's last compressed block was.
+func appendArchive(inputPath, archivePath, password string, opts createOptions) error {
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	hadSig, recovery, err := archiveTrailers(archivePath)
+	if err != nil {
+		return err
+	}
+	ar, err := openArchive(archivePath, password)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+	if ar.version == versionV1 {
+		return errors.New("version 1 archives cannot be appended to; create a new archive")
+	}
+	br, meta := ar.blocks, ar.meta
+	if err := checkAppendOptions(meta, br.flags, opts); err != nil {
+		return err
+	}
+	opts.perFile = br.flags&payloadPerFile != 0
+	inherit := opts.method == "" && opts.level == 0
+	p, argv, err := blockPreset(opts)
+	if err != nil {
+		return err
+	}
+	if argv != nil && meta.exec == "" {
+		meta.exec = strings.Join(argv, " ")
+	}
+	inFlight := 0
+	if opts.maxMemory > 0 {
+		size, n, err := fitMemory(opts.maxMemory, p.method, br.size)
+		if err != nil {
+			return err
+		}
+		if size < br.size {
+			return fmt.Errorf("-max-memory %d is too small for the archive's %d byte blocks", opts.maxMemory, br.size)
+		}
+		inFlight = n
+	}
+
+	opts.readAhead = newReadAhead(opts.jobs, readAheadBudget(opts.maxMemory, p.method, br.size, inFlight), nil)
+	defer opts.readAhead.stop()
+	files, err := inputFiles(inputPath, opts, opts.readAhead.add)
+	if err != nil {
+		return err
+	}
+	verbosef("Found %d file(s) to append.", len(files))
+	linkOf, totalBytes := resolveHardlinks(files)
+	var dropped []bool // the blocks of replaced entries
+	if opts.replace {
+		if err := ar.prepare(readOptions{dict: opts.dict}); err != nil {
+			return err
+		}
+		names := make(map[string]bool)
+		for _, f := range files {
+			names[nfc(filepath.ToSlash(f.relPath))] = true
+		}
+		var entries, size uint64
+		if dropped, entries, size, err = replacedBlocks(ar, names); err != nil {
+			return err
+		}
+		meta.entries -= min(entries, meta.entries)
+		meta.totalSize -= min(size, meta.totalSize)
+	}
+	if meta.hasTotals { // an archive without totals cannot gain exact ones
+		meta.entries += uint64(len(files))
+		meta.totalSize += uint64(totalBytes)
+	}
+	if opts.comment != "" {
+		meta.comment = opts.comment
+	}
+	header, authHeader, err := sealHeader(br.aead, ar.table.fixed, ar.table.encodeSlots(), meta)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), ".append-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	cw := &countingWriter{w: tmp}
+	if _, err := cw.Write(header); err != nil {
+		return err
+	}
+	bw, err := newBlockWriter(cw, br.aead, br.size, br.flags, authHeader)
+	if err != nil {
+		return err
+	}
+	bw.coding = blockCoding{method: p.method, effort: p.effort, dict: opts.dict, exec: argv}
+	if inFlight > 0 {
+		bw.workers = min(bw.workers, inFlight)
+	}
+
+	// Copy the old blocks as they are compressed.
+	for i, b := range ar.index {
+		if dropped != nil && dropped[i] {
+			continue
+		}
+		sealed, err := br.sealedAt(ar.r, ar.index, i)
+		if err != nil {
+			return err
+		}
+		plain, err := br.decrypt(sealed, uint64(i), i == len(ar.index)-1)
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(plain[1:5]) != b.rawLen {
+			return fmt.Errorf("block %d does not match the index", i)
+		}
+		if inherit && plain[0] != methodStore && plain[0] != methodExec {
+			bw.coding.method = plain[0]
+		}
+		if b.rawLen == 0 {
+			continue // the only block of an archive without entries
+		}
+		if err := bw.writeEncoded(plain, b.rawLen, b.flags); err != nil {
+			return err
+		}
+		showProgress("Copying", "", b.rawOffset+int64(b.rawLen), ar.total)
+	}
+	if err := writeEntries(bw, files, linkOf, totalBytes, opts); err != nil {
+		return err
+	}
+	if opts.recovery == 0 {
+		opts.recovery = recovery
+	}
+	if err := finishArchive(tmp, cw, bw, archivePath, opts); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	ar.Close() // Windows cannot rename over an open file
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return err
+	}
+	if hadSig && opts.signKey == nil {
+		fmt.Fprintln(os.Stderr, "warning: the archive's signature no longer matches and was dropped; sign it again with -sign")
+	}
+	return nil
+}
+
+// checkAppendOptions refuses options that do not fit the archive being
+// appended to: its dictionary must be given again, an external compressor
+// cannot be swapped for another, and solid archives stay solid.
+func checkAppendOptions(meta archiveMeta, payloadFlags byte, opts createOptions) error {
+	switch {
+	case meta.dictID != nil && opts.dict == nil:
+		return fmt.Errorf("archive was compressed with dictionary %x; pass it with -dict", meta.dictID)
+	case meta.dictID == nil && opts.dict != nil:
+		return errors.New("-dict: the archive was compressed without a dictionary")
+	case opts.dict != nil && !bytes.Equal(dictID(opts.dict), meta.dictID):
+		return fmt.Errorf("dictionary %x does not match the archive's dictionary %x", dictID(opts.dict), meta.dictID)
+	case opts.perFile && payloadFlags&payloadPerFile == 0:
+		return errors.New("-per-file: the archive is solid; entries are appended to it the same way")
+	case opts.replace && payloadFlags&payloadPerFile == 0:
+		return errors.New("-replace: the archive is solid; entries can only be replaced in -per-file archives")
+	}
+	if argv, isExec, _ := parseExecMethod(opts.method); isExec && meta.exec != "" && strings.Join(argv, " ") != meta.exec {
+		return fmt.Errorf("the archive already uses the external compressor %q", meta.exec)
+	}
+	return nil
+}
+
+// replacedBlocks finds the entries of the per-file archive ar that names
+// holds the names of, and returns which blocks are theirs along with how
+// many entries and bytes of file data they take off the header's totals.
+func replacedBlocks(ar *archiveReader, names map[string]bool) (dropped []bool, entries, size uint64, err error) {
+	dropped = make([]bool, len(ar.index))
+	er := newEntryReader(ar)
+	defer er.skipEntry()
+	sizes := make(map[string]uint64) // of the files so far, for copies
+	for k := 0; ; k++ {
+		h, err := ar.nextEntry(er)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if h.refers() {
+			target := make([]byte, h.size)
+			if _, err := io.ReadFull(er, target); err != nil {
+				return nil, 0, 0, noEOF(err)
+			}
+			h.linkTarget = string(target)
+		}
+		var n uint64 // what the entry counts in the header's total
+		switch h.typ {
+		case entryFile, entryChunks:
+			n = h.contentSize()
+		case entryCopy:
+			n = sizes[h.linkTarget]
+		}
+		sizes[h.name] = n
+		if names[h.name] {
+			first, end := er.starts[k], len(ar.index)
+			if k+1 < len(er.starts) {
+				end = er.starts[k+1]
+			}
+			for i := first; i < end; i++ {
+				dropped[i] = true
+			}
+			entries, size = entries+1, size+n
+			verbosef("replacing %s", displayName(h))
+			er.skipEntry()
+			continue
+		}
+		if (h.typ == entryHardlink || h.typ == entryCopy) && names[h.linkTarget] {
+			return nil, 0, 0, fmt.Errorf("-replace: %s has the data of %s; replace both or neither", h.name, h.linkTarget)
+		}
+		if h.typ == entryChunks {
+			lr := &io.LimitedReader{R: er, N: int64(h.size)}
+			for {
+				p, c, err := readChunkRecord(lr)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, 0, 0, fmt.Errorf("%s: %w", h.name, err)
+				}
+				if names[p.name] {
+					return nil, 0, 0, fmt.Errorf("-replace: %s shares chunks of %s; replace both or neither", h.name, p.name)
+				}
+				if p.name == "" {
+					if _, err := io.CopyN(io.Discard, lr, c.size); err != nil {
+						return nil, 0, 0, fmt.Errorf("%s: %w", h.name, noEOF(err))
+					}
+				}
+			}
+		}
+		er.skipEntry()
+	}
+	return dropped, entries, size, nil
+}
+
+// archiveTrailers reports whether the archive at path carries an embedded
+// signature, and the share of its recovery record in percent (0 = none),
+// so that appending can say the signature is gone and keep a recovery
+// record. Self-extracting archives are refused.
+func archiveTrailers(path string) (signed bool, recovery float64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	start, end, sfx, err := sfxRange(f)
+	if err != nil {
+		return false, 0, err
+	}
+	if sfx {
+		return false, 0, errors.New("self-extracting archives cannot be appended to")
+	}
+	size, err := archiveLength(f, end-start)
+	if err != nil {
+		return false, 0, err
+	}
+	if size < end {
+		rh, err := readRecoveryHeader(f, size)
+		if err != nil {
+			return false, 0, err
+		}
+		per := (rh.slices + rh.stripes - 1) / rh.stripes
+		recovery = 100 * float64(rh.parity) / float64(per)
+	}
+	_, rec, err := signatureLength(f, size)
+	if err != nil {
+		return false, 0, err
+	}
+	return rec != nil, recovery, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+)
+
+// ---------------------- Argon2id (RFC 9106) -------------------------
+//
+// Argon2id fills a memory of m KiB in t passes, split into p lanes that are
+// filled in parallel. The first half of the first pass picks the blocks it
+// mixes independently of the password (resisting side channels), the rest
+// depending on the data (resisting time-memory trade-offs). Only what the
+// key derivation needs is implemented: no secret, no associated data.
+
+const (
+	argon2Version   = 0x13
+	argon2idType    = 2
+	argon2SyncPoint = 4   // slices per pass
+	argon2BlockLen  = 128 // uint64 words per 1 KiB block
+)
+
+type argon2Block [argon2BlockLen]uint64
+
+// argon2idKey derives keyLen bytes from password and salt with time
+// passes over memory KiB using threads lanes.
+func argon2idKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	h0 := argon2H0(password, salt, time, memory, uint32(threads), keyLen)
+	defer clear(h0)
+	return argon2Fill(h0, time, memory, uint32(threads), keyLen)
+}
+
+// argon2H0 hashes the parameters and inputs into the 64 byte seed H0.
+func argon2H0(password, salt []byte, time, memory, threads, keyLen uint32) []byte {
+	le := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+	return blake2bSum(64,
+		le(threads), le(keyLen), le(memory), le(time), le(argon2Version), le(argon2idType),
+		le(uint32(len(password))), password,
+		le(uint32(len(salt))), salt,
+		le(0), // secret
+		le(0), // associated data
+	)
+}
+
+// argon2Fill runs the memory-hard part on the seed h0.
+func argon2Fill(h0 []byte, time, memory, threads, keyLen uint32) []byte {
+	// memory is rounded down to whole segments, at least 2 blocks each
+	segments := argon2SyncPoint * threads
+	memory = max(memory/segments*segments, 2*segments)
+	laneLen := memory / threads
+	segLen := laneLen / argon2SyncPoint
+
+	B := make([]argon2Block, memory)
+	var buf [1024]byte
+	for lane := uint32(0); lane < threads; lane++ {
+		for i := uint32(0); i < 2; i++ {
+			argon2Hash(buf[:], h0, binary.LittleEndian.AppendUint32(nil, i), binary.LittleEndian.AppendUint32(nil, lane))
+			b := &B[lane*laneLen+i]
+			for j := range b {
+				b[j] = binary.LittleEndian.Uint64(buf[j*8:])
+			}
+		}
+	}
+
+	segment := func(pass, slice, lane uint32) {
+		// data-independent addressing: pseudo-random indexes come from
+		// hashing a counter block
+		independent := pass == 0 && slice < argon2SyncPoint/2
+		var addresses, input, zero argon2Block
+		if independent {
+			input[0], input[1], input[2] = uint64(pass), uint64(lane), uint64(slice)
+			input[3], input[4], input[5] = uint64(memory), uint64(time), argon2idType
+		}
+		index := uint32(0)
+		if pass == 0 && slice == 0 {
+			index = 2 // the first two blocks come from H0
+			if independent {
+				input[6]++
+				argon2G(&addresses, &input, &zero, false)
+				argon2G(&addresses, &addresses, &zero, false)
+			}
+		}
+		offset := lane*laneLen + slice*segLen + index
+		for ; index < segLen; index, offset = index+1, offset+1 {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += laneLen // the lane's last block
+			}
+			var rnd uint64
+			if independent {
+				if index%argon2BlockLen == 0 {
+					input[6]++
+					argon2G(&addresses, &input, &zero, false)
+					argon2G(&addresses, &addresses, &zero, false)
+				}
+				rnd = addresses[index%argon2BlockLen]
+			} else {
+				rnd = B[prev][0]
+			}
+			ref := argon2RefIndex(rnd, laneLen, segLen, threads, pass, slice, lane, index)
+			// from the second pass on, blocks are XORed into the old ones
+			argon2G(&B[offset], &B[prev], &B[ref], pass > 0)
+		}
+	}
+
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < argon2SyncPoint; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go func(lane uint32) {
+					defer wg.Done()
+					segment(pass, slice, lane)
+				}(lane)
+			}
+			wg.Wait()
+		}
+	}
+
+	final := B[laneLen-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		last := &B[lane*laneLen+laneLen-1]
+		for i := range final {
+			final[i] ^= last[i]
+		}
+	}
+	for i, v := range final {
+		binary.LittleEndian.PutUint64(buf[i*8:], v)
+	}
+	out := make([]byte, keyLen)
+	argon2Hash(out, buf[:])
+	// the memory is derived from the password too
+	clear(B)
+	clear(buf[:])
+	clear(final[:])
+	return out
+}
+
+// argon2RefIndex maps a pseudo-random value to the block the current one
+// is mixed with: any finished block of the same lane, or of the finished
+// slices of another lane.
+func argon2RefIndex(rnd uint64, laneLen, segLen, threads, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(rnd>>32) % threads
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+	area, start := 3*segLen, ((slice+1)%argon2SyncPoint)*segLen
+	if lane == refLane {
+		area += index
+	}
+	if pass == 0 {
+		area, start = slice*segLen, 0
+		if slice == 0 || lane == refLane {
+			area += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		area--
+	}
+	x := rnd & 0xffffffff
+	x = x * x >> 32
+	x = x * uint64(area) >> 32
+	return refLane*laneLen + uint32((uint64(start)+uint64(area)-(x+1))%uint64(laneLen))
+}
+
+// argon2Hash is the variable-length hash H' over the concatenated parts,
+// filling out.
+func argon2Hash(out []byte, parts ...[]byte) {
+	in := append([][]byte{binary.LittleEndian.AppendUint32(nil, uint32(len(out)))}, parts...)
+	if len(out) <= 64 {
+		copy(out, blake2bSum(len(out), in...))
+		return
+	}
+	v := blake2bSum(64, in...)
+	for len(out) > 64 {
+		n := copy(out, v[:32])
+		out = out[n:]
+		if len(out) > 64 {
+			v = blake2bSum(64, v)
+		}
+	}
+	copy(out, blake2bSum(len(out), v))
+}
+
+// argon2G is the compression function: out = G(x, y), or out ^= G(x, y).
+func argon2G(out, x, y *argon2Block, xor bool) {
+	var r, t argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	t = r
+	for i := 0; i < argon2BlockLen; i += 16 { // rows
+		blamka(&t[i], &t[i+1], &t[i+2], &t[i+3], &t[i+4], &t[i+5], &t[i+6], &t[i+7],
+			&t[i+8], &t[i+9], &t[i+10], &t[i+11], &t[i+12], &t[i+13], &t[i+14], &t[i+15])
+	}
+	for i := 0; i < 16; i += 2 { // columns
+		blamka(&t[i], &t[i+1], &t[16+i], &t[16+i+1], &t[32+i], &t[32+i+1], &t[48+i], &t[48+i+1],
+			&t[64+i], &t[64+i+1], &t[80+i], &t[80+i+1], &t[96+i], &t[96+i+1], &t[112+i], &t[112+i+1])
+	}
+	if xor {
+		for i := range out {
+			out[i] ^= r[i] ^ t[i]
+		}
+	} else {
+		for i := range out {
+			out[i] = r[i] ^ t[i]
+		}
+	}
+}
+
+// blamka is the permutation P on eight 128-bit registers.
+func blamka(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 *uint64) {
+	gb(v0, v4, v8, v12)
+	gb(v1, v5, v9, v13)
+	gb(v2, v6, v10, v14)
+	gb(v3, v7, v11, v15)
+	gb(v0, v5, v10, v15)
+	gb(v1, v6, v11, v12)
+	gb(v2, v7, v8, v13)
+	gb(v3, v4, v9, v14)
+}
+
+// gb is BLAKE2b's G with the additions replaced by a + b + 2*lo(a)*lo(b).
+func gb(a, b, c, d *uint64) {
+	fBlaMka := func(x, y uint64) uint64 {
+		return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+	}
+	*a = fBlaMka(*a, *b)
+	*d = bits.RotateLeft64(*d^*a, -32)
+	*c = fBlaMka(*c, *d)
+	*b = bits.RotateLeft64(*b^*c, -24)
+	*a = fBlaMka(*a, *b)
+	*d = bits.RotateLeft64(*d^*a, -16)
+	*c = fBlaMka(*c, *d)
+	*b = bits.RotateLeft64(*b^*c, -63)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The Argon2id test vector of RFC 9106, section 5.3. It has a secret and
+// associated data, which argon2idKey does not take, so H0 is put together
+// here as the RFC lays it out.
+func TestArgon2idRFC9106(t *testing.T) {
+	le := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+	password := bytes.Repeat([]byte{0x01}, 32)
+	salt := bytes.Repeat([]byte{0x02}, 16)
+	secret := bytes.Repeat([]byte{0x03}, 8)
+	ad := bytes.Repeat([]byte{0x04}, 12)
+	h0 := blake2bSum(64,
+		le(4), le(32), le(32), le(3), le(argon2Version), le(argon2idType),
+		le(32), password, le(16), salt, le(8), secret, le(12), ad)
+	want := "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"
+	if got := hex.EncodeToString(argon2Fill(h0, 3, 32, 4, 32)); got != want {
+		t.Errorf("tag = %s, want %s", got, want)
+	}
+}
+
+// Argon2id vectors of golang.org/x/crypto/argon2, for the password
+// "password" and salt "somesalt".
+func TestArgon2idKey(t *testing.T) {
+	for _, tc := range []struct {
+		time, memory uint32
+		threads      uint8
+		want         string
+	}{
+		{1, 64, 1, "655ad15eac652dc59f7170a7332bf49b8469be1fdb9c28bb"},
+		{2, 64, 1, "068d62b26455936aa6ebe60060b0a65870dbfa3ddf8d41f7"},
+	} {
+		key := argon2idKey([]byte("password"), []byte("somesalt"), tc.time, tc.memory, tc.threads, 24)
+		if got := hex.EncodeToString(key); got != tc.want {
+			t.Errorf("t=%d m=%d p=%d: key = %s, want %s", tc.time, tc.memory, tc.threads, got, tc.want)
+		}
+	}
+}
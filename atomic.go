@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ---------------------- Atomic extraction --------------------------
+//
+// An extracted file is written to name.tmp-<random> next to its place and
+// renamed to name once all of its data is there, so an interrupted
+// extraction leaves no half-written files under real names, only
+// .tmp- files to delete. Renaming also replaces a symlink or hard link
+// found at name instead of writing through it.
+//
+// With -staging the whole archive is extracted into dest.tmp-<random>,
+// which becomes dest once the last entry is written: dest either does not
+// appear or holds everything. It must not exist yet or be empty.
+
+// tempName returns path with a random .tmp- suffix.
+func tempName(path string) (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return path + ".tmp-" + hex.EncodeToString(b[:]), nil
+}
+
+// writeEntryFile copies size bytes of entry data from r into a new file at
+// target, by way of a temporary file.
+func writeEntryFile(target string, r io.Reader, size int64) error {
+	tmp, err := writeEntryTemp(target, r, size)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeEntryTemp copies size bytes of entry data from r into a new
+// temporary file next to target and returns its name, for the caller to
+// rename to target or remove.
+func writeEntryTemp(target string, r io.Reader, size int64) (string, error) {
+	tmp, err := tempName(target)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.CopyN(f, r, size); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// extractStaged extracts the archive into a staging directory next to
+// destDir and renames it to destDir when done.
+func extractStaged(archivePath, destDir, password string, opts extractOptions) error {
+	if entries, err := os.ReadDir(destDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("-staging: %s exists and is not empty", destDir)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	stage, err := tempName(destDir)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(stage, 0o755); err != nil {
+		return err
+	}
+	if err := extractArchive(archivePath, stage, password, opts); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	os.Remove(destDir) // empty, if there
+	if err := os.Rename(stage, destDir); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	return nil
+}
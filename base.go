@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ---------------------- Differential archives (-base) --------------
+//
+// "ghzip -c -in data -out mon.gha -base sun.gha" makes a differential
+// archive: it leaves out what is the same as in sun.gha, records what
+// has gone since as deleted entries, and names sun.gha, by its path
+// relative to mon.gha and its ID, as its base. A file is the same when
+// its size, mode and modification time are, as rsync and tar's
+// incremental mode have it; a directory when its mode and time are; a
+// symlink when its target is. The rest is archived as usual, except that
+// copies and shared chunks (dedup.go, chunks.go) may also name files of
+// the base, so a large file that changed in a few places only stores the
+// chunks that did. A base may be differential itself, making a chain.
+// The base is opened with the new archive's password or key file.
+//
+// Extracting a differential archive extracts its base into -out first,
+// then the archive over it, and deletes what its deleted entries name if
+// the extraction wrote it: a file -skip-existing or -freshen kept, or
+// one renamed out of the way, is left alone. Deleted entries in an
+// archive without a base are an error.
+// Testing reads the base too, for the files copies and chunks name.
+// Listing, grep, diff and export show the archive's own entries only,
+// and -to-stdout writes its own files only, reading the base only for
+// what copies and chunks name (source.go).
+
+// baseEntry is an entry of the tree a base archive extracts to.
+type baseEntry struct {
+	h      entryHeader // linkTarget set for links and copies
+	size   int64       // of a file's contents, copies included
+	chunks []chunk     // of a large file's contents
+}
+
+// baseTree is the tree a base archive, with its own bases, extracts to.
+type baseTree struct {
+	id      [16]byte
+	entries map[string]*baseEntry
+}
+
+// readBase reads the archive at path, and its bases, for the tree it
+// extracts to.
+func readBase(path, password string) (*baseTree, error) {
+	ar, err := openArchive(path, password)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(readOptions{}); err != nil {
+		return nil, err
+	}
+	t := &baseTree{id: ar.meta.id, entries: make(map[string]*baseEntry)}
+	if ar.meta.basePath != "" {
+		parent, err := readBase(basePath(path, ar.meta), password)
+		if err != nil {
+			return nil, fmt.Errorf("base of %s: %w", path, err)
+		}
+		if parent.id != ar.meta.baseID {
+			return nil, fmt.Errorf("%s is not the base %s was made against", basePath(path, ar.meta), path)
+		}
+		t.entries = parent.entries
+	}
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := &io.LimitedReader{R: ar.payload, N: int64(h.size)}
+		e := &baseEntry{h: h}
+		switch {
+		case h.refers():
+			target, err := io.ReadAll(data)
+			if err != nil {
+				return nil, err
+			}
+			e.h.linkTarget = string(target)
+			if first := t.entries[e.h.linkTarget]; h.typ == entryCopy && first != nil {
+				e.size, e.chunks = first.size, first.chunks
+			}
+		case h.typ == entryChunks:
+			if e.chunks, _, err = readChunkList(data); err != nil {
+				return nil, err
+			}
+			e.size = int64(h.fileSize)
+		case h.typ == entryFile:
+			e.size = int64(h.size)
+			if h.size > streamFileMin {
+				var r io.Reader = data
+				if h.filter.kind != filterNone {
+					r = &unfilterReader{r: data, f: h.filter}
+				}
+				c := newChunker()
+				if _, err := io.Copy(c, r); err != nil {
+					return nil, err
+				}
+				e.chunks = c.finish()
+			}
+		}
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return nil, err
+		}
+		if data.N > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if h.typ == entryDeleted {
+			delete(t.entries, h.name)
+		} else {
+			t.entries[h.name] = e
+		}
+	}
+}
+
+// basePath returns the path of the base of the archive at path.
+func basePath(path string, meta archiveMeta) string {
+	base := filepath.FromSlash(meta.basePath)
+	if filepath.IsAbs(base) {
+		return base
+	}
+	return filepath.Join(filepath.Dir(path), base)
+}
+
+// storedBasePath returns how the archive written to out names its base:
+// relative to out's directory where that can be.
+func storedBasePath(base, out string) string {
+	abs, err := filepath.Abs(base)
+	if err != nil {
+		return filepath.ToSlash(base)
+	}
+	if out == "-" {
+		return filepath.ToSlash(abs)
+	}
+	dir, err := filepath.Abs(filepath.Dir(out))
+	if err != nil {
+		return filepath.ToSlash(abs)
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(abs)
+}
+
+// changes leaves the files that are the same in t out of files and
+// returns the rest, and the names of t's entries that files lacks.
+func (t *baseTree) changes(files []inputFile) (changed []inputFile, deleted []string, err error) {
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		name := nfc(filepath.ToSlash(f.relPath))
+		present[name] = true
+		same, err := t.unchanged(name, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !same {
+			changed = append(changed, f)
+		}
+	}
+	for name := range t.entries {
+		if !present[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	return changed, deleted, nil
+}
+
+// unchanged reports whether f, to be archived as name, is the same as
+// the entry of that name in t.
+func (t *baseTree) unchanged(name string, f inputFile) (bool, error) {
+	e := t.entries[name]
+	if e == nil {
+		return false, nil
+	}
+	h, mode := e.h, f.info.Mode()
+	sameMeta := h.hasMode && h.mode == unixMode(mode) && h.mtime.Equal(f.info.ModTime())
+	switch {
+	case mode.IsDir():
+		return h.typ == entryDir && sameMeta, nil
+	case mode&fs.ModeSymlink != 0:
+		if h.typ != entrySymlink {
+			return false, nil
+		}
+		target, err := os.Readlink(f.absPath)
+		return filepath.ToSlash(target) == h.linkTarget, err
+	case mode.IsRegular():
+		isFile := h.typ == entryFile || h.typ == entryChunks || h.typ == entryCopy
+		return isFile && e.size == f.info.Size() && sameMeta, nil
+	}
+	return false, nil
+}
+
+// seed adds the files of t to the copies and chunks a new archive may
+// refer to.
+func (t *baseTree) seed(firstOf map[string]string, chunks chunkIndex) {
+	for name, e := range t.entries {
+		if e.h.sum != nil {
+			if _, ok := firstOf[string(e.h.sum)]; !ok {
+				firstOf[string(e.h.sum)] = name
+			}
+		}
+		for _, c := range e.chunks {
+			if _, ok := chunks[c.sum]; !ok {
+				chunks[c.sum] = chunkPlace{name, c.off}
+			}
+		}
+	}
+}
+
+// forget takes the file of t named name out of the copies and chunks
+// entries may refer to, once an entry of that name is archived: it
+// replaces the file on extraction, before the entries that follow.
+func (t *baseTree) forget(name string, firstOf map[string]string, chunks chunkIndex) {
+	e := t.entries[name]
+	if e == nil {
+		return
+	}
+	if e.h.sum != nil && firstOf[string(e.h.sum)] == name {
+		delete(firstOf, string(e.h.sum))
+	}
+	for _, c := range e.chunks {
+		if p, ok := chunks[c.sum]; ok && p.name == name {
+			delete(chunks, c.sum)
+		}
+	}
+}
+
+// writeDeleted writes a deleted entry for each of names.
+func writeDeleted(bw *blockWriter, names []string, perFile bool) error {
+	for _, name := range names {
+		if perFile {
+			if err := bw.startEntry(); err != nil {
+				return err
+			}
+		}
+		if err := writeEntryHeader(bw, entryHeader{typ: entryDeleted, name: name}); err != nil {
+			return err
+		}
+		verbosef("%s", displayName(entryHeader{typ: entryDeleted, name: name}))
+	}
+	return nil
+}
+
+// layers is what extracting a differential archive and its bases share.
+type layers struct {
+	conflicts *conflicts        // which files a layer wrote, for the next to replace
+	matched   []bool            // the -files patterns some layer matched
+	names     map[string]string // stored name -> name written, for copies and chunks
+}
+
+// extractBase extracts the base of the archive at path, whose metadata
+// is meta, into destDir, setting up opts.layers for the archive itself.
+func extractBase(path, destDir, password string, meta archiveMeta, opts *extractOptions) error {
+	if opts.resume {
+		return fmt.Errorf("%s is a differential archive, which -resume does not continue", path)
+	}
+	base := basePath(path, meta)
+	sf, err := openSlotFile(base, false)
+	if err != nil {
+		return fmt.Errorf("base archive: %w", err)
+	}
+	sf.Close()
+	if sf.id != meta.baseID {
+		return fmt.Errorf("%s is not the base %s was made against", base, path)
+	}
+	if opts.layers == nil {
+		opts.layers = &layers{
+			conflicts: newConflicts(opts.existing),
+			matched:   make([]bool, len(opts.files)),
+			names:     make(map[string]string),
+		}
+	}
+	infof("Extracting base %s first.", base)
+	return extractArchive(base, destDir, password, *opts)
+}
+
+// deleteEntries removes what the deleted entries at paths name, the
+// deepest first.
+func deleteEntries(paths []string) error {
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			if fi, serr := os.Lstat(path); serr == nil && fi.IsDir() {
+				fmt.Fprintf(os.Stderr, "warning: %s: not deleted: %v\n", path, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
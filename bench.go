@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// ---------------------- Codec benchmark (bench) ---------------------
+//
+// "ghzip bench <file>" compresses a sample with every method and level
+// through the same encodeBlock/decodeBlock path archives use, one block
+// after the other on a single core, and prints ratio and throughput so
+// users can pick a method for their data. Blocks a method cannot shrink
+// are stored, as they would be in an archive.
+
+// benchMinTime is how long every method runs at least; short samples are
+// coded repeatedly to get stable numbers.
+const benchMinTime = 300 * time.Millisecond
+
+// benchResult is what one method or level achieved on the sample.
+type benchResult struct {
+	name         string
+	coded        int64
+	comp, decomp time.Duration // per pass over the sample
+}
+
+// benchCoding codes the sample in blocks of blockSize with bc until
+// benchMinTime has passed, checking that every block comes back intact.
+func benchCoding(name string, sample []byte, blockSize int, bc blockCoding) (benchResult, error) {
+	var blocks [][]byte
+	for off := 0; off < len(sample); off += blockSize {
+		blocks = append(blocks, sample[off:min(off+blockSize, len(sample))])
+	}
+	res := benchResult{name: name}
+	coded := make([][]byte, len(blocks))
+	start, passes := time.Now(), 0
+	for passes == 0 || time.Since(start) < benchMinTime {
+		res.coded = 0
+		for i, b := range blocks {
+			c, err := encodeBlock(b, bc)
+			if err != nil {
+				return res, err
+			}
+			coded[i] = c
+			res.coded += int64(len(c))
+		}
+		passes++
+	}
+	res.comp = time.Since(start) / time.Duration(passes)
+	start, passes = time.Now(), 0
+	for passes == 0 || time.Since(start) < benchMinTime {
+		for i, c := range coded {
+			raw, _, err := decodeBlock(c, len(blocks[i]), bc)
+			if err != nil {
+				return res, err
+			}
+			if !bytes.Equal(raw, blocks[i]) {
+				return res, fmt.Errorf("%s: block %d does not decode to its input", name, i)
+			}
+		}
+		passes++
+	}
+	res.decomp = time.Since(start) / time.Duration(passes)
+	return res, nil
+}
+
+// mbPerSec formats the throughput of coding n bytes in d.
+func mbPerSec(n int, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f MB/s", float64(n)/d.Seconds()/1e6)
+}
+
+// runBench implements "ghzip bench".
+func runBench(args []string) {
+	cmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	limit := cmd.Int("size", 16<<20, "use at most the first `bytes` of the file")
+	parseCommand(cmd, args)
+	if cmd.NArg() != 1 {
+		fmt.Println("usage: ghzip bench [-size bytes] <file>")
+		return
+	}
+	f, err := os.Open(cmd.Arg(0))
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	sample, err := io.ReadAll(io.LimitReader(f, int64(*limit)))
+	f.Close()
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	if len(sample) == 0 {
+		fail("%s is empty", cmd.Arg(0))
+		return
+	}
+
+	var methods []byte
+	for m := range codecs {
+		// store is the baseline every ratio is measured against; exec needs
+		// a command line
+		if m != methodStore && m != methodExec {
+			methods = append(methods, m)
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+	fmt.Printf("Sample: %s, %d bytes\n\n", cmd.Arg(0), len(sample))
+	fmt.Printf("%-16s %8s %14s %14s\n", "Method", "Ratio", "Compress", "Decompress")
+	report := func(r benchResult, err error) {
+		if err != nil {
+			fmt.Printf("%-16s failed: %v\n", r.name, err)
+			return
+		}
+		fmt.Printf("%-16s %7.1f%% %14s %14s\n", r.name, 100*float64(r.coded)/float64(len(sample)),
+			mbPerSec(len(sample), r.comp), mbPerSec(len(sample), r.decomp))
+	}
+	for _, m := range methods {
+		report(benchCoding(methodName(m), sample, defaultBlockSize, blockCoding{method: m}))
+	}
+	fmt.Println()
+	for level := 1; level < len(presets); level++ {
+		p := presets[level]
+		name := fmt.Sprintf("-%d (%s)", level, methodName(p.method))
+		report(benchCoding(name, sample, p.blockSize, blockCoding{method: p.method, effort: p.effort}))
+	}
+}
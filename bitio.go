@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ---------------------- Bit streams ---------------------------------
+//
+// bitWriter and bitReader pack bits most significant first on top of any
+// io.Writer or io.Reader, moving bitBufSize bytes at a time, so a coder
+// needs the same memory whether it handles a block or a whole disk image.
+// Both keep the first I/O error and report it from then on.
+
+const bitBufSize = 32 << 10
+
+// bitWriter packs bits most significant first into w.
+type bitWriter struct {
+	w   io.Writer
+	buf []byte
+	acc uint64 // pending bits in the low n bits, n < 32
+	n   uint
+	err error
+}
+
+func newBitWriter(w io.Writer) *bitWriter {
+	return &bitWriter{w: w, buf: make([]byte, 0, bitBufSize)}
+}
+
+// WriteBits writes the low n bits of bits (n <= 32).
+func (w *bitWriter) WriteBits(bits uint32, n uint8) {
+	w.acc = w.acc<<n | uint64(bits)
+	w.n += uint(n)
+	if w.n >= 32 {
+		w.n -= 32
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(w.acc>>w.n))
+		if len(w.buf) >= bitBufSize {
+			w.writeBuf()
+		}
+	}
+}
+
+func (w *bitWriter) writeBit(one bool) {
+	var b uint32
+	if one {
+		b = 1
+	}
+	w.WriteBits(b, 1)
+}
+
+func (w *bitWriter) writeBuf() {
+	if w.err == nil {
+		_, w.err = w.w.Write(w.buf)
+	}
+	w.buf = w.buf[:0]
+}
+
+// Flush pads the last byte with zero bits and writes out what is
+// buffered. Bits written afterwards start a new byte.
+func (w *bitWriter) Flush() error {
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.n))
+	}
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.n)))
+		w.n = 0
+	}
+	w.writeBuf()
+	return w.err
+}
+
+// bitReader reads bits most significant first from r. It reads ahead, so
+// r should hold nothing after the bit stream that someone else needs.
+type bitReader struct {
+	r   io.Reader
+	buf []byte
+	pos int
+	acc uint64 // unread bits, left-aligned
+	n   uint   // number of unread bits in acc
+	err error  // what ended the input, io.EOF at its end (set once fill fails)
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{r: r}
+}
+
+// refill tops acc up to at least 57 bits, or all that is left.
+func (r *bitReader) refill() {
+	if r.pos+8 <= len(r.buf) {
+		// whole bytes up to 64 bits; the bits of the next, partial byte
+		// land below them and are ORed in again, unchanged, later on
+		k := (64 - r.n) / 8
+		r.acc |= binary.BigEndian.Uint64(r.buf[r.pos:]) >> r.n
+		r.pos += int(k)
+		r.n += k * 8
+		return
+	}
+	for r.n <= 56 {
+		if r.pos == len(r.buf) && !r.fill() {
+			return
+		}
+		r.acc |= uint64(r.buf[r.pos]) << (56 - r.n)
+		r.pos++
+		r.n += 8
+	}
+}
+
+// fill reads the next chunk of input into buf.
+func (r *bitReader) fill() bool {
+	if r.buf == nil {
+		r.buf = make([]byte, bitBufSize)
+	}
+	for r.err == nil {
+		n, err := r.r.Read(r.buf[:cap(r.buf)])
+		r.buf, r.pos, r.err = r.buf[:n], 0, err
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// skip consumes n bits; the caller has checked that they are there.
+func (r *bitReader) skip(n uint) {
+	r.acc <<= n
+	r.n -= n
+}
+
+func (r *bitReader) readBit() (int, error) {
+	if r.n == 0 {
+		r.refill()
+		if r.n == 0 {
+			return 0, r.err
+		}
+	}
+	v := r.acc >> 63
+	r.skip(1)
+	return int(v), nil
+}
+
+// ReadBits reads n bits (n <= 32).
+func (r *bitReader) ReadBits(n uint8) (uint32, error) {
+	if r.n < uint(n) {
+		r.refill()
+		if r.n < uint(n) {
+			if r.err != io.EOF {
+				return 0, r.err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	v := uint32(r.acc >> (64 - n))
+	r.skip(uint(n))
+	return v, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The "abc" example of RFC 7693, appendix A.
+func TestBlake2bRFC7693(t *testing.T) {
+	want := "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"
+	if got := hex.EncodeToString(blake2bSum(64, []byte("abc"))); got != want {
+		t.Errorf("sum = %s, want %s", got, want)
+	}
+}
+
+// Digests of 0, 1, 2, ... (mod 251) around the block size, made with
+// Python's hashlib.blake2b. The message is written in uneven parts so the
+// buffering is exercised too.
+func TestBlake2bSizes(t *testing.T) {
+	for _, tc := range []struct {
+		size, n int
+		want    string
+	}{
+		{64, 0, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{64, 3, "40a374727302d9a4769c17b5f409ff32f58aa24ff122d7603e4fda1509e919d4107a52c57570a6d94e50967aea573b11f86f473f537565c66f7039830a85d186"},
+		{64, 127, "b6292669ccd38d5f01caae96ba272c76a879a45743afa0725d83b9ebb26665b731f1848c52f11972b6644f554c064fa90780dbbbf3a89d4fc31f67df3e5857ef"},
+		{64, 128, "2319e3789c47e2daa5fe807f61bec2a1a6537fa03f19ff32e87eecbfd64b7e0e8ccff439ac333b040f19b0c4ddd11a61e24ac1fe0f10a039806c5dcc0da3d115"},
+		{64, 129, "f59711d44a031d5f97a9413c065d1e614c417ede998590325f49bad2fd444d3e4418be19aec4e11449ac1a57207898bc57d76a1bcf3566292c20c683a5c4648f"},
+		{64, 1000, "c11e1c0340bd7e5a1b275f1230c962fad215ecb1391486e74e31b960a2f2996381a5fad092da06841d5f26e38f6ecfeaf441acbcd1c2de61aef121e7927175f5"},
+		{32, 0, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{32, 3, "3d8c3d594928271f44aad7a04b177154806867bcf918e1549c0bc16f9da2b09b"},
+		{32, 127, "f2fe67ff342e21b8f45e8f2e0bcd1d9243245d50ee6c78042e9c491388791c72"},
+		{32, 128, "c3582f71ebb2be66fa5dd750f80baae97554f3b015663c8be377cfcb2488c1d1"},
+		{32, 129, "f7f3c46ba2564ff4c4c162da1f5b605f9f1c4aa6a20652a9f9a337c1a2f5b9c9"},
+		{32, 1000, "b372d0608f720c8c3dd41e9c8eecb10143b41abe520b616607e754bf79c08331"},
+		{16, 0, "cae66941d9efbd404e4d88758ea67670"},
+		{16, 3, "a75c0b0d97360c1ba783496eb6a0395a"},
+		{16, 127, "28b1296c7d4807883de6ee4ec04dcc0a"},
+		{16, 128, "a74787004ef589e31149183900d0294a"},
+		{16, 129, "aaf1b0371f6d4ee49ee4fb5ddd9c49ef"},
+		{16, 1000, "bca120dfd89cd95d82898473a5b01c90"},
+	} {
+		msg := make([]byte, tc.n)
+		for i := range msg {
+			msg[i] = byte(i % 251)
+		}
+		var parts [][]byte
+		for rest, k := msg, 1; len(rest) > 0; k = k*3 + 1 {
+			k = min(k, len(rest))
+			parts, rest = append(parts, rest[:k]), rest[k:]
+		}
+		if got := hex.EncodeToString(blake2bSum(tc.size, parts...)); got != tc.want {
+			t.Errorf("size %d, %d bytes: sum = %s, want %s", tc.size, tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// ---------------------- Block container (v2) ----------------------
+//
+// The v2 payload is cut into blocks of at most blockSize raw bytes. Every
+// block is compressed on its own and sealed as a separate AES-GCM (or
+// XChaCha20-Poly1305) message (a chunked AEAD), so blocks can be decoded on
+// their own (streaming, partial reads, parallel decode) and no single GCM
+// message grows with the archive:
+//
+//   [4 bytes block size uint32]            nominal raw size of a block
+//   [1 byte flags]                         payloadPerFile, ...
+//   [12 or 24 bytes base nonce]            random per archive, cipher's nonce size
+//   per block:
+//     [4 bytes sealed length uint32 (>0)]
+//     [sealed block]
+//   [4 bytes 0]                            end of blocks
+//   [4 bytes block count uint32]           block index:
+//   per block: [8 bytes file offset][8 bytes payload offset][4 bytes raw length][1 byte flags]
+//   [16 bytes index tag]                   with payloadIndexTag
+//   [8 bytes index offset uint64]["GHIX"]  trailer
+//
+// A sealed block opens to [1 byte method][4 bytes raw length][method data].
+// Block nonces are derived from the base nonce and the block number (see
+// blockNonce) instead of being stored. The additional data of a block is a
+// SHA-256 of the archive and container headers, the block number and
+// whether it is the last block (as in the STREAM construction), so header
+// fields cannot be altered, blocks cannot be reordered or swapped, and an
+// archive cut off after any block fails to open rather than looking
+// complete. There is always at least one block.
+//
+// The index tag seals nothing under the header hash, block count and
+// records as additional data, so a damaged or altered index is refused
+// rather than trusted: per-file listing and extraction find entries by its
+// flags alone. Its nonce is that of block 1<<63 | count, a number no block
+// gets.
+
+const defaultBlockSize = 4 << 20
+
+// Payload flags stored after the block size.
+const (
+	// payloadPerFile marks non-solid archives: every entry starts a new
+	// block, so each entry can be decoded without touching the others.
+	payloadPerFile byte = 1 << 0
+
+	// payloadIndexTag marks archives whose block index is authenticated
+	// by the index tag. Archives written since it was added all have one.
+	payloadIndexTag byte = 1 << 1
+)
+
+// Block flags stored in the index.
+const (
+	blockEntryStart byte = 1 << 0 // block begins with an entry header
+)
+
+// indexRecordSize is the size of one block index record.
+const indexRecordSize = 21
+
+const indexMagic = "GHIX"
+
+// indexTagSize is the size of the index tag, that of every cipher's tag.
+const indexTagSize = 16
+
+// blockInfo is one entry of the block index.
+type blockInfo struct {
+	offset    int64 // file offset of the block's length prefix
+	rawOffset int64 // payload offset of the block's first byte
+	rawLen    uint32
+	flags     byte
+}
+
+// countingWriter tracks how many bytes went through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// blockWriter turns the payload written to it into sealed blocks.
+type blockWriter struct {
+	w      *countingWriter
+	aead   cipher.AEAD
+	base   []byte // base nonce
+	hdrSum []byte // hash of the archive header, part of every block's AAD
+	size   int
+	buf    []byte
+	index  []blockInfo
+
+	// flags for the block currently being filled
+	flags byte
+
+	coding blockCoding // how every block is compressed
+
+	// incompressible marks writes of data known to be compressed already;
+	// known counts such bytes in buf, and a block made of them is stored.
+	incompressible bool
+	known          int
+
+	rawTotal  int64
+	compTotal int64
+
+	// blocks being compressed, sealed or written, at most workers at a
+	// time; writeBlocks writes them out in order
+	workers int
+	slots   chan struct{}      // one per block not written yet
+	out     chan *pendingBlock // to writeBlocks, oldest first
+	written chan struct{}      // closed when writeBlocks is done
+	werr    error              // why writeBlocks stopped early
+	last    *pendingBlock      // the newest block, not told yet whether it is final
+	queued  uint64             // blocks queued so far
+}
+
+// pendingBlock is a block handed to a compression goroutine.
+type pendingBlock struct {
+	done   chan struct{}
+	final  chan bool // whether it is the last block, sent once known
+	info   blockInfo
+	sealed []byte
+	plain  int // compressed size, for the statistics
+	err    error
+}
+
+// newBlockWriter writes the block size, payload flags and base nonce to w
+// and returns a writer for the payload. header is everything already written
+// to w but the key slots; it is authenticated with every block. w must count
+// from the start of the archive file so the index records absolute offsets.
+func newBlockWriter(w *countingWriter, aead cipher.AEAD, size int, payloadFlags byte, header []byte) (*blockWriter, error) {
+	hdr := binary.LittleEndian.AppendUint32(nil, uint32(size))
+	hdr = append(hdr, payloadFlags|payloadIndexTag)
+	base := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(base); err != nil {
+		return nil, err
+	}
+	hdr = append(hdr, base...)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &blockWriter{
+		w: w, aead: aead, base: base, size: size, buf: make([]byte, 0, size),
+		hdrSum: headerSum(header, hdr), coding: blockCoding{method: methodHuffman},
+		workers: runtime.GOMAXPROCS(0),
+	}, nil
+}
+
+// startEntry ends the current block so the next entry begins a fresh one,
+// which is what makes per-file (non-solid) archives independently decodable.
+func (bw *blockWriter) startEntry() error {
+	if err := bw.flush(); err != nil {
+		return err
+	}
+	bw.flags |= blockEntryStart
+	return nil
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := bw.size - len(bw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		bw.buf = append(bw.buf, p[:n]...)
+		if bw.incompressible {
+			bw.known += n
+		}
+		p = p[n:]
+		written += n
+		if len(bw.buf) == bw.size {
+			if err := bw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush hands the buffered bytes to a goroutine that compresses and seals
+// them as the next block. Up to workers blocks are in flight; a further
+// goroutine writes finished ones in order.
+func (bw *blockWriter) flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	return bw.startBlock()
+}
+
+// startBlock starts compressing buf as the next block.
+func (bw *blockWriter) startBlock() error {
+	bc := bw.coding
+	// leave room for the entry header sharing the block
+	if bw.known >= len(bw.buf)-len(bw.buf)/16 {
+		bc.method = methodStore
+	}
+	if err := bw.queueBlock(bw.buf, nil, uint32(len(bw.buf)), bc); err != nil {
+		return err
+	}
+	bw.buf = make([]byte, 0, bw.size)
+	bw.known = 0
+	return nil
+}
+
+// writeEncoded adds a block that is compressed already: plain is what a
+// block opens to, holding rawLen payload bytes. Buffered payload goes into
+// a block of its own first. It serves copying blocks between archives
+// without decompressing them.
+func (bw *blockWriter) writeEncoded(plain []byte, rawLen uint32, flags byte) error {
+	if err := bw.flush(); err != nil {
+		return err
+	}
+	bw.flags |= flags
+	return bw.queueBlock(nil, plain, rawLen, bw.coding)
+}
+
+// queueBlock hands the next block to a goroutine that compresses raw with
+// bc, unless plain holds it compressed already, and seals it. The block
+// is only sealed once the next block starts or the writer is closed,
+// which tells it whether it is the last one.
+func (bw *blockWriter) queueBlock(raw, plain []byte, rawLen uint32, bc blockCoding) error {
+	if bw.out == nil { // workers is set by now
+		bw.slots = make(chan struct{}, bw.workers)
+		bw.out = make(chan *pendingBlock, bw.workers)
+		bw.written = make(chan struct{})
+		go bw.writeBlocks()
+	}
+	if bw.last != nil {
+		bw.last.final <- false
+	}
+	select {
+	case bw.slots <- struct{}{}:
+	case <-bw.written:
+		return bw.werr
+	}
+	num := bw.queued
+	bw.queued++
+	pb := &pendingBlock{
+		done:  make(chan struct{}),
+		final: make(chan bool, 1),
+		info:  blockInfo{rawOffset: bw.rawTotal, rawLen: rawLen, flags: bw.flags},
+	}
+	go func() {
+		defer close(pb.done)
+		if plain == nil {
+			var err error
+			if plain, err = encodeBlock(raw, bc); err != nil {
+				pb.err = err
+				return
+			}
+		}
+		pb.plain = len(plain)
+		final := <-pb.final
+		pb.sealed = bw.aead.Seal(nil, blockNonce(bw.base, num), plain, blockAAD(bw.hdrSum, num, final))
+		clear(plain)
+		clear(raw)
+	}()
+	bw.out <- pb
+	bw.last = pb
+	bw.rawTotal += int64(rawLen)
+	bw.flags = 0
+	return nil
+}
+
+// writeBlocks writes the blocks from out as they are sealed, in order,
+// until out is closed or writing one fails.
+func (bw *blockWriter) writeBlocks() {
+	defer close(bw.written)
+	for pb := range bw.out {
+		<-pb.done
+		if bw.werr = bw.writeBlock(pb); bw.werr != nil {
+			return
+		}
+		<-bw.slots
+	}
+}
+
+// writeBlock writes out block pb.
+func (bw *blockWriter) writeBlock(pb *pendingBlock) error {
+	if pb.err != nil {
+		return pb.err
+	}
+	pb.info.offset = bw.w.n
+	if err := binary.Write(bw.w, binary.LittleEndian, uint32(len(pb.sealed))); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(pb.sealed); err != nil {
+		return err
+	}
+	bw.index = append(bw.index, pb.info)
+	bw.compTotal += int64(pb.plain)
+	debugf("block %d: %d bytes compressed to %d", len(bw.index)-1, pb.info.rawLen, pb.plain)
+	return nil
+}
+
+// Close flushes the last block and writes the terminator, index and trailer.
+func (bw *blockWriter) Close() error {
+	// an empty payload still gets an (empty) final block
+	if len(bw.buf) > 0 || bw.last == nil {
+		if err := bw.startBlock(); err != nil {
+			return err
+		}
+	}
+	bw.last.final <- true
+	close(bw.out)
+	<-bw.written
+	if bw.werr != nil {
+		return bw.werr
+	}
+	if err := binary.Write(bw.w, binary.LittleEndian, uint32(0)); err != nil {
+		return err
+	}
+	indexOffset := bw.w.n
+	idx := encodeIndex(bw.index)
+	idx = bw.aead.Seal(idx, indexNonce(bw.base, len(bw.index)), nil, indexAAD(bw.hdrSum, idx))
+	idx = binary.LittleEndian.AppendUint64(idx, uint64(indexOffset))
+	idx = append(idx, indexMagic...)
+	_, err := bw.w.Write(idx)
+	return err
+}
+
+// headerSum hashes the archive header and the block container header.
+func headerSum(header, container []byte) []byte {
+	h := sha256.New()
+	h.Write(header)
+	h.Write(container)
+	return h.Sum(nil)
+}
+
+// blockAAD is the additional data of block num: the header hash followed by
+// the block number and a byte that is 1 for the last block.
+func blockAAD(hdrSum []byte, num uint64, final bool) []byte {
+	aad := binary.LittleEndian.AppendUint64(append([]byte(nil), hdrSum...), num)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// encodeIndex returns the block count and index records of index.
+func encodeIndex(index []blockInfo) []byte {
+	idx := binary.LittleEndian.AppendUint32(nil, uint32(len(index)))
+	for _, b := range index {
+		idx = binary.LittleEndian.AppendUint64(idx, uint64(b.offset))
+		idx = binary.LittleEndian.AppendUint64(idx, uint64(b.rawOffset))
+		idx = binary.LittleEndian.AppendUint32(idx, b.rawLen)
+		idx = append(idx, b.flags)
+	}
+	return idx
+}
+
+// indexAAD is the additional data of the index tag: the header hash
+// followed by the encoded index.
+func indexAAD(hdrSum, idx []byte) []byte {
+	return append(append([]byte(nil), hdrSum...), idx...)
+}
+
+// indexNonce is the nonce of the index tag of an archive of count blocks.
+func indexNonce(base []byte, count int) []byte {
+	return blockNonce(base, 1<<63|uint64(count))
+}
+
+// checkIndex verifies the index tag against index, which readBlockIndex
+// read along with it.
+func (br *blockReader) checkIndex(index []blockInfo, tag []byte) error {
+	if br.flags&payloadIndexTag == 0 {
+		if tag != nil {
+			return errors.New("corrupt block index size")
+		}
+		return nil
+	}
+	if tag == nil {
+		return errors.New("block index tag missing")
+	}
+	idx := encodeIndex(index)
+	if _, err := br.aead.Open(nil, indexNonce(br.base, len(index)), tag, indexAAD(br.hdrSum, idx)); err != nil {
+		return errors.New("block index does not match the archive (altered?)")
+	}
+	return nil
+}
+
+// blockNonce derives the nonce of block num by XORing the block number into
+// the last 8 bytes of the archive's random base nonce. Every block of an
+// archive thus gets a distinct nonce without storing one per block.
+func blockNonce(base []byte, num uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^num)
+	return nonce
+}
+
+// blockReader serves the payload block by block. Since every block has
+// its own nonce, it reads blocks ahead and decodes up to workers of them
+// in parallel, handing them out in order.
+type blockReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	base   []byte // base nonce
+	hdrSum []byte
+	size   int
+	flags  byte   // payload flags
+	buf    []byte // the unread rest of block
+	block  []byte // the current decoded block, wiped once read
+	done   bool
+	err    error // the error that ended reading
+
+	// blocks being decoded, oldest first; ahead counts the blocks read
+	// from r and ended is set once the last one (or an error) was
+	pending []*pendingRead
+	workers int
+	ahead   uint64
+	ended   bool
+	stop    uint64 // the block to end before, as if the payload did (0 = none)
+
+	// nextLen is the length prefix of the next block, read ahead to tell
+	// whether the current block is the last one (-1 = not read yet)
+	nextLen int64
+
+	// dictID identifies the dictionary the archive was compressed with
+	// (nil = none); coding holds that dictionary and the external
+	// compressor command once the caller supplied them
+	dictID []byte
+	coding blockCoding
+
+	maxMemory int64 // refuse blocks that need more to decode (0 = no limit)
+}
+
+// pendingRead is a block handed to a decoding goroutine.
+type pendingRead struct {
+	done  chan struct{}
+	final bool
+	raw   []byte
+	err   error
+}
+
+// newBlockReader reads the block size, payload flags and base nonce from r.
+// header is the archive header that precedes them, without the key slots.
+func newBlockReader(r io.Reader, aead cipher.AEAD, header []byte) (*blockReader, error) {
+	hdr := make([]byte, 5+aead.NonceSize())
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:4])
+	if size == 0 || size > 1<<30 {
+		return nil, fmt.Errorf("corrupt header (block size %d)", size)
+	}
+	return &blockReader{
+		r: r, aead: aead, base: hdr[5:], size: int(size), flags: hdr[4],
+		hdrSum: headerSum(header, hdr), nextLen: -1, workers: runtime.GOMAXPROCS(0),
+	}, nil
+}
+
+// reopen returns a reader of the same payload, decoding as br does,
+// for r starting at the length prefix of block num.
+func (br *blockReader) reopen(r io.Reader, num uint64) *blockReader {
+	return &blockReader{
+		r: r, aead: br.aead, base: br.base, hdrSum: br.hdrSum, size: br.size, flags: br.flags,
+		nextLen: -1, workers: br.workers, ahead: num, dictID: br.dictID, coding: br.coding, maxMemory: br.maxMemory,
+	}
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		if br.done {
+			return 0, io.EOF
+		}
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+// readLen reads a block length prefix.
+func (br *blockReader) readLen() (uint32, error) {
+	var slen uint32
+	err := binary.Read(br.r, binary.LittleEndian, &slen)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return slen, err
+}
+
+// next hands out the next decoded block, wiping the previous one.
+func (br *blockReader) next() error {
+	clear(br.block)
+	br.block, br.buf = nil, nil
+	if br.err != nil {
+		return br.err
+	}
+	br.readAhead()
+	if len(br.pending) == 0 { // at stop
+		br.done = true
+		return nil
+	}
+	pr := br.pending[0]
+	<-pr.done
+	br.pending = br.pending[1:]
+	if pr.err != nil {
+		br.err = pr.err
+		return pr.err
+	}
+	br.block, br.buf, br.done = pr.raw, pr.raw, pr.final
+	return nil
+}
+
+// readAhead reads blocks from r and starts decoding them until workers
+// blocks are in flight or the last one was read. A read error takes the
+// place of the block that could not be read.
+func (br *blockReader) readAhead() {
+	for !br.ended && len(br.pending) < br.workers && (br.stop == 0 || br.ahead < br.stop) {
+		num := br.ahead
+		pr := &pendingRead{done: make(chan struct{})}
+		br.pending = append(br.pending, pr)
+		sealed, err := br.readNext(num)
+		if err != nil {
+			pr.err, br.ended = err, true
+			close(pr.done)
+			return
+		}
+		br.ahead++
+		pr.final = br.nextLen == 0
+		br.ended = pr.final
+		go func() {
+			defer close(pr.done)
+			pr.raw, _, pr.err = br.open(sealed, num, pr.final)
+			if pr.err != nil && !pr.final {
+				if raw, _, ferr := br.open(sealed, num, true); ferr == nil {
+					clear(raw)
+					pr.err = fmt.Errorf("block %d is marked as the last one, but more follow", num)
+				}
+			}
+		}()
+	}
+}
+
+// readNext reads the sealed bytes of block num and the length prefix of
+// the block after it, which is 0 if num is the last block.
+func (br *blockReader) readNext(num uint64) ([]byte, error) {
+	if br.nextLen < 0 {
+		slen, err := br.readLen()
+		if err != nil {
+			return nil, err
+		}
+		br.nextLen = int64(slen)
+	}
+	if br.nextLen == 0 {
+		// the end marker right away; otherwise the final block ends reading
+		return nil, errors.New("archive has no final block (truncated?)")
+	}
+	sealed, err := br.readSealed(br.r, uint32(br.nextLen), num)
+	if err != nil {
+		return nil, err
+	}
+	following, err := br.readLen()
+	if err != nil {
+		return nil, err
+	}
+	br.nextLen = int64(following)
+	return sealed, nil
+}
+
+// Close waits for the blocks still being decoded and wipes them along
+// with the current one.
+func (br *blockReader) Close() error {
+	clear(br.block)
+	for _, pr := range br.pending {
+		<-pr.done
+		clear(pr.raw)
+	}
+	br.pending = nil
+	return nil
+}
+
+// readSealed reads the sealed bytes of block num, whose length prefix slen
+// was already consumed.
+func (br *blockReader) readSealed(r io.Reader, slen uint32, num uint64) ([]byte, error) {
+	// a block never expands by more than its method header and tag
+	if int64(slen) > int64(br.size)+1024 {
+		return nil, fmt.Errorf("corrupt block %d (sealed length %d)", num, slen)
+	}
+	// the block size is not authenticated until a block opens
+	return appendRead(nil, r, uint64(slen))
+}
+
+// decrypt opens block num, final if it is the last block, to its
+// compressed form: [1 byte method][4 bytes raw length][method data].
+func (br *blockReader) decrypt(sealed []byte, num uint64, final bool) ([]byte, error) {
+	plain, err := br.aead.Open(nil, blockNonce(br.base, num), sealed, blockAAD(br.hdrSum, num, final))
+	if err != nil {
+		if final {
+			return nil, fmt.Errorf("block %d: %w (or the archive is truncated after it)", num, err)
+		}
+		return nil, fmt.Errorf("block %d: %w", num, err)
+	}
+	if len(plain) < 5 {
+		return nil, fmt.Errorf("corrupt block %d", num)
+	}
+	return plain, nil
+}
+
+// open decrypts and decodes block num, final if it is the last block, and
+// returns the raw block and its compression method.
+func (br *blockReader) open(sealed []byte, num uint64, final bool) ([]byte, byte, error) {
+	plain, err := br.decrypt(sealed, num, final)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkBlockMemory(plain, br.maxMemory); err != nil {
+		return nil, 0, fmt.Errorf("block %d: %w", num, err)
+	}
+	if br.dictID != nil && br.coding.dict == nil {
+		return nil, 0, fmt.Errorf("archive was compressed with dictionary %x; pass it with -dict", br.dictID)
+	}
+	raw, method, err := decodeBlock(plain, br.size, br.coding)
+	if method != methodStore {
+		clear(plain) // stored blocks are returned in place
+	}
+	if err != nil {
+		return nil, method, fmt.Errorf("block %d: %w", num, err)
+	}
+	return raw, method, nil
+}
+
+// readAt decodes block num directly, using its index record.
+func (br *blockReader) readAt(r io.ReaderAt, index []blockInfo, num int) ([]byte, byte, error) {
+	sealed, err := br.sealedAt(r, index, num)
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, method, err := br.open(sealed, uint64(num), num == len(index)-1)
+	if err != nil {
+		return nil, method, err
+	}
+	if len(raw) != int(index[num].rawLen) {
+		return nil, method, fmt.Errorf("block %d does not match the index", num)
+	}
+	return raw, method, nil
+}
+
+// sealedAt reads the sealed bytes of block num, using its index record.
+func (br *blockReader) sealedAt(r io.ReaderAt, index []blockInfo, num int) ([]byte, error) {
+	sr := io.NewSectionReader(r, index[num].offset, 1<<62)
+	var slen uint32
+	if err := binary.Read(sr, binary.LittleEndian, &slen); err != nil {
+		return nil, err
+	}
+	return br.readSealed(sr, slen, uint64(num))
+}
+
+// readBlockIndex loads the block index from the trailer at the end of r,
+// along with the index tag if there is one; blockReader.checkIndex checks
+// it. It also returns where the blocks end: the offset of the end marker.
+func readBlockIndex(r io.ReadSeeker) ([]blockInfo, []byte, int64, error) {
+	end, err := r.Seek(-12, io.SeekEnd)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var trailer [12]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return nil, nil, 0, err
+	}
+	if string(trailer[8:]) != indexMagic {
+		return nil, nil, 0, errors.New("block index not found (truncated archive?)")
+	}
+	off := int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if off < 4 || off > end-4 {
+		return nil, nil, 0, errors.New("corrupt block index offset")
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return nil, nil, 0, err
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, nil, 0, err
+	}
+	tagged := int64(count)*indexRecordSize+indexTagSize == end-off-4
+	if !tagged && int64(count)*indexRecordSize != end-off-4 {
+		return nil, nil, 0, errors.New("corrupt block index size")
+	}
+	index := make([]blockInfo, count)
+	for i := range index {
+		var rec [indexRecordSize]byte
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			return nil, nil, 0, err
+		}
+		index[i] = blockInfo{
+			offset:    int64(binary.LittleEndian.Uint64(rec[0:8])),
+			rawOffset: int64(binary.LittleEndian.Uint64(rec[8:16])),
+			rawLen:    binary.LittleEndian.Uint32(rec[16:20]),
+			flags:     rec[20],
+		}
+	}
+	var tag []byte
+	if tagged {
+		tag = make([]byte, indexTagSize)
+		if _, err := io.ReadFull(r, tag); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	return index, tag, off - 4, nil
+}
+
+// payloadSize is the total raw size described by a block index.
+func payloadSize(index []blockInfo) int64 {
+	if len(index) == 0 {
+		return 0
+	}
+	last := index[len(index)-1]
+	return last.rawOffset + int64(last.rawLen)
+}
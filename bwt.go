@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ---------------------- BWT + MTF + RLE (method bwt) ----------------
+//
+// A bzip2-style pipeline: the Burrows-Wheeler transform groups bytes with
+// similar contexts, move-to-front turns those groups into runs of small
+// numbers (mostly zeros), zero runs are collapsed, and the result goes to
+// the Huffman coder. Method data:
+//
+//   [4 bytes primary index]  row of the original string's end
+//   symbols stream           MTF values, a run of zeros written as one 0
+//   runs stream              per 0 symbol: uvarint run length - 1
+//
+// with the streams coded as in appendStreams.
+
+// suffixArray sorts the suffixes of s (a shorter suffix sorts before a
+// longer one it is a prefix of) by prefix doubling with counting sorts.
+func suffixArray(s []byte) []int32 {
+	n := len(s)
+	sa := make([]int32, n)
+	rank := make([]int32, n)
+	tmp := make([]int32, n)
+	buckets := make([]int32, max(n, 256)+1)
+	for i, b := range s {
+		rank[i] = int32(b)
+		buckets[int(b)+1]++
+	}
+	for i := 1; i < len(buckets); i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i, b := range s {
+		sa[buckets[b]] = int32(i)
+		buckets[b]++
+	}
+	for k := 1; n > 1; k <<= 1 {
+		// order by the second half: suffixes without one first, then
+		// the others in the order of their second halves
+		j := 0
+		for i := n - k; i < n; i++ {
+			if i >= 0 {
+				tmp[j] = int32(i)
+				j++
+			}
+		}
+		for _, p := range sa {
+			if int(p) >= k {
+				tmp[j] = p - int32(k)
+				j++
+			}
+		}
+		// stable counting sort by the first half
+		clear(buckets)
+		for _, r := range rank {
+			buckets[r+1]++
+		}
+		for i := 1; i < len(buckets); i++ {
+			buckets[i] += buckets[i-1]
+		}
+		for _, p := range tmp {
+			sa[buckets[rank[p]]] = p
+			buckets[rank[p]]++
+		}
+		// re-rank
+		second := func(p int32) int32 {
+			if int(p)+k < n {
+				return rank[int(p)+k]
+			}
+			return -1
+		}
+		tmp[sa[0]] = 0
+		for i := 1; i < n; i++ {
+			a, b := sa[i-1], sa[i]
+			tmp[b] = tmp[a]
+			if rank[a] != rank[b] || second(a) != second(b) {
+				tmp[b]++
+			}
+		}
+		rank, tmp = tmp, rank
+		if int(rank[sa[n-1]]) == n-1 {
+			break
+		}
+	}
+	return sa
+}
+
+// bwtForward returns the Burrows-Wheeler transform of s with an implicit
+// end marker, and the row at which the marker was dropped.
+func bwtForward(s []byte) ([]byte, int) {
+	n := len(s)
+	if n == 0 {
+		return nil, 0
+	}
+	out := make([]byte, 0, n)
+	out = append(out, s[n-1]) // row 0 is the empty suffix
+	primary := 0
+	for r, p := range suffixArray(s) {
+		if p == 0 {
+			primary = r + 1
+			continue
+		}
+		out = append(out, s[p-1])
+	}
+	return out, primary
+}
+
+// bwtInverse undoes bwtForward.
+func bwtInverse(l []byte, primary int) ([]byte, error) {
+	n := len(l)
+	if n == 0 {
+		return nil, nil
+	}
+	if primary < 1 || primary > n {
+		return nil, errors.New("corrupt bwt block (primary index)")
+	}
+	// full last column, with the end marker at row primary
+	var count [256]int
+	for _, b := range l {
+		count[b]++
+	}
+	var less [256]int
+	sum := 1 // the end marker sorts first
+	for c := range less {
+		less[c] = sum
+		sum += count[c]
+	}
+	lf := make([]int32, n+1)
+	col := make([]byte, n+1)
+	var seen [256]int
+	for row, i := 0, 0; row <= n; row++ {
+		if row == primary {
+			continue
+		}
+		b := l[i]
+		i++
+		col[row] = b
+		lf[row] = int32(less[b] + seen[b])
+		seen[b]++
+	}
+	out := make([]byte, n)
+	row := 0
+	for k := n - 1; k >= 0; k-- {
+		if row == primary {
+			return nil, errors.New("corrupt bwt block")
+		}
+		out[k] = col[row]
+		row = int(lf[row])
+	}
+	return out, nil
+}
+
+func bwtEncode(raw []byte) ([]byte, error) {
+	l, primary := bwtForward(raw)
+	var mtf [256]byte
+	for i := range mtf {
+		mtf[i] = byte(i)
+	}
+	var syms, runs []byte
+	zeros := 0
+	for _, b := range l {
+		j := 0
+		for mtf[j] != b {
+			j++
+		}
+		copy(mtf[1:j+1], mtf[:j])
+		mtf[0] = b
+		if j == 0 {
+			zeros++
+			continue
+		}
+		if zeros > 0 {
+			syms = append(syms, 0)
+			runs = binary.AppendUvarint(runs, uint64(zeros-1))
+			zeros = 0
+		}
+		syms = append(syms, byte(j))
+	}
+	if zeros > 0 {
+		syms = append(syms, 0)
+		runs = binary.AppendUvarint(runs, uint64(zeros-1))
+	}
+	return appendStreams(binary.LittleEndian.AppendUint32(nil, uint32(primary)), syms, runs)
+}
+
+func bwtDecode(data []byte, rawLen int) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("corrupt bwt block (truncated)")
+	}
+	primary := int(binary.LittleEndian.Uint32(data))
+	streams, err := readStreams(data[4:], rawLen, 2)
+	if err != nil {
+		return nil, err
+	}
+	syms, runs := streams[0], streams[1]
+	var mtf [256]byte
+	for i := range mtf {
+		mtf[i] = byte(i)
+	}
+	l := make([]byte, 0, rawLen)
+	for _, j := range syms {
+		if j == 0 {
+			z, n := binary.Uvarint(runs)
+			if n <= 0 || z >= uint64(rawLen-len(l)) {
+				return nil, errors.New("corrupt bwt block (run length)")
+			}
+			runs = runs[n:]
+			for ; z > 0; z-- {
+				l = append(l, mtf[0])
+			}
+			l = append(l, mtf[0])
+			continue
+		}
+		if len(l) == rawLen {
+			return nil, errors.New("corrupt bwt block (too long)")
+		}
+		b := mtf[j]
+		copy(mtf[1:int(j)+1], mtf[:j])
+		mtf[0] = b
+		l = append(l, b)
+	}
+	if len(l) != rawLen || len(runs) != 0 {
+		return nil, errors.New("corrupt bwt block (length mismatch)")
+	}
+	return bwtInverse(l, primary)
+}
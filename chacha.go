@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ---------------------- XChaCha20-Poly1305 --------------------------
+//
+// ChaCha20-Poly1305 (RFC 8439) with the 24 byte nonces of XChaCha20
+// (draft-irtf-cfrg-xchacha): HChaCha20 derives a subkey from the key and
+// the first 16 nonce bytes, and the remaining 8 bytes become the ChaCha20
+// nonce. Random 24 byte nonces can be used under one key practically
+// without limit, where 12 byte GCM nonces risk colliding after about 2^32
+// messages. The standard library only has it internally, hence this copy.
+
+const (
+	chachaKeySize   = 32
+	xchachaNonceLen = 24
+	poly1305TagSize = 16
+)
+
+var errOpen = errors.New("cipher: message authentication failed")
+
+// xchacha20poly1305 implements cipher.AEAD.
+type xchacha20poly1305 struct {
+	key [8]uint32
+}
+
+// newXChaCha20Poly1305 returns XChaCha20-Poly1305 for a 32 byte key.
+func newXChaCha20Poly1305(key []byte) (*xchacha20poly1305, error) {
+	if len(key) != chachaKeySize {
+		return nil, errors.New("xchacha20poly1305: bad key length")
+	}
+	x := &xchacha20poly1305{}
+	for i := range x.key {
+		x.key[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return x, nil
+}
+
+func (x *xchacha20poly1305) NonceSize() int { return xchachaNonceLen }
+func (x *xchacha20poly1305) Overhead() int  { return poly1305TagSize }
+
+// setup derives the ChaCha20 state for nonce and the one-time Poly1305 key.
+func (x *xchacha20poly1305) setup(nonce []byte) (state [16]uint32, polyKey [32]byte) {
+	if len(nonce) != xchachaNonceLen {
+		panic("xchacha20poly1305: bad nonce length")
+	}
+	sub := hchacha20(&x.key, nonce[:16])
+	state = chachaState(&sub, 0, [3]uint32{0, binary.LittleEndian.Uint32(nonce[16:]), binary.LittleEndian.Uint32(nonce[20:])})
+	var block [64]byte
+	chachaBlock(&state, &block)
+	copy(polyKey[:], block[:])
+	state[12] = 1 // the payload starts with the second block
+	return state, polyKey
+}
+
+func (x *xchacha20poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	state, polyKey := x.setup(nonce)
+	ret, out := sliceForAppend(dst, len(plaintext)+poly1305TagSize)
+	ct := out[:len(plaintext)]
+	chachaXOR(&state, ct, plaintext)
+	tag := aeadTag(&polyKey, additionalData, ct)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (x *xchacha20poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < poly1305TagSize {
+		return nil, errOpen
+	}
+	state, polyKey := x.setup(nonce)
+	ct, tag := ciphertext[:len(ciphertext)-poly1305TagSize], ciphertext[len(ciphertext)-poly1305TagSize:]
+	want := aeadTag(&polyKey, additionalData, ct)
+	if subtle.ConstantTimeCompare(want[:], tag) != 1 {
+		return nil, errOpen
+	}
+	ret, out := sliceForAppend(dst, len(ct))
+	chachaXOR(&state, out, ct)
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// n new bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	return head, head[len(in):]
+}
+
+// aeadTag is the Poly1305 tag over the additional data and ciphertext,
+// each padded to 16 bytes, followed by both lengths.
+func aeadTag(key *[32]byte, ad, ct []byte) [16]byte {
+	p := newPoly1305(key)
+	var pad [16]byte
+	p.write(ad)
+	p.write(pad[:(16-len(ad)%16)%16])
+	p.write(ct)
+	p.write(pad[:(16-len(ct)%16)%16])
+	binary.LittleEndian.PutUint64(pad[:8], uint64(len(ad)))
+	binary.LittleEndian.PutUint64(pad[8:], uint64(len(ct)))
+	p.write(pad[:])
+	return p.sum()
+}
+
+// ---------------------- ChaCha20 ----------------------------------
+
+// chachaState lays out the input block: constants, key, counter, nonce.
+func chachaState(key *[8]uint32, counter uint32, nonce [3]uint32) [16]uint32 {
+	return [16]uint32{
+		0x61707865, 0x3320646e, 0x79622d32, 0x6b206574,
+		key[0], key[1], key[2], key[3], key[4], key[5], key[6], key[7],
+		counter, nonce[0], nonce[1], nonce[2],
+	}
+}
+
+// chachaRounds runs the 20 rounds on x.
+func chachaRounds(x *[16]uint32) {
+	qr := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for i := 0; i < 10; i++ {
+		qr(0, 4, 8, 12) // columns
+		qr(1, 5, 9, 13)
+		qr(2, 6, 10, 14)
+		qr(3, 7, 11, 15)
+		qr(0, 5, 10, 15) // diagonals
+		qr(1, 6, 11, 12)
+		qr(2, 7, 8, 13)
+		qr(3, 4, 9, 14)
+	}
+}
+
+// chachaBlock writes the key stream block for state to out.
+func chachaBlock(state *[16]uint32, out *[64]byte) {
+	x := *state
+	chachaRounds(&x)
+	for i, v := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], v+state[i])
+	}
+}
+
+// chachaXOR XORs the key stream from state's counter on into dst, advancing
+// the counter.
+func chachaXOR(state *[16]uint32, dst, src []byte) {
+	var block [64]byte
+	for len(src) > 0 {
+		chachaBlock(state, &block)
+		state[12]++
+		n := min(len(src), 64)
+		subtle.XORBytes(dst[:n], src[:n], block[:n])
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// hchacha20 derives a subkey from key and a 16 byte nonce.
+func hchacha20(key *[8]uint32, nonce []byte) [8]uint32 {
+	x := chachaState(key, binary.LittleEndian.Uint32(nonce), [3]uint32{
+		binary.LittleEndian.Uint32(nonce[4:]),
+		binary.LittleEndian.Uint32(nonce[8:]),
+		binary.LittleEndian.Uint32(nonce[12:]),
+	})
+	chachaRounds(&x)
+	return [8]uint32{x[0], x[1], x[2], x[3], x[12], x[13], x[14], x[15]}
+}
+
+// ---------------------- Poly1305 ----------------------------------
+
+// poly1305 is a running one-time MAC. The accumulator h is kept in three
+// 64-bit words, only partially reduced modulo 2^130 - 5.
+type poly1305 struct {
+	h0, h1, h2 uint64
+	r0, r1     uint64
+	s0, s1     uint64
+	buf        [16]byte
+	n          int
+}
+
+func newPoly1305(key *[32]byte) *poly1305 {
+	return &poly1305{
+		r0: binary.LittleEndian.Uint64(key[0:]) & 0x0ffffffc0fffffff, // clamped
+		r1: binary.LittleEndian.Uint64(key[8:]) & 0x0ffffffc0ffffffc,
+		s0: binary.LittleEndian.Uint64(key[16:]),
+		s1: binary.LittleEndian.Uint64(key[24:]),
+	}
+}
+
+func (p *poly1305) write(b []byte) {
+	if p.n > 0 {
+		c := copy(p.buf[p.n:], b)
+		p.n += c
+		b = b[c:]
+		if p.n < 16 {
+			return
+		}
+		p.block(p.buf[:], 1)
+		p.n = 0
+	}
+	for ; len(b) >= 16; b = b[16:] {
+		p.block(b, 1)
+	}
+	p.n = copy(p.buf[:], b)
+}
+
+// block adds the 16 byte m plus hibit·2^128 to h and multiplies by r.
+func (p *poly1305) block(m []byte, hibit uint64) {
+	var c uint64
+	p.h0, c = bits.Add64(p.h0, binary.LittleEndian.Uint64(m[0:]), 0)
+	p.h1, c = bits.Add64(p.h1, binary.LittleEndian.Uint64(m[8:]), c)
+	p.h2 += c + hibit
+
+	// h * r; h2 is at most 7 and r is clamped, so nothing overflows
+	h0r0hi, h0r0lo := bits.Mul64(p.h0, p.r0)
+	h1r0hi, h1r0lo := bits.Mul64(p.h1, p.r0)
+	h0r1hi, h0r1lo := bits.Mul64(p.h0, p.r1)
+	h1r1hi, h1r1lo := bits.Mul64(p.h1, p.r1)
+	h2r0, h2r1 := p.h2*p.r0, p.h2*p.r1
+
+	m1lo, c := bits.Add64(h1r0lo, h0r1lo, 0)
+	m1hi, _ := bits.Add64(h1r0hi, h0r1hi, c)
+	m2lo, c := bits.Add64(h1r1lo, h2r0, 0)
+	m2hi, _ := bits.Add64(h1r1hi, 0, c)
+
+	t0 := h0r0lo
+	t1, c := bits.Add64(m1lo, h0r0hi, 0)
+	t2, c := bits.Add64(m2lo, m1hi, c)
+	t3, _ := bits.Add64(h2r1, m2hi, c)
+
+	// 2^130 = 5 (mod p): add the part above 2^130 times 4, then times 1
+	p.h0, p.h1, p.h2 = t0, t1, t2&3
+	cLo, cHi := t2&^3, t3
+	p.h0, c = bits.Add64(p.h0, cLo, 0)
+	p.h1, c = bits.Add64(p.h1, cHi, c)
+	p.h2 += c
+	cLo, cHi = cLo>>2|cHi<<62, cHi>>2
+	p.h0, c = bits.Add64(p.h0, cLo, 0)
+	p.h1, c = bits.Add64(p.h1, cHi, c)
+	p.h2 += c
+}
+
+// sum finishes the MAC.
+func (p *poly1305) sum() [16]byte {
+	if p.n > 0 {
+		p.buf[p.n] = 1
+		clear(p.buf[p.n+1:])
+		p.block(p.buf[:], 0)
+	}
+	// h mod p: subtract p if h >= p
+	t0, b := bits.Sub64(p.h0, 0xfffffffffffffffb, 0)
+	t1, b := bits.Sub64(p.h1, 0xffffffffffffffff, b)
+	_, b = bits.Sub64(p.h2, 3, b)
+	mask := b - 1 // all ones without a borrow, selecting h - p
+	h0 := p.h0&^mask | t0&mask
+	h1 := p.h1&^mask | t1&mask
+	var c uint64
+	h0, c = bits.Add64(h0, p.s0, 0)
+	h1, _ = bits.Add64(h1, p.s1, c)
+	var tag [16]byte
+	binary.LittleEndian.PutUint64(tag[0:], h0)
+	binary.LittleEndian.PutUint64(tag[8:], h1)
+	return tag
+}
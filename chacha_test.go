@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// keyWords reads a 32 byte key as ChaCha20 takes it.
+func keyWords(key []byte) *[8]uint32 {
+	var k [8]uint32
+	for i := range k {
+		k[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return &k
+}
+
+// The block function test vector of RFC 8439, section 2.3.2.
+func TestChaCha20BlockRFC8439(t *testing.T) {
+	nonce := unhex(t, "000000090000004a00000000")
+	state := chachaState(keyWords(unhex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")), 1, [3]uint32{
+		binary.LittleEndian.Uint32(nonce), binary.LittleEndian.Uint32(nonce[4:]), binary.LittleEndian.Uint32(nonce[8:]),
+	})
+	var out [64]byte
+	chachaBlock(&state, &out)
+	want := "10f1e7e4d13b5915500fdd1fa32071c4c7d1f4c733c068030422aa9ac3d46c4ed2826446079faa0914c2d705d98b02a2b5129cd1de164eb9cbd083e8a2503c4e"
+	if got := hex.EncodeToString(out[:]); got != want {
+		t.Errorf("block = %s, want %s", got, want)
+	}
+}
+
+// The Poly1305 test vector of RFC 8439, section 2.5.2, written in uneven
+// parts.
+func TestPoly1305RFC8439(t *testing.T) {
+	var key [32]byte
+	copy(key[:], unhex(t, "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b"))
+	p := newPoly1305(&key)
+	msg := []byte("Cryptographic Forum Research Group")
+	p.write(msg[:5])
+	p.write(msg[5:21])
+	p.write(msg[21:])
+	tag := p.sum()
+	if got, want := hex.EncodeToString(tag[:]), "a8061dc1305136c6c22b8baf0c0127a9"; got != want {
+		t.Errorf("tag = %s, want %s", got, want)
+	}
+}
+
+// The AEAD test vector of RFC 8439, section 2.8.2, which XChaCha20-Poly1305
+// runs once it has derived the subkey.
+func TestChaCha20Poly1305RFC8439(t *testing.T) {
+	key := keyWords(unhex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"))
+	ad := unhex(t, "50515253c0c1c2c3c4c5c6c7")
+	pt := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	state := chachaState(key, 0, [3]uint32{7, 0x43424140, 0x47464544})
+	var block [64]byte
+	chachaBlock(&state, &block)
+	var polyKey [32]byte
+	copy(polyKey[:], block[:])
+	state[12] = 1
+	ct := make([]byte, len(pt))
+	chachaXOR(&state, ct, pt)
+	tag := aeadTag(&polyKey, ad, ct)
+	want := "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116"
+	if got := hex.EncodeToString(ct); got != want {
+		t.Errorf("ciphertext = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(tag[:]), "1ae10b594f09e26a7e902ecbd0600691"; got != want {
+		t.Errorf("tag = %s, want %s", got, want)
+	}
+}
+
+// The HChaCha20 test vector of draft-irtf-cfrg-xchacha, section 2.2.1.
+func TestHChaCha20(t *testing.T) {
+	sub := hchacha20(keyWords(unhex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")),
+		unhex(t, "000000090000004a0000000031415927"))
+	var got []byte
+	for _, w := range sub {
+		got = binary.LittleEndian.AppendUint32(got, w)
+	}
+	if want := "82413b4227b27bfed30e42508a877d73a0f9e4d58a74a853c12ec41326d3ecdc"; hex.EncodeToString(got) != want {
+		t.Errorf("subkey = %x, want %s", got, want)
+	}
+}
+
+// The AEAD test vector of draft-irtf-cfrg-xchacha, appendix A.3.1.
+func TestXChaCha20Poly1305(t *testing.T) {
+	aead, err := newXChaCha20Poly1305(unhex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := unhex(t, "404142434445464748494a4b4c4d4e4f5051525354555657")
+	ad := unhex(t, "50515253c0c1c2c3c4c5c6c7")
+	pt := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	want := unhex(t, "bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b4522f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff921f9664c97637da9768812f615c68b13b52e"+
+		"c0875924c1c7987947deafd8780acf49")
+	sealed := aead.Seal(nil, nonce, pt, ad)
+	if !bytes.Equal(sealed, want) {
+		t.Fatalf("sealed = %x, want %x", sealed, want)
+	}
+	opened, err := aead.Open(nil, nonce, sealed, ad)
+	if err != nil || !bytes.Equal(opened, pt) {
+		t.Fatalf("open = %q, %v", opened, err)
+	}
+	for _, i := range []int{0, len(pt), len(sealed) - 1} {
+		bad := bytes.Clone(sealed)
+		bad[i] ^= 1
+		if _, err := aead.Open(nil, nonce, bad, ad); err == nil {
+			t.Errorf("open accepted a change to byte %d", i)
+		}
+	}
+	if _, err := aead.Open(nil, nonce, sealed, ad[1:]); err == nil {
+		t.Error("open accepted other additional data")
+	}
+}
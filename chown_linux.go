@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// canChown reports whether the process may give files to other users: as
+// root, or with CAP_CHOWN in its effective capabilities.
+func canChown() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range bytes.Split(status, []byte("\n")) {
+		if hex, ok := bytes.CutPrefix(line, []byte("CapEff:")); ok {
+			caps, err := strconv.ParseUint(string(bytes.TrimSpace(hex)), 16, 64)
+			return err == nil && caps&(1<<0) != 0 // CAP_CHOWN is 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// canChown reports whether the process may give files to other users,
+// which only root may do here.
+func canChown() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// ---------------------- Shared chunks ------------------------------
+//
+// Large files that differ in a few places, such as VM images or database
+// dumps taken a day apart, are no copies of each other, but most of their
+// contents are the same. Every file that is streamed (largefile.go) is cut
+// into chunks where a rolling hash of the last 64 bytes hits a pattern,
+// so the cuts follow the contents rather than offsets: an insertion only
+// changes the chunks around it. A file whose chunks include some already
+// archived in this run is stored as a chunked entry, a list of records
+// that either carry a chunk's data or name the file and offset it was
+// archived at first. Extraction reads those back from the files already
+// extracted, or else from the archive (source.go). Files with no chunk in common are stored as before, and
+// -no-dedup turns chunking off along with copies.
+//
+// Chunks are 256 KiB to 4 MiB, 1.25 MiB on average. The cut points are
+// part of the format: -t finds the chunks of plain files again to check
+// the chunks named by later entries.
+
+const (
+	chunkMin  = 256 << 10
+	chunkMax  = 4 << 20
+	chunkMask = (1<<20 - 1) << 44 // the top bits, which depend on 64 bytes
+)
+
+// Records of a chunked entry's data.
+const (
+	chunkData byte = 0 // [8 bytes length][data]
+	chunkRef  byte = 1 // [2 bytes name length][name][8 bytes offset][8 bytes length][32 bytes SHA-256]
+)
+
+// gear holds the random value the rolling hash adds for every byte. It
+// is derived from SHA-256, as the cut points depend on it.
+var gear = func() (g [256]uint64) {
+	for i := range g {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		g[i] = binary.LittleEndian.Uint64(sum[:])
+	}
+	return g
+}()
+
+// chunk is a piece of a file.
+type chunk struct {
+	off, size int64
+	sum       [sha256.Size]byte
+}
+
+// chunker cuts what is written to it into chunks.
+type chunker struct {
+	hash   uint64
+	size   int64 // of the chunk being written
+	off    int64 // where it starts
+	sum    hash.Hash
+	chunks []chunk
+}
+
+func newChunker() *chunker {
+	return &chunker{sum: sha256.New()}
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// the hash only matters from chunkMin on, and only its last 64
+		// bytes count, so the bytes before are not hashed
+		i := int(min(max(chunkMin-64-c.size, 0), int64(len(p))))
+		c.size += int64(i)
+		end := false
+		for ; i < len(p) && !end; i++ {
+			c.hash = c.hash<<1 + gear[p[i]]
+			c.size++
+			end = c.size >= chunkMax || c.size >= chunkMin && c.hash&chunkMask == 0
+		}
+		c.sum.Write(p[:i])
+		p = p[i:]
+		if end {
+			c.cut()
+		}
+	}
+	return n, nil
+}
+
+// cut ends the chunk being written.
+func (c *chunker) cut() {
+	if c.size == 0 {
+		return
+	}
+	ch := chunk{off: c.off, size: c.size}
+	c.sum.Sum(ch.sum[:0])
+	c.chunks = append(c.chunks, ch)
+	c.off += c.size
+	c.hash, c.size = 0, 0
+	c.sum.Reset()
+}
+
+// finish returns the chunks, the last one ending with what was written.
+func (c *chunker) finish() []chunk {
+	c.cut()
+	return c.chunks
+}
+
+// contentSize returns the size of the contents of file or chunked entry
+// h.
+func (h entryHeader) contentSize() uint64 {
+	if h.typ == entryChunks {
+		return h.fileSize
+	}
+	return h.size
+}
+
+// chunkPlace is where a chunk was archived first: in the file entry
+// named name, at off.
+type chunkPlace struct {
+	name string
+	off  int64
+}
+
+// chunkIndex maps the checksums of the chunks archived so far to where
+// they were archived first.
+type chunkIndex map[[sha256.Size]byte]chunkPlace
+
+// share looks up the chunks of lf and notes those archived before in
+// lf.shared. It reports whether there were any.
+func (ix chunkIndex) share(lf *largeFile) bool {
+	found := false
+	lf.shared = make([]chunkPlace, len(lf.chunks))
+	for i, c := range lf.chunks {
+		if p, ok := ix[c.sum]; ok {
+			lf.shared[i], found = p, true
+		}
+	}
+	return found
+}
+
+// add notes the chunks of lf, archived as name, that are new.
+func (ix chunkIndex) add(name string, lf *largeFile) {
+	for _, c := range lf.chunks {
+		if _, ok := ix[c.sum]; !ok {
+			ix[c.sum] = chunkPlace{name, c.off}
+		}
+	}
+}
+
+// chunkListSize returns the size of lf as a chunked entry's data.
+func (lf *largeFile) chunkListSize() uint64 {
+	var n uint64
+	for i, c := range lf.chunks {
+		if p := lf.shared[i]; p.name != "" {
+			n += 1 + 2 + uint64(len(p.name)) + 8 + 8 + sha256.Size
+		} else {
+			n += 1 + 8 + uint64(c.size)
+		}
+	}
+	return n
+}
+
+// writeChunks writes the file to w as a chunked entry's data, showing
+// progress from base bytes of total on.
+func (lf *largeFile) writeChunks(w io.Writer, name string, base, total int64) error {
+	return lf.reread(name, base, total, func(r io.Reader) error {
+		for i, c := range lf.chunks {
+			var rec []byte
+			dst := w
+			if p := lf.shared[i]; p.name != "" {
+				rec = append([]byte{chunkRef}, binary.LittleEndian.AppendUint16(nil, uint16(len(p.name)))...)
+				rec = append(rec, p.name...)
+				rec = binary.LittleEndian.AppendUint64(rec, uint64(p.off))
+				rec = binary.LittleEndian.AppendUint64(rec, uint64(c.size))
+				rec = append(rec, c.sum[:]...)
+				dst = io.Discard
+			} else {
+				rec = binary.LittleEndian.AppendUint64([]byte{chunkData}, uint64(c.size))
+			}
+			if _, err := w.Write(rec); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(dst, r, c.size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readChunkRecord reads the next record of a chunked entry's data: the
+// size of the chunk and, for a shared one, where it was archived and its
+// checksum. A data record's data follows in r. At the end of the records
+// it returns io.EOF.
+func readChunkRecord(r io.Reader) (p chunkPlace, c chunk, err error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return p, c, err
+	}
+	switch kind[0] {
+	case chunkData:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return p, c, noEOF(err)
+		}
+		c.size = int64(binary.LittleEndian.Uint64(b[:]))
+	case chunkRef:
+		var n [2]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return p, c, noEOF(err)
+		}
+		b := make([]byte, int(binary.LittleEndian.Uint16(n[:]))+8+8+sha256.Size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return p, c, noEOF(err)
+		}
+		name, b := b[:len(b)-16-sha256.Size], b[len(b)-16-sha256.Size:]
+		p = chunkPlace{string(name), int64(binary.LittleEndian.Uint64(b))}
+		c.size = int64(binary.LittleEndian.Uint64(b[8:]))
+		copy(c.sum[:], b[16:])
+		if p.name == "" || p.off < 0 {
+			return p, c, errors.New("bad chunk record")
+		}
+	default:
+		return p, c, fmt.Errorf("unknown chunk record %d", kind[0])
+	}
+	if c.size < 0 || c.size > chunkMax {
+		return p, c, errors.New("bad chunk record")
+	}
+	return p, c, nil
+}
+
+// noEOF turns io.EOF within a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// chunkReader reads the contents of a chunked entry from its data in r.
+// open returns a reader of size bytes of the entry named by p from p.off
+// on, for the shared chunks: one of the file extracted for it, or of the
+// archive (source.go). A reader that is an io.Closer is closed once read.
+type chunkReader struct {
+	r    io.Reader
+	open func(p chunkPlace, size int64) (io.Reader, error)
+	cur  io.Reader // the rest of the current chunk
+	c    io.Closer // cur's, if shared
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if cr.cur != nil {
+			n, err := cr.cur.Read(b)
+			if err == io.EOF {
+				cr.cur = nil
+				err = cr.Close()
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		p, c, err := readChunkRecord(cr.r)
+		if err != nil {
+			return 0, err
+		}
+		if p.name == "" {
+			cr.cur = io.LimitReader(cr.r, c.size)
+			continue
+		}
+		if cr.cur, err = cr.open(p, c.size); err != nil {
+			return 0, err
+		}
+		cr.c, _ = cr.cur.(io.Closer)
+	}
+}
+
+// Close closes what the current chunk is read from.
+func (cr *chunkReader) Close() error {
+	if cr.c == nil {
+		return nil
+	}
+	err := cr.c.Close()
+	cr.c = nil
+	return err
+}
+
+// openSection opens size bytes of the file at path from off on.
+func openSection(path string, off, size int64) (io.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, off, size), f}, nil
+}
+
+// chunkTable holds the checksums of the chunks of the large files and
+// chunked entries read so far, for -t to check the shared chunks named
+// by later entries.
+type chunkTable map[chunkPlace]chunk
+
+// addFile returns a writer that the contents of the file entry named
+// name go to, to find its chunks. finish adds them.
+func (t chunkTable) addFile(name string) (w io.Writer, finish func()) {
+	c := newChunker()
+	return c, func() {
+		for _, ch := range c.finish() {
+			t[chunkPlace{name, ch.off}] = ch
+		}
+	}
+}
+
+// check reads the data of chunked entry h from r, hashing the chunks it
+// carries and comparing the shared ones with the chunks they name.
+// bad describes what does not match; err is an error reading r.
+func (t chunkTable) check(h entryHeader, r io.Reader) (bad, err error) {
+	chunks, places, err := readChunkList(r)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for i, c := range chunks {
+		size += c.size
+		p := places[i]
+		if p.name == "" || bad != nil {
+			continue
+		}
+		if first, ok := t[p]; !ok {
+			bad = fmt.Errorf("shares a chunk of %s at %d, which is not in the archive", p.name, p.off)
+		} else if first.size != c.size || first.sum != c.sum {
+			bad = fmt.Errorf("shares a chunk of %s at %d, which does not match", p.name, p.off)
+		}
+	}
+	// only now, as h may share chunks of an earlier file of its name
+	for _, c := range chunks {
+		t[chunkPlace{h.name, c.off}] = c
+	}
+	if bad == nil && uint64(size) != h.fileSize {
+		bad = fmt.Errorf("chunks of %d bytes, not %d", size, h.fileSize)
+	}
+	return bad, nil
+}
+
+// readChunkList reads the data of a chunked entry from r and returns its
+// chunks, hashing the ones stored in it, and where each shared one was
+// archived first (places[i].name is "" for the others).
+func readChunkList(r io.Reader) (chunks []chunk, places []chunkPlace, err error) {
+	var off int64
+	for {
+		p, c, err := readChunkRecord(r)
+		if err == io.EOF {
+			return chunks, places, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.name == "" {
+			sum := sha256.New()
+			if _, err := io.CopyN(sum, r, c.size); err != nil {
+				return nil, nil, noEOF(err)
+			}
+			sum.Sum(c.sum[:0])
+		}
+		c.off = off
+		off += c.size
+		chunks, places = append(chunks, c), append(places, p)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ---------------------- Compression methods ------------------------
+//
+// Every block records the method it was compressed with, so archives can
+// mix methods and readers only need to know the methods actually used.
+
+// Compression methods, recorded in front of every block.
+const (
+	methodStore    byte = 0  // raw bytes
+	methodHuffman  byte = 1  // [256 bytes code lengths][bits]
+	methodDeflate  byte = 2  // raw DEFLATE stream (compress/flate)
+	methodLZ77     byte = 3  // LZ77 parse, Huffman coded streams (lz77.go)
+	methodAdaptive byte = 4  // adaptive Huffman bit stream, no table (adaptive.go)
+	methodOrder1   byte = 5  // Huffman tables per preceding byte (order1.go)
+	methodBWT      byte = 6  // BWT + MTF + zero runs, Huffman coded (bwt.go)
+	methodRLE      byte = 7  // byte runs collapsed, then Huffman (rle.go)
+	methodRange    byte = 8  // order-1 adaptive binary range coder (rangecoder.go)
+	methodLZW      byte = 9  // compress(1)-style LZW codes, 9-16 bits (lzw.go)
+	methodExec     byte = 10 // output of an external compressor (exec.go)
+	methodZstd     byte = 11 // zstd frame, only in builds with -tags zstd (zstd.go)
+)
+
+// codec compresses and decompresses the data of one block.
+type codec struct {
+	name   string
+	encode func(raw []byte) ([]byte, error)
+	// decode must return exactly rawLen bytes or an error
+	decode func(data []byte, rawLen int) ([]byte, error)
+}
+
+var codecs = map[byte]codec{
+	methodStore:    {"store", nil, nil},
+	methodHuffman:  {"huffman", huffmanEncodeBlock, huffmanDecodeBlock},
+	methodDeflate:  {"deflate", deflateEncode, deflateDecode},
+	methodLZ77:     {"lz77", lz77Encode, lz77Decode},
+	methodAdaptive: {"adaptive", adaptiveEncode, adaptiveDecode},
+	methodOrder1:   {"order1", order1Encode, order1Decode},
+	methodBWT:      {"bwt", bwtEncode, bwtDecode},
+	methodRLE:      {"rle", rleEncode, rleDecode},
+	methodRange:    {"range", rangeEncode, rangeDecode},
+	methodLZW:      {"lzw", lzwEncode, lzwDecode},
+	methodExec:     {"exec", nil, nil}, // needs the command, see execEncode
+}
+
+// errNoZstd is returned for zstd in builds without the zstd tag.
+var errNoZstd = errors.New("this build has no zstd support (rebuild with -tags zstd)")
+
+// blockCoding is what, besides the method, decides how blocks are coded.
+type blockCoding struct {
+	method byte     // method to try (encoding only)
+	effort int      // search effort for tuned methods (0 = their default)
+	dict   []byte   // shared dictionary for tuned methods (dict.go)
+	exec   []string // external compressor command for methodExec
+}
+
+// tunedCodecs are the methods that take a search effort of 1 (fastest) to
+// 9 (best; 0 = default) and can code against a shared dictionary (dict.go);
+// they are used instead of the plain codec. Other methods ignore both.
+var tunedCodecs = map[byte]struct {
+	encode func(raw, dict []byte, effort int) ([]byte, error)
+	decode func(data []byte, rawLen int, dict []byte) ([]byte, error)
+}{
+	methodLZ77:    {lz77EncodeDict, lz77DecodeDict},
+	methodDeflate: {deflateEncodeDict, deflateDecodeDict},
+}
+
+// methodName returns the display name of a compression method.
+func methodName(m byte) string {
+	if c, ok := codecs[m]; ok {
+		return c.name
+	}
+	return fmt.Sprintf("method-%d", m)
+}
+
+// parseMethod looks up a compression method by name.
+func parseMethod(name string) (byte, error) {
+	if name == "exec" {
+		return 0, errors.New(`the exec method needs a command, e.g. "exec:zstd"`)
+	}
+	if _, ok := codecs[methodZstd]; name == "zstd" && !ok {
+		return 0, errNoZstd
+	}
+	var names []string
+	for m, c := range codecs {
+		if c.name == name {
+			return m, nil
+		}
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown compression method %q (available: %v)", name, names)
+}
+
+// encodeBlock compresses one block as [method][raw length][method data],
+// falling back to storing it when the method would not make it smaller
+// (JPEGs, videos, already compressed files). Blocks that look random are
+// stored without trying the method at all.
+func encodeBlock(raw []byte, bc blockCoding) ([]byte, error) {
+	method := bc.method
+	if method != methodStore && highEntropy(raw) {
+		method = methodStore
+	}
+	var data []byte
+	if method == methodExec {
+		var err error
+		if data, err = execEncode(raw, bc.exec); err != nil {
+			return nil, err
+		}
+	} else if t, ok := tunedCodecs[method]; ok {
+		var err error
+		if data, err = t.encode(raw, bc.dict, bc.effort); err != nil {
+			return nil, err
+		}
+	} else if c := codecs[method]; c.encode != nil {
+		var err error
+		if data, err = c.encode(raw); err != nil {
+			return nil, err
+		}
+	}
+	if method == methodHuffman && hasLongRuns(raw) {
+		alt, err := rleEncode(raw)
+		if err != nil {
+			return nil, err
+		}
+		if len(alt) < len(data) {
+			method, data = methodRLE, alt
+		}
+	}
+	if data == nil || len(data) >= len(raw) {
+		method, data = methodStore, raw
+	}
+	out := make([]byte, 0, 5+len(data))
+	out = append(out, method)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(raw)))
+	return append(out, data...), nil
+}
+
+// decodeBlock reverses encodeBlock and reports the method that was used.
+// bc holds the dictionary and external command the archive needs, if any.
+func decodeBlock(plain []byte, maxRaw int, bc blockCoding) ([]byte, byte, error) {
+	if len(plain) < 5 {
+		return nil, 0, errors.New("corrupt block (too short)")
+	}
+	method := plain[0]
+	rawLen := binary.LittleEndian.Uint32(plain[1:5])
+	if int64(rawLen) > int64(maxRaw) {
+		return nil, method, fmt.Errorf("corrupt block (raw length %d exceeds block size)", rawLen)
+	}
+	data := plain[5:]
+	if method == methodStore {
+		if len(data) != int(rawLen) {
+			return nil, method, errors.New("corrupt stored block")
+		}
+		return data, method, nil
+	}
+	c, ok := codecs[method]
+	if !ok && method == methodZstd {
+		return nil, method, errNoZstd
+	}
+	if !ok {
+		return nil, method, fmt.Errorf("unknown compression method %d", method)
+	}
+	var raw []byte
+	var err error
+	if method == methodExec {
+		raw, err = execDecode(data, int(rawLen), bc.exec)
+	} else if t, ok := tunedCodecs[method]; ok {
+		raw, err = t.decode(data, int(rawLen), bc.dict)
+	} else {
+		raw, err = c.decode(data, int(rawLen))
+	}
+	if err == nil && len(raw) != int(rawLen) {
+		err = fmt.Errorf("corrupt %s block (length mismatch)", c.name)
+	}
+	return raw, method, err
+}
+
+func huffmanEncodeBlock(raw []byte) ([]byte, error) {
+	var freq [256]uint64
+	for _, b := range raw {
+		freq[b]++
+	}
+	lengths := codeLengths(freq)
+	bits, err := huffmanCompress(raw, lengths)
+	if err != nil {
+		return nil, err
+	}
+	return append(lengths[:], bits...), nil
+}
+
+func huffmanDecodeBlock(data []byte, rawLen int) ([]byte, error) {
+	if len(data) < 256 {
+		return nil, errors.New("corrupt block (too short)")
+	}
+	var lengths [256]uint8
+	copy(lengths[:], data[:256])
+	return huffmanDecompress(data[256:], lengths, uint64(rawLen))
+}
+
+func deflateEncode(raw []byte) ([]byte, error) {
+	return deflateEncodeDict(raw, nil, 0)
+}
+
+// deflateEncodeDict uses the effort as the compress/flate level and primes
+// the window with the end of dict.
+func deflateEncodeDict(raw, dict []byte, effort int) ([]byte, error) {
+	if effort == 0 {
+		effort = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, effort, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func deflateDecode(data []byte, rawLen int) ([]byte, error) {
+	return deflateDecodeDict(data, rawLen, nil)
+}
+
+func deflateDecodeDict(data []byte, rawLen int, dict []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), dict)
+	defer r.Close()
+	raw := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("corrupt deflate block: %w", err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, errors.New("corrupt deflate block (trailing data)")
+	}
+	return raw, nil
+}
+
+// appendStreams Huffman codes each stream and appends it to out as
+// [4 bytes raw length][4 bytes coded length][code lengths + bits].
+func appendStreams(out []byte, streams ...[]byte) ([]byte, error) {
+	for _, s := range streams {
+		coded, err := huffmanEncodeBlock(s)
+		if err != nil {
+			return nil, err
+		}
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(s)))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(coded)))
+		out = append(out, coded...)
+	}
+	return out, nil
+}
+
+// readStreams decodes n streams written by appendStreams for a block of
+// rawLen bytes.
+func readStreams(data []byte, rawLen int, n int) ([][]byte, error) {
+	streams := make([][]byte, n)
+	for k := range streams {
+		if len(data) < 8 {
+			return nil, errors.New("corrupt block (truncated stream)")
+		}
+		slen := binary.LittleEndian.Uint32(data[0:4])
+		clen := binary.LittleEndian.Uint32(data[4:8])
+		data = data[8:]
+		// no stream is longer than three times the block (varint overhead)
+		if int64(slen) > 3*int64(rawLen)+16 || int64(clen) > int64(len(data)) {
+			return nil, errors.New("corrupt block (stream size)")
+		}
+		var err error
+		if slen > 0 {
+			if streams[k], err = huffmanDecodeBlock(data[:clen], int(slen)); err != nil {
+				return nil, err
+			}
+		}
+		data = data[clen:]
+	}
+	return streams, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// codecInputs are the blocks every codec must give back unchanged: the
+// edge cases of their formats and sizes around the smallest block size
+// -max-memory shrinks blocks to.
+func codecInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	two := make([]byte, 5000)
+	for i := range two {
+		two[i] = "ab"[rng.Intn(2)]
+	}
+	runs := append(bytes.Repeat([]byte{0}, 70000), bytes.Repeat([]byte{0xff}, 300)...)
+	runs = append(runs, bytes.Repeat([]byte("xy"), 40000)...)
+	in := map[string][]byte{
+		"empty":   {},
+		"one":     {42},
+		"two":     two,
+		"runs":    runs,
+		"text":    text,
+		"random":  random(100000),
+		"all":     bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 255}, 100),
+		"allsame": bytes.Repeat([]byte{7}, 1<<16),
+	}
+	for _, n := range []int{minLimitedBlock - 1, minLimitedBlock, minLimitedBlock + 1} {
+		in[fmt.Sprintf("block%d", n)] = blockInput(rng, n)
+	}
+	return in
+}
+
+// blockInput returns n bytes of text followed by letters drawn at random
+// from eight, which compress about threefold.
+func blockInput(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	copy(b, "the quick brown fox jumps over the lazy dog")
+	return b
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	inputs := codecInputs()
+	if !testing.Short() { // BWT takes seconds over a full block
+		inputs["full"] = blockInput(rand.New(rand.NewSource(2)), defaultBlockSize)
+	}
+	for method, c := range codecs {
+		if c.encode == nil {
+			continue // store and exec
+		}
+		for name, raw := range inputs {
+			data, err := c.encode(raw)
+			if err != nil {
+				t.Errorf("%s/%s: encode: %v", c.name, name, err)
+				continue
+			}
+			got, err := c.decode(data, len(raw))
+			if err != nil {
+				t.Errorf("%s/%s: decode: %v", c.name, name, err)
+			} else if !bytes.Equal(got, raw) {
+				t.Errorf("%s/%s: decoded %d bytes differ from the %d encoded", c.name, name, len(got), len(raw))
+			}
+			// and as a block, through the tuned codec where there is one
+			plain := binary.LittleEndian.AppendUint32([]byte{method}, uint32(len(raw)))
+			if _, ok := tunedCodecs[method]; !ok {
+				plain = append(plain, data...)
+			} else if plain, err = encodeBlock(raw, blockCoding{method: method}); err != nil {
+				t.Errorf("%s/%s: encodeBlock: %v", c.name, name, err)
+				continue
+			}
+			if got, _, err := decodeBlock(plain, defaultBlockSize, blockCoding{}); err != nil || !bytes.Equal(got, raw) {
+				t.Errorf("%s/%s: block does not round-trip: %v", c.name, name, err)
+			}
+		}
+	}
+}
+
+func TestTunedCodecsRoundTrip(t *testing.T) {
+	inputs := codecInputs()
+	dict := inputs["text"][:4096]
+	for method, tc := range tunedCodecs {
+		name := methodName(method)
+		for effort := 1; effort <= 9; effort++ {
+			for _, d := range [][]byte{nil, dict} {
+				for in, raw := range inputs {
+					data, err := tc.encode(raw, d, effort)
+					if err != nil {
+						t.Errorf("%s -%d dict=%t %s: encode: %v", name, effort, d != nil, in, err)
+						continue
+					}
+					got, err := tc.decode(data, len(raw), d)
+					if err != nil {
+						t.Errorf("%s -%d dict=%t %s: decode: %v", name, effort, d != nil, in, err)
+					} else if !bytes.Equal(got, raw) {
+						t.Errorf("%s -%d dict=%t %s: decoded data differs", name, effort, d != nil, in)
+					}
+				}
+			}
+		}
+	}
+}
+
+// fuzzDecoder feeds the decoder of method with the encodings of the codec
+// inputs as seeds and with whatever the fuzzer makes of them: a decoder
+// must return exactly rawLen bytes or an error, and never panic.
+func fuzzDecoder(f *testing.F, method byte) {
+	c := codecs[method]
+	for _, raw := range codecInputs() {
+		if len(raw) > 1<<14 {
+			continue // keep the seeds quick
+		}
+		data, err := c.encode(raw)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data, uint32(len(raw)))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, rawLen uint32) {
+		rawLen %= 1 << 20
+		raw, err := c.decode(data, int(rawLen))
+		if err == nil && len(raw) != int(rawLen) {
+			t.Errorf("%s decoded %d bytes, want %d", c.name, len(raw), rawLen)
+		}
+	})
+}
+
+func FuzzLZ77Decode(f *testing.F)     { fuzzDecoder(f, methodLZ77) }
+func FuzzAdaptiveDecode(f *testing.F) { fuzzDecoder(f, methodAdaptive) }
+func FuzzOrder1Decode(f *testing.F)   { fuzzDecoder(f, methodOrder1) }
+func FuzzBWTDecode(f *testing.F)      { fuzzDecoder(f, methodBWT) }
+func FuzzRLEDecode(f *testing.F)      { fuzzDecoder(f, methodRLE) }
+func FuzzRangeDecode(f *testing.F)    { fuzzDecoder(f, methodRange) }
+func FuzzLZWDecode(f *testing.F)      { fuzzDecoder(f, methodLZW) }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- Case collisions ----------------------------
+//
+// Windows and macOS file systems do not tell README from readme, and
+// macOS not é composed from é decomposed either, so of two entries whose
+// names differ only so the second would silently overwrite the first.
+// Before extracting, goZip creates a file in the destination and looks
+// for it under its upper-case name; if it is found, entry names are
+// compared with case and Unicode normalization folded, and for an entry
+// colliding with one before it -case-collisions decides:
+//
+//	error   stop extracting (the default)
+//	rename  write it as name.1 (or .2, ...)
+//	skip    leave it out
+//
+// Directories that collide are merged, as existing directories are. On
+// case-sensitive file systems nothing is checked.
+
+// Policies for case collisions (extractOptions.collisions).
+const (
+	collideError  = "error"
+	collideRename = "rename"
+	collideSkip   = "skip"
+)
+
+// checkCollisionPolicy validates a -case-collisions value.
+func checkCollisionPolicy(policy string) error {
+	switch policy {
+	case collideError, collideRename, collideSkip:
+		return nil
+	}
+	return fmt.Errorf("-case-collisions %q: want error, rename or skip", policy)
+}
+
+// caseFolder remembers the names extracted to a case-insensitive
+// destination; nil stands for a case-sensitive one.
+type caseFolder struct {
+	policy string
+	seen   map[string]foldedName // folded name -> the first one written
+}
+
+type foldedName struct {
+	name string
+	dir  bool
+}
+
+// newCaseFolder probes destDir, creating it if need be, and returns nil if
+// it tells names apart by case.
+func newCaseFolder(destDir, policy string) (*caseFolder, error) {
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(destDir, ".ghzip-case-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	upper := filepath.Join(destDir, strings.ToUpper(filepath.Base(f.Name())))
+	if _, err := os.Lstat(upper); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &caseFolder{policy: policy, seen: make(map[string]foldedName)}, nil
+}
+
+// foldName returns the form of name that names the same file on a
+// case-insensitive file system.
+func foldName(name string) string {
+	return strings.ToLower(nfc(name))
+}
+
+// resolve returns the name to extract an entry named name as: name
+// itself, a free name.N, or "" to leave it out.
+func (c *caseFolder) resolve(name string, dir bool) (string, error) {
+	if c == nil {
+		return name, nil
+	}
+	key := foldName(name)
+	prev, ok := c.seen[key]
+	if !ok || prev.name == name || dir && prev.dir {
+		if !ok {
+			c.seen[key] = foldedName{name, dir}
+		}
+		return name, nil
+	}
+	switch c.policy {
+	case collideSkip:
+		fmt.Printf("skipped: %s collides with %s\n", name, prev.name)
+		return "", nil
+	case collideRename:
+		for n := 1; ; n++ {
+			alt := name + "." + strconv.Itoa(n)
+			if _, taken := c.seen[foldName(alt)]; !taken {
+				c.seen[foldName(alt)] = foldedName{alt, dir}
+				return alt, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s and %s would be the same file here, differing only by case or Unicode normalization; choose -case-collisions rename or skip",
+		prev.name, name)
+}
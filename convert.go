@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------- ghzip convert ------------------------------
+//
+// "ghzip convert -in backup.tar.gz -out backup.gha" repackages a tar
+// (plain, gzip or bzip2 compressed) or zip archive as a goZip archive. It
+// takes the same options as -c: the entries are compressed, encrypted and
+// named as if they had been read from disk. Directories, symlinks, hard
+// links, modes, modification times, the tar's uid/gid (recorded as with
+// -owner) and its extended attributes carry over. Devices and FIFOs are
+// left out with a warning.
+//
+// Nothing is unpacked to disk. A tar is read twice, first for the names
+// and sizes that go into the header, then for the data, one file at a
+// time; a zip has them in its central directory.
+
+// importedEntry is where an inputFile converted from another archive comes
+// from, in place of a file on disk.
+type importedEntry struct {
+	read     func() ([]byte, error) // the contents or symlink target
+	link     string                 // the entry a hard link points to
+	uid, gid uint32
+	hasOwner bool
+	xattrs   map[string][]byte
+}
+
+// importArchive lists the entries of the tar or zip archive at path as
+// input files, leaving out those matching an exclude pattern. Call done
+// once they have been written.
+func importArchive(path string, exclude []string) (files []inputFile, done func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(f, head); err != nil && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, nil, err
+	}
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) {
+		fi, err := f.Stat()
+		if err == nil {
+			files, err = importZip(f, fi.Size(), exclude)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return files, f.Close, nil
+	}
+	f.Close()
+	files, done, err = importTar(path, exclude)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w (not a zip archive either)", path, err)
+	}
+	return files, done, nil
+}
+
+// openTar opens the tar archive at path, decompressing gzip and bzip2.
+func openTar(path string) (*tar.Reader, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	head, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		if r, err = gzip.NewReader(br); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	case bytes.HasPrefix(head, []byte("BZh")):
+		r = bzip2.NewReader(br)
+	}
+	return tar.NewReader(r), f, nil
+}
+
+// importTar lists the entries of a tar archive. Their read functions
+// share a second reader, which they move forward to their own entry, so
+// they must be called in order.
+func importTar(path string, exclude []string) ([]inputFile, func() error, error) {
+	tr, f, err := openTar(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	data := &tarData{path: path}
+	files := []inputFile{}
+	for num := 0; ; num++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "warning: %s: leaving out tar entry of type %q\n", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		name, err := listName(hdr.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == "" || excluded(exclude, filepath.ToSlash(name)) {
+			continue
+		}
+		imp := &importedEntry{uid: uint32(hdr.Uid), gid: uint32(hdr.Gid), hasOwner: true}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			target := []byte(hdr.Linkname)
+			imp.read = func() ([]byte, error) { return target, nil }
+		case tar.TypeLink:
+			if imp.link, err = listName(hdr.Linkname); err != nil {
+				return nil, nil, err
+			}
+		case tar.TypeReg:
+			imp.read = func() ([]byte, error) { return data.read(num, hdr.Size) }
+		}
+		for key, value := range hdr.PAXRecords {
+			if attr, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				if imp.xattrs == nil {
+					imp.xattrs = make(map[string][]byte)
+				}
+				imp.xattrs[attr] = []byte(value)
+			}
+		}
+		files = append(files, inputFile{relPath: name, info: hdr.FileInfo(), imported: imp})
+	}
+	return files, data.close, nil
+}
+
+// tarData reads file contents from the second pass over a tar archive.
+type tarData struct {
+	path string
+	tr   *tar.Reader
+	f    *os.File
+	next int // number of the entry tr.Next returns next
+}
+
+// read returns the data of entry num, which has size bytes.
+func (d *tarData) read(num int, size int64) ([]byte, error) {
+	if d.tr == nil {
+		var err error
+		if d.tr, d.f, err = openTar(d.path); err != nil {
+			return nil, err
+		}
+	}
+	for ; d.next <= num; d.next++ {
+		if _, err := d.tr.Next(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("%s changed while converting: %w", d.path, err)
+		}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(d.tr, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (d *tarData) close() error {
+	if d.f == nil {
+		return nil
+	}
+	return d.f.Close()
+}
+
+// importZip lists the entries of a zip archive.
+func importZip(r io.ReaderAt, size int64, exclude []string) ([]inputFile, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	files := []inputFile{}
+	for _, zf := range zr.File {
+		info := zf.FileInfo()
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s: leaving out zip entry of mode %v\n", zf.Name, info.Mode())
+			continue
+		}
+		name, err := listName(zf.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || excluded(exclude, filepath.ToSlash(name)) {
+			continue
+		}
+		imp := &importedEntry{read: func() ([]byte, error) {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}}
+		files = append(files, inputFile{relPath: name, info: info, imported: imp})
+	}
+	return files, nil
+}
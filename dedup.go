@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// ---------------------- Deduplication ------------------------------
+//
+// Creating an archive hashes every file anyway, for the checksum in its
+// entry header. A file with the same SHA-256 as one archived before it is
+// stored as a copy entry: its own name, mode, time, owner and extended
+// attributes, and instead of data the name of the first file. Extraction
+// writes the first file's data out again under the copy's name, so the
+// two stay separate files, unlike hard links; grep, -to-stdout and export
+// read the first file's data (source.go). -no-dedup stores every file in
+// full, without the shared chunks of chunks.go either. Files are compared
+// within one run of -c or -a only; an append does not look at what the
+// archive holds already.
+//
+// Copy entries are entry type 4, which builds before deduplication reject
+// as unknown; archives without duplicates, or made with -no-dedup, read
+// as before.
+
+// refers reports whether h holds the name of something else instead of
+// data: a symlink, hard link or copy.
+func (h entryHeader) refers() bool {
+	return h.typ == entrySymlink || h.typ == entryHardlink || h.typ == entryCopy
+}
+
+// copySizes sets the size of the copies among the listed entries to that
+// of the file each copies, the last entry of that name before it. Copies
+// of a base's files (-base) stay unknown: listings do not read the base.
+func copySizes(entries []entryHeader) {
+	sizes := make(map[string]uint64) // of the files listed so far
+	for i, h := range entries {
+		if h.typ == entryCopy {
+			entries[i].fileSize, entries[i].copySized = sizes[h.linkTarget]
+		}
+		if size, ok := entries[i].listedSize(); ok {
+			sizes[h.name] = size
+		} else {
+			delete(sizes, h.name)
+		}
+	}
+}
+
+// listedSize returns the size of the contents of listed entry h, if it
+// has any: a file's, a chunked entry's or a copy's, as copySizes found it.
+func (h entryHeader) listedSize() (uint64, bool) {
+	switch {
+	case h.typ == entryFile || h.typ == entryChunks:
+		return h.contentSize(), true
+	case h.typ == entryCopy && h.copySized:
+		return h.fileSize, true
+	}
+	return 0, false
+}
+
+// extractCopy writes copy entry h to target from src, the size bytes of
+// the file it is a copy of, checking the result against h's checksum.
+// The bytes are counted against limits first.
+func extractCopy(target string, src io.Reader, size int64, h entryHeader, opts extractOptions, limits *entryLimits, bad *mismatches) error {
+	if err := limits.add(h.name, uint64(size)); err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if err := writeEntryFile(target, io.TeeReader(src, sum), size); err != nil {
+		return err
+	}
+	if err := bad.add(h, checkWritten(target, h, sum.Sum(nil), opts.verify)); err != nil {
+		return err
+	}
+	return restoreMetadata(target, h, opts)
+}
+
+// openExtracted opens the file extracted as name below destDir, for a
+// copy of it, and returns its size.
+func openExtracted(destDir, name string) (*os.File, int64, error) {
+	path, err := sourceJoin(destDir, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
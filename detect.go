@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"math"
+)
+
+// ---------------------- Incompressible input ------------------------
+//
+// Compressed formats (archives, images, video) do not shrink further, and
+// running a codec over them only costs time before encodeBlock falls back
+// to storing the block. Entries whose data starts with a known signature
+// are stored straight away, and any block whose sampled byte entropy is
+// close to 8 bits is stored without trying the codec.
+
+// compressedMagic lists signatures of formats that are already compressed,
+// with the offset they appear at.
+var compressedMagic = []struct {
+	off   int
+	magic string
+}{
+	{0, "\x1f\x8b"},           // gzip
+	{0, "PK\x03\x04"},         // zip, jar, docx, apk
+	{0, "\x89PNG\r\n\x1a\n"},  // png
+	{0, "\xff\xd8\xff"},       // jpeg
+	{4, "ftyp"},               // mp4, mov, m4a, heic
+	{0, "GIF8"},               // gif
+	{0, "BZh"},                // bzip2
+	{0, "\xfd7zXZ\x00"},       // xz
+	{0, "\x28\xb5\x2f\xfd"},   // zstd
+	{0, "7z\xbc\xaf\x27\x1c"}, // 7-Zip
+	{0, "Rar!\x1a\x07"},       // rar
+	{0, "\x1a\x45\xdf\xa3"},   // mkv, webm
+	{0, "OggS"},               // ogg, opus
+	{0, "fLaC"},               // flac
+	{0, "ID3"},                // mp3
+	{8, "WEBP"},               // webp
+	{0, magic},                // goZip archives
+}
+
+// knownCompressed reports whether data starts like a compressed format.
+func knownCompressed(data []byte) bool {
+	for _, m := range compressedMagic {
+		if len(data) >= m.off+len(m.magic) && bytes.Equal(data[m.off:m.off+len(m.magic)], []byte(m.magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	entropySamples    = 64   // windows sampled from a block
+	entropyWindow     = 512  // bytes per window
+	entropyMinSize    = 8192 // smaller blocks are cheap to just try
+	entropyStoreLimit = 7.9  // bits per byte at which a block is stored
+)
+
+// highEntropy estimates the order-0 entropy of b from evenly spread
+// windows and reports whether it is too high for any codec to pay off.
+func highEntropy(b []byte) bool {
+	if len(b) < entropyMinSize {
+		return false
+	}
+	var freq [256]int
+	n := 0
+	step := len(b) / entropySamples
+	for i := 0; i < entropySamples; i++ {
+		w := b[i*step:]
+		w = w[:min(len(w), entropyWindow, step)]
+		for _, c := range w {
+			freq[c]++
+		}
+		n += len(w)
+	}
+	bits := 0.0
+	for _, f := range freq {
+		if f > 0 {
+			p := float64(f) / float64(n)
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits >= entropyStoreLimit
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------- Shared dictionaries -------------------------
+//
+// Many small, similar files (JSON logs, protobufs, configs) compress badly
+// on their own, especially in per-file mode: every block starts with an
+// empty window. A dictionary trained from samples of such files holds the
+// substrings they share; the lz77 and deflate methods prime their window
+// with it, so even the first bytes of a block find matches.
+//
+// A dictionary file is ["GHDC"][dictionary bytes]. Archives record the
+// dictionary's ID (the first 8 bytes of its SHA-256) in their metadata, and
+// the same dictionary must be given to list or extract them.
+
+const (
+	dictMagic       = "GHDC"
+	defaultDictSize = 64 << 10
+	maxDictSize     = lzWindow / 2 // leave most of the LZ77 window to the data
+
+	dictDmer    = 8   // substring length counted while training
+	dictSegment = 256 // length of the pieces the dictionary is made of
+	dictStep    = 64  // distance between candidate pieces
+	dictHashLog = 20
+)
+
+// dictID identifies a dictionary by its content.
+func dictID(dict []byte) []byte {
+	sum := sha256.Sum256(dict)
+	return sum[:8]
+}
+
+// loadDictionary reads a dictionary file written by "ghzip dict train".
+func loadDictionary(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(dictMagic) || string(b[:len(dictMagic)]) != dictMagic {
+		return nil, fmt.Errorf("%s: not a ghzip dictionary", path)
+	}
+	dict := b[len(dictMagic):]
+	if len(dict) == 0 || len(dict) > maxDictSize {
+		return nil, fmt.Errorf("%s: bad dictionary size %d", path, len(dict))
+	}
+	return dict, nil
+}
+
+// dictCandidate is a piece of a sample that may go into the dictionary.
+type dictCandidate struct {
+	piece []byte
+	score int
+}
+
+type candidateHeap []dictCandidate
+
+func (h candidateHeap) Len() int            { return len(h) }
+func (h candidateHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h candidateHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *candidateHeap) Push(x interface{}) { *h = append(*h, x.(dictCandidate)) }
+func (h *candidateHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func dmerHash(b []byte) uint64 {
+	return (binary.LittleEndian.Uint64(b) * 0x9E3779B97F4A7C15) >> (64 - dictHashLog)
+}
+
+// trainDictionary picks the pieces of the samples whose substrings occur
+// in the most samples. Pieces are taken greedily; a substring counts only
+// for the first piece that holds it, so the dictionary does not repeat
+// itself. The most valuable pieces go last, closest to the data.
+func trainDictionary(samples [][]byte, size int) ([]byte, error) {
+	// count in how many samples every substring occurs
+	counts := make([]uint32, 1<<dictHashLog)
+	last := make([]int32, 1<<dictHashLog) // sample that counted it last, +1
+	for i, s := range samples {
+		for p := 0; p+dictDmer <= len(s); p++ {
+			h := dmerHash(s[p:])
+			if last[h] != int32(i+1) {
+				last[h] = int32(i + 1)
+				counts[h]++
+			}
+		}
+	}
+	score := func(piece []byte) int {
+		n := 0
+		for p := 0; p+dictDmer <= len(piece); p++ {
+			if c := counts[dmerHash(piece[p:])]; c > 1 {
+				n += int(c)
+			}
+		}
+		return n
+	}
+	h := &candidateHeap{}
+	for _, s := range samples {
+		for p := 0; p+dictDmer <= len(s); p += dictStep {
+			piece := s[p:min(p+dictSegment, len(s))]
+			if sc := score(piece); sc > 0 {
+				*h = append(*h, dictCandidate{piece, sc})
+			}
+		}
+	}
+	heap.Init(h)
+	var picked [][]byte
+	total := 0
+	for h.Len() > 0 && total < size {
+		c := heap.Pop(h).(dictCandidate)
+		// scores only drop as pieces are picked; re-check before taking one
+		c.score = score(c.piece)
+		if c.score == 0 {
+			continue
+		}
+		if h.Len() > 0 && c.score < (*h)[0].score {
+			heap.Push(h, c)
+			continue
+		}
+		picked = append(picked, c.piece)
+		total += len(c.piece)
+		for p := 0; p+dictDmer <= len(c.piece); p++ {
+			counts[dmerHash(c.piece[p:])] = 0
+		}
+	}
+	if len(picked) == 0 {
+		return nil, errors.New("samples share too little data to train a dictionary")
+	}
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict, nil
+}
+
+// readSamples reads every regular file under the given paths.
+func readSamples(paths []string) ([][]byte, error) {
+	var samples [][]byte
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if len(b) > 0 {
+				samples = append(samples, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// runDict implements "ghzip dict train".
+func runDict(args []string) {
+	if len(args) == 0 || args[0] != "train" {
+		fmt.Println("usage: ghzip dict train -out <dictionary> <sample files or dirs>...")
+		return
+	}
+	cmd := flag.NewFlagSet("dict train", flag.ExitOnError)
+	outPath := cmd.String("out", "", "write the dictionary to this `file`")
+	size := cmd.Int("size", defaultDictSize, "dictionary size in `bytes`")
+	parseCommand(cmd, args[1:])
+	if *outPath == "" || cmd.NArg() == 0 {
+		fmt.Println("dict train requires -out <dictionary> and at least one sample file or directory")
+		return
+	}
+	if *size <= 0 || *size > maxDictSize {
+		fail("dictionary size must be between 1 and %d bytes", maxDictSize)
+		return
+	}
+	samples, err := readSamples(cmd.Args())
+	if err != nil {
+		fail("Reading samples failed: %v", err)
+		return
+	}
+	dict, err := trainDictionary(samples, *size)
+	if err != nil {
+		fail("Training failed: %v", err)
+		return
+	}
+	if err := os.WriteFile(*outPath, append([]byte(dictMagic), dict...), 0o644); err != nil {
+		fail("Writing dictionary failed: %v", err)
+		return
+	}
+	showOK("Dictionary %x (%d bytes from %d samples) written to %s", dictID(dict), len(dict), len(samples), *outPath)
+}
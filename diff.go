@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ---------------------- ghzip diff ---------------------------------
+//
+// "ghzip diff -in backup.gha -against ./dir" compares an archive with the
+// directory it was made from, to tell whether the backup is current
+// before an older one is overwritten. Files on disk but not in the archive
+// are added, entries missing from disk removed, and files whose type,
+// size, SHA-256 or link target differ modified. The archive is streamed
+// once; a disk file is only read when its size matches its entry's. As
+// with diff(1), the exit status is 0 when nothing differs, 1 when
+// something does and 2 on an error.
+
+// diffCounts sums up what compareArchive found.
+type diffCounts struct {
+	added, removed, modified, same int
+}
+
+func runDiff(args []string) {
+	cmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	inPath := cmd.String("in", "", "the `archive`")
+	against := cmd.String("against", "", "the `directory` (or file) to compare the archive with")
+	pass := cmd.String("pass", "", "password (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "open the archive with a key `file` or X25519 identity file")
+	var excludeFlags multiFlag
+	cmd.Var(&excludeFlags, "exclude", "ignore files and directories matching `pattern`, on disk and in the archive, as when creating (repeatable)")
+	dictPath := cmd.String("dict", "", "the dictionary `file` the archive was compressed with")
+	allowExec := cmd.Bool("allow-exec", false, "run the external compressor the archive names")
+	parseCommand(cmd, args)
+	exitCode = 2 // until the comparison is done
+	if *inPath == "" || *against == "" || cmd.NArg() != 0 {
+		fmt.Println("usage: ghzip diff [-pass p | -keyfile f] [-exclude pattern] -in <archive> -against <directory>")
+		return
+	}
+	for _, p := range excludeFlags {
+		if err := checkGlob(p); err != nil {
+			fail("-exclude: %v", err)
+			return
+		}
+	}
+	ro := readOptions{allowExec: *allowExec}
+	var err error
+	if *dictPath != "" {
+		if ro.dict, err = loadDictionary(*dictPath); err != nil {
+			fail("%v", err)
+			return
+		}
+	}
+	if *pass == "" && *keyfilePath == "" {
+		if *pass, err = readPassword(*passFd, *passFile); err != nil {
+			fail("%v", err)
+			return
+		}
+	}
+	secret, err := slotSecret(*pass, *keyfilePath, "Password: ")
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	files, err := walkInput(*against, excludeFlags, symlinkStore, nil)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	n, err := compareArchive(*inPath, secret, files, excludeFlags, ro)
+	if err != nil {
+		fail("Diff failed: %v", err)
+		return
+	}
+	fmt.Printf("\n%d added, %d removed, %d modified, %d unchanged\n", n.added, n.removed, n.modified, n.same)
+	if n.added+n.removed+n.modified == 0 {
+		showOK("%s is up to date with %s", *inPath, *against)
+		exitCode = 0
+	} else {
+		exitCode = 1
+	}
+}
+
+// compareArchive compares the entries of the archive at path with files,
+// printing every difference as "added", "removed" or "modified" and the
+// name, sorted by name. Of a name archived more than once (see -a), the
+// last copy counts, as it is the one extraction leaves behind. Entries in
+// or below what matches an exclude pattern are skipped, as walkInput
+// skipped them on disk.
+func compareArchive(path, password string, files []inputFile, exclude []string, ro readOptions) (diffCounts, error) {
+	var n diffCounts
+	ar, err := openArchive(path, password)
+	if err != nil {
+		return n, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(ro); err != nil {
+		return n, err
+	}
+	onDisk := make(map[string]inputFile, len(files))
+	for _, f := range files {
+		onDisk[nfc(filepath.ToSlash(f.relPath))] = f
+	}
+	sums := make(map[string][sha256.Size]byte) // file entry -> SHA-256, for hard links
+	status := make(map[string]string)          // name -> "removed", "modified", "added" or ""
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		data := &io.LimitedReader{R: ar.payload, N: int64(h.size)}
+		skip := excluded(exclude, h.name)
+		f, ok := onDisk[h.name]
+		same := false
+		if !skip {
+			if same, err = sameAsDisk(h, data, f, ok, sums); err != nil {
+				return n, fmt.Errorf("%s: %w", h.name, err)
+			}
+		}
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return n, err
+		}
+		if data.N > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		switch {
+		case skip:
+		case !ok:
+			status[h.name] = "removed"
+		case !same:
+			status[h.name] = "modified"
+		default:
+			status[h.name] = ""
+		}
+	}
+	for name := range onDisk {
+		if _, ok := status[name]; !ok {
+			status[name] = "added"
+		}
+	}
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch status[name] {
+		case "added":
+			n.added++
+		case "removed":
+			n.removed++
+		case "modified":
+			n.modified++
+		default:
+			n.same++
+			continue
+		}
+		fmt.Printf("%-9s %s\n", status[name]+":", name)
+	}
+	return n, nil
+}
+
+// sameAsDisk reads the entry's data and reports whether f (if onDisk) has
+// the same type and content. File entries are hashed into sums even when
+// they differ, since later hard links are compared against them.
+func sameAsDisk(h entryHeader, data io.Reader, f inputFile, onDisk bool, sums map[string][sha256.Size]byte) (bool, error) {
+	var mode os.FileMode
+	if onDisk {
+		mode = f.info.Mode()
+	}
+	switch h.typ {
+	case entryDir:
+		return onDisk && mode.IsDir(), nil
+	case entryDeleted:
+		return !onDisk, nil
+	case entryChunks:
+		// its chunks are only complete on disk, so only the sum is compared
+		if h.sum == nil {
+			return false, nil
+		}
+		sum := [sha256.Size]byte(h.sum)
+		sums[h.name] = sum
+		if !onDisk || !mode.IsRegular() || uint64(f.info.Size()) != h.fileSize {
+			return false, nil
+		}
+		return fileHasSum(f.absPath, sum)
+	case entrySymlink, entryHardlink, entryCopy:
+		target := make([]byte, h.size)
+		if _, err := io.ReadFull(data, target); err != nil {
+			return false, err
+		}
+		if h.typ == entrySymlink {
+			if !onDisk || mode&os.ModeSymlink == 0 {
+				return false, nil
+			}
+			link, err := os.Readlink(f.absPath)
+			return err == nil && filepath.ToSlash(link) == string(target), nil
+		}
+		sum, ok := sums[string(target)]
+		if !ok || !onDisk || !mode.IsRegular() {
+			return false, nil
+		}
+		return fileHasSum(f.absPath, sum)
+	}
+	var r io.Reader = data
+	if h.filter.kind != filterNone {
+		r = &unfilterReader{r: data, f: h.filter}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return false, err
+	}
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	sums[h.name] = sum
+	if !onDisk || !mode.IsRegular() || uint64(f.info.Size()) != h.size {
+		return false, nil
+	}
+	return fileHasSum(f.absPath, sum)
+}
+
+// fileHasSum reports whether the file at path has the SHA-256 sum.
+func fileHasSum(path string, sum [sha256.Size]byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash.Sum(nil), sum[:]), nil
+}
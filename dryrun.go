@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------- Dry runs (-n) ------------------------------
+//
+// "ghzip -c -n -in dir -out dir.gha" lists what would be archived, after
+// -exclude and -files-from, and the method and block size blocks would be
+// compressed with (after -1..-9, -store and -max-memory), without reading
+// any file or writing the archive, so no password is asked for. "ghzip -x -n -in dir.gha -out dest"
+// reads the archive (it must be opened for that) and lists the paths that
+// would be written under dest, marking those that exist already and would
+// be overwritten, skipped, renamed or kept as newer (or, with no policy
+// for existing files, asked about). Nothing is created, not even dest.
+
+// dryRunCreate prints the entries createArchive would write to outPath.
+func dryRunCreate(inPath, outPath string, opts createOptions) error {
+	p, _, err := blockPreset(opts)
+	if err != nil {
+		return err
+	}
+	if opts.maxMemory > 0 {
+		if p.blockSize, _, err = fitMemory(opts.maxMemory, p.method, p.blockSize); err != nil {
+			return err
+		}
+	}
+	files, err := inputFiles(inPath, opts, nil)
+	if err != nil {
+		return err
+	}
+	linkOf, totalBytes := resolveHardlinks(files)
+	for i, f := range files {
+		name := filepath.ToSlash(f.relPath)
+		switch {
+		case linkOf[i] != "":
+			fmt.Printf("  hardlink   %s => %s\n", name, linkOf[i])
+		case f.info.IsDir():
+			fmt.Printf("  dir        %s/\n", name)
+		case f.info.Mode()&os.ModeSymlink != 0:
+			fmt.Printf("  symlink    %s\n", name)
+		default:
+			fmt.Printf("  file       %s (%d bytes)\n", name, f.info.Size())
+		}
+	}
+	fmt.Printf("Would archive %d entries (%d bytes) into %s.\n", len(files), totalBytes, outPath)
+	method := methodName(p.method)
+	if p.effort > 0 {
+		method += fmt.Sprintf(" at effort %d", p.effort)
+	}
+	fmt.Printf("Blocks would be compressed with %s, %d bytes at a time.\n", method, p.blockSize)
+	if _, err := os.Stat(outPath); err == nil {
+		fmt.Printf("%s exists and would be replaced.\n", outPath)
+	}
+	return nil
+}
+
+// dryRunExtract prints the paths extractArchive would write under destDir
+// and which of them exist.
+func dryRunExtract(archivePath, destDir, password string, opts extractOptions) error {
+	entries, _, err := listArchive(archivePath, password, opts.readOptions)
+	if err != nil {
+		return err
+	}
+	matched := make([]bool, len(opts.files))
+	var written, existing int
+	for _, h := range entries {
+		if opts.files != nil {
+			selected := false
+			for i, p := range opts.files {
+				if matchPattern(p, h.name) {
+					matched[i], selected = true, true
+				}
+			}
+			if !selected {
+				continue
+			}
+		}
+		name := opts.targetName(h)
+		if name == "" {
+			continue
+		}
+		target, err := safeJoin(destDir, name)
+		if err != nil {
+			return err
+		}
+		what := "new      "
+		if fi, err := os.Lstat(target); err == nil {
+			if h.typ == entryDir && fi.IsDir() {
+				what = "exists   "
+			} else {
+				what = map[string]string{
+					existingAsk:       "conflict ",
+					existingOverwrite: "overwrite",
+					existingSkip:      "skip     ",
+					existingRename:    "rename   ",
+					existingKeepNewer: "keep     ",
+					existingFreshen:   "keep     ",
+				}[opts.existing]
+				if what == "keep     " && olderThan(fi, h) {
+					what = "overwrite"
+				}
+				existing++
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		} else if opts.existing == existingFreshen {
+			continue
+		}
+		switch h.typ {
+		case entryDir:
+			target += string(filepath.Separator)
+		case entrySymlink:
+			target += " -> " + h.linkTarget
+		case entryHardlink:
+			target += " => " + h.linkTarget
+		case entryCopy:
+			target += " == " + h.linkTarget
+		case entryDeleted:
+			what = "delete   "
+		case entryFile, entryChunks:
+			target += fmt.Sprintf(" (%d bytes)", h.contentSize())
+		}
+		fmt.Printf("  %s  %s\n", what, target)
+		if h.typ != entryDir {
+			written++
+		}
+	}
+	for i, ok := range matched {
+		if !ok {
+			return fmt.Errorf("no entry matches -files %q", opts.files[i])
+		}
+	}
+	fmt.Printf("Would extract %d entries to %s; %d exist already.\n", written, destDir, existing)
+	return nil
+}
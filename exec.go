@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ---------------------- External compressors (method exec) ----------
+//
+// "-method exec:zstd -19" pipes every block through an external command:
+// the command line plus -c compresses stdin to stdout, and plus -d -c
+// decompresses, the convention of gzip, bzip2, xz, zstd and lz4. goZip
+// still encrypts and frames the output. The command line is recorded in
+// the archive metadata; since opening an archive must not run programs
+// named by whoever made it, extraction only runs it with -allow-exec.
+
+// parseExecMethod returns the command of an "exec:<command line>" method.
+func parseExecMethod(method string) ([]string, bool, error) {
+	cmdline, ok := strings.CutPrefix(method, "exec:")
+	if !ok {
+		return nil, false, nil
+	}
+	argv := strings.Fields(cmdline)
+	if len(argv) == 0 {
+		return nil, true, fmt.Errorf("method %q names no command", method)
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		return nil, true, err
+	}
+	return argv, true, nil
+}
+
+// runExec runs argv with extra arguments, feeding it in.
+func runExec(argv, extra []string, in []byte) ([]byte, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("block was compressed by an external command; pass -allow-exec to run it")
+	}
+	cmd := exec.Command(argv[0], append(append([]string(nil), argv[1:]...), extra...)...)
+	var out, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", argv[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+func execEncode(raw []byte, argv []string) ([]byte, error) {
+	return runExec(argv, []string{"-c"}, raw)
+}
+
+func execDecode(data []byte, rawLen int, argv []string) ([]byte, error) {
+	raw, err := runExec(argv, []string{"-d", "-c"}, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != rawLen {
+		return nil, fmt.Errorf("%s returned %d bytes, want %d", argv[0], len(raw), rawLen)
+	}
+	return raw, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- Existing files on extract ------------------
+//
+// Extracting over a file, symlink or hard link that is already there
+// follows one of these policies:
+//
+//	-overwrite        replace it
+//	-skip-existing    keep it and leave the entry out
+//	-rename-existing  write the entry as name.1 (or .2, ...) next to it
+//	-keep-newer       replace it only if it is older than the entry
+//	-freshen          the same, and leave out entries with no file yet
+//
+// Without one of them, goZip asks for each such file when stdin is a
+// terminal, offering the same choices for it or for all that follow. In
+// scripts, where nobody can answer, the first conflict stops extraction
+// with an error instead of clobbering local files. Existing directories
+// are merged into, as always; with -freshen, missing ones are not made.
+// -keep-newer and -freshen, as tar's --keep-newer-files and unzip -f,
+// merge a restore into a live tree: they compare modification times, and
+// keep the file when the entry has none recorded (hard links, archives
+// from before times were recorded).
+
+// Policies for existing files (extractOptions.existing).
+const (
+	existingAsk       = ""
+	existingOverwrite = "overwrite"
+	existingSkip      = "skip"
+	existingRename    = "rename"
+	existingKeepNewer = "keep-newer"
+	existingFreshen   = "freshen"
+)
+
+// existingPolicy returns the policy the flags select.
+func existingPolicy(overwrite, skip, rename, keepNewer, freshen bool) (string, error) {
+	policy := existingAsk
+	for _, f := range []struct {
+		set    bool
+		policy string
+	}{{overwrite, existingOverwrite}, {skip, existingSkip}, {rename, existingRename}, {keepNewer, existingKeepNewer}, {freshen, existingFreshen}} {
+		if f.set {
+			if policy != existingAsk {
+				return "", errors.New("-overwrite, -skip-existing, -rename-existing, -keep-newer and -freshen exclude each other")
+			}
+			policy = f.policy
+		}
+	}
+	return policy, nil
+}
+
+// conflicts decides, following a policy, what to do with entries whose
+// target exists. Answers for "all" at the prompt become the policy.
+type conflicts struct {
+	policy  string
+	written map[string]bool // paths this extraction wrote
+}
+
+func newConflicts(policy string) *conflicts {
+	return &conflicts{policy: policy, written: make(map[string]bool)}
+}
+
+// resolve returns the path to write entry h, aimed at target, to: target
+// itself, a new name next to it, or "" to skip the entry. A later copy of
+// an entry replaces what this extraction wrote without asking.
+func (c *conflicts) resolve(target string, h entryHeader) (path string, err error) {
+	defer func() {
+		if path != "" {
+			c.written[path] = true
+		}
+	}()
+	if c.written[target] {
+		return target, nil
+	}
+	fi, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		if c.policy == existingFreshen {
+			return "", nil
+		}
+		return target, nil
+	} else if err != nil {
+		return "", err
+	}
+	policy := c.policy
+	if policy == existingAsk {
+		var err error
+		if policy, err = c.ask(target); err != nil {
+			return "", err
+		}
+	}
+	switch policy {
+	case existingSkip:
+		fmt.Printf("skipped: %s exists\n", target)
+		return "", nil
+	case existingRename:
+		return freeName(target)
+	case existingKeepNewer, existingFreshen:
+		if !olderThan(fi, h) {
+			fmt.Printf("kept: %s is not older than the archived copy\n", target)
+			return "", nil
+		}
+	}
+	return target, nil
+}
+
+// olderThan reports whether the file fi describes was modified before
+// entry h; not if h has no time.
+func olderThan(fi fs.FileInfo, h entryHeader) bool {
+	return !h.mtime.IsZero() && fi.ModTime().Before(h.mtime)
+}
+
+// ask prompts for what to do with target.
+func (c *conflicts) ask(target string) (string, error) {
+	unanswered := fmt.Errorf("%s exists; choose -overwrite, -skip-existing or -rename-existing", target)
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return "", unanswered
+	}
+	for {
+		fmt.Printf("%s exists. Replace? [y]es, [n]o, [r]ename, [A]ll, [N]one: ", target)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", unanswered
+		}
+		switch strings.TrimSpace(line) {
+		case "y", "yes":
+			return existingOverwrite, nil
+		case "n", "no":
+			return existingSkip, nil
+		case "r", "rename":
+			return existingRename, nil
+		case "A", "all":
+			c.policy = existingOverwrite
+			return c.policy, nil
+		case "N", "none":
+			c.policy = existingSkip
+			return c.policy, nil
+		}
+	}
+}
+
+// freeName returns the first of path.1, path.2, ... that does not exist.
+func freeName(path string) (string, error) {
+	for n := 1; ; n++ {
+		name := path + "." + strconv.Itoa(n)
+		if _, err := os.Lstat(name); errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
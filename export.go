@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------------- ghzip export -------------------------------
+//
+// "ghzip export -in backup.gha -out backup.tar.gz" converts an archive to
+// a tar file, gzip-compressed with -gzip or an -out ending in .gz or .tgz,
+// for backup tools that know tar but not goZip. The tar is written as the
+// archive is read, so "-out -" can feed it to another program. Entries
+// keep their type, link target, mode, modification time, recorded uid/gid
+// and extended attributes (as SCHILY.xattr PAX records); copies and files
+// sharing chunks become files of their own. Entries of
+// archives that predate modes and times get 0644 (directories 0755) and
+// the time the archive was created. A failed export exits 1.
+
+func runExport(args []string) {
+	cmd := flag.NewFlagSet("export", flag.ExitOnError)
+	inPath := cmd.String("in", "", "the `archive`")
+	outPath := cmd.String("out", "", "the tar `file` to write; - writes to stdout")
+	gz := cmd.Bool("gzip", false, "compress the tar with gzip (the default for -out names ending in .gz or .tgz)")
+	pass := cmd.String("pass", "", "password (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "open the archive with a key `file` or X25519 identity file")
+	dictPath := cmd.String("dict", "", "the dictionary `file` the archive was compressed with")
+	allowExec := cmd.Bool("allow-exec", false, "run the external compressor the archive names")
+	parseCommand(cmd, args)
+	if *inPath == "" || *outPath == "" || cmd.NArg() != 0 {
+		fmt.Println("usage: ghzip export [-gzip] [-pass p | -keyfile f] -in <archive> -out <file.tar[.gz]>")
+		return
+	}
+	if strings.HasSuffix(*outPath, ".gz") || strings.HasSuffix(*outPath, ".tgz") {
+		*gz = true
+	}
+	if *outPath == "-" {
+		if err := checkStdout(); err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+		toStderr()
+	}
+	ro := readOptions{allowExec: *allowExec}
+	var err error
+	if *dictPath != "" {
+		if ro.dict, err = loadDictionary(*dictPath); err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+	}
+	if *pass == "" && *keyfilePath == "" {
+		if *pass, err = readPassword(*passFd, *passFile); err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+	}
+	secret, err := slotSecret(*pass, *keyfilePath, "Password: ")
+	if err != nil {
+		fail("%v", err)
+		exitCode = 1
+		return
+	}
+	showBox("Exporting archive", fmt.Sprintf("Archive: %s\nTar: %s", *inPath, *outPath))
+	n, err := exportTar(*inPath, *outPath, secret, *gz, ro)
+	if err != nil {
+		fail("Export failed: %v", err)
+		exitCode = 1
+		return
+	}
+	showOK("Exported %d entries to: %s", n, *outPath)
+}
+
+// exportTar writes the entries of the archive at archivePath to a tar
+// file at outPath ("-" for stdout), gzip-compressed if gz, and returns how
+// many it wrote. A partly written file is removed on failure.
+func exportTar(archivePath, outPath, password string, gz bool, ro readOptions) (n int, err error) {
+	ar, err := openArchive(archivePath, password)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(ro); err != nil {
+		return 0, err
+	}
+	mtime := ar.meta.created
+	if mtime.IsZero() { // version 1
+		mtime = time.Now()
+	}
+
+	out := stdout
+	if outPath != "-" {
+		if out, err = os.Create(outPath); err != nil {
+			return 0, err
+		}
+		defer func() {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(outPath)
+			}
+		}()
+	}
+	var w io.Writer = out
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(out)
+		zw.ModTime = mtime
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	src := newArchiveSource(archivePath, password, ar, ro)
+	defer src.Close()
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		th := tarHeader(h, mtime)
+		data := &io.LimitedReader{R: ar.payload, N: int64(h.size)}
+		contents, size, err := src.contents(h, data)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", h.name, err)
+		}
+		if contents != nil {
+			th.Size = size
+		} else if h.refers() {
+			target, err := io.ReadAll(data)
+			if err != nil {
+				return n, err
+			}
+			th.Linkname = string(target)
+		}
+		if h.typ != entryDeleted { // tar has no way to say so
+			if err := tw.WriteHeader(th); err != nil {
+				return n, fmt.Errorf("%s: %w", h.name, err)
+			}
+			if contents != nil {
+				if _, err := io.CopyN(tw, contents, size); err != nil {
+					return n, fmt.Errorf("%s: %w", h.name, noEOF(err))
+				}
+			}
+			n++
+		}
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return n, err
+		}
+		if data.N > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		src.add(h.name)
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// tarHeader describes the archive entry h as a tar header, without the
+// link target, which is in the entry's data, or the size of a file's
+// contents. mtime stands in for a modification time h does not record.
+func tarHeader(h entryHeader, mtime time.Time) *tar.Header {
+	th := &tar.Header{Name: h.name, ModTime: mtime, Mode: 0o644}
+	switch h.typ {
+	case entryDir:
+		th.Typeflag, th.Name, th.Mode = tar.TypeDir, h.name+"/", 0o755
+	case entrySymlink:
+		th.Typeflag, th.Mode = tar.TypeSymlink, 0o777
+	case entryHardlink:
+		th.Typeflag = tar.TypeLink
+	default: // files, and copies and chunked entries as files of their own
+		th.Typeflag = tar.TypeReg
+	}
+	if h.hasMode {
+		th.Mode = int64(h.mode)
+	}
+	if !h.mtime.IsZero() {
+		th.ModTime = h.mtime
+	}
+	if h.hasOwner {
+		th.Uid, th.Gid = int(h.uid), int(h.gid)
+	}
+	for name, value := range h.xattrs {
+		if th.PAXRecords == nil {
+			th.PAXRecords = make(map[string]string)
+		}
+		th.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+	return th
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- FIDO2 security keys ------------------------
+//
+// A key slot can wrap the master key with the hmac-secret extension of a
+// FIDO2 security key (YubiKey, SoloKey, Nitrokey, ...): the token keeps a
+// secret per credential and returns HMAC-SHA256(secret, salt) only when
+// touched, so opening the archive needs the token in hand. The slot
+// stores the credential ID and the salt:
+//
+//   [1 byte kind][1 byte credential ID length][credential ID][32 byte salt][nonce][wrapped key]
+//
+// and the wrapping key is HKDF-SHA256 of the token's answer. The standard
+// library does not speak CTAP2, so this drives the fido2-cred and
+// fido2-assert tools of libfido2, which also ask for the token's PIN.
+
+const (
+	fido2RelyingParty = "ghzip"
+	fido2SaltSize     = 32
+	fido2Info         = "ghzip fido2 key slot"
+
+	// fido2SecretPrefix marks the answer of a token for one key slot,
+	// handed to unlock like a password: ghzip-fido2:<slot>:<hex>.
+	fido2SecretPrefix = "ghzip-fido2:"
+)
+
+// fido2Device returns device, or else the first token fido2-token lists.
+func fido2Device(device string) (string, error) {
+	if device != "" {
+		return device, nil
+	}
+	out, err := runFIDO2("fido2-token", nil, "-L")
+	if err != nil {
+		return "", err
+	}
+	// "/dev/hidraw3: vendor=0x1050, product=0x0407 (Yubico YubiKey ...)"
+	line, _, _ := strings.Cut(string(out), "\n")
+	path, _, ok := strings.Cut(line, ": ")
+	if !ok {
+		return "", errors.New("no FIDO2 security key found (fido2-token -L lists none)")
+	}
+	return path, nil
+}
+
+// runFIDO2 runs a libfido2 tool with input on its standard input. Its
+// standard error stays on the terminal, for PIN prompts.
+func runFIDO2(tool string, input []string, args ...string) ([]byte, error) {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = strings.NewReader(strings.Join(input, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s not found (install libfido2's tools, e.g. the fido2-tools package)", tool)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", tool, err)
+	}
+	return out, nil
+}
+
+// fido2Lines returns the base64 or text lines of a tool's output.
+func fido2Lines(out []byte) []string {
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func randomBase64(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// fido2Register makes a new hmac-secret credential on the token.
+func fido2Register(device string) ([]byte, error) {
+	cdh, err := randomBase64(32) // no attestation is checked
+	if err != nil {
+		return nil, err
+	}
+	user, err := randomBase64(16)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "Touch your security key to register it...")
+	out, err := runFIDO2("fido2-cred", []string{cdh, fido2RelyingParty, "ghzip archive", user}, "-M", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// client data hash, relying party, format, authenticator data,
+	// credential ID, signature[, certificate]
+	lines := fido2Lines(out)
+	if len(lines) < 5 {
+		return nil, errors.New("fido2-cred: unexpected output")
+	}
+	return base64.StdEncoding.DecodeString(lines[4])
+}
+
+// fido2Secret asks the token for HMAC(credential secret, salt).
+func fido2Secret(device string, credID, salt []byte) ([]byte, error) {
+	cdh, err := randomBase64(32)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "Touch your security key...")
+	out, err := runFIDO2("fido2-assert", []string{cdh, fido2RelyingParty,
+		base64.StdEncoding.EncodeToString(credID), base64.StdEncoding.EncodeToString(salt)}, "-G", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// client data hash, relying party, authenticator data, signature,
+	// hmac-secret
+	lines := fido2Lines(out)
+	secret, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil || len(secret) != 32 {
+		return nil, errors.New("fido2-assert: no hmac-secret in the output")
+	}
+	return secret, nil
+}
+
+func fido2Key(secret []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, nil, fido2Info, masterKeySize)
+}
+
+// newFIDO2Slot registers a credential on the token and wraps master with
+// its hmac-secret. The token is touched twice.
+func newFIDO2Slot(device string, cipherID byte, master, aad []byte) (keySlot, error) {
+	s := keySlot{kind: slotFIDO2, salt: make([]byte, fido2SaltSize)}
+	device, err := fido2Device(device)
+	if err != nil {
+		return s, err
+	}
+	if s.credID, err = fido2Register(device); err != nil {
+		return s, err
+	}
+	if len(s.credID) == 0 || len(s.credID) > 255 {
+		return s, fmt.Errorf("unsupported credential ID length %d", len(s.credID))
+	}
+	if _, err := rand.Read(s.salt); err != nil {
+		return s, err
+	}
+	secret, err := fido2Secret(device, s.credID, s.salt)
+	if err != nil {
+		return s, err
+	}
+	kek, err := fido2Key(secret)
+	clear(secret)
+	if err != nil {
+		return s, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return s, err
+	}
+	s.nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.nonce); err != nil {
+		return s, err
+	}
+	s.wrapped = aead.Seal(nil, s.nonce, master, aad)
+	if len(s.encode()) > keySlotSize {
+		return s, fmt.Errorf("the token's credential ID (%d bytes) does not fit in a key slot", len(s.credID))
+	}
+	return s, nil
+}
+
+// fido2Unlock asks the token for the secret of the first FIDO2 slot of
+// the archive at path it answers for, and returns it as a secret for
+// unlock.
+func fido2Unlock(path, device string) (string, error) {
+	sf, err := openSlotFile(path, false)
+	if err != nil {
+		return "", err
+	}
+	defer sf.Close()
+	return sf.fido2Unlock(device)
+}
+
+func (sf *slotFile) fido2Unlock(device string) (string, error) {
+	device, err := fido2Device(device)
+	if err != nil {
+		return "", err
+	}
+	lastErr := errors.New("the archive has no FIDO2 key slot")
+	for i, s := range sf.slots {
+		if s.kind != slotFIDO2 {
+			continue
+		}
+		secret, err := fido2Secret(device, s.credID, s.salt)
+		if err != nil {
+			lastErr = err // most likely another token's credential
+			continue
+		}
+		defer clear(secret)
+		return fido2SecretPrefix + strconv.Itoa(i) + ":" + hex.EncodeToString(secret), nil
+	}
+	return "", lastErr
+}
+
+// parseFIDO2Secret splits a secret from fido2Unlock into the slot index
+// and the token's answer.
+func parseFIDO2Secret(s string) (int, []byte, bool) {
+	rest, ok := strings.CutPrefix(s, fido2SecretPrefix)
+	if !ok {
+		return 0, nil, false
+	}
+	idx, enc, ok := strings.Cut(rest, ":")
+	i, err := strconv.Atoi(idx)
+	if !ok || err != nil {
+		return 0, nil, false
+	}
+	secret, err := hex.DecodeString(enc)
+	if err != nil {
+		return 0, nil, false
+	}
+	return i, secret, true
+}
+
+// unwrapFIDO2 returns the master key if secret is the token's answer for
+// the slot.
+func (s keySlot) unwrapFIDO2(secret []byte, cipherID byte, aad []byte) ([]byte, error) {
+	kek, err := fido2Key(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, s.nonce, s.wrapped, aad)
+}
+
+// encodeFIDO2 appends the credential ID and salt of a FIDO2 slot.
+func (s keySlot) encodeFIDO2(b []byte) []byte {
+	b = append(b, byte(len(s.credID)))
+	b = append(b, s.credID...)
+	return append(b, s.salt...)
+}
+
+// decodeFIDO2 reads what encodeFIDO2 wrote.
+func (s *keySlot) decodeFIDO2(r *bytes.Reader) error {
+	n, err := r.ReadByte()
+	if err != nil || n == 0 {
+		return errors.New("corrupt key slot")
+	}
+	s.credID = make([]byte, n)
+	s.salt = make([]byte, fido2SaltSize)
+	if _, err := io.ReadFull(r, s.credID); err != nil {
+		return errors.New("corrupt key slot")
+	}
+	if _, err := io.ReadFull(r, s.salt); err != nil {
+		return errors.New("corrupt key slot")
+	}
+	return nil
+}
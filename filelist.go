@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------- File lists (-files-from) -------------------
+//
+// "find src -name '*.go' -print0 | ghzip -c -files-from - -0 -out go.gha"
+// archives the paths a list names instead of one -in tree. The list has
+// one path per line, or with -0 ends each path with a NUL byte, as
+// find -print0 and xargs -0 do, so names may contain newlines. Entries are
+// named as listed, without a leading "/" or "./"; a listed directory
+// brings everything below it, and what is listed twice (e.g. a directory
+// and, as find prints them, its files) is archived once.
+
+// readFileList reads the paths listed in name ("-" for stdin), separated
+// by newlines or, with null, by NUL bytes. Empty entries are skipped.
+func readFileList(name string, null bool) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-files-from: %w", err)
+	}
+	sep := []byte{'\n'}
+	if null {
+		sep = []byte{0}
+	}
+	paths := []string{}
+	for _, p := range bytes.Split(data, sep) {
+		if !null {
+			p = bytes.TrimSuffix(p, []byte{'\r'})
+		}
+		if len(p) > 0 {
+			paths = append(paths, string(p))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("-files-from %s: the list is empty", name)
+	}
+	return paths, nil
+}
+
+// listName turns a listed path into its entry name: cleaned and relative,
+// "" for the current directory. Paths above it are refused, as extraction
+// would refuse their entries.
+func listName(p string) (string, error) {
+	name := filepath.Clean(p)
+	name = strings.TrimLeft(name[len(filepath.VolumeName(name)):], `/\`)
+	switch {
+	case name == "" || name == ".":
+		return "", nil
+	case name == ".." || strings.HasPrefix(filepath.ToSlash(name), "../"):
+		return "", fmt.Errorf("%s: listed paths must not lead out of the current directory", p)
+	}
+	return name, nil
+}
+
+// walkList lists the listed paths and everything below the directories
+// among them, each entry once, leaving out what matches an exclude
+// pattern. Listed symlinks are treated as the symlinks policy says.
+// found, if not nil, gets every entry as it is listed.
+func walkList(paths, exclude []string, symlinks string, found func(inputFile)) ([]inputFile, error) {
+	files := []inputFile{}
+	seen := make(map[string]bool)
+	add := func(f inputFile) {
+		if !seen[f.relPath] {
+			seen[f.relPath] = true
+			files = append(files, f)
+			if found != nil {
+				found(f)
+			}
+		}
+	}
+	for _, p := range paths {
+		name, err := listName(p)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" && excluded(exclude, filepath.ToSlash(name)) {
+			continue
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if isSymlink(fi) && symlinks == symlinkSkip {
+			continue
+		}
+		if isSymlink(fi) && symlinks == symlinkFollow {
+			if err := followSymlink(p, name, exclude, nil, add); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if name != "" {
+			add(inputFile{relPath: name, absPath: p, info: fi})
+		}
+		if fi.IsDir() {
+			if err := walkTree(p, name, exclude, symlinks, nil, add); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// inputFiles lists what createArchive or appendArchive packs: the
+// entries being converted, the paths of opts.list if -files-from gave
+// one, or else inputPath. found, if not nil, gets the files walked as
+// they are found.
+func inputFiles(inputPath string, opts createOptions, found func(inputFile)) ([]inputFile, error) {
+	if opts.imported != nil {
+		return opts.imported, nil
+	}
+	if opts.list != nil {
+		return walkList(opts.list, opts.exclude, opts.symlinks, found)
+	}
+	return walkInput(inputPath, opts.exclude, opts.symlinks, found)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- Entry filters -------------------------------
+//
+// Structured binary data (audio samples, bitmaps, sensor logs) repeats
+// slowly changing values at a fixed stride. Replacing every byte by its
+// difference to the byte stride positions earlier turns those values into
+// small numbers the entropy coders handle well. Filters are chosen per
+// entry (-prefilter pattern=spec), applied to the file data before it is
+// written to the payload and undone while extracting; the entry records
+// its filter as [1 byte kind][1 byte stride] in extension tag extFilter.
+
+const (
+	filterNone  byte = 0
+	filterDelta byte = 1 // byte minus the byte stride positions earlier
+	filterXor   byte = 2 // byte xor the byte stride positions earlier
+)
+
+var filterNames = map[byte]string{
+	filterDelta: "delta",
+	filterXor:   "xor",
+}
+
+type entryFilter struct {
+	kind   byte
+	stride byte // 1-255
+}
+
+func (f entryFilter) String() string {
+	if f.stride == 1 {
+		return filterNames[f.kind]
+	}
+	return fmt.Sprintf("%s:%d", filterNames[f.kind], f.stride)
+}
+
+// parseFilter parses "delta", "xor" or either with a stride, "delta:4".
+func parseFilter(spec string) (entryFilter, error) {
+	name, n, hasStride := strings.Cut(spec, ":")
+	f := entryFilter{stride: 1}
+	for k, kn := range filterNames {
+		if kn == name {
+			f.kind = k
+		}
+	}
+	if f.kind == filterNone {
+		return f, fmt.Errorf("unknown filter %q (available: delta, xor)", name)
+	}
+	if hasStride {
+		s, err := strconv.Atoi(n)
+		if err != nil || s < 1 || s > 255 {
+			return f, fmt.Errorf("bad filter stride %q (1-255)", n)
+		}
+		f.stride = byte(s)
+	}
+	return f, nil
+}
+
+// apply filters data in place.
+func (f entryFilter) apply(data []byte) {
+	s := int(f.stride)
+	for i := len(data) - 1; i >= s; i-- {
+		if f.kind == filterDelta {
+			data[i] -= data[i-s]
+		} else {
+			data[i] ^= data[i-s]
+		}
+	}
+}
+
+// unfilterReader undoes a filter on the data read through it.
+type unfilterReader struct {
+	r    io.Reader
+	f    entryFilter
+	hist [255]byte // the last stride bytes, by position mod stride
+	pos  int
+}
+
+func (u *unfilterReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	s := int(u.f.stride)
+	for i := range p[:n] {
+		prev := &u.hist[u.pos%s]
+		if u.f.kind == filterDelta {
+			p[i] += *prev
+		} else {
+			p[i] ^= *prev
+		}
+		*prev = p[i]
+		u.pos++
+	}
+	return n, err
+}
+
+// filterWriter applies a filter to the data written through it, for files
+// streamed rather than filtered in place.
+type filterWriter struct {
+	w    io.Writer
+	f    entryFilter
+	hist [255]byte // the last stride bytes, by position mod stride
+	pos  int
+	buf  []byte
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	fw.buf = append(fw.buf[:0], p...)
+	s := int(fw.f.stride)
+	for i, c := range fw.buf {
+		prev := &fw.hist[fw.pos%s]
+		if fw.f.kind == filterDelta {
+			fw.buf[i] -= *prev
+		} else {
+			fw.buf[i] ^= *prev
+		}
+		*prev = c
+		fw.pos++
+	}
+	return fw.w.Write(fw.buf)
+}
+
+// filterRule applies a filter to the entries whose name or base name
+// matches pattern.
+type filterRule struct {
+	pattern string
+	filter  entryFilter
+}
+
+// parseFilterRules parses -prefilter values of the form pattern=spec.
+func parseFilterRules(vals []string) ([]filterRule, error) {
+	var rules []filterRule
+	for _, v := range vals {
+		pattern, spec, ok := strings.Cut(v, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("bad -prefilter %q, want pattern=filter", v)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad -prefilter pattern %q: %w", pattern, err)
+		}
+		f, err := parseFilter(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, filterRule{pattern, f})
+	}
+	return rules, nil
+}
+
+// matchFilter returns the filter of the first rule matching name.
+func matchFilter(rules []filterRule, name string) (entryFilter, bool) {
+	for _, r := range rules {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return r.filter, true
+		}
+		if ok, _ := path.Match(r.pattern, path.Base(name)); ok {
+			return r.filter, true
+		}
+	}
+	return entryFilter{}, false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/fips140"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ---------------------- FIPS mode (-fips) --------------------------
+//
+// -fips restricts goZip to FIPS 140-3 approved primitives, for regulated
+// environments: AES-256-GCM for the metadata and blocks, PBKDF2-HMAC-
+// SHA256 for the key slots, HKDF and SHA-256. Argon2id, scrypt,
+// XChaCha20-Poly1305 and AES-GCM-SIV (implemented here, not by Go's
+// validated module), X25519 recipients and FIDO2 tokens are refused. An
+// archive created in the mode records it in its metadata. Reading,
+// archives are checked before any key is derived. Go's own FIPS 140-3
+// module is switched on with GODEBUG=fips140=on; without it goZip warns.
+
+// checkFIPSFlags reports an error for a flag of fs that -fips does not
+// allow. Flags left at their default are overridden by applyFIPS.
+func checkFIPSFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "kdf":
+			if alg, perr := parseKDF(f.Value.String()); perr == nil && alg != kdfPBKDF2 {
+				err = fmt.Errorf("-fips allows only -kdf pbkdf2, not %s", f.Value)
+			}
+		case "cipher":
+			if id, perr := parseCipher(f.Value.String()); perr == nil && id != cipherAESGCM {
+				err = fmt.Errorf("-fips allows only -cipher aes-gcm, not %s", f.Value)
+			}
+		case "recipient", "identity":
+			err = fmt.Errorf("-fips does not allow X25519 recipients (-%s)", f.Name)
+		case "fido2", "open-fido2":
+			err = fmt.Errorf("-fips does not allow FIDO2 security keys (-%s)", f.Name)
+		}
+	})
+	if err == nil && !fips140.Enabled() {
+		fmt.Fprintln(os.Stderr, "warning: Go's FIPS 140-3 module is off; run with GODEBUG=fips140=on to use it")
+	}
+	return err
+}
+
+// applyFIPS sets the -kdf and -cipher flags of fs, where it has them, to
+// the approved algorithms.
+func applyFIPS(fs *flag.FlagSet) {
+	for name, value := range map[string]string{"kdf": "pbkdf2", "cipher": "aes-gcm"} {
+		if f := fs.Lookup(name); f != nil {
+			f.Value.Set(value)
+		}
+	}
+}
+
+// checkFIPSArchive refuses the archive at path unless it is sealed with
+// AES-GCM and all its key slots use PBKDF2, so that opening it with -fips
+// runs approved algorithms only.
+func checkFIPSArchive(path string) error {
+	sf, err := openSlotFile(path, false)
+	if err != nil {
+		return fmt.Errorf("-fips: %w", err)
+	}
+	defer sf.Close()
+	if sf.cipher != cipherAESGCM {
+		return fmt.Errorf("-fips: the archive is encrypted with %s, not AES-GCM", cipherNames[sf.cipher])
+	}
+	for i, s := range sf.slots {
+		switch {
+		case s.kind == slotEmpty:
+		case !s.hasKDF():
+			return fmt.Errorf("-fips: key slot %d (%s) is not allowed", i, s)
+		case s.kdf.alg != kdfPBKDF2:
+			return fmt.Errorf("-fips: key slot %d uses %s, not PBKDF2", i, kdfNames[s.kdf.alg])
+		}
+	}
+	return nil
+}
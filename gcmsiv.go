@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ---------------------- AES-GCM-SIV (RFC 8452) ----------------------
+//
+// AES-256-GCM-SIV derives the tag from the plaintext (through POLYVAL)
+// and uses it as the CTR counter, so a repeated nonce - cloned VMs with
+// bad entropy, say - reveals no more than whether two messages are equal,
+// where with GCM it leaks their XOR and the authentication key. Every
+// message gets its own authentication and encryption keys derived from
+// the key and the nonce. Sealing takes two passes over the data.
+
+const (
+	gcmSIVNonceSize = 12
+	gcmSIVTagSize   = 16
+)
+
+// aesGCMSIV implements cipher.AEAD.
+type aesGCMSIV struct {
+	kgk cipher.Block // key-generating key
+}
+
+// newAESGCMSIV returns AES-256-GCM-SIV for a 32 byte key.
+func newAESGCMSIV(key []byte) (*aesGCMSIV, error) {
+	if len(key) != 32 {
+		return nil, errors.New("aes-gcm-siv: bad key length")
+	}
+	kgk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMSIV{kgk: kgk}, nil
+}
+
+func (s *aesGCMSIV) NonceSize() int { return gcmSIVNonceSize }
+func (s *aesGCMSIV) Overhead() int  { return gcmSIVTagSize }
+
+// messageKeys derives the POLYVAL key and the AES-256 encryption key for
+// nonce from the halves of six encrypted counter blocks.
+func (s *aesGCMSIV) messageKeys(nonce []byte) (authKey []byte, enc cipher.Block) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("aes-gcm-siv: bad nonce length")
+	}
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	keys := make([]byte, 0, 48)
+	for i := uint32(0); i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		s.kgk.Encrypt(out[:], in[:])
+		keys = append(keys, out[:8]...)
+	}
+	enc, err := aes.NewCipher(keys[16:])
+	if err != nil {
+		panic(err) // 32 bytes is always a valid AES key
+	}
+	return keys[:16], enc
+}
+
+// tag computes the tag of plaintext and additional data.
+func (s *aesGCMSIV) tag(authKey []byte, enc cipher.Block, nonce, plaintext, ad []byte) [16]byte {
+	p := newPolyval(authKey)
+	p.update(ad)
+	p.update(plaintext)
+	var lens [16]byte
+	binary.LittleEndian.PutUint64(lens[:8], uint64(len(ad))*8)
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(plaintext))*8)
+	p.update(lens[:])
+	sum := p.sum()
+	subtle.XORBytes(sum[:12], sum[:12], nonce)
+	sum[15] &= 0x7f
+	enc.Encrypt(sum[:], sum[:])
+	return sum
+}
+
+// gcmSIVCTR XORs src with the key stream that starts at the tag (top bit
+// set) and counts up in its first 32 bits, little-endian.
+func gcmSIVCTR(enc cipher.Block, tag [16]byte, dst, src []byte) {
+	ctr := tag
+	ctr[15] |= 0x80
+	var ks [16]byte
+	for len(src) > 0 {
+		enc.Encrypt(ks[:], ctr[:])
+		binary.LittleEndian.PutUint32(ctr[:4], binary.LittleEndian.Uint32(ctr[:4])+1)
+		n := subtle.XORBytes(dst, src, ks[:])
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+func (s *aesGCMSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	authKey, enc := s.messageKeys(nonce)
+	tag := s.tag(authKey, enc, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	gcmSIVCTR(enc, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (s *aesGCMSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < gcmSIVTagSize {
+		return nil, errOpen
+	}
+	authKey, enc := s.messageKeys(nonce)
+	ct := ciphertext[:len(ciphertext)-gcmSIVTagSize]
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ct):])
+	ret, out := sliceForAppend(dst, len(ct))
+	gcmSIVCTR(enc, tag, out, ct)
+	want := s.tag(authKey, enc, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(want[:], tag[:]) != 1 {
+		clear(out)
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// ---------------------- POLYVAL -----------------------------------
+//
+// POLYVAL is GHASH with the bytes of every block (and of the key and the
+// result) in the opposite order and the key multiplied by x (RFC 8452,
+// appendix A), so it is computed with a GHASH multiplication on 4-bit
+// tables. GHASH field elements are bit-reflected: the coefficient of x^0
+// is the top bit of hi.
+
+type ghashElem struct{ hi, lo uint64 }
+
+// ghashReduction holds the reduction of the four bits shifted out of lo.
+var ghashReduction = [16]uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+// ghashDouble multiplies x by the polynomial x.
+func ghashDouble(x ghashElem) ghashElem {
+	carry := x.lo & 1
+	x.lo = x.lo>>1 | x.hi<<63
+	x.hi >>= 1
+	x.hi ^= 0xe100000000000000 & -carry
+	return x
+}
+
+// reverse4 reverses the low four bits of i.
+func reverse4(i int) int {
+	return (i&1)<<3 | (i&2)<<1 | (i&4)>>1 | (i&8)>>3
+}
+
+// polyval is a running POLYVAL hash.
+type polyval struct {
+	table [16]ghashElem // products of the key with every 4-bit value
+	s     ghashElem
+}
+
+// polyvalElem loads a POLYVAL block as a GHASH element (byte reversed).
+func polyvalElem(b []byte) ghashElem {
+	return ghashElem{hi: binary.LittleEndian.Uint64(b[8:]), lo: binary.LittleEndian.Uint64(b[:8])}
+}
+
+func newPolyval(key []byte) *polyval {
+	p := &polyval{}
+	h := ghashDouble(polyvalElem(key))
+	p.table[reverse4(1)] = h
+	for i := 2; i < 16; i += 2 {
+		p.table[reverse4(i)] = ghashDouble(p.table[reverse4(i/2)])
+		t := p.table[reverse4(i)]
+		p.table[reverse4(i+1)] = ghashElem{t.hi ^ h.hi, t.lo ^ h.lo}
+	}
+	return p
+}
+
+// mul sets s to s times the key.
+func (p *polyval) mul() {
+	var z ghashElem
+	for _, word := range [2]uint64{p.s.lo, p.s.hi} {
+		for j := 0; j < 64; j += 4 {
+			out := z.lo & 0xf
+			z.lo = z.lo>>4 | z.hi<<60
+			z.hi >>= 4
+			z.hi ^= uint64(ghashReduction[out]) << 48
+			t := p.table[word&0xf]
+			z.hi ^= t.hi
+			z.lo ^= t.lo
+			word >>= 4
+		}
+	}
+	p.s = z
+}
+
+// update hashes b, zero padded to whole blocks.
+func (p *polyval) update(b []byte) {
+	for len(b) > 0 {
+		var block [16]byte
+		n := copy(block[:], b)
+		b = b[n:]
+		x := polyvalElem(block[:])
+		p.s.hi ^= x.hi
+		p.s.lo ^= x.lo
+		p.mul()
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var out [16]byte
+	binary.LittleEndian.PutUint64(out[:8], p.s.lo)
+	binary.LittleEndian.PutUint64(out[8:], p.s.hi)
+	return out
+}
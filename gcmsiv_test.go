@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// AEAD_AES_256_GCM_SIV test vectors of RFC 8452, appendix C.2 and C.3.
+func TestAESGCMSIVRFC8452(t *testing.T) {
+	for _, tc := range []struct {
+		key, nonce, ad, pt, want string
+	}{
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "",
+			"", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "",
+			"0100000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+		{"0000000000000000000000000000000000000000000000000000000000000000", "000000000000000000000000", "",
+			"000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108",
+			"f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000"},
+	} {
+		aead, err := newAESGCMSIV(unhex(t, tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, ad, pt := unhex(t, tc.nonce), unhex(t, tc.ad), unhex(t, tc.pt)
+		sealed := aead.Seal(nil, nonce, pt, ad)
+		if got := hex.EncodeToString(sealed); got != tc.want {
+			t.Errorf("%s: sealed = %s, want %s", tc.pt, got, tc.want)
+			continue
+		}
+		opened, err := aead.Open(nil, nonce, sealed, ad)
+		if err != nil || !bytes.Equal(opened, pt) {
+			t.Errorf("%s: open = %x, %v", tc.pt, opened, err)
+		}
+		for i := range sealed {
+			bad := bytes.Clone(sealed)
+			bad[i] ^= 0x80
+			if _, err := aead.Open(nil, nonce, bad, ad); err == nil {
+				t.Errorf("%s: open accepted a change to byte %d", tc.pt, i)
+			}
+		}
+	}
+}
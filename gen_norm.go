@@ -0,0 +1,141 @@
+//go:build ignore
+
+// gen_norm generates normtables.go, the Unicode data used for filename
+// normalization, from the Unicode Character Database:
+//
+//	go run gen_norm.go -ucd https://www.unicode.org/Public/14.0.0/ucd
+//
+// -ucd may also be a local directory holding UnicodeData.txt and
+// CompositionExclusions.txt.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func open(base, name string) io.ReadCloser {
+	if strings.HasPrefix(base, "http://") || strings.HasPrefix(base, "https://") {
+		resp, err := http.Get(base + "/" + name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("%s: %s", name, resp.Status)
+		}
+		return resp.Body
+	}
+	f, err := os.Open(filepath.Join(base, name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func parseRune(s string) rune {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 16, 32)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rune(v)
+}
+
+func main() {
+	ucd := flag.String("ucd", "https://www.unicode.org/Public/14.0.0/ucd", "UCD directory or URL")
+	out := flag.String("o", "normtables.go", "output file")
+	flag.Parse()
+
+	decomp := map[rune][]rune{}
+	ccc := map[rune]uint8{}
+	r := open(*ucd, "UnicodeData.txt")
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), ";")
+		if len(f) < 6 {
+			continue
+		}
+		cp := parseRune(f[0])
+		if c, _ := strconv.Atoi(f[3]); c != 0 {
+			ccc[cp] = uint8(c)
+		}
+		if f[5] != "" && !strings.HasPrefix(f[5], "<") { // canonical only
+			for _, s := range strings.Fields(f[5]) {
+				decomp[cp] = append(decomp[cp], parseRune(s))
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+	r.Close()
+
+	excluded := map[rune]bool{}
+	r = open(*ucd, "CompositionExclusions.txt")
+	sc = bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			excluded[parseRune(line)] = true
+		}
+	}
+	r.Close()
+	// full composition exclusions also cover singletons and non-starter
+	// decompositions
+	for cp, d := range decomp {
+		if len(d) == 1 || ccc[cp] != 0 || ccc[d[0]] != 0 {
+			excluded[cp] = true
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_norm.go; DO NOT EDIT.\n\npackage main\n\n")
+	fmt.Fprintf(&b, "// canonicalDecomp maps a character to its canonical decomposition (one level).\n")
+	fmt.Fprintf(&b, "var canonicalDecomp = map[rune]string{\n")
+	for _, cp := range sortedKeys(decomp) {
+		fmt.Fprintf(&b, "0x%04X: %+q,\n", cp, string(decomp[cp]))
+	}
+	fmt.Fprintf(&b, "}\n\n// combiningClass holds the non-zero canonical combining classes.\n")
+	fmt.Fprintf(&b, "var combiningClass = map[rune]uint8{\n")
+	for i, cp := range sortedKeys(ccc) {
+		fmt.Fprintf(&b, "0x%04X: %d,", cp, ccc[cp])
+		if i%6 == 5 {
+			b.WriteByte('\n')
+		}
+	}
+	fmt.Fprintf(&b, "\n}\n\n// compositionExcluded lists decompositions that are never recomposed.\n")
+	fmt.Fprintf(&b, "var compositionExcluded = map[rune]bool{\n")
+	for i, cp := range sortedKeys(excluded) {
+		fmt.Fprintf(&b, "0x%04X: true,", cp)
+		if i%6 == 5 {
+			b.WriteByte('\n')
+		}
+	}
+	fmt.Fprintf(&b, "\n}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func sortedKeys[V any](m map[rune]V) []rune {
+	keys := make([]rune, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ---------------------- Name patterns ------------------------------
+//
+// Patterns select archive entries by name, for -files, -filter and
+// -exclude. They use path.Match syntax (*, ?, [...]) within one path
+// segment, and a segment "**" that matches any number of segments, so
+// "src/**/*.go" finds Go files at any depth below src. A pattern without a
+// slash also matches the base name, as -prefilter patterns do, and a
+// pattern matching a directory selects everything below it.
+
+// checkGlob reports a malformed pattern.
+func checkGlob(pattern string) error {
+	for _, seg := range strings.Split(pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the slash-separated name matches pattern.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches name segments against pattern segments, "**"
+// standing for zero or more of them.
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchPattern reports whether name, or one of the directories it is in,
+// matches pattern.
+func matchPattern(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	for n := strings.TrimSuffix(name, "/"); ; n = path.Dir(n) {
+		if matchGlob(pattern, n) {
+			return true
+		}
+		if !strings.Contains(n, "/") {
+			return false
+		}
+	}
+}
+
+// excluded reports whether name, or a directory it is in, matches one of
+// the exclude patterns.
+func excluded(exclude []string, name string) bool {
+	for _, p := range exclude {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,3 +2,4 @@ module doesbuzz/goZip
 
 go 1.25.1
 
+require github.com/klauspost/compress v1.20.1
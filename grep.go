@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// ---------------------- ghzip grep ---------------------------------
+//
+// "ghzip grep -in backup.gha 'pattern'" searches the files in archives
+// without extracting them: entries are decompressed and decrypted as a
+// stream, as for extraction, and each line is matched on the way. Hits
+// print as entry:line:text, prefixed with the archive when several are
+// searched, so the backup holding a string is found in one pass. Copies
+// and files sharing chunks are searched too, reading what they share back
+// from the archive (source.go). Patterns are Go regular expressions (RE2
+// syntax); -F takes them literally. As with grep(1), the exit status is 0
+// when a line matched, 1 when none did and 2 on an error, which goes to
+// stderr; an archive that fails does not stop the others being searched.
+
+// grepMaxLine caps how much of a line is kept for matching and printing;
+// the rest of a longer line is skipped.
+const grepMaxLine = 1 << 20
+
+// grepOptions holds the options of grepArchive.
+type grepOptions struct {
+	readOptions
+
+	files       []string // only search entries matching these patterns (glob.go)
+	namesOnly   bool     // print matching entry names, not lines
+	withArchive bool     // prefix hits with the archive path
+}
+
+func runGrep(args []string) {
+	cmd := flag.NewFlagSet("grep", flag.ExitOnError)
+	var inPaths multiFlag
+	cmd.Var(&inPaths, "in", "`archive` to search (repeatable; more can follow the pattern)")
+	pass := cmd.String("pass", "", "password (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "open the archives with a key `file` or X25519 identity file")
+	ignoreCase := cmd.Bool("i", false, "ignore case")
+	fixed := cmd.Bool("F", false, "match the pattern as a plain string, not a regular expression")
+	namesOnly := cmd.Bool("l", false, "print only the names of the entries that match")
+	var filesFlags multiFlag
+	cmd.Var(&filesFlags, "files", "only search entries matching `pattern`, e.g. '*.log' (repeatable)")
+	dictPath := cmd.String("dict", "", "the dictionary `file` the archives were compressed with")
+	allowExec := cmd.Bool("allow-exec", false, "run the external compressor the archives name")
+	parseCommand(cmd, args)
+	exitCode = 2 // until the search is done
+	if cmd.NArg() == 0 || len(inPaths)+cmd.NArg()-1 == 0 {
+		fmt.Println("usage: ghzip grep [-i] [-F] [-l] [-files pattern] [-pass p | -keyfile f] -in <archive> <pattern> [archive ...]")
+		return
+	}
+	archives := append(inPaths, cmd.Args()[1:]...)
+	expr := cmd.Arg(0)
+	if *fixed {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if *ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		grepError("%v", err)
+		return
+	}
+	for _, p := range filesFlags {
+		if err := checkGlob(p); err != nil {
+			grepError("-files: %v", err)
+			return
+		}
+	}
+	opts := grepOptions{files: filesFlags, namesOnly: *namesOnly, withArchive: len(archives) > 1}
+	opts.allowExec = *allowExec
+	if *dictPath != "" {
+		if opts.dict, err = loadDictionary(*dictPath); err != nil {
+			grepError("%v", err)
+			return
+		}
+	}
+	if *pass == "" && *keyfilePath == "" {
+		if *pass, err = readPassword(*passFd, *passFile); err != nil {
+			grepError("%v", err)
+			return
+		}
+	}
+	secret, err := slotSecret(*pass, *keyfilePath, "Password: ")
+	if err != nil {
+		grepError("%v", err)
+		return
+	}
+	matched, failed := false, false
+	for _, path := range archives {
+		found, err := grepArchive(path, secret, re, opts)
+		if err != nil {
+			grepError("%s: %v", path, err)
+			failed = true
+		}
+		matched = matched || found
+	}
+	switch {
+	case failed:
+	case matched:
+		exitCode = 0
+	default:
+		exitCode = 1
+	}
+}
+
+// grepError reports an error on stderr, where it does not mix with the
+// matches printed on stdout.
+func grepError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+}
+
+// grepArchive prints the lines of the files in the archive at path that
+// match re and reports whether there were any, also when it fails.
+func grepArchive(path, password string, re *regexp.Regexp, opts grepOptions) (matched bool, err error) {
+	ar, err := openArchive(path, password)
+	if err != nil {
+		return false, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(opts.readOptions); err != nil {
+		return false, err
+	}
+	prefix := ""
+	if opts.withArchive {
+		prefix = path + ":"
+	}
+	src := newArchiveSource(path, password, ar, opts.readOptions)
+	defer src.Close()
+	br := bufio.NewReaderSize(nil, 64<<10)
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			return matched, nil
+		}
+		if err != nil {
+			return matched, err
+		}
+		data := &io.LimitedReader{R: ar.payload, N: int64(h.size)}
+		if selectedBy(opts.files, h.name) {
+			r, _, err := src.contents(h, data)
+			if err != nil {
+				return matched, fmt.Errorf("%s: %w", h.name, err)
+			}
+			if r != nil {
+				br.Reset(r)
+				found, err := grepEntry(br, prefix+h.name, re, opts.namesOnly)
+				matched = matched || found
+				if err != nil {
+					return matched, fmt.Errorf("%s: %w", h.name, err)
+				}
+			}
+		}
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return matched, err
+		}
+		if data.N > 0 {
+			return matched, io.ErrUnexpectedEOF
+		}
+		src.add(h.name)
+	}
+}
+
+// grepEntry matches the lines read from r, printing them as name:line:text,
+// and reports whether any did. A matching line with NUL bytes in it marks
+// a binary file, reported once as such.
+func grepEntry(r *bufio.Reader, name string, re *regexp.Regexp, namesOnly bool) (matched bool, err error) {
+	var line []byte
+	for num := 1; ; num++ {
+		line = line[:0]
+		var err error
+		for {
+			var chunk []byte
+			chunk, err = r.ReadSlice('\n')
+			if len(line) < grepMaxLine {
+				line = append(line, chunk[:min(len(chunk), grepMaxLine-len(line))]...)
+			}
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				break
+			}
+		}
+		if err != nil && err != io.EOF {
+			return matched, err
+		}
+		text := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+		if len(line) > 0 && re.Match(text) {
+			matched = true
+			switch {
+			case namesOnly:
+				fmt.Println(name)
+				return true, nil
+			case bytes.IndexByte(text, 0) >= 0:
+				fmt.Printf("%s: binary file matches\n", name)
+				return true, nil
+			}
+			fmt.Printf("%s:%d:%s\n", name, num, text)
+		}
+		if err == io.EOF {
+			return matched, nil
+		}
+	}
+}
+
+// selectedBy reports whether name is picked by one of the patterns, or
+// by none being given.
+func selectedBy(patterns []string, name string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
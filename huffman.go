@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ---------------------- Huffman compression -----------------------
+//
+// v2 archives store canonical Huffman code lengths (one byte per symbol)
+// instead of the v1 frequency table: the codes themselves follow from the
+// lengths, so encoder and decoder build identical tables deterministically.
+
+// maxCodeLen bounds canonical code lengths so every code fits comfortably
+// in a machine word.
+const maxCodeLen = 15
+
+// node and heap for building Huffman tree
+type node struct {
+	b     byte
+	freq  uint64
+	left  *node
+	right *node
+}
+
+type nodeHeap []*node
+
+func (h nodeHeap) Len() int           { return len(h) }
+func (h nodeHeap) Less(i, j int) bool { return h[i].freq < h[j].freq }
+func (h nodeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*node))
+}
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func buildTree(freq [256]uint64) *node {
+	h := &nodeHeap{}
+	for b, f := range freq {
+		if f > 0 {
+			heap.Push(h, &node{b: byte(b), freq: f})
+		}
+	}
+	if h.Len() == 0 {
+		return nil
+	}
+	if h.Len() == 1 {
+		only := heap.Pop(h).(*node)
+		root := &node{freq: only.freq, left: only}
+		return root
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a := heap.Pop(h).(*node)
+		b := heap.Pop(h).(*node)
+		parent := &node{freq: a.freq + b.freq, left: a, right: b}
+		heap.Push(h, parent)
+	}
+	return heap.Pop(h).(*node)
+}
+
+// codeLengths returns the Huffman code length of every symbol (0 = unused),
+// limited to maxCodeLen bits.
+func codeLengths(freq [256]uint64) [256]uint8 {
+	var lengths [256]uint8
+	root := buildTree(freq)
+	if root == nil {
+		return lengths
+	}
+	var dfs func(n *node, depth int)
+	dfs = func(n *node, depth int) {
+		if n == nil {
+			return
+		}
+		if n.left == nil && n.right == nil {
+			if depth == 0 {
+				depth = 1
+			}
+			if depth > 255 {
+				depth = 255
+			}
+			lengths[n.b] = uint8(depth)
+			return
+		}
+		dfs(n.left, depth+1)
+		dfs(n.right, depth+1)
+	}
+	dfs(root, 0)
+	limitCodeLengths(&lengths, freq)
+	return lengths
+}
+
+// limitCodeLengths clamps lengths to maxCodeLen and then lengthens the
+// least frequent short codes until the Kraft inequality holds again.
+func limitCodeLengths(lengths *[256]uint8, freq [256]uint64) {
+	over := false
+	for _, l := range lengths {
+		if l > maxCodeLen {
+			over = true
+			break
+		}
+	}
+	if !over {
+		return
+	}
+	const full = 1 << maxCodeLen
+	kraft := 0
+	for s, l := range lengths {
+		if l > maxCodeLen {
+			lengths[s] = maxCodeLen
+		}
+		if lengths[s] > 0 {
+			kraft += 1 << (maxCodeLen - lengths[s])
+		}
+	}
+	// symbols ordered from least to most frequent
+	syms := make([]int, 0, 256)
+	for s, l := range lengths {
+		if l > 0 {
+			syms = append(syms, s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool { return freq[syms[i]] < freq[syms[j]] })
+	for kraft > full {
+		for _, s := range syms {
+			if lengths[s] < maxCodeLen {
+				kraft -= 1 << (maxCodeLen - lengths[s] - 1)
+				lengths[s]++
+				if kraft <= full {
+					break
+				}
+			}
+		}
+	}
+}
+
+// huffCode is one canonical code: its len low bits of bits, most
+// significant bit first.
+type huffCode struct {
+	bits uint32
+	len  uint8
+}
+
+// canonicalCodes assigns canonical codes to the given lengths: shorter codes
+// first, ties broken by symbol value. Unused symbols get length 0.
+func canonicalCodes(lengths [256]uint8) [256]huffCode {
+	var codes [256]huffCode
+	syms := make([]int, 0, 256)
+	for s, l := range lengths {
+		if l > 0 {
+			syms = append(syms, s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if lengths[syms[i]] != lengths[syms[j]] {
+			return lengths[syms[i]] < lengths[syms[j]]
+		}
+		return syms[i] < syms[j]
+	})
+	code := uint32(0)
+	prevLen := uint8(0)
+	for _, s := range syms {
+		l := lengths[s]
+		code <<= l - prevLen
+		prevLen = l
+		codes[s] = huffCode{bits: code, len: l}
+		code++
+	}
+	return codes
+}
+
+// validLengths checks that lengths read from an archive describe a prefix code.
+func validLengths(lengths [256]uint8) bool {
+	kraft := 0
+	for _, l := range lengths {
+		if l > maxCodeLen {
+			return false
+		}
+		if l > 0 {
+			kraft += 1 << (maxCodeLen - l)
+		}
+	}
+	return kraft <= 1<<maxCodeLen
+}
+
+// huffmanCompress encodes data with the canonical code described by lengths.
+func huffmanCompress(data []byte, lengths [256]uint8) ([]byte, error) {
+	codes := canonicalCodes(lengths)
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	bw := newBitWriter(&buf)
+	for _, b := range data {
+		c := codes[b]
+		if c.len == 0 {
+			return nil, fmt.Errorf("no code for byte %v", b)
+		}
+		bw.WriteBits(c.bits, c.len)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canonicalTree rebuilds the decoding tree for a canonical code.
+func canonicalTree(lengths [256]uint8) *node {
+	root := &node{}
+	for s, c := range canonicalCodes(lengths) {
+		if c.len == 0 {
+			continue
+		}
+		n := root
+		for i := int(c.len) - 1; i >= 0; i-- {
+			next := &n.left
+			if c.bits>>i&1 == 1 {
+				next = &n.right
+			}
+			if *next == nil {
+				*next = &node{}
+			}
+			n = *next
+		}
+		n.b = byte(s)
+	}
+	return root
+}
+
+// huffmanDecompress decodes exactly n symbols of a canonical Huffman stream.
+func huffmanDecompress(comp []byte, lengths [256]uint8, n uint64) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if !validLengths(lengths) {
+		return nil, errors.New("corrupt Huffman code lengths")
+	}
+	return newHuffDecoder(lengths).decode(newBitReader(bytes.NewReader(comp)), n)
+}
+
+// huffLookupBits is how many bits the decoder resolves with one table
+// lookup; longer codes are rare and take the canonical walk.
+const huffLookupBits = 11
+
+// huffDecoder decodes a canonical Huffman code.
+type huffDecoder struct {
+	// lookup maps the next huffLookupBits bits to symbol | length<<8,
+	// or 0 when the code is longer (or not a valid code)
+	lookup [1 << huffLookupBits]uint16
+	count  [maxCodeLen + 1]int // codes per length
+	syms   []byte              // symbols in canonical order
+}
+
+func newHuffDecoder(lengths [256]uint8) *huffDecoder {
+	d := &huffDecoder{}
+	for l := 1; l <= maxCodeLen; l++ {
+		for s := range lengths {
+			if int(lengths[s]) == l {
+				d.syms = append(d.syms, byte(s))
+				d.count[l]++
+			}
+		}
+	}
+	for s, c := range canonicalCodes(lengths) {
+		if c.len == 0 || c.len > huffLookupBits {
+			continue
+		}
+		shift := huffLookupBits - c.len
+		start := c.bits << shift
+		for i := uint32(0); i < 1<<shift; i++ {
+			d.lookup[start+i] = uint16(s) | uint16(c.len)<<8
+		}
+	}
+	return d
+}
+
+// walk decodes one symbol from the next maxCodeLen bits (most significant
+// first) by comparing against the first code of every length.
+func (d *huffDecoder) walk(bits uint64) (sym byte, length uint, ok bool) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeLen; l++ {
+		code |= int(bits>>(maxCodeLen-l)) & 1
+		if code-first < d.count[l] {
+			return d.syms[index+code-first], uint(l), true
+		}
+		index += d.count[l]
+		first = (first + d.count[l]) << 1
+		code <<= 1
+	}
+	return 0, 0, false
+}
+
+// decode decodes exactly n symbols from r.
+func (d *huffDecoder) decode(r *bitReader, n uint64) ([]byte, error) {
+	out := make([]byte, 0, n)
+	acc, nbits := r.acc, r.n // kept in locals for speed, written back below
+	for uint64(len(out)) < n {
+		if nbits < 32 { // refilling tops up to 57 bits, enough for several codes
+			r.acc, r.n = acc, nbits
+			r.refill()
+			acc, nbits = r.acc, r.n
+		}
+		var sym byte
+		var l uint
+		if e := d.lookup[acc>>(64-huffLookupBits)]; e != 0 {
+			sym, l = byte(e), uint(e>>8)
+		} else {
+			var ok bool
+			if sym, l, ok = d.walk(acc >> (64 - maxCodeLen)); !ok {
+				return nil, errors.New("corrupt compressed data (invalid code)")
+			}
+		}
+		if l > nbits {
+			if r.err != io.EOF {
+				return nil, r.err
+			}
+			return nil, errors.New("compressed data truncated")
+		}
+		acc <<= l
+		nbits -= l
+		out = append(out, sym)
+	}
+	r.acc, r.n = acc, nbits
+	return out, nil
+}
+
+// huffmanDecompressV1 decodes a v1 payload, whose tree is rebuilt from the
+// stored frequency table. Every symbol takes at least one bit, so no more
+// than 8*len(comp) are decoded whatever the table claims.
+func huffmanDecompressV1(comp []byte, freq [256]uint64) ([]byte, error) {
+	root := buildTree(freq)
+	if root == nil {
+		return nil, nil
+	}
+	// The last byte is zero-padded, so stop once every counted symbol has been
+	// decoded instead of decoding the padding bits as extra symbols.
+	total := min(freqTotal(freq), 8*uint64(len(comp)))
+	// single-symbol
+	if root.left != nil && root.right == nil && root.left.left == nil && root.left.right == nil {
+		return bytes.Repeat([]byte{root.left.b}, int(total)), nil
+	}
+	return decodeTree(root, comp, total)
+}
+
+// freqTotal returns the number of symbols a frequency table counts,
+// saturating at the largest uint64.
+func freqTotal(freq [256]uint64) uint64 {
+	var total uint64
+	for _, v := range freq {
+		if total+v < total {
+			return math.MaxUint64
+		}
+		total += v
+	}
+	return total
+}
+
+// decodeTree walks the tree bit by bit until total symbols are decoded.
+func decodeTree(root *node, comp []byte, total uint64) ([]byte, error) {
+	br := newBitReader(bytes.NewReader(comp))
+	var out bytes.Buffer
+	for uint64(out.Len()) < total {
+		n := root
+		for n.left != nil || n.right != nil {
+			bit, err := br.readBit()
+			if err != nil {
+				if err == io.EOF {
+					return out.Bytes(), nil
+				}
+				return nil, err
+			}
+			if bit == 0 {
+				n = n.left
+			} else {
+				n = n.right
+			}
+			if n == nil {
+				return nil, errors.New("corrupt compressed data (walked to nil)")
+			}
+		}
+		out.WriteByte(n.b)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// ---------------------- Interruption (Ctrl+C) ----------------------
+//
+// While an archive is created, appended to or extracted, SIGINT and
+// SIGTERM do not kill goZip mid-write. They are noted, and the work stops
+// at the next entry, or at the next read of archive data while a file is
+// being extracted. The archive being written is then removed; with -a
+// and -sfx that is the temporary copy, so the archive appended to is left
+// as it was. When extracting, the partly written file is removed. Files
+// already extracted stay, and so does the -resume record. goZip then
+// exits with 130 for SIGINT or 143 for SIGTERM, the codes a shell gives
+// a command killed by them. A second signal ends goZip at once.
+//
+// Once the work has succeeded (the archive is written and, with -a, -sfx
+// and -staging, renamed into place) signals are ignored, and one caught
+// too late to stop anything is forgotten: goZip exits as it would have
+// without it.
+
+// errInterrupted is returned by work stopped by a signal.
+var errInterrupted = errors.New("interrupted")
+
+// caught is the number of the signal caught, 0 for none, or signalsDone
+// once the work has succeeded.
+var caught atomic.Int32
+
+const signalsDone = -1
+
+// catchInterrupts catches SIGINT and SIGTERM until stop is called.
+func catchInterrupts() (stop func()) {
+	caught.Store(0)
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range ch {
+			n := int32(sig.(syscall.Signal))
+			if !caught.CompareAndSwap(0, n) {
+				if caught.Load() == signalsDone {
+					continue
+				}
+				os.Exit(128 + int(n))
+			}
+			fmt.Fprintln(os.Stderr, "\ninterrupted: stopping (again to quit at once)")
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
+// workDone is called once the work caught for has succeeded; signals
+// caught until stop are ignored, and any caught already is forgotten.
+func workDone() {
+	caught.Store(signalsDone)
+}
+
+// interrupted returns errInterrupted once a signal has been caught.
+func interrupted() error {
+	if caught.Load() > 0 {
+		return errInterrupted
+	}
+	return nil
+}
+
+// exitInterrupted exits with the code for the signal caught, if any.
+func exitInterrupted() {
+	if n := caught.Load(); n > 0 {
+		os.Exit(128 + int(n))
+	}
+}
+
+// interruptReader fails reads once a signal has been caught.
+type interruptReader struct {
+	r io.Reader
+}
+
+func (ir interruptReader) Read(p []byte) (int, error) {
+	if err := interrupted(); err != nil {
+		return 0, err
+	}
+	return ir.r.Read(p)
+}
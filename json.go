@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ---------------------- JSON output (-json) ------------------------
+//
+// "ghzip -l -json -in backup.gha" and "ghzip -t -json ..." print one JSON
+// object on stdout instead of the boxes and tables, for scripts and
+// monitoring:
+//
+//	{"archive": {"path": ..., "id": ..., "entries": 12, ...},
+//	 "entries": [{"type": "file", "name": "a.txt", "size": 3, "mode": "0644",
+//	              "mtime": ..., "sha256": ..., "ratio": 0.42}, ...]}
+//
+// Fields that an archive does not record are left out: mode, mtime and
+// sha256 of archives written before they were stored, stored/ratio/method
+// of solid archives, where entries share their blocks. The messages that
+// are otherwise printed go to stderr.
+
+// jsonListing is what -json prints.
+type jsonListing struct {
+	Archive jsonArchive `json:"archive"`
+	Entries []jsonEntry `json:"entries"`
+	Failed  *int        `json:"failed,omitempty"` // -t: entries that failed
+	Error   string      `json:"error,omitempty"`  // why listing or testing stopped
+}
+
+type jsonArchive struct {
+	Path       string     `json:"path"`
+	ID         string     `json:"id,omitempty"`
+	Created    *time.Time `json:"created,omitempty"`
+	Tool       string     `json:"tool,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	Entries    *uint64    `json:"entries,omitempty"`
+	Size       *uint64    `json:"size,omitempty"` // sum of the file sizes
+	Dictionary string     `json:"dictionary,omitempty"`
+	Compressor string     `json:"compressor,omitempty"`
+	FIPS       bool       `json:"fips,omitempty"`
+	Base       *jsonBase  `json:"base,omitempty"` // of a differential archive
+}
+
+type jsonBase struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+type jsonEntry struct {
+	Type    string     `json:"type"` // see entryTypeNames
+	Name    string     `json:"name"`
+	Size    uint64     `json:"size"` // of a file's contents, 0 for others
+	Link    string     `json:"link,omitempty"`
+	Mode    string     `json:"mode,omitempty"` // octal, e.g. "0755"
+	Mtime   *time.Time `json:"mtime,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`
+	Stored  *int64     `json:"stored,omitempty"` // bytes of the entry's blocks
+	Ratio   *float64   `json:"ratio,omitempty"`  // stored / size
+	Method  string     `json:"method,omitempty"`
+	Filter  string     `json:"filter,omitempty"`
+	UID     *uint32    `json:"uid,omitempty"`
+	GID     *uint32    `json:"gid,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+	OK      *bool      `json:"ok,omitempty"` // -t
+	Problem string     `json:"problem,omitempty"`
+}
+
+var entryTypeNames = map[byte]string{
+	entryFile:     "file",
+	entryDir:      "dir",
+	entrySymlink:  "symlink",
+	entryHardlink: "hardlink",
+	entryCopy:     "copy",
+	entryChunks:   "chunked",
+	entryDeleted:  "deleted",
+}
+
+// newJSONListing describes the archive at path from its metadata.
+func newJSONListing(path string, meta archiveMeta) *jsonListing {
+	a := jsonArchive{
+		Path:       path,
+		ID:         meta.idString(),
+		Tool:       meta.tool,
+		Host:       meta.host,
+		Comment:    meta.comment,
+		Compressor: meta.exec,
+		FIPS:       meta.fips,
+	}
+	if !meta.created.IsZero() {
+		a.Created = &meta.created
+	}
+	if meta.hasTotals {
+		a.Entries, a.Size = &meta.entries, &meta.totalSize
+	}
+	if meta.dictID != nil {
+		a.Dictionary = hex.EncodeToString(meta.dictID)
+	}
+	if meta.basePath != "" {
+		a.Base = &jsonBase{meta.basePath, formatUUID(meta.baseID)}
+	}
+	return &jsonListing{Archive: a, Entries: []jsonEntry{}}
+}
+
+// jsonEntryOf converts an entry header from listArchive or testArchive.
+func jsonEntryOf(h entryHeader) jsonEntry {
+	e := jsonEntry{
+		Type:    entryTypeNames[h.typ],
+		Name:    h.name,
+		Link:    h.linkTarget,
+		Comment: h.comment,
+	}
+	if size, ok := h.listedSize(); ok {
+		e.Size = size
+	}
+	if h.sum != nil { // files and copies
+		e.SHA256 = hex.EncodeToString(h.sum)
+	}
+	if h.hasMode {
+		e.Mode = fmt.Sprintf("%04o", h.mode)
+	}
+	if !h.mtime.IsZero() {
+		e.Mtime = &h.mtime
+	}
+	if h.hasMethod {
+		e.Stored = &h.stored
+		if h.typ == entryFile || h.typ == entryChunks {
+			e.Method = methodName(h.method)
+			if h.contentSize() > 0 {
+				ratio := math.Round(1e4*float64(h.stored)/float64(h.contentSize())) / 1e4
+				e.Ratio = &ratio
+			}
+		}
+	}
+	if h.filter.kind != filterNone {
+		e.Filter = h.filter.String()
+	}
+	if h.hasOwner {
+		e.UID, e.GID = &h.uid, &h.gid
+	}
+	return e
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ---------------------- Key derivation -----------------------------
+//
+// Every key slot of a v2 archive (keyslots.go) records how its key was
+// derived, so the KDF can change (and get stronger) without breaking old
+// archives:
+//
+//   [1 byte algorithm][1 byte salt length][salt][2 bytes params length][params]
+//
+// params holds the algorithm specific cost parameters.
+
+// KDF algorithms.
+const (
+	// kdfSHA256 is SHA-256(salt || password). v1 archives use it without
+	// a salt. It is fast and therefore weak against brute force; new
+	// archives no longer use it.
+	kdfSHA256 byte = 0
+
+	// kdfArgon2id is Argon2id (argon2.go) with params
+	// [4 bytes passes][4 bytes memory in KiB][1 byte lanes].
+	kdfArgon2id byte = 1
+
+	// kdfScrypt is scrypt (scrypt.go) with params
+	// [1 byte log2 N][4 bytes r][4 bytes p].
+	kdfScrypt byte = 2
+
+	// kdfPBKDF2 is PBKDF2-HMAC-SHA256 (crypto/pbkdf2) with params
+	// [4 bytes iterations]. Not memory-hard, but it is all standard
+	// library and FIPS 140 approved.
+	kdfPBKDF2 byte = 3
+)
+
+var kdfNames = map[byte]string{
+	kdfSHA256:   "sha256",
+	kdfArgon2id: "argon2id",
+	kdfScrypt:   "scrypt",
+	kdfPBKDF2:   "pbkdf2",
+}
+
+// Argon2id cost for new archives unless overridden, the second
+// recommendation of RFC 9106: 3 passes over 64 MiB in 4 lanes.
+const (
+	defaultArgonTime    = 3
+	defaultArgonMemory  = 64 << 10 // KiB
+	defaultArgonThreads = 4
+
+	maxArgonTime   = 1 << 10
+	maxArgonMemory = 4 << 20 // KiB; archives asking for more are refused
+)
+
+// scrypt cost for new archives unless overridden: N = 2^17, r = 8, p = 1,
+// which takes 128 MiB.
+const (
+	defaultScryptLogN = 17
+	defaultScryptR    = 8
+
+	maxScryptLogN = 22 // 4 GiB at r = 8
+	maxScryptP    = 1 << 10
+)
+
+// PBKDF2 iterations for new archives, OWASP's recommendation for
+// PBKDF2-HMAC-SHA256; fewer are refused when creating.
+const (
+	minPBKDF2Iter = 600_000
+	maxPBKDF2Iter = 1 << 28
+)
+
+// kdfOptions tune the key derivation of new archives (0 = default).
+type kdfOptions struct {
+	alg    byte   // kdfArgon2id, kdfScrypt or kdfPBKDF2
+	time   uint32 // Argon2id passes, scrypt p, PBKDF2 iterations
+	memory uint32 // KiB; scrypt rounds it down to a power of two N
+}
+
+// parseKDF looks up a KDF for new archives by name.
+func parseKDF(name string) (byte, error) {
+	switch name {
+	case "", "argon2id":
+		return kdfArgon2id, nil
+	case "scrypt":
+		return kdfScrypt, nil
+	case "pbkdf2":
+		return kdfPBKDF2, nil
+	}
+	return 0, fmt.Errorf("unknown key derivation %q (available: argon2id, scrypt, pbkdf2)", name)
+}
+
+// saltSize is the salt length used for new archives.
+const saltSize = 16
+
+// kdfParams describes the key derivation of one archive.
+type kdfParams struct {
+	alg    byte
+	salt   []byte
+	params []byte
+}
+
+// newKDFParams returns the KDF settings for a new archive with a fresh salt.
+func newKDFParams(opts kdfOptions) (kdfParams, error) {
+	k := kdfParams{alg: opts.alg, salt: make([]byte, saltSize)}
+	if _, err := rand.Read(k.salt); err != nil {
+		return k, err
+	}
+	switch k.alg {
+	case kdfScrypt:
+		return k, k.setScryptParams(opts)
+	case kdfPBKDF2:
+		iter := max(opts.time, minPBKDF2Iter)
+		if opts.memory != 0 {
+			return k, errors.New("PBKDF2 does not use memory; -kdf-memory does not apply")
+		}
+		if opts.time != 0 && opts.time < minPBKDF2Iter || iter > maxPBKDF2Iter {
+			return k, fmt.Errorf("PBKDF2 iterations out of range (%d to %d)", minPBKDF2Iter, maxPBKDF2Iter)
+		}
+		k.params = binary.LittleEndian.AppendUint32(nil, iter)
+		return k, nil
+	}
+	k.alg = kdfArgon2id
+	t, m := opts.time, opts.memory
+	if t == 0 {
+		t = defaultArgonTime
+	}
+	if m == 0 {
+		m = defaultArgonMemory
+	}
+	if t > maxArgonTime || m < 8*defaultArgonThreads || m > maxArgonMemory {
+		return k, fmt.Errorf("Argon2id cost out of range (1-%d passes, %d KiB to %d GiB)",
+			maxArgonTime, 8*defaultArgonThreads, maxArgonMemory>>20)
+	}
+	k.params = binary.LittleEndian.AppendUint32(nil, t)
+	k.params = binary.LittleEndian.AppendUint32(k.params, m)
+	k.params = append(k.params, defaultArgonThreads)
+	return k, nil
+}
+
+// setScryptParams picks N, r and p from opts.
+func (k *kdfParams) setScryptParams(opts kdfOptions) error {
+	logN, p := uint8(defaultScryptLogN), max(opts.time, 1)
+	if opts.memory != 0 {
+		// 128*r bytes per block, N blocks
+		logN = 0
+		for blocks := uint64(opts.memory) << 10 / (128 * defaultScryptR); blocks > 1; blocks >>= 1 {
+			logN++
+		}
+	}
+	if logN < 1 || logN > maxScryptLogN || p > maxScryptP {
+		return fmt.Errorf("scrypt cost out of range (p up to %d, %d KiB to %d GiB)",
+			maxScryptP, 2*128*defaultScryptR>>10, (128*defaultScryptR<<maxScryptLogN)>>30)
+	}
+	k.params = append([]byte{logN}, binary.LittleEndian.AppendUint32(nil, defaultScryptR)...)
+	k.params = binary.LittleEndian.AppendUint32(k.params, p)
+	return nil
+}
+
+// scryptParams decodes and checks the scrypt cost parameters.
+func (k kdfParams) scryptParams() (logN uint8, r, p uint32, err error) {
+	if len(k.params) != 9 {
+		return 0, 0, 0, errors.New("corrupt scrypt parameters")
+	}
+	logN = k.params[0]
+	r = binary.LittleEndian.Uint32(k.params[1:5])
+	p = binary.LittleEndian.Uint32(k.params[5:9])
+	if logN < 1 || r == 0 || p == 0 || p > maxScryptP || uint64(r)<<logN > uint64(defaultScryptR)<<maxScryptLogN {
+		return 0, 0, 0, fmt.Errorf("unsupported scrypt parameters (N=2^%d, r=%d, p=%d)", logN, r, p)
+	}
+	return logN, r, p, nil
+}
+
+// pbkdf2Iter decodes and checks the PBKDF2 iteration count.
+func (k kdfParams) pbkdf2Iter() (uint32, error) {
+	if len(k.params) != 4 {
+		return 0, errors.New("corrupt PBKDF2 parameters")
+	}
+	iter := binary.LittleEndian.Uint32(k.params)
+	if iter == 0 || iter > maxPBKDF2Iter {
+		return 0, fmt.Errorf("unsupported PBKDF2 iteration count %d", iter)
+	}
+	return iter, nil
+}
+
+// argon2Params decodes and checks the Argon2id cost parameters.
+func (k kdfParams) argon2Params() (time, memory uint32, threads uint8, err error) {
+	if len(k.params) != 9 {
+		return 0, 0, 0, errors.New("corrupt Argon2id parameters")
+	}
+	time = binary.LittleEndian.Uint32(k.params[0:4])
+	memory = binary.LittleEndian.Uint32(k.params[4:8])
+	threads = k.params[8]
+	if time == 0 || time > maxArgonTime || threads == 0 || memory < 8*uint32(threads) || memory > maxArgonMemory {
+		return 0, 0, 0, fmt.Errorf("unsupported Argon2id parameters (t=%d, m=%d KiB, p=%d)", time, memory, threads)
+	}
+	return time, memory, threads, nil
+}
+
+// deriveKey turns the password into a 32 byte key. Copies of the password
+// made on the way are wiped; wiping the key is up to the caller.
+func (k kdfParams) deriveKey(password string) ([]byte, error) {
+	switch k.alg {
+	case kdfSHA256:
+		in := append(append([]byte(nil), k.salt...), password...)
+		defer clear(in)
+		sum := sha256.Sum256(in)
+		return sum[:], nil
+	case kdfArgon2id:
+		t, m, p, err := k.argon2Params()
+		if err != nil {
+			return nil, err
+		}
+		pw := []byte(password)
+		defer clear(pw)
+		return argon2idKey(pw, k.salt, t, m, p, 32), nil
+	case kdfScrypt:
+		logN, r, p, err := k.scryptParams()
+		if err != nil {
+			return nil, err
+		}
+		pw := []byte(password)
+		defer clear(pw)
+		return scryptKey(pw, k.salt, logN, r, p, 32)
+	case kdfPBKDF2:
+		iter, err := k.pbkdf2Iter()
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(sha256.New, password, k.salt, int(iter), 32)
+	}
+	return nil, fmt.Errorf("unsupported key derivation algorithm %d", k.alg)
+}
+
+// weakness describes why the parameters are considered weak, or "" if not.
+func (k kdfParams) weakness() string {
+	switch {
+	case k.alg == kdfSHA256 && len(k.salt) == 0:
+		return "key is an unsalted SHA-256 of the password"
+	case k.alg == kdfSHA256:
+		return "key is a single salted SHA-256 of the password (no work factor)"
+	case len(k.salt) < 8:
+		return "salt is shorter than 8 bytes"
+	case k.alg == kdfArgon2id:
+		if _, m, _, err := k.argon2Params(); err == nil && m < 8<<10 {
+			return "Argon2id uses less than 8 MiB of memory"
+		}
+	case k.alg == kdfScrypt:
+		if logN, r, _, err := k.scryptParams(); err == nil && uint64(r)<<logN*128 < 8<<20 {
+			return "scrypt uses less than 8 MiB of memory"
+		}
+	case k.alg == kdfPBKDF2:
+		if iter, err := k.pbkdf2Iter(); err == nil && iter < minPBKDF2Iter {
+			return fmt.Sprintf("PBKDF2 uses only %d iterations", iter)
+		}
+	}
+	return ""
+}
+
+func (k kdfParams) String() string {
+	name, ok := kdfNames[k.alg]
+	if !ok {
+		name = fmt.Sprintf("kdf-%d", k.alg)
+	}
+	if k.alg == kdfArgon2id {
+		if t, m, p, err := k.argon2Params(); err == nil {
+			name += fmt.Sprintf(" (t=%d, m=%d KiB, p=%d)", t, m, p)
+		}
+	}
+	if k.alg == kdfScrypt {
+		if logN, r, p, err := k.scryptParams(); err == nil {
+			name += fmt.Sprintf(" (N=2^%d, r=%d, p=%d)", logN, r, p)
+		}
+	}
+	if k.alg == kdfPBKDF2 {
+		if iter, err := k.pbkdf2Iter(); err == nil {
+			name += fmt.Sprintf(" (%d iterations)", iter)
+		}
+	}
+	return name
+}
+
+func (k kdfParams) encode() []byte {
+	b := []byte{k.alg, byte(len(k.salt))}
+	b = append(b, k.salt...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(k.params)))
+	return append(b, k.params...)
+}
+
+func readKDFParams(r io.Reader) (kdfParams, error) {
+	var k kdfParams
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return k, err
+	}
+	k.alg = hdr[0]
+	k.salt = make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, k.salt); err != nil {
+		return k, err
+	}
+	var plen uint16
+	if err := binary.Read(r, binary.LittleEndian, &plen); err != nil {
+		return k, err
+	}
+	if plen > 1024 {
+		return k, errors.New("corrupt KDF parameters")
+	}
+	k.params = make([]byte, plen)
+	if _, err := io.ReadFull(r, k.params); err != nil {
+		return k, err
+	}
+	return k, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ---------------------- OS keychain --------------------------------
+//
+// With -use-keychain the password of an archive is kept in the operating
+// system's credential store - the macOS Keychain, the Windows Credential
+// Manager or a Secret Service provider such as GNOME Keyring or KWallet
+// (keychain_*.go) - under the archive's UUID, which v2 archives carry in
+// their plain header. Batch jobs then need no password in scripts: the
+// password is stored once (when creating, or the first time an archive
+// is opened) and looked up from then on.
+
+// keychainService names ghzip's entries in the credential store.
+const keychainService = "ghzip"
+
+// errNotInKeychain is returned by keychainLookup for unknown archives.
+var errNotInKeychain = errors.New("no password stored in the keychain")
+
+// keychainLabel describes the entry of an archive to the user.
+func keychainLabel(id string) string {
+	return "ghzip archive " + id
+}
+
+// archiveID returns the UUID of the v2 archive at path, read from its
+// plain header.
+func archiveID(path string) (string, error) {
+	sf, err := openSlotFile(path, false)
+	if err != nil {
+		return "", fmt.Errorf("-use-keychain: %w", err)
+	}
+	defer sf.Close()
+	return formatUUID(sf.id), nil
+}
+
+// rememberPassword stores password in the keychain for the archive at
+// path, whose ID is looked up unless given. Failing to is only a warning;
+// the archive itself is fine.
+func rememberPassword(path, id, password string) {
+	var err error
+	if id == "" {
+		id, err = archiveID(path)
+	}
+	if err == nil {
+		err = keychainStore(id, password)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+		return
+	}
+	fmt.Printf("Password stored in the keychain as %q.\n", keychainLabel(id))
+}
@@ -0,0 +1,42 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The macOS Keychain through security(1). The password is handed over as
+// hex on its standard input ("security -i"), not as an argument that ps
+// would show.
+
+func keychainLookup(id string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", id, "-w").Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && ee.ExitCode() == 44 { // errSecItemNotFound
+			return "", errNotInKeychain
+		}
+		return "", fmt.Errorf("keychain: %w", err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keychainStore(id, password string) error {
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -l \"%s\" -X %s\n",
+		keychainService, id, keychainLabel(id), hex.EncodeToString([]byte(password))))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("keychain: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	// "security -i" reports failed commands only in its output
+	if got, err := keychainLookup(id); err != nil || got != password {
+		return fmt.Errorf("keychain: storing the password failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
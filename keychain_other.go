@@ -0,0 +1,45 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The Secret Service (GNOME Keyring, KWallet, KeePassXC, ...) through
+// secret-tool(1) from libsecret. It reads the password to store from its
+// standard input, so it never shows up in ps.
+
+func keychainLookup(id string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keychainService, "archive", id).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) == 0 {
+			return "", errNotInKeychain
+		}
+		return "", secretToolError(err)
+	}
+	return string(out), nil
+}
+
+func keychainStore(id, password string) error {
+	cmd := exec.Command("secret-tool", "store", "--label="+keychainLabel(id), "service", keychainService, "archive", id)
+	cmd.Stdin = strings.NewReader(password)
+	if _, err := cmd.Output(); err != nil {
+		return secretToolError(err)
+	}
+	return nil
+}
+
+func secretToolError(err error) error {
+	var ee *exec.ExitError
+	if errors.Is(err, exec.ErrNotFound) {
+		return errors.New("keychain: secret-tool not found (install libsecret-tools or the like)")
+	} else if errors.As(err, &ee) {
+		return fmt.Errorf("keychain: %s", strings.TrimSpace(string(ee.Stderr)))
+	}
+	return fmt.Errorf("keychain: %w", err)
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ---------------------- Key slots ---------------------------------
+//
+// v2 archives are encrypted with a random master key. The header holds a
+// table of fixed-size key slots, LUKS style; each used slot wraps the
+// master key with a key derived from one password or key file:
+//
+//   [1 byte kind][KDF algorithm, salt and parameters][nonce][wrapped key]
+//
+// (for an X25519 recipient, recipients.go, the ephemeral public key takes
+// the place of the KDF, for a FIDO2 token, fido2.go, its credential ID and
+// salt), zero padded to keySlotSize. The wrapped key is
+// the master key sealed with the archive's cipher under the derived key,
+// with the fixed header (magic, version, cipher, slot count, archive ID)
+// as additional data. Any slot opens the archive. Because slots have a
+// fixed size and are left out of what the metadata and blocks
+// authenticate, they can be added, replaced or cleared in place without
+// touching the rest of the archive.
+
+const (
+	keySlotSize     = 256
+	defaultKeySlots = 8
+	maxKeySlots     = 32
+
+	masterKeySize = 32
+
+	// maxKeyfileSize bounds key files; they are secrets, not data.
+	maxKeyfileSize = 1 << 20
+)
+
+// Key slot kinds.
+const (
+	slotEmpty    byte = 0
+	slotPassword byte = 1
+	slotKeyfile  byte = 2
+	slotRecovery byte = 3 // a printable random key, see newRecoveryKey
+	slotX25519   byte = 4 // a public key, see newRecipientSlot
+	slotFIDO2    byte = 5 // a security key, see newFIDO2Slot
+)
+
+var slotKindNames = map[byte]string{
+	slotEmpty:    "empty",
+	slotPassword: "password",
+	slotKeyfile:  "key file",
+	slotRecovery: "recovery key",
+	slotX25519:   "x25519 recipient",
+	slotFIDO2:    "fido2 token",
+}
+
+// keySlot is one entry of the key slot table.
+type keySlot struct {
+	kind      byte
+	kdf       kdfParams
+	ephemeral []byte // X25519 public key (slotX25519 only, instead of kdf)
+	credID    []byte // FIDO2 credential ID and hmac-secret salt
+	salt      []byte // (slotFIDO2 only, instead of kdf)
+	nonce     []byte
+	wrapped   []byte
+}
+
+// newKeySlot derives a key from secret with fresh KDF parameters and
+// wraps master with it.
+func newKeySlot(kind byte, secret string, opts kdfOptions, cipherID byte, master, aad []byte) (keySlot, error) {
+	s := keySlot{kind: kind}
+	var err error
+	if s.kdf, err = newKDFParams(opts); err != nil {
+		return s, err
+	}
+	kek, err := s.kdf.deriveKey(secret)
+	if err != nil {
+		return s, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return s, err
+	}
+	s.nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.nonce); err != nil {
+		return s, err
+	}
+	s.wrapped = aead.Seal(nil, s.nonce, master, aad)
+	if len(s.encode()) > keySlotSize {
+		return s, fmt.Errorf("key slot does not fit in %d bytes", keySlotSize)
+	}
+	return s, nil
+}
+
+// unwrap returns the master key if secret opens the slot.
+func (s keySlot) unwrap(secret string, cipherID byte, aad []byte) ([]byte, error) {
+	kek, err := s.kdf.deriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, s.nonce, s.wrapped, aad)
+}
+
+func (s keySlot) encode() []byte {
+	if s.kind == slotEmpty {
+		return make([]byte, keySlotSize)
+	}
+	b := []byte{s.kind}
+	switch s.kind {
+	case slotX25519:
+		b = append(b, s.ephemeral...)
+	case slotFIDO2:
+		b = s.encodeFIDO2(b)
+	default:
+		b = append(b, s.kdf.encode()...)
+	}
+	b = append(b, s.nonce...)
+	b = append(b, s.wrapped...)
+	if len(b) < keySlotSize {
+		b = append(b, make([]byte, keySlotSize-len(b))...)
+	}
+	return b
+}
+
+func decodeKeySlot(b []byte, nonceSize int) (keySlot, error) {
+	s := keySlot{kind: b[0]}
+	if s.kind == slotEmpty {
+		return s, nil
+	}
+	if _, ok := slotKindNames[s.kind]; !ok {
+		return s, fmt.Errorf("unknown key slot kind %d", s.kind)
+	}
+	r := bytes.NewReader(b[1:])
+	switch s.kind {
+	case slotX25519:
+		s.ephemeral = make([]byte, x25519KeySize)
+		if _, err := io.ReadFull(r, s.ephemeral); err != nil {
+			return s, errors.New("corrupt key slot")
+		}
+	case slotFIDO2:
+		if err := s.decodeFIDO2(r); err != nil {
+			return s, err
+		}
+	default:
+		var err error
+		if s.kdf, err = readKDFParams(r); err != nil {
+			return s, errors.New("corrupt key slot")
+		}
+	}
+	s.nonce = make([]byte, nonceSize)
+	s.wrapped = make([]byte, masterKeySize+16)
+	if _, err := io.ReadFull(r, s.nonce); err != nil {
+		return s, errors.New("corrupt key slot")
+	}
+	if _, err := io.ReadFull(r, s.wrapped); err != nil {
+		return s, errors.New("corrupt key slot")
+	}
+	return s, nil
+}
+
+func (s keySlot) String() string {
+	if !s.hasKDF() {
+		return slotKindNames[s.kind]
+	}
+	return slotKindNames[s.kind] + ", " + s.kdf.String()
+}
+
+// hasKDF reports whether the slot's key is derived from a password or key
+// file, and so has KDF parameters.
+func (s keySlot) hasKDF() bool {
+	return s.kind != slotEmpty && s.kind != slotX25519 && s.kind != slotFIDO2
+}
+
+// slotTable is the plaintext front of a v2 header: everything up to the
+// metadata nonce.
+type slotTable struct {
+	cipher byte
+	id     [16]byte // the archive's UUID
+	slots  []keySlot
+	offset int64  // of the first slot, from the start of the archive
+	fixed  []byte // magic, version, cipher, slot count and ID
+}
+
+// readSlotTable reads the header up to and including the key slots from
+// r, positioned just past the version byte.
+func readSlotTable(r io.Reader) (slotTable, error) {
+	var t slotTable
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return t, err
+	}
+	t.cipher = hdr[0]
+	n := int(hdr[1])
+	if n == 0 || n > maxKeySlots {
+		return t, fmt.Errorf("corrupt header (%d key slots)", n)
+	}
+	aead, err := newAEAD(t.cipher, make([]byte, masterKeySize))
+	if err != nil {
+		return t, err
+	}
+	if _, err := io.ReadFull(r, t.id[:]); err != nil {
+		return t, err
+	}
+	t.fixed = append([]byte(magic), version, hdr[0], hdr[1])
+	t.fixed = append(t.fixed, t.id[:]...)
+	t.offset = int64(len(t.fixed))
+	buf := make([]byte, n*keySlotSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return t, err
+	}
+	t.slots = make([]keySlot, n)
+	for i := range t.slots {
+		if t.slots[i], err = decodeKeySlot(buf[i*keySlotSize:(i+1)*keySlotSize], aead.NonceSize()); err != nil {
+			return t, fmt.Errorf("key slot %d: %w", i, err)
+		}
+	}
+	return t, nil
+}
+
+// encodeSlots returns the slot table as stored in the header.
+func (t slotTable) encodeSlots() []byte {
+	var b []byte
+	for _, s := range t.slots {
+		b = append(b, s.encode()...)
+	}
+	return b
+}
+
+// unlock tries secret on every used slot and returns the master key and
+// the index of the slot that opened. Recovery key slots are only tried
+// when secret is written like a recovery key, recipient slots when it is
+// an identity file, and a FIDO2 slot with the token's answer for it.
+func (t slotTable) unlock(secret string) ([]byte, int, error) {
+	recovery, isRecovery := parseRecoveryKey(secret)
+	ids := parseIdentities(secret)
+	fidoSlot, fidoSecret, isFIDO := parseFIDO2Secret(secret)
+	for i, s := range t.slots {
+		if s.kind == slotEmpty || s.kind == slotRecovery && !isRecovery {
+			continue
+		}
+		if s.kind == slotFIDO2 {
+			if isFIDO && fidoSlot == i {
+				if key, err := s.unwrapFIDO2(fidoSecret, t.cipher, t.fixed); err == nil {
+					return key, i, nil
+				}
+			}
+			continue
+		}
+		if s.kind == slotX25519 {
+			for _, id := range ids {
+				if key, err := s.unwrapIdentity(id, t.cipher, t.fixed); err == nil {
+					return key, i, nil
+				}
+			}
+			continue
+		}
+		sec := secret
+		if s.kind == slotRecovery {
+			sec = recovery
+		}
+		if key, err := s.unwrap(sec, t.cipher, t.fixed); err == nil {
+			return key, i, nil
+		}
+	}
+	return nil, -1, errors.New("wrong password, key file or identity (no key slot opens)")
+}
+
+// recoveryKeySize is the number of random bytes in a recovery key.
+const recoveryKeySize = 32
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryKey returns a random 256-bit recovery key, printed as base32
+// in dash-separated groups of four characters so it can be written down.
+// It is entered like a password.
+func newRecoveryKey() (string, error) {
+	b := make([]byte, recoveryKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	enc := recoveryEncoding.EncodeToString(b)
+	var sb strings.Builder
+	for i := 0; i < len(enc); i += 4 {
+		if i > 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteString(enc[i:min(i+4, len(enc))])
+	}
+	return sb.String(), nil
+}
+
+// parseRecoveryKey returns the raw bytes of a recovery key as the slot
+// secret. Case, dashes and spaces do not matter.
+func parseRecoveryKey(s string) (string, bool) {
+	s = strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, s))
+	if len(s) != recoveryEncoding.EncodedLen(recoveryKeySize) {
+		return "", false
+	}
+	b, err := recoveryEncoding.DecodeString(s)
+	if err != nil || len(b) != recoveryKeySize {
+		return "", false
+	}
+	return string(b), true
+}
+
+// printRecoveryKey shows a new recovery key; it is not stored anywhere
+// else.
+func printRecoveryKey(key string) {
+	fmt.Println()
+	fmt.Println("Recovery key (shown only this once; it opens the archive like the password):")
+	fmt.Println()
+	fmt.Println("  " + key)
+	fmt.Println()
+}
+
+// readKeyfile reads a key file; its contents serve as the secret.
+func readKeyfile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxKeyfileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 || len(b) > maxKeyfileSize {
+		return "", fmt.Errorf("%s: key files must hold 1 byte to %d KiB", path, maxKeyfileSize>>10)
+	}
+	return string(b), nil
+}
+
+// slotFile is an archive opened for editing its key slots.
+type slotFile struct {
+	f          *os.File
+	path       string
+	start, end int64 // the archive within the file (after an SFX stub)
+	slotTable
+}
+
+// openSlotFile reads the slot table of the archive at path, opened for
+// writing if write is set.
+func openSlotFile(path string, write bool) (*slotFile, error) {
+	mode := os.O_RDONLY
+	if write {
+		mode = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	sf := &slotFile{f: f, path: path}
+	sf.start, sf.end, _, err = sfxRange(f)
+	if err == nil {
+		sf.slotTable, err = readSlotTableAt(io.NewSectionReader(f, sf.start, sf.end-sf.start))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// readSlotTableAt checks magic and version and reads the slot table.
+func readSlotTableAt(r io.Reader) (slotTable, error) {
+	m := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, m); err != nil {
+		return slotTable{}, err
+	}
+	if string(m[:len(magic)]) != magic {
+		return slotTable{}, fmt.Errorf("not a ghzip archive (magic mismatch)")
+	}
+	if m[len(magic)] != version {
+		return slotTable{}, fmt.Errorf("version %d archives have no key slots", m[len(magic)])
+	}
+	return readSlotTable(r)
+}
+
+// writeSlot stores slot i in the file and brings a recovery record up to
+// date. It returns a warning when a signature no longer matches.
+func (sf *slotFile) writeSlot(i int) (string, error) {
+	if _, err := sf.f.WriteAt(sf.slots[i].encode(), sf.start+sf.offset+int64(i)*keySlotSize); err != nil {
+		return "", err
+	}
+	sec := io.NewSectionReader(sf.f, sf.start, sf.end-sf.start)
+	size, err := archiveLength(sec, sf.end-sf.start)
+	if err != nil {
+		return "", err
+	}
+	var warning string
+	if size < sf.end-sf.start {
+		if sf.start > 0 {
+			warning = "the recovery record no longer matches the self-extracting archive"
+		} else if rh, err := findRecovery(sf.f, sf.end); err != nil {
+			return "", err
+		} else if err := writeRecovery(sf.f, rh); err != nil {
+			return "", err
+		}
+	}
+	_, rec, err := signatureLength(sec, size)
+	if err != nil {
+		return "", err
+	}
+	if _, serr := os.Stat(sf.path + ".sig"); rec != nil || serr == nil {
+		warning = "the archive signature no longer matches; sign it again if needed"
+	}
+	return warning, sf.f.Sync()
+}
+
+func (sf *slotFile) Close() error { return sf.f.Close() }
+
+// runSlot implements "ghzip slot list|add|remove".
+func runSlot(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "add" && args[0] != "remove") {
+		fmt.Println("usage: ghzip slot list <archive>")
+		fmt.Println("       ghzip slot add [-pass p | -keyfile f | -open-fido2] [-new-pass p | -new-keyfile f | -recipient key | -fido2 | -recovery-key] [-kdf name] [-fips] <archive>")
+		fmt.Println("       ghzip slot remove -slot n [-pass p | -keyfile f | -open-fido2] <archive>")
+		return
+	}
+	action := args[0]
+	cmd := flag.NewFlagSet("slot "+action, flag.ExitOnError)
+	inPath := cmd.String("in", "", "the `archive`")
+	pass := cmd.String("pass", "", "a password that opens the archive (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password that opens the archive from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password that opens the archive from `file`")
+	keyfilePath := cmd.String("keyfile", "", "a key `file` that opens the archive")
+	openFIDO2 := cmd.Bool("open-fido2", false, "open the archive with a FIDO2 security key")
+	newPass := cmd.String("new-pass", "", "password for the new slot (add; prompted if neither it nor -new-keyfile is given)")
+	newKeyfilePath := cmd.String("new-keyfile", "", "key `file` for the new slot (add)")
+	recipient := cmd.String("recipient", "", "X25519 public `key` (ghzip1...) for the new slot (add)")
+	fido2 := cmd.Bool("fido2", false, "register a FIDO2 security key for the new slot (add)")
+	fido2Device := cmd.String("fido2-device", "", "FIDO2 token `path` (default: the first one found)")
+	recoveryKey := cmd.Bool("recovery-key", false, "generate a printable recovery key for the new slot (add)")
+	kdfName := cmd.String("kdf", "argon2id", "key derivation for the new slot: argon2id, scrypt or pbkdf2 (add)")
+	slotNum := cmd.Int("slot", -1, "slot `number` to clear, see slot list (remove)")
+	fips := cmd.Bool("fips", false, "use approved algorithms only: the archive must be, and the new slot is, PBKDF2 based (add/remove)")
+	parseCommand(cmd, args[1:])
+	if *inPath == "" && cmd.NArg() == 1 {
+		*inPath = cmd.Arg(0)
+	}
+	if *inPath == "" {
+		fmt.Printf("slot %s requires -in <archive>\n", action)
+		return
+	}
+	if *fips && action != "list" {
+		if err := checkFIPSFlags(cmd); err != nil {
+			fail("%v", err)
+			return
+		}
+		applyFIPS(cmd)
+		if err := checkFIPSArchive(*inPath); err != nil {
+			fail("%v", err)
+			return
+		}
+	}
+	sf, err := openSlotFile(*inPath, action != "list")
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	defer sf.Close()
+
+	if action == "list" {
+		fmt.Printf("Key slots of %s (%s):\n", *inPath, cipherNames[sf.cipher])
+		for i, s := range sf.slots {
+			fmt.Printf("  %2d: %s\n", i, s)
+		}
+		return
+	}
+
+	var secret string
+	if *openFIDO2 {
+		secret, err = sf.fido2Unlock(*fido2Device)
+	} else if *pass == "" && *keyfilePath == "" {
+		if secret, err = readPassword(*passFd, *passFile); err == nil {
+			secret, err = slotSecret(secret, "", "Password: ")
+		}
+	} else {
+		secret, err = slotSecret(*pass, *keyfilePath, "Password: ")
+	}
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	master, _, err := sf.unlock(secret)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	defer clear(master)
+	var i int
+	var printed string // a new recovery key
+	switch action {
+	case "add":
+		alg, err := parseKDF(*kdfName)
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		kind := slotPassword
+		if *newKeyfilePath != "" {
+			kind = slotKeyfile
+		}
+		var newSecret string
+		var pub *ecdh.PublicKey
+		if *fido2 {
+			if *newPass != "" || *newKeyfilePath != "" || *recipient != "" || *recoveryKey {
+				fail("-fido2 conflicts with -new-pass, -new-keyfile, -recipient and -recovery-key")
+				return
+			}
+		} else if *recipient != "" {
+			if *newPass != "" || *newKeyfilePath != "" || *recoveryKey {
+				fail("-recipient conflicts with -new-pass, -new-keyfile and -recovery-key")
+				return
+			}
+			if pub, err = parseRecipient(*recipient); err != nil {
+				fail("%v", err)
+				return
+			}
+		} else if *recoveryKey {
+			if *newPass != "" || *newKeyfilePath != "" {
+				fail("-recovery-key conflicts with -new-pass and -new-keyfile")
+				return
+			}
+			kind = slotRecovery
+			if printed, err = newRecoveryKey(); err != nil {
+				fail("%v", err)
+				return
+			}
+			newSecret, _ = parseRecoveryKey(printed)
+		} else if newSecret, err = slotSecret(*newPass, *newKeyfilePath, "New password: "); err != nil {
+			fail("%v", err)
+			return
+		}
+		for i = 0; i < len(sf.slots) && sf.slots[i].kind != slotEmpty; i++ {
+		}
+		if i == len(sf.slots) {
+			fail("all %d key slots are in use; remove one first", len(sf.slots))
+			return
+		}
+		if *fido2 {
+			sf.slots[i], err = newFIDO2Slot(*fido2Device, sf.cipher, master, sf.fixed)
+		} else if pub != nil {
+			sf.slots[i], err = newRecipientSlot(pub, sf.cipher, master, sf.fixed)
+		} else {
+			sf.slots[i], err = newKeySlot(kind, newSecret, kdfOptions{alg: alg}, sf.cipher, master, sf.fixed)
+		}
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+	case "remove":
+		i = *slotNum
+		if i < 0 || i >= len(sf.slots) || sf.slots[i].kind == slotEmpty {
+			fail("-slot %d is not a used key slot (see ghzip slot list)", i)
+			return
+		}
+		used := 0
+		for _, s := range sf.slots {
+			if s.kind != slotEmpty {
+				used++
+			}
+		}
+		if used == 1 {
+			fail("slot %d is the only one left; the archive could no longer be opened", i)
+			return
+		}
+		sf.slots[i] = keySlot{}
+	}
+	warning, err := sf.writeSlot(i)
+	if err != nil {
+		fail("Writing key slot failed: %v", err)
+		return
+	}
+	if warning != "" {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if action == "add" {
+		if printed != "" {
+			printRecoveryKey(printed)
+		}
+		showOK("Key slot %d added to %s", i, *inPath)
+	} else {
+		showOK("Key slot %d cleared in %s", i, *inPath)
+	}
+}
+
+// slotSecret returns the contents of keyfilePath if given, else pass, else
+// a password read after prompt.
+func slotSecret(pass, keyfilePath, prompt string) (string, error) {
+	if keyfilePath != "" {
+		return readKeyfile(keyfilePath)
+	}
+	if pass == "" {
+		pass = promptPassword(prompt)
+	}
+	return pass, nil
+}
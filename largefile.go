@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ---------------------- Large files --------------------------------
+//
+// The payload already goes out block by block, so creating an archive
+// takes memory for the blocks in flight, not for the archive. What is
+// left is the file at hand: a file up to streamFileMin is read whole, as
+// its checksum and signature sniffing need it anyway, but a larger one is
+// streamed through the block writer. Its entry header carries the
+// SHA-256 in front of the data, so such a file is read twice: once for
+// the checksum and once into the archive. A file that changes in between
+// fails the archive rather than storing data that does not match its
+// checksum.
+
+// streamFileMin is the size above which files are streamed.
+const streamFileMin = 16 << 20
+
+// largeFile is a file that is streamed into the archive.
+type largeFile struct {
+	path string
+	size int64
+	sum  []byte
+	head []byte // the start, for knownCompressed
+
+	chunks []chunk      // see chunks.go
+	shared []chunkPlace // where chunks[i] was archived before, if it was
+}
+
+// scanLargeFile reads the file at path for its size, checksum and chunks.
+func scanLargeFile(path string) (*largeFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lf := &largeFile{path: path}
+	var head bytes.Buffer
+	sum := sha256.New()
+	chunks := newChunker()
+	// the first bytes also go to head
+	n, err := io.Copy(io.MultiWriter(sum, chunks, &limitedBuffer{&head, 64}), interruptReader{f})
+	if err != nil {
+		return nil, err
+	}
+	lf.size, lf.sum, lf.head, lf.chunks = n, sum.Sum(nil), head.Bytes(), chunks.finish()
+	return lf, nil
+}
+
+// copyTo writes the file to w, filtered by filt, showing progress from
+// base bytes of total on.
+func (lf *largeFile) copyTo(w io.Writer, filt entryFilter, name string, base, total int64) error {
+	if filt.kind != filterNone {
+		w = &filterWriter{w: w, f: filt}
+	}
+	return lf.reread(name, base, total, func(r io.Reader) error {
+		_, err := io.CopyN(w, r, lf.size)
+		return err
+	})
+}
+
+// reread opens the file again for write, which must read all of it from
+// r, and checks that it is what scanLargeFile saw.
+func (lf *largeFile) reread(name string, base, total int64, write func(r io.Reader) error) error {
+	f, err := os.Open(lf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	r := &progressReader{r: interruptReader{io.TeeReader(f, sum)}, prefix: "Packing", name: name, base: base, total: total}
+	changed := fmt.Errorf("%s changed while being archived", lf.path)
+	if err := write(r); err != nil {
+		if errors.Is(err, io.EOF) {
+			return changed
+		}
+		return err
+	}
+	if n, _ := f.Read(make([]byte, 1)); n > 0 || !bytes.Equal(sum.Sum(nil), lf.sum) {
+		return changed
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first n bytes written to it and drops the rest.
+type limitedBuffer struct {
+	b *bytes.Buffer
+	n int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := lb.n - lb.b.Len(); rest > 0 {
+		lb.b.Write(p[:min(rest, len(p))])
+	}
+	return len(p), nil
+}
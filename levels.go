@@ -0,0 +1,40 @@
+package main
+
+import "fmt"
+
+// ---------------------- Compression levels --------------------------
+//
+// A level (-1 ... -9, like gzip) picks the method, block size and search
+// effort together, trading speed for ratio: level 1 uses the single-pass
+// LZW coder, the middle levels LZ77 with growing hash chains and blocks,
+// and 8 and 9 block sorting. An explicit -method still overrides the
+// level's method.
+
+// preset is what a level selects.
+type preset struct {
+	method    byte
+	blockSize int
+	effort    int // match search effort, 1-9 (0 = the method's default)
+}
+
+// presets[0] applies when no level is given.
+var presets = [10]preset{
+	0: {methodHuffman, defaultBlockSize, 0},
+	1: {methodLZW, 1 << 20, 0},
+	2: {methodLZ77, 1 << 20, 1},
+	3: {methodLZ77, 2 << 20, 2},
+	4: {methodLZ77, 2 << 20, 3},
+	5: {methodLZ77, 4 << 20, 5},
+	6: {methodLZ77, 4 << 20, 6},
+	7: {methodLZ77, 8 << 20, 8},
+	8: {methodBWT, 4 << 20, 0},
+	9: {methodBWT, 8 << 20, 0},
+}
+
+// levelPreset returns the preset for level (0 = none given).
+func levelPreset(level int) (preset, error) {
+	if level < 0 || level >= len(presets) {
+		return preset{}, fmt.Errorf("compression level %d out of range (1-9)", level)
+	}
+	return presets[level], nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+
+// ---------------------- Resource limits -----------------------------
+//
+// An archive names the size of every entry, and a hostile one can claim
+// terabytes of data or millions of entries in a few kilobytes of blocks.
+// -max-extract-size caps the file data of the whole archive,
+// -max-entry-size that of any one entry and -max-entries their number;
+// they are checked as each entry header is parsed, before its data is
+// read or anything is allocated for it, and the first one exceeded stops
+// listing, testing or extracting with an error. Totals in the archive
+// header that exceed them are refused up front, so an archive that is
+// honest about its size fails before anything is extracted, and so does a
+// version 1 archive whose payload, decoded whole, exceeds -max-extract-size.
+// None is set by default.
+// Link targets are limited regardless, to the 64 KiB entry names are.
+// Copy entries (dedup.go) count with the size of the file they copy,
+// once that is known on extraction.
+
+// maxLinkTarget is the longest symlink or hard link target read.
+const maxLinkTarget = 1<<16 - 1
+
+// entryLimits counts the entries parsed from a payload against the
+// limits of readOptions.
+type entryLimits struct {
+	maxExtractSize, maxEntrySize, maxEntries int64 // 0 = no limit
+
+	entries int64
+	total   uint64 // file data, saturating at 1<<62
+}
+
+// check counts h and fails if it takes the archive over a limit.
+func (l *entryLimits) check(h entryHeader) error {
+	l.entries++
+	if l.maxEntries > 0 && l.entries > l.maxEntries {
+		return fmt.Errorf("the archive holds more than -max-entries %d entries", l.maxEntries)
+	}
+	if h.typ != entryFile && h.typ != entryChunks {
+		return nil
+	}
+	return l.add(h.name, h.contentSize())
+}
+
+// add counts size bytes of file data for the entry named name.
+func (l *entryLimits) add(name string, size uint64) error {
+	if l.maxEntrySize > 0 && size > uint64(l.maxEntrySize) {
+		return fmt.Errorf("%s: %d bytes, more than -max-entry-size %d", name, size, l.maxEntrySize)
+	}
+	l.total = min(l.total+min(size, 1<<62), 1<<62)
+	if l.maxExtractSize > 0 && l.total > uint64(l.maxExtractSize) {
+		return fmt.Errorf("the archive holds more than -max-extract-size %d bytes (at %s)", l.maxExtractSize, name)
+	}
+	return nil
+}
+
+// checkTotals refuses an archive whose header totals exceed the limits.
+func (l *entryLimits) checkTotals(m archiveMeta) error {
+	switch {
+	case !m.hasTotals:
+	case l.maxEntries > 0 && m.entries > uint64(l.maxEntries):
+		return fmt.Errorf("the archive holds %d entries, more than -max-entries %d", m.entries, l.maxEntries)
+	case l.maxExtractSize > 0 && m.totalSize > uint64(l.maxExtractSize):
+		return fmt.Errorf("the archive holds %d bytes, more than -max-extract-size %d", m.totalSize, l.maxExtractSize)
+	}
+	return nil
+}
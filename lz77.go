@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ---------------------- LZ77 + Huffman (method lz77) ----------------
+//
+// The block is parsed into sequences of [literal run][match], where a match
+// copies length bytes from distance bytes back. The parse is split into
+// three byte streams that are each coded with the canonical Huffman coder:
+//
+//   literals  the literal bytes
+//   lengths   per sequence: uvarint literal run, uvarint match length code
+//             (0 = no match, otherwise length-lzMinMatch+1)
+//   dists     per match: uvarint distance
+//
+// Method data: [4 bytes sequence count] then per stream
+// [4 bytes raw length][4 bytes coded length][code lengths + bits].
+
+const (
+	lzMinMatch  = 4
+	lzWindow    = 1 << 20
+	lzHashBits  = 16
+	lzEffort    = 7   // default search effort: 64 candidates per position
+	lzGoodMatch = 258 // stop searching once a match is this long
+)
+
+func lzHash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - lzHashBits)
+}
+
+// lzMatcher finds matches with hash chains over 4-byte prefixes.
+type lzMatcher struct {
+	src  []byte
+	head []int32
+	prev []int32
+	pos  int // next position to insert
+	// chain is how many candidates find tries per position
+	chain int
+}
+
+func newLZMatcher(src []byte, chain int) *lzMatcher {
+	m := &lzMatcher{src: src, head: make([]int32, 1<<lzHashBits), prev: make([]int32, len(src)), chain: chain}
+	for i := range m.head {
+		m.head[i] = -1
+	}
+	return m
+}
+
+// advance adds every position before end to the hash chains.
+func (m *lzMatcher) advance(end int) {
+	for ; m.pos < end; m.pos++ {
+		if m.pos+lzMinMatch > len(m.src) {
+			continue
+		}
+		h := lzHash(m.src[m.pos:])
+		m.prev[m.pos] = m.head[h]
+		m.head[h] = int32(m.pos)
+	}
+}
+
+// find returns the longest earlier match for position i; positions up to
+// i must have been added with advance.
+func (m *lzMatcher) find(i int) (length, dist int) {
+	if i+lzMinMatch > len(m.src) {
+		return 0, 0
+	}
+	src := m.src
+	cand := m.head[lzHash(src[i:])]
+	for chain := 0; cand >= 0 && chain < m.chain; chain++ {
+		j := int(cand)
+		if i-j > lzWindow {
+			break
+		}
+		if src[j+length] == src[i+length] || length == 0 {
+			n := 0
+			for i+n < len(src) && src[j+n] == src[i+n] {
+				n++
+			}
+			if n > length {
+				length, dist = n, i-j
+				if n >= lzGoodMatch || i+n == len(src) {
+					break
+				}
+			}
+		}
+		cand = m.prev[j]
+	}
+	if length < lzMinMatch {
+		return 0, 0
+	}
+	return length, dist
+}
+
+func lz77Encode(raw []byte) ([]byte, error) {
+	return lz77EncodeDict(raw, nil, lzEffort)
+}
+
+// lz77EncodeDict parses with hash chains of 2^(effort-1) candidates, so
+// effort 1 takes the first match found and 9 tries 256. Matches may reach
+// back into dict, which the decoder must supply as well.
+func lz77EncodeDict(raw, dict []byte, effort int) ([]byte, error) {
+	if effort == 0 {
+		effort = lzEffort
+	}
+	var lits, lens, dists []byte
+	var seqs uint32
+	src := raw
+	if len(dict) > 0 {
+		src = append(append(make([]byte, 0, len(dict)+len(raw)), dict...), raw...)
+	}
+	m := newLZMatcher(src, 1<<(effort-1))
+	start := len(dict) // start of the pending literal run
+	for i := start; i < len(src); {
+		m.advance(i)
+		length, dist := m.find(i)
+		// lazy matching: prefer a longer match starting one byte later
+		if length > 0 && length < lzGoodMatch && i+1 < len(src) {
+			m.advance(i + 1)
+			if l2, d2 := m.find(i + 1); l2 > length+1 {
+				i++
+				length, dist = l2, d2
+			}
+		}
+		if length == 0 {
+			i++
+			continue
+		}
+		lits = append(lits, src[start:i]...)
+		lens = binary.AppendUvarint(lens, uint64(i-start))
+		lens = binary.AppendUvarint(lens, uint64(length-lzMinMatch+1))
+		dists = binary.AppendUvarint(dists, uint64(dist))
+		seqs++
+		i += length
+		start = i
+	}
+	if start < len(src) || seqs == 0 {
+		lits = append(lits, src[start:]...)
+		lens = binary.AppendUvarint(lens, uint64(len(src)-start))
+		lens = binary.AppendUvarint(lens, 0)
+		seqs++
+	}
+	return appendStreams(binary.LittleEndian.AppendUint32(nil, seqs), lits, lens, dists)
+}
+
+func lz77Decode(data []byte, rawLen int) ([]byte, error) {
+	return lz77DecodeDict(data, rawLen, nil)
+}
+
+func lz77DecodeDict(data []byte, rawLen int, dict []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("corrupt lz77 block (truncated)")
+	}
+	seqs := binary.LittleEndian.Uint32(data)
+	streams, err := readStreams(data[4:], rawLen, 3)
+	if err != nil {
+		return nil, err
+	}
+	lits, lens, dists := streams[0], streams[1], streams[2]
+	limit := len(dict) + rawLen // matches may copy from dict
+	out := append(make([]byte, 0, limit), dict...)
+	bad := errors.New("corrupt lz77 block")
+	next := func(b *[]byte) (int, error) {
+		v, n := binary.Uvarint(*b)
+		if n <= 0 || v > uint64(limit) {
+			return 0, bad
+		}
+		*b = (*b)[n:]
+		return int(v), nil
+	}
+	for ; seqs > 0; seqs-- {
+		litLen, err := next(&lens)
+		if err != nil {
+			return nil, err
+		}
+		code, err := next(&lens)
+		if err != nil {
+			return nil, err
+		}
+		if litLen > len(lits) || len(out)+litLen > limit {
+			return nil, bad
+		}
+		out = append(out, lits[:litLen]...)
+		lits = lits[litLen:]
+		if code == 0 {
+			continue
+		}
+		dist, err := next(&dists)
+		if err != nil {
+			return nil, err
+		}
+		length := code + lzMinMatch - 1
+		if dist == 0 || dist > len(out) || len(out)+length > limit {
+			return nil, bad
+		}
+		for k := 0; k < length; k++ {
+			out = append(out, out[len(out)-dist])
+		}
+	}
+	if len(lits) != 0 || len(lens) != 0 || len(dists) != 0 || len(out) != limit {
+		return nil, bad
+	}
+	return out[len(dict):], nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import "errors"
+
+// ---------------------- LZW (method lzw) ----------------------------
+//
+// compress(1)-style LZW: codes 0-255 are the bytes, 256 clears the
+// dictionary and new strings get codes from 257 up. Codes start 9 bits
+// wide and grow a bit whenever the next free code no longer fits, up to
+// 16 bits; when all 65536 codes are in use the encoder sends a clear and
+// starts over. Method data is the code stream, packed least significant
+// bit first; the raw length in the block header ends it.
+
+const (
+	lzwClear    = 256
+	lzwFirst    = 257
+	lzwMinWidth = 9
+	lzwMaxWidth = 16
+	lzwMaxCodes = 1 << lzwMaxWidth
+)
+
+// lzwWidth returns the number of bits needed for codes below limit.
+func lzwWidth(limit int) uint {
+	w := uint(lzwMinWidth)
+	for limit > 1<<w && w < lzwMaxWidth {
+		w++
+	}
+	return w
+}
+
+type lzwBitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *lzwBitWriter) write(code int, width uint) {
+	w.acc |= uint64(code) << w.nbits
+	w.nbits += width
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *lzwBitWriter) finish() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+func lzwEncode(raw []byte) ([]byte, error) {
+	w := &lzwBitWriter{out: make([]byte, 0, len(raw)/2)}
+	if len(raw) == 0 {
+		return w.finish(), nil
+	}
+	dict := make(map[uint32]int32, lzwMaxCodes)
+	next := lzwFirst
+	cur := int32(raw[0])
+	for _, b := range raw[1:] {
+		key := uint32(cur)<<8 | uint32(b)
+		if code, ok := dict[key]; ok {
+			cur = code
+			continue
+		}
+		width := lzwWidth(next)
+		w.write(int(cur), width)
+		if next < lzwMaxCodes {
+			dict[key] = int32(next)
+			next++
+		} else {
+			w.write(lzwClear, width)
+			clear(dict)
+			next = lzwFirst
+		}
+		cur = int32(b)
+	}
+	w.write(int(cur), lzwWidth(next))
+	return w.finish(), nil
+}
+
+func lzwDecode(data []byte, rawLen int) ([]byte, error) {
+	prefix := make([]int32, lzwMaxCodes)
+	suffix := make([]byte, lzwMaxCodes)
+	length := make([]int32, lzwMaxCodes)
+	for c := 0; c < 256; c++ {
+		suffix[c], length[c] = byte(c), 1
+	}
+	out := make([]byte, rawLen)
+	pos := 0
+	var acc uint64
+	var nbits uint
+	next := lzwFirst
+	prev := int32(-1)
+	for pos < rawLen {
+		// the decoder adds each entry one code later than the encoder
+		width := lzwWidth(next + 1)
+		if prev < 0 {
+			width = lzwMinWidth
+		}
+		for nbits < width {
+			if len(data) == 0 {
+				return nil, errors.New("lzw data truncated")
+			}
+			acc |= uint64(data[0]) << nbits
+			data = data[1:]
+			nbits += 8
+		}
+		code := int32(acc & (1<<width - 1))
+		acc >>= width
+		nbits -= width
+		if code == lzwClear {
+			if prev < 0 {
+				return nil, errors.New("corrupt lzw data (misplaced clear)")
+			}
+			next, prev = lzwFirst, -1
+			continue
+		}
+		switch {
+		case int(code) < next && (code < 256 || code >= lzwFirst):
+			// known string
+		case int(code) == next && prev >= 0 && next < lzwMaxCodes:
+			// the string being defined: prev's string plus its first byte
+			length[code] = length[prev] + 1
+			prefix[code] = prev
+		default:
+			return nil, errors.New("corrupt lzw data (bad code)")
+		}
+		n := int(length[code])
+		if n > rawLen-pos {
+			return nil, errors.New("corrupt lzw data (too long)")
+		}
+		c := code
+		for i := pos + n - 1; i > pos; i-- {
+			out[i] = suffix[c]
+			c = prefix[c]
+		}
+		out[pos] = suffix[c]
+		first := out[pos]
+		if int(code) == next {
+			out[pos+n-1] = first
+		}
+		if prev >= 0 && next < lzwMaxCodes {
+			prefix[next], suffix[next] = prev, first
+			length[next] = length[prev] + 1
+			next++
+		}
+		pos += n
+		prev = code
+	}
+	return out, nil
+}
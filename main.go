@@ -1,5 +1,5 @@
 // ghzip_cli.go
-// Single-file Huffman + AES-GCM archiver with TUI-like CLI.
+// Huffman + AES-GCM archiver with TUI-like CLI (platform bits live in *_unix.go / *_other.go).
 // Only uses Go stdlib.
 
 package main
@@ -7,9 +7,10 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"container/heap"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -20,75 +21,757 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Archive format (high level):
 // [4 bytes magic] "GHA1"
-// [1 byte version] 1
+// [1 byte version] 2 (1 is still accepted when reading)
+// [1 byte cipher] (v2 only, see cipherAESGCM & co.)
+// [1 byte slot count] [key slots wrapping the master key] (v2 only, see keyslots.go)
+// [metadata nonce] [4 bytes metadata length uint32] [metadata ciphertext] (v2 only)
+// [payload blocks, block index and trailer] (v2, see blocks.go)
+//
+// v1 archives instead continue with one AES-GCM message:
 // [12 bytes nonce for AES-GCM]
 // [256 * 8 bytes frequency table (uint64 little-endian) ]
 // [8 bytes compressed ciphertext length (uint64)]
 // [ciphertext bytes (AES-GCM output; includes tag)]
 //
-// Decrypted compressed payload is a concatenation of file entries:
-// For each file:
+// Decrypted compressed payload is a concatenation of entries:
+// For each entry:
+//   [1 byte entry type] (v2 only; v1 archives hold regular files only)
 //   [2 bytes filename length uint16]
 //   [filename bytes]
+//   [2 bytes extension length uint16][extension records] (v2 only)
 //   [8 bytes original size uint64]
 //   [original file bytes]
+// Directory entries have size 0 and are recreated (even when empty) on extract.
+// Symlink entries store the link target as their data instead of following it.
+// Hardlink entries store the name of the earlier entry they share an inode with.
+// Copy entries store the name of an earlier file entry with the same contents.
+// Chunked entries store a file as chunk records, some naming earlier files.
+// Deleted entries, with no data, name what a differential archive removes.
+//
+// In v2 every entry header also carries an extension block between the
+// filename and the size: [2 bytes length uint16][records], see extOwner & co.
+
+// toolVersion is recorded in the metadata of every archive this build writes.
+const toolVersion = "ghzip/2.0.0"
 
 const magic = "GHA1"
-const version = 1
+const version = 2
+const versionV1 = 1
+
+// Entry types stored in front of each v2 payload entry.
+const (
+	entryFile     byte = 0
+	entryDir      byte = 1
+	entrySymlink  byte = 2
+	entryHardlink byte = 3
+	entryCopy     byte = 4 // see dedup.go
+	entryChunks   byte = 5 // see chunks.go
+	entryDeleted  byte = 6 // see base.go
+)
 
 func main() {
+	// Work stopped by Ctrl+C ends with its own exit code (interrupt.go),
+	// and diff and -t with the one their result gives
+	defer exitResult()
+	defer exitInterrupted()
+
+	// A self-extracting archive extracts itself instead of running normally
+	if exe, ok := selfArchive(); ok {
+		runSFX(exe, os.Args[1:])
+		return
+	}
+
+	// Subcommands
+	convert := false // "convert" is -c with a tar or zip archive as -in
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			convert = true
+			os.Args = append([]string{os.Args[0], "-c"}, os.Args[2:]...)
+		case "repair":
+			runRepair(os.Args[2:])
+			return
+		case "dict":
+			runDict(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "slot":
+			runSlot(os.Args[2:])
+			return
+		case "rekey":
+			runRekey(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "grep":
+			runGrep(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "z":
+			runZ(os.Args[2:])
+			return
+		case "unz":
+			runUnz(os.Args[2:])
+			return
+		}
+	}
+
 	// Flags for non-interactive use
 	createFlag := flag.Bool("c", false, "create archive (non-interactive)")
 	extractFlag := flag.Bool("x", false, "extract archive (non-interactive)")
 	listFlag := flag.Bool("l", false, "list archive contents (non-interactive)")
-	inPath := flag.String("in", "", "input path (for create) or archive (for extract/list)")
-	outPath := flag.String("out", "", "output archive (for create) or destination dir (for extract)")
-	pass := flag.String("pass", "", "password (optional; if empty you'll be prompted)")
-	flag.Parse()
+	testFlag := flag.Bool("t", false, "test the archive: decode every entry and check it against its checksum (non-interactive)")
+	dryRunFlag := flag.Bool("n", false, "dry run: list what would be archived or extracted, writing nothing (create/extract)")
+	appendFlag := flag.Bool("a", false, "append -in to the existing archive -out (non-interactive)")
+	replaceFlag := flag.Bool("replace", false, "with -a, drop the entries of the archive named like the files appended (-per-file archives)")
+	inPath := flag.String("in", "", "input path (for create) or archive (for extract/list); - reads stdin")
+	outPath := flag.String("out", "", "output archive (for create; - writes to stdout) or destination dir (for extract)")
+	pass := flag.String("pass", "", "password (optional; if empty you'll be prompted); visible to other users in ps, see -pass-fd, -pass-file and "+passwordEnv)
+	passFdFlag := flag.Int("pass-fd", -1, "read the password from the first line of file descriptor `n`, e.g. 3 with 3<<<\"$PW\"")
+	passFileFlag := flag.String("pass-file", "", "read the password from the first line of `file`")
+	ownerFlag := flag.Bool("owner", false, "record uid/gid of each entry (create)")
+	restoreOwnerFlag := flag.Bool("restore-owner", false, "restore recorded uid/gid on extract (requires root or CAP_CHOWN)")
+	sameOwnerFlag := flag.Bool("same-owner", false, "the same as -restore-owner, as GNU tar calls it (extract)")
+	unsafeLinksFlag := flag.Bool("allow-unsafe-links", false, "extract symlinks that are absolute or lead out of -out instead of skipping them (extract)")
+	commentFlag := flag.String("comment", "", "archive comment stored (encrypted) in the header (create)")
+	var entryComments multiFlag
+	flag.Var(&entryComments, "comment-file", "`name=text` comment for one entry (create, repeatable)")
+	filesFromFlag := flag.String("files-from", "", "archive the paths listed in `file`, one per line, instead of -in; - reads stdin (create)")
+	nullFlag := flag.Bool("0", false, "the -files-from list is NUL-separated, as from find -print0 (create)")
+	followSymlinksFlag := flag.Bool("follow-symlinks", false, "archive what symlinks point to, files and directories, instead of the links (create)")
+	skipSymlinksFlag := flag.Bool("skip-symlinks", false, "leave symlinks out (create)")
+	storeSymlinksFlag := flag.Bool("store-symlinks", false, "archive symlinks as links, the default (create)")
+	noDedupFlag := flag.Bool("no-dedup", false, "store files with the same contents in full each time instead of as copies (create)")
+	baseFlag := flag.String("base", "", "make a differential archive holding what changed since `archive` (create)")
+	var excludeFlags multiFlag
+	flag.Var(&excludeFlags, "exclude", "leave out files and directories matching `pattern`, e.g. 'node_modules/**', '*.o' or '.git/**' (create, repeatable)")
+	var prefilterFlags multiFlag
+	flag.Var(&prefilterFlags, "prefilter", "`pattern=filter` pre-filter for matching entries: delta, xor, or delta:N / xor:N with stride N, e.g. *.wav=delta:4 (create, repeatable)")
+	var filterFlags multiFlag
+	flag.Var(&filterFlags, "filter", "list only entries matching `glob`, as -files does (list, repeatable)")
+	jsonFlag := flag.Bool("json", false, "print the listing or test results as JSON on stdout (list/test)")
+	methodFlag := flag.String("method", "", "compression `method`: huffman (default), rle, range, adaptive, order1, lz77, lzw, bwt, deflate, store, zstd (-tags zstd) or exec:<command> (create)")
+	storeFlag := flag.Bool("store", false, "do not compress, only encrypt; same as -method store (create)")
+	levelFlag := flag.Int("level", 0, "compression `level` 1 (fastest) to 9 (smallest); sets method, block size and effort (create)")
+	var levelFlags [10]*bool
+	for n := 1; n <= 9; n++ {
+		levelFlags[n] = flag.Bool(strconv.Itoa(n), false, fmt.Sprintf("same as -level %d", n))
+	}
+	perFileFlag := flag.Bool("per-file", false, "compress each entry independently (non-solid) (create)")
+	recoveryFlag := flag.String("recovery", "", "append a recovery record of `pct` of the archive size, e.g. 5% (create)")
+	signFlag := flag.String("sign", "", "sign the archive with this Ed25519 private `keyfile` (PEM) (create)")
+	detachSigFlag := flag.Bool("detach-sig", false, "write the -sign signature to <archive>.sig instead of embedding it (create)")
+	verifySigFlag := flag.String("verify-sig", "", "verify the archive signature against this Ed25519 public `keyfile` (PEM) (extract/list)")
+	var filesFlags multiFlag
+	flag.Var(&filesFlags, "files", "extract or list only entries matching `pattern`, e.g. 'src/**/*.go' or README.md; a directory selects its contents (extract/list, repeatable)")
+	sortFlag := flag.String("sort", "", "sort the listing by `key`: name, size (largest first) or mtime (newest first) (list)")
+	verifyFlag := flag.Bool("verify", false, "read every extracted file back and check it against its recorded SHA-256 (extract)")
+	resumeFlag := flag.Bool("resume", false, "continue an interrupted extraction into -out at the first entry it did not finish (extract)")
+	stagingFlag := flag.Bool("staging", false, "extract into a temporary directory that becomes -out (new or empty) only once everything is written (extract)")
+	toStdoutFlag := flag.Bool("to-stdout", false, "write the contents of the (-files selected) files to stdout instead of extracting them (extract)")
+	var transformFlags multiFlag
+	flag.Var(&transformFlags, "transform", "rename entries by `rule`: old/=new/ replaces a name prefix, s/regexp/replacement/[gi] as in sed (extract, repeatable)")
+	jobsFlag := flag.Int("jobs", 0, "read up to `n` files ahead (create) or write up to n small files at once (extract); 0 as many as there are CPUs")
+	stripFlag := flag.Int("strip", 0, "drop the first `n` components of entry names, e.g. 1 extracts project/src/a.go as src/a.go (extract)")
+	noPermsFlag := flag.Bool("no-perms", false, "do not apply the recorded permissions (extract)")
+	noTimesFlag := flag.Bool("no-times", false, "do not apply the recorded modification times (extract)")
+	overwriteFlag := flag.Bool("overwrite", false, "replace files that exist already (extract)")
+	skipExistingFlag := flag.Bool("skip-existing", false, "keep files that exist already, leaving their entries out (extract)")
+	keepNewerFlag := flag.Bool("keep-newer", false, "replace files that exist already only if they are older than the archived copy (extract)")
+	freshenFlag := flag.Bool("freshen", false, "only replace files that exist already and are older than the archived copy, creating none (extract)")
+	caseCollisionsFlag := flag.String("case-collisions", collideError, "on case-insensitive file systems, what to do with entries whose names differ from earlier ones only by case: error, rename or skip (extract)")
+	renameExistingFlag := flag.Bool("rename-existing", false, "write entries whose file exists already as name.1, name.2, ... (extract; default: ask, or fail without a terminal)")
+	namesFlag := flag.String("names", nameNFC, "write entry names as `form`: nfc, nfd (macOS) or original bytes (extract)")
+	sfxFlag := flag.Bool("sfx", false, "create a self-extracting executable instead of a plain archive (create)")
+	sfxStubFlag := flag.String("sfx-stub", "", "goZip `binary` used as the extractor for -sfx, e.g. one built for another GOOS/GOARCH (default: this binary)")
+	keyfileFlag := flag.String("keyfile", "", "key `file` whose contents open the archive; creating, it gets a key slot next to -pass (if given)")
+	var recipientFlags multiFlag
+	flag.Var(&recipientFlags, "recipient", "encrypt for this X25519 public `key` (ghzip1..., from \"ghzip keygen\"), in a key slot of its own (create, repeatable)")
+	identityFlag := flag.String("identity", "", "open the archive with the secret key in this identity `file` from \"ghzip keygen\" (extract/list)")
+	fido2Flag := flag.Bool("fido2", false, "add a key slot for a FIDO2 security key (create) or open the archive with one (list/extract); needs libfido2's tools")
+	fido2DeviceFlag := flag.String("fido2-device", "", "FIDO2 token `path`, e.g. /dev/hidraw3 (default: the first one found)")
+	useKeychainFlag := flag.Bool("use-keychain", false, "keep the password in the OS keychain under the archive ID: store it (create) or look it up, storing it once the archive opened (list/extract)")
+	recoveryKeyFlag := flag.Bool("recovery-key", false, "also generate a printable recovery key that opens the archive; it is shown once (create)")
+	kdfFlag := flag.String("kdf", "argon2id", "derive the key from the password with `kdf`: argon2id, scrypt or pbkdf2 (create)")
+	kdfTimeFlag := flag.Uint("kdf-time", 0, "Argon2id passes (default 3), scrypt p (default 1) or PBKDF2 iterations (default 600000) for the password key (create)")
+	cipherFlag := flag.String("cipher", "aes-gcm", "encrypt with `cipher`: aes-gcm, aes-gcm-siv (nonce misuse resistant) or xchacha20 (XChaCha20-Poly1305) (create)")
+	kdfMemoryFlag := flag.String("kdf-memory", "", "key derivation memory `size`, e.g. 256M (create, default 64M for Argon2id, 128M for scrypt)")
+	maxMemoryFlag := flag.String("max-memory", "", "cap the memory used for compressing and decoding blocks at `size`, e.g. 512M")
+	maxExtractSizeFlag := flag.String("max-extract-size", "", "refuse archives holding more than `size` of file data, e.g. 10G (list/test/extract)")
+	maxEntrySizeFlag := flag.String("max-entry-size", "", "refuse archives holding a file larger than `size` (list/test/extract)")
+	maxEntriesFlag := flag.Int64("max-entries", 0, "refuse archives holding more than `n` entries (list/test/extract)")
+	allowExecFlag := flag.Bool("allow-exec", false, "let list/extract run the external compressor recorded by -method exec:... (list/extract)")
+	dictFlag := flag.String("dict", "", "shared compression dictionary `file` from \"ghzip dict train\"; needed again to list or extract")
+	fipsFlag := flag.Bool("fips", false, "use FIPS 140-3 approved algorithms only: AES-GCM and PBKDF2, no recipients or FIDO2; recorded in the archive (create) or required of it (list/extract)")
+	xattrsFlag := flag.Bool("xattrs", false, "record (create) or restore (extract) user.* and security.* extended attributes")
+	progressJSONFlag := flag.Bool("progress-json", false, "write progress as JSON lines (phase, file, bytes, total) to stderr or -progress-fd instead of drawing a bar (create/extract)")
+	progressFdFlag := flag.Int("progress-fd", 2, "file descriptor `n` for -progress-json")
+	parseCommand(flag.CommandLine, os.Args[1:])
 
 	// If any of create/extract/list provided, run non-interactive
-	if *createFlag || *extractFlag || *listFlag {
+	if *createFlag || *extractFlag || *listFlag || *testFlag || *appendFlag {
+		if *progressJSONFlag {
+			if err := openProgressEvents(*progressFdFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		inName := *inPath // as shown; -in - reads stdin into a temporary file
+		if *inPath == "-" {
+			if *filesFromFlag == "-" {
+				exitCode = 1
+				fail("-in - and -files-from - cannot both read stdin")
+				return
+			}
+			name := "stdin"
+			if !*createFlag && !*appendFlag {
+				name = "archive.gha"
+			}
+			path, dir, err := spoolStdin(name)
+			if err != nil {
+				exitCode = 1
+				fail("-in -: %v", err)
+				return
+			}
+			defer os.RemoveAll(dir)
+			*inPath = path
+		}
+		if *createFlag && *outPath == "-" {
+			if err := checkStdout(); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			toStderr()
+		}
+		if *dryRunFlag && !*createFlag && !*extractFlag {
+			exitCode = 1
+			fail("-n applies to -c and -x")
+			return
+		}
+		if *toStdoutFlag {
+			if !*extractFlag || *outPath != "" || *dryRunFlag || *stagingFlag {
+				exitCode = 1
+				fail("-to-stdout applies to -x, without -out, -n and -staging")
+				return
+			}
+			toStderr()
+		}
+		if len(filterFlags) > 0 && !*listFlag {
+			exitCode = 1
+			fail("-filter applies to -l; pre-filters for -c are -prefilter")
+			return
+		}
+		if *jsonFlag {
+			if !*listFlag && !*testFlag {
+				exitCode = 1
+				fail("-json applies to -l and -t")
+				return
+			}
+			toStderr()
+		}
+		archivePath := *inPath // the archive opened, if any
+		if *appendFlag {
+			archivePath = *outPath
+		}
+		if *fipsFlag {
+			if err := checkFIPSFlags(flag.CommandLine); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			applyFIPS(flag.CommandLine)
+			if !*createFlag {
+				if err := checkFIPSArchive(archivePath); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+			}
+		}
+		var dict []byte
+		if *dictFlag != "" {
+			var err error
+			if dict, err = loadDictionary(*dictFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		var maxMemory int64
+		if *maxMemoryFlag != "" {
+			var err error
+			if maxMemory, err = parseByteSize(*maxMemoryFlag); err != nil {
+				exitCode = 1
+				fail("-max-memory: %v", err)
+				return
+			}
+			debug.SetMemoryLimit(maxMemory)
+		}
+		ro := readOptions{dict: dict, allowExec: *allowExecFlag, maxMemory: maxMemory, maxEntries: *maxEntriesFlag}
+		if *maxEntriesFlag < 0 {
+			exitCode = 1
+			fail("-max-entries must not be negative")
+			return
+		}
+		if *maxExtractSizeFlag != "" {
+			var err error
+			if ro.maxExtractSize, err = parseByteSize(*maxExtractSizeFlag); err != nil {
+				exitCode = 1
+				fail("-max-extract-size: %v", err)
+				return
+			}
+		}
+		if *maxEntrySizeFlag != "" {
+			var err error
+			if ro.maxEntrySize, err = parseByteSize(*maxEntrySizeFlag); err != nil {
+				exitCode = 1
+				fail("-max-entry-size: %v", err)
+				return
+			}
+		}
 		pw := *pass
 		if pw == "" {
+			var err error
+			if pw, err = readPassword(*passFdFlag, *passFileFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		var keyfile string
+		if *keyfileFlag != "" {
+			var err error
+			if keyfile, err = readKeyfile(*keyfileFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		var recipients []*ecdh.PublicKey
+		for _, r := range recipientFlags {
+			pub, err := parseRecipient(r)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			recipients = append(recipients, pub)
+		}
+		var identity string
+		if *identityFlag != "" {
+			var err error
+			if identity, err = readKeyfile(*identityFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if parseIdentities(identity) == nil {
+				exitCode = 1
+				fail("%s: %v", *identityFlag, errNoIdentity)
+				return
+			}
+		}
+		// the archive ID whose password goes to the keychain once it opened
+		var keychainID string
+		if *useKeychainFlag && !*createFlag && keyfile == "" && identity == "" {
+			id, err := archiveID(archivePath)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if pw != "" {
+				keychainID = id
+			} else if pw, err = keychainLookup(id); errors.Is(err, errNotInKeychain) {
+				keychainID = id
+			} else if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		if *fido2Flag && !*createFlag {
+			var err error
+			if pw, err = fido2Unlock(archivePath, *fido2DeviceFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+		}
+		if pw == "" && keyfile == "" && identity == "" && (len(recipients) == 0 && !*fido2Flag || !*createFlag) && !(*dryRunFlag && *createFlag) {
+			if *filesFromFlag == "-" || inName == "-" {
+				exitCode = 1
+				fail("stdin is taken by the input; give the password with -pass-fd, -pass-file or %s", passwordEnv)
+				return
+			}
 			pw = promptPassword("Password: ")
 		}
-		if *createFlag {
-			if *inPath == "" || *outPath == "" {
-				fmt.Println("create requires -in <file-or-dir> and -out <archive>")
+		if *useKeychainFlag && *createFlag && pw == "" && !*dryRunFlag {
+			exitCode = 1
+			fail("-use-keychain stores a password; give one with -pass or at the prompt")
+			return
+		}
+		if !*createFlag {
+			if keyfile != "" {
+				pw = keyfile // a key file opens its slot like a password
+			}
+			if identity != "" {
+				pw = identity // and so does an identity file, see unlock
+			}
+		}
+		if *createFlag || *appendFlag {
+			if (*inPath == "") == (*filesFromFlag == "") || *outPath == "" {
+				exitCode = 1
+				fmt.Println("create and append require -in <file-or-dir> or -files-from <list>, and -out <archive>")
+				return
+			}
+			if convert && (*appendFlag || *extractFlag || *listFlag || *filesFromFlag != "") {
+				exitCode = 1
+				fail("convert takes a tar or zip archive as -in; -a, -x, -l and -files-from do not apply")
+				return
+			}
+			if *replaceFlag && !*appendFlag {
+				exitCode = 1
+				fail("-replace only applies to -a")
+				return
+			}
+			if *appendFlag && (*recoveryKeyFlag || *sfxFlag) {
+				exitCode = 1
+				fail("-recovery-key and -sfx only apply when creating (see \"ghzip slot add -recovery-key\")")
+				return
+			}
+			if *baseFlag != "" && (*appendFlag || *sfxFlag || convert || *dryRunFlag) {
+				exitCode = 1
+				fail("-base makes a new differential archive; -a, -sfx, convert and -n do not apply")
+				return
+			}
+			if *outPath == "-" && (*appendFlag || *sfxFlag || *signFlag != "" || *recoveryFlag != "" || *useKeychainFlag) {
+				exitCode = 1
+				fail("-out - streams the archive; -a, -sfx, -sign, -recovery and -use-keychain need an archive file")
+				return
+			}
+			comments, err := parseEntryComments(entryComments)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			filters, err := parseFilterRules(prefilterFlags)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			for _, p := range excludeFlags {
+				if err := checkGlob(p); err != nil {
+					exitCode = 1
+					fail("-exclude: %v", err)
+					return
+				}
+			}
+			symlinks, err := symlinkPolicy(*followSymlinksFlag, *skipSymlinksFlag, *storeSymlinksFlag)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if *jobsFlag < 0 {
+				exitCode = 1
+				fail("-jobs takes a number of files, 1 or more (0 for one per CPU)")
+				return
+			}
+			var list []string
+			if *filesFromFlag != "" {
+				if list, err = readFileList(*filesFromFlag, *nullFlag); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+			}
+			var imported []inputFile
+			if convert {
+				var done func() error
+				if imported, done, err = importArchive(*inPath, excludeFlags); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+				defer done()
+			}
+			kdf := kdfOptions{time: uint32(min(*kdfTimeFlag, 1<<31))}
+			if kdf.alg, err = parseKDF(*kdfFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			cipherID, err := parseCipher(*cipherFlag)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if *kdfMemoryFlag != "" {
+				m, err := parseByteSize(*kdfMemoryFlag)
+				if err != nil {
+					exitCode = 1
+					fail("-kdf-memory: %v", err)
+					return
+				}
+				kdf.memory = uint32(min(m>>10, 1<<31))
+			}
+			var recovery float64
+			if *recoveryFlag != "" {
+				if recovery, err = parseRecoveryPercent(*recoveryFlag); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+			}
+			input := inName
+			if list != nil {
+				input = fmt.Sprintf("%d path(s) from %s", len(list), *filesFromFlag)
+			}
+			if *appendFlag {
+				showBox("Appending to archive", fmt.Sprintf("Input: %s\nArchive: %s", input, *outPath))
+			} else {
+				showBox("Creating archive", fmt.Sprintf("Input: %s\nOutput: %s", input, *outPath))
+			}
+			opts := createOptions{
+				detachedSig:   *detachSigFlag,
+				owner:         *ownerFlag,
+				xattrs:        *xattrsFlag,
+				comment:       *commentFlag,
+				entryComments: comments,
+				filters:       filters,
+				exclude:       excludeFlags,
+				symlinks:      symlinks,
+				noDedup:       *noDedupFlag,
+				base:          *baseFlag,
+				list:          list,
+				imported:      imported,
+				perFile:       *perFileFlag,
+				replace:       *replaceFlag,
+				jobs:          *jobsFlag,
+				method:        *methodFlag,
+				level:         *levelFlag,
+				dict:          dict,
+				maxMemory:     maxMemory,
+				kdf:           kdf,
+				cipher:        cipherID,
+				keyfile:       keyfile,
+				recipients:    recipients,
+				fido2:         *fido2Flag,
+				fido2Device:   *fido2DeviceFlag,
+				fips:          *fipsFlag,
+				recovery:      recovery,
+			}
+			if *recoveryKeyFlag {
+				if opts.recoveryKey, err = newRecoveryKey(); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+			}
+			for n, set := range levelFlags {
+				if set != nil && *set {
+					opts.level = n
+				}
+			}
+			if *storeFlag {
+				if opts.method != "" && opts.method != "store" {
+					exitCode = 1
+					fail("-store conflicts with -method %s", opts.method)
+					return
+				}
+				opts.method = "store"
+			}
+			if *dryRunFlag {
+				if err := dryRunCreate(*inPath, *outPath, opts); err != nil {
+					exitCode = 1
+					fail("%v", err)
+				}
+				return
+			}
+			if *signFlag != "" {
+				if opts.signKey, err = loadSigningKey(*signFlag); err != nil {
+					exitCode = 1
+					fail("%v", err)
+					return
+				}
+			}
+			stop := catchInterrupts()
+			defer stop()
+			if *appendFlag {
+				if err = appendArchive(*inPath, *outPath, pw, opts); err != nil {
+					exitCode = 1
+					fail("Append failed: %v", err)
+					return
+				}
+				workDone()
+				if keychainID != "" {
+					rememberPassword(*outPath, keychainID, pw)
+				}
+				showOK("Appended to: %s", *outPath)
 				return
 			}
-			showBox("Creating archive", fmt.Sprintf("Input: %s\nOutput: %s", *inPath, *outPath))
-			if err := createArchive(*inPath, *outPath, pw, true); err != nil {
+			if *sfxFlag {
+				err = createSFX(*inPath, *outPath, *sfxStubFlag, pw, opts)
+			} else {
+				err = createArchive(*inPath, *outPath, pw, opts)
+			}
+			if err != nil {
+				exitCode = 1
 				fail("Create failed: %v", err)
+				return
+			} else {
+				workDone()
+				if opts.recoveryKey != "" {
+					printRecoveryKey(opts.recoveryKey)
+				}
+				if *useKeychainFlag {
+					rememberPassword(*outPath, "", pw)
+				}
 			}
 			showOK("Archive created: %s", *outPath)
 			return
 		}
 		if *listFlag {
 			if *inPath == "" {
+				exitCode = 2
 				fmt.Println("list requires -in <archive>")
 				return
 			}
-			showBox("Listing archive", fmt.Sprintf("Archive: %s", *inPath))
-			names, err := listArchive(*inPath, pw)
+			showBox("Listing archive", fmt.Sprintf("Archive: %s", inName))
+			if !checkSignature(*inPath, *verifySigFlag) {
+				exitCode = 2
+				return
+			}
+			for _, p := range filesFlags {
+				if err := checkGlob(p); err != nil {
+					exitCode = 2
+					fail("-files: %v", err)
+					return
+				}
+			}
+			for _, p := range filterFlags {
+				if err := checkGlob(p); err != nil {
+					exitCode = 2
+					fail("-filter: %v", err)
+					return
+				}
+			}
+			if err := checkSortKey(*sortFlag); err != nil {
+				exitCode = 2
+				fail("%v", err)
+				return
+			}
+			entries, meta, err := listArchive(*inPath, pw, ro)
 			if err != nil {
+				exitCode = 2
 				fail("List failed: %v", err)
+				if !*jsonFlag { // -json lists what was read, with the error
+					return
+				}
+			} else if keychainID != "" {
+				rememberPassword(*inPath, keychainID, pw)
+			}
+			entries = selectEntries(entries, append(filesFlags, filterFlags...))
+			sortEntries(entries, *sortFlag)
+			if !*jsonFlag {
+				printListing(entries, meta, logLevel >= verbosityVerbose)
+				return
+			}
+			out := newJSONListing(inName, meta)
+			for _, h := range entries {
+				out.Entries = append(out.Entries, jsonEntryOf(h))
+			}
+			if err != nil {
+				out.Error = err.Error()
+			}
+			if err := printJSON(out); err != nil {
+				exitCode = 2
+				fail("%v", err)
+			}
+			return
+		}
+		if *testFlag {
+			if *inPath == "" {
+				exitCode = 2
+				fmt.Println("test requires -in <archive>")
+				return
+			}
+			showBox("Testing archive", fmt.Sprintf("Archive: %s", inName))
+			if !checkSignature(*inPath, *verifySigFlag) {
+				exitCode = 2
+				return
+			}
+			results, meta, err := testArchive(*inPath, pw, ro)
+			if err == nil && keychainID != "" {
+				rememberPassword(*inPath, keychainID, pw)
+			}
+			failed := 0
+			if *jsonFlag {
+				out := newJSONListing(inName, meta)
+				for _, r := range results {
+					e := jsonEntryOf(r.h)
+					ok := r.err == nil
+					e.OK = &ok
+					if !ok {
+						e.Problem = r.err.Error()
+						failed++
+					}
+					out.Entries = append(out.Entries, e)
+				}
+				out.Failed = &failed
+				if err != nil {
+					out.Error = err.Error()
+				}
+				if err := printJSON(out); err != nil {
+					exitCode = 2
+					fail("%v", err)
+				}
+			} else {
+				failed = printTest(results)
 			}
-			fmt.Println()
-			fmt.Println("Files in archive:")
-			for _, n := range names {
-				fmt.Println("  -", n)
+			switch {
+			case err != nil:
+				fail("Test failed: %v", err)
+				exitCode = 2
+			case failed > 0:
+				fail("%d of %d entries failed the test", failed, len(results))
+				exitCode = 1
+			default:
+				showOK("No errors found in %d entries", len(results))
 			}
 			return
 		}
 		if *extractFlag {
 			if *inPath == "" {
+				exitCode = 1
 				fmt.Println("extract requires -in <archive>")
 				return
 			}
@@ -96,9 +779,101 @@ func main() {
 			if dest == "" {
 				dest = "."
 			}
-			showBox("Extracting archive", fmt.Sprintf("Archive: %s\nDestination: %s", *inPath, dest))
-			if err := extractArchive(*inPath, dest, pw, true); err != nil {
+			if *toStdoutFlag {
+				dest = "stdout"
+			}
+			showBox("Extracting archive", fmt.Sprintf("Archive: %s\nDestination: %s", inName, dest))
+			if !checkSignature(*inPath, *verifySigFlag) {
+				exitCode = 1
+				return
+			}
+			if err := checkNameForm(*namesFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			for _, p := range filesFlags {
+				if err := checkGlob(p); err != nil {
+					exitCode = 1
+					fail("-files: %v", err)
+					return
+				}
+			}
+			existing, err := existingPolicy(*overwriteFlag, *skipExistingFlag, *renameExistingFlag, *keepNewerFlag, *freshenFlag)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if *stripFlag < 0 {
+				exitCode = 1
+				fail("-strip takes a number of components, 0 or more")
+				return
+			}
+			if *jobsFlag < 0 {
+				exitCode = 1
+				fail("-jobs takes a number of files, 1 or more (0 for one per CPU)")
+				return
+			}
+			if *jobsFlag == 0 {
+				*jobsFlag = runtime.GOMAXPROCS(0)
+			}
+			if *resumeFlag && (*stagingFlag || *toStdoutFlag || *dryRunFlag) {
+				exitCode = 1
+				fail("-resume continues extracting into -out; -staging, -to-stdout and -n do not apply")
+				return
+			}
+			transform, err := parseTransforms(transformFlags)
+			if err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			if err := checkCollisionPolicy(*caseCollisionsFlag); err != nil {
+				exitCode = 1
+				fail("%v", err)
+				return
+			}
+			opts := extractOptions{
+				restoreOwner: *restoreOwnerFlag || *sameOwnerFlag,
+				xattrs:       *xattrsFlag,
+				noPerms:      *noPermsFlag,
+				noTimes:      *noTimesFlag,
+				unsafeLinks:  *unsafeLinksFlag,
+				nameForm:     *namesFlag,
+				files:        filesFlags,
+				existing:     existing,
+				strip:        *stripFlag,
+				transform:    transform,
+				toStdout:     *toStdoutFlag,
+				resume:       *resumeFlag,
+				verify:       *verifyFlag,
+				collisions:   *caseCollisionsFlag,
+				jobs:         *jobsFlag,
+				readOptions:  ro,
+			}
+			if *dryRunFlag {
+				if err := dryRunExtract(*inPath, dest, pw, opts); err != nil {
+					exitCode = 1
+					fail("%v", err)
+				}
+				return
+			}
+			stop := catchInterrupts()
+			defer stop()
+			if *stagingFlag {
+				err = extractStaged(*inPath, dest, pw, opts)
+			} else {
+				err = extractArchive(*inPath, dest, pw, opts)
+			}
+			if err != nil {
+				exitCode = 1
 				fail("Extract failed: %v", err)
+				return
+			}
+			workDone()
+			if keychainID != "" {
+				rememberPassword(*inPath, keychainID, pw)
 			}
 			showOK("Extracted to: %s", dest)
 			return
@@ -128,12 +903,20 @@ func main() {
 			fmt.Print("Output archive path (e.g. archive.gha): ")
 			outp, _ := reader.ReadString('\n')
 			outp = strings.TrimSpace(outp)
+			fmt.Print("Comment (optional): ")
+			comment, _ := reader.ReadString('\n')
+			comment = strings.TrimSpace(comment)
 			pw := promptPassword("Password: ")
 			showBox("Creating archive", fmt.Sprintf("Input: %s\nOutput: %s", inp, outp))
-			err := createArchive(inp, outp, pw, false)
+			stop := catchInterrupts()
+			err := createArchive(inp, outp, pw, createOptions{comment: comment})
 			if err != nil {
+				stop()
 				fail("Create failed: %v", err)
+				exitInterrupted()
 			} else {
+				workDone()
+				stop()
 				showOK("Archive created: %s", outp)
 			}
 			pause()
@@ -143,17 +926,14 @@ func main() {
 			inp = strings.TrimSpace(inp)
 			pw := promptPassword("Password: ")
 			showBox("Listing archive", fmt.Sprintf("Archive: %s", inp))
-			names, err := listArchive(inp, pw)
+			entries, meta, err := listArchive(inp, pw, readOptions{})
 			if err != nil {
+				exitCode = 2
 				fail("List failed: %v", err)
 				pause()
 				continue
 			}
-			fmt.Println()
-			fmt.Println("Files in archive:")
-			for _, n := range names {
-				fmt.Println("  -", n)
-			}
+			printListing(entries, meta, true)
 			pause()
 		case "3":
 			fmt.Print("Archive path: ")
@@ -167,10 +947,15 @@ func main() {
 			}
 			pw := promptPassword("Password: ")
 			showBox("Extracting archive", fmt.Sprintf("Archive: %s\nDestination: %s", inp, dest))
-			err := extractArchive(inp, dest, pw, false)
+			stop := catchInterrupts()
+			err := extractArchive(inp, dest, pw, extractOptions{})
 			if err != nil {
+				stop()
 				fail("Extract failed: %v", err)
+				exitInterrupted()
 			} else {
+				workDone()
+				stop()
 				showOK("Extracted to: %s", dest)
 			}
 			pause()
@@ -184,32 +969,204 @@ func main() {
 	}
 }
 
-// ---------- Small TUI helpers (ASCII boxes, progress) ------------
-
-func clearScreen() {
-	// ANSI clear
-	fmt.Print("\033[H\033[2J")
-}
-
-func drawTitle(s string) {
-	fmt.Println("+------------------------------------------------------------+")
-	center := (60 - len(s)) / 2
-	if center < 0 {
-		center = 0
+// runRepair implements "ghzip repair": it rebuilds damaged parts of an
+// archive from its recovery record. No password is needed.
+func runRepair(args []string) {
+	cmd := flag.NewFlagSet("repair", flag.ExitOnError)
+	inPath := cmd.String("in", "", "archive to repair")
+	outPath := cmd.String("out", "", "write the repaired archive here instead of repairing in place")
+	salvageDir := cmd.String("salvage", "", "extract every entry that is still intact into `directory`, reporting the lost ones")
+	pass := cmd.String("pass", "", "password for -salvage (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "open the archive with a key `file` or X25519 identity file")
+	dictPath := cmd.String("dict", "", "the dictionary `file` the archive was compressed with")
+	allowExec := cmd.Bool("allow-exec", false, "run the external compressor the archive names")
+	parseCommand(cmd, args)
+	if *inPath == "" && cmd.NArg() == 1 {
+		*inPath = cmd.Arg(0)
 	}
-	fmt.Printf("|%s%s%s|\n", strings.Repeat(" ", 2), strings.Repeat(" ", center)+s, strings.Repeat(" ", 60-len(s)-center-2))
-	fmt.Println("+------------------------------------------------------------+")
+	if *inPath == "" {
+		fmt.Println("repair requires -in <archive>")
+		return
+	}
+	if *salvageDir != "" {
+		ro := readOptions{allowExec: *allowExec}
+		var err error
+		if *dictPath != "" {
+			if ro.dict, err = loadDictionary(*dictPath); err != nil {
+				exitCode = 2
+				fail("%v", err)
+				return
+			}
+		}
+		if *pass == "" && *keyfilePath == "" {
+			if *pass, err = readPassword(*passFd, *passFile); err != nil {
+				exitCode = 2
+				fail("%v", err)
+				return
+			}
+		}
+		secret, err := slotSecret(*pass, *keyfilePath, "Password: ")
+		if err != nil {
+			exitCode = 2
+			fail("%v", err)
+			return
+		}
+		runSalvage(*inPath, *outPath, *salvageDir, secret, ro)
+		return
+	}
+	target := *inPath
+	if *outPath != "" {
+		if err := copyFile(*inPath, *outPath); err != nil {
+			fail("Repair failed: %v", err)
+			return
+		}
+		target = *outPath
+	}
+	showBox("Repairing archive", fmt.Sprintf("Archive: %s", target))
+	rep, err := repairArchive(target)
+	fmt.Printf("Checked %d slice(s): %d damaged, %d repaired; %d damaged recovery slice(s)\n",
+		rep.slices, rep.damaged, rep.repaired, rep.parityDamaged)
+	if rep.rewritten {
+		fmt.Println("Recovery record rewritten.")
+	}
+	if err != nil {
+		fail("Repair failed: %v", err)
+		return
+	}
+	showOK("Archive intact: %s", target)
 }
 
-func drawMenuBox(lines []string) {
-	fmt.Println("+------------------------------------------------------------+")
-	for _, l := range lines {
-		fmt.Printf("|  %-56s |\n", l)
-	}
+// runSalvage repairs the archive with its recovery record, if it has one,
+// and extracts what is intact into destDir. As with -t, it exits 1 when
+// anything was lost and 2 on an error.
+func runSalvage(inPath, outPath, destDir, password string, ro readOptions) {
+	target := inPath
+	if outPath != "" {
+		if err := copyFile(inPath, outPath); err != nil {
+			exitCode = 2
+			fail("Repair failed: %v", err)
+			return
+		}
+		target = outPath
+	}
+	showBox("Salvaging archive", fmt.Sprintf("Archive: %s\nDestination: %s", target, destDir))
+	if _, recovery, _ := archiveTrailers(target); recovery > 0 {
+		if rep, err := repairArchive(target); err != nil {
+			fmt.Printf("The recovery record repaired %d of %d damaged slice(s): %v\n", rep.repaired, rep.damaged, err)
+		} else if rep.damaged > 0 {
+			fmt.Printf("The recovery record repaired %d damaged slice(s).\n", rep.repaired)
+		}
+	}
+	rep, err := salvageArchive(target, destDir, password, ro)
+	if err != nil {
+		exitCode = 2
+		fail("Salvage failed: %v", err)
+		return
+	}
+	if rep.rebuilt {
+		fmt.Println("The block index was damaged and had to be rebuilt.")
+	}
+	fmt.Printf("Recovered %d entries; %d lost", rep.recovered, len(rep.lost))
+	if rep.unknown > 0 {
+		fmt.Printf(", and %d more whose names were in damaged blocks", rep.unknown)
+	}
+	fmt.Printf(" (%d damaged block(s))\n", rep.damaged)
+	// with no entry count in the header, damaged blocks may have held
+	// entries nobody knows of
+	if len(rep.lost) > 0 || rep.unknown > 0 || rep.unknown < 0 && rep.damaged > 0 {
+		exitCode = 1
+		return
+	}
+	showOK("Everything extracted to: %s", destDir)
+}
+
+// checkSignature verifies the archive signature when a public key file is
+// given and reports the result; it returns false if extraction or listing
+// must not go ahead.
+func checkSignature(archivePath, pubPath string) bool {
+	if pubPath == "" {
+		return true
+	}
+	pub, err := loadVerifyKey(pubPath)
+	if err == nil {
+		err = verifyArchiveSignature(archivePath, pub)
+	}
+	if err != nil {
+		fail("Signature check failed: %v", err)
+		return false
+	}
+	showOK("Good signature from %s", keyFingerprint(pub))
+	return true
+}
+
+// copyFile copies src to dst, replacing dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// multiFlag collects the values of a repeatable string flag.
+type multiFlag []string
+
+func (m *multiFlag) String() string     { return strings.Join(*m, ",") }
+func (m *multiFlag) Set(v string) error { *m = append(*m, v); return nil }
+
+// parseEntryComments turns repeated name=text flag values into a map.
+func parseEntryComments(vals []string) (map[string]string, error) {
+	comments := make(map[string]string)
+	for _, v := range vals {
+		name, text, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("bad -comment-file %q, want name=text", v)
+		}
+		comments[nfc(filepath.ToSlash(name))] = text
+	}
+	return comments, nil
+}
+
+// ---------- Small TUI helpers (ASCII boxes, progress) ------------
+
+func clearScreen() {
+	// ANSI clear
+	fmt.Print("\033[H\033[2J")
+}
+
+func drawTitle(s string) {
+	fmt.Println("+------------------------------------------------------------+")
+	center := (60 - len(s)) / 2
+	if center < 0 {
+		center = 0
+	}
+	fmt.Printf("|%s%s%s|\n", strings.Repeat(" ", 2), strings.Repeat(" ", center)+s, strings.Repeat(" ", 60-len(s)-center-2))
+	fmt.Println("+------------------------------------------------------------+")
+}
+
+func drawMenuBox(lines []string) {
+	fmt.Println("+------------------------------------------------------------+")
+	for _, l := range lines {
+		fmt.Printf("|  %-56s |\n", l)
+	}
 	fmt.Println("+------------------------------------------------------------+")
 }
 
 func showBox(title, body string) {
+	if logLevel == verbosityQuiet {
+		return
+	}
 	clearScreen()
 	fmt.Println("+------------------------------------------------------------+")
 	fmt.Printf("| %-54s |\n", title)
@@ -232,10 +1189,29 @@ func showBox(title, body string) {
 }
 
 func showOK(format string, args ...interface{}) {
+	if logLevel == verbosityQuiet {
+		return
+	}
 	fmt.Println()
 	fmt.Printf("[ OK ] "+format+"\n", args...)
 }
 
+// exitCode is the status goZip exits with, for commands whose result is
+// given by it: diff exits 1 when something differs, as diff(1) does, -t
+// when an entry fails the test and repair -salvage when it loses one; all
+// exit 2 on an error, as -l does when the archive cannot be listed or its
+// signature does not verify. -x exits 1 when it fails, skipped symlinks,
+// checksum mismatches and bad signatures included, and so do -c, -a,
+// export, z and unz, and any of them given flags they cannot use.
+var exitCode int
+
+// exitResult exits with exitCode, if set.
+func exitResult() {
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
 func fail(format string, args ...interface{}) {
 	fmt.Println()
 	fmt.Printf("[FAIL] "+format+"\n", args...)
@@ -254,293 +1230,2375 @@ func promptPassword(prompt string) string {
 	return strings.TrimSpace(line)
 }
 
-func showProgress(prefix string, done, total int64) {
-	// simple ASCII progress bar
-	const width = 40
-	var pct int
-	if total > 0 {
-		pct = int((done * 100) / total)
-	} else {
-		pct = 0
+// passwordEnv names the environment variable read for the password when
+// neither -pass, -pass-fd nor -pass-file gives one.
+const passwordEnv = "GHZIP_PASSWORD"
+
+// readPassword returns the first line of file descriptor fd (if not -1)
+// or of file (if given), or else the value of $GHZIP_PASSWORD; "" means
+// no password was supplied. Unlike -pass, none of these show up in ps.
+func readPassword(fd int, file string) (string, error) {
+	var r io.Reader
+	var from string
+	switch {
+	case fd >= 0:
+		from = fmt.Sprintf("-pass-fd %d", fd)
+		f := os.NewFile(uintptr(fd), "pass-fd")
+		if f == nil {
+			return "", fmt.Errorf("%s: not an open file descriptor", from)
+		}
+		defer f.Close()
+		r = f
+	case file != "":
+		from = "-pass-file"
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("-pass-file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	default:
+		pw := os.Getenv(passwordEnv)
+		os.Unsetenv(passwordEnv) // keep it from external compressors
+		return pw, nil
 	}
-	filled := (pct * width) / 100
-	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
-	fmt.Printf("\r%s [%s] %3d%%", prefix, bar, pct)
-	if done >= total {
-		fmt.Println()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("%s: %w", from, err)
 	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("%s: the first line is empty", from)
+	}
+	return line, nil
 }
 
 // ---------------------- Archive operations -------------------------
 
-func createArchive(inputPath, outArchive, password string, quiet bool) error {
-	// Walk input path
-	files := []struct {
-		relPath string
-		absPath string
-		info    fs.FileInfo
-	}{}
+// inputFile is one filesystem object collected for archiving.
+type inputFile struct {
+	relPath string
+	absPath string
+	info    fs.FileInfo
 
-	fi, err := os.Stat(inputPath)
+	// imported, if set, is the tar or zip entry the file is converted
+	// from (convert.go); it has no absPath then.
+	imported *importedEntry
+}
+
+// createOptions holds the optional behaviour of createArchive.
+type createOptions struct {
+	owner   bool   // record uid/gid of every entry
+	xattrs  bool   // record user.* and security.* extended attributes
+	comment string // archive-level comment stored in the metadata section
+
+	// signKey signs the archive with Ed25519; the signature is embedded
+	// unless detachedSig is set, in which case it goes to "<archive>.sig".
+	signKey     ed25519.PrivateKey
+	detachedSig bool
+
+	// recovery appends a recovery record of about this many percent of
+	// the archive size (0 = none).
+	recovery float64
+
+	// method names the compression method ("" = huffman, or the level's).
+	method string
+
+	// level is a compression level preset, 1-9 (0 = none).
+	level int
+
+	// dict is a shared dictionary (dict.go) to compress against; it
+	// needs a tuned method and switches the default method to deflate.
+	dict []byte
+
+	// kdf tunes the cost of deriving the key from the password.
+	kdf kdfOptions
+
+	// keyfile is the contents of a key file that opens the archive as
+	// well as (or, with no password, instead of) the password.
+	keyfile string
+
+	// recipients are X25519 public keys that get a key slot each.
+	recipients []*ecdh.PublicKey
+
+	// fido2 adds a key slot for a FIDO2 security key (fido2Device, or the
+	// first one found).
+	fido2       bool
+	fido2Device string
+
+	// recoveryKey is a printable key from newRecoveryKey that gets a key
+	// slot of its own, for when the password is lost.
+	recoveryKey string
+
+	// cipher is the AEAD sealing the metadata and blocks (cipherAESGCM & co.).
+	cipher byte
+
+	// fips marks the archive as made with approved algorithms only (fips.go).
+	fips bool
+
+	// maxMemory caps the memory for compressing blocks (memory.go),
+	// shrinking parallelism and block size as needed (0 = no limit).
+	maxMemory int64
+
+	// perFile compresses every entry independently (non-solid) instead of
+	// as one continuous stream.
+	perFile bool
+
+	// replace drops the entries of a -per-file archive that files being
+	// appended have the names of (append.go).
+	replace bool
+
+	// jobs is how many files are read ahead at once (0 = one per CPU);
+	// createArchive and appendArchive set readAhead (readahead.go).
+	jobs      int
+	readAhead *readAhead
+
+	// entryComments maps archive names (slash-separated, relative to the
+	// archive root) to a comment stored with that entry.
+	entryComments map[string]string
+
+	// filters pick a pre-filter for the files they match (filter.go).
+	filters []filterRule
+
+	// exclude leaves out the files and directories matching these
+	// patterns (glob.go).
+	exclude []string
+
+	// symlinks is what to do with symlinks: symlinkStore (also for ""),
+	// symlinkFollow or symlinkSkip (symlinks.go).
+	symlinks string
+
+	// noDedup stores files with the same contents in full each time
+	// instead of as copy entries (dedup.go), and large files without
+	// shared chunks (chunks.go).
+	noDedup bool
+
+	// base is the archive to make a differential archive against, which
+	// createArchive reads into baseTree (base.go).
+	base     string
+	baseTree *baseTree
+
+	// list, if not nil, names the paths to archive instead of inputPath
+	// (-files-from, see filelist.go).
+	list []string
+
+	// imported, if not nil, are the entries of the tar or zip archive
+	// being converted, archived instead of inputPath (convert.go).
+	imported []inputFile
+}
+
+func createArchive(inputPath, outArchive, password string, opts createOptions) (err error) {
+	defer func(start time.Time) {
+		if err == nil {
+			debugf("archive written in %v", time.Since(start).Round(time.Millisecond))
+		}
+	}(time.Now())
+	p, argv, err := blockPreset(opts)
 	if err != nil {
 		return err
 	}
-	baseDir := filepath.Dir(inputPath)
-	if fi.IsDir() {
-		baseDir = inputPath
-		err := filepath.WalkDir(inputPath, func(path string, d fs.DirEntry, walkErr error) error {
-			if walkErr != nil {
-				return walkErr
-			}
-			if d.IsDir() {
-				return nil
-			}
-			info, err := d.Info()
-			if err != nil {
-				return err
-			}
-			rel, err := filepath.Rel(baseDir, path)
-			if err != nil {
-				return err
-			}
-			files = append(files, struct {
-				relPath string
-				absPath string
-				info    fs.FileInfo
-			}{relPath: rel, absPath: path, info: info})
-			return nil
-		})
-		if err != nil {
+	inFlight := 0 // blocks compressed at once (0 = one per core)
+	if opts.maxMemory > 0 {
+		if p.blockSize, inFlight, err = fitMemory(opts.maxMemory, p.method, p.blockSize); err != nil {
 			return err
 		}
-	} else {
-		rel := filepath.Base(inputPath)
-		files = append(files, struct {
-			relPath string
-			absPath string
-			info    fs.FileInfo
-		}{relPath: rel, absPath: inputPath, info: fi})
 	}
 
-	if !quiet {
-		fmt.Printf("Found %d file(s) to archive.\n", len(files))
+	if opts.base != "" {
+		secret := password
+		if secret == "" {
+			secret = opts.keyfile
+		}
+		if opts.baseTree, err = readBase(opts.base, secret); err != nil {
+			return fmt.Errorf("-base: %w", err)
+		}
 	}
-
-	// Build payload
-	var payload bytes.Buffer
-	var totalBytes int64
-	for _, f := range files {
-		data, err := os.ReadFile(f.absPath)
-		if err != nil {
+	opts.readAhead = newReadAhead(opts.jobs, readAheadBudget(opts.maxMemory, p.method, p.blockSize, inFlight), opts.baseTree)
+	defer opts.readAhead.stop()
+	files, err := inputFiles(inputPath, opts, opts.readAhead.add)
+	if err != nil {
+		return err
+	}
+	verbosef("Found %d file(s) to archive.", len(files))
+	var deleted []string // base entries gone since
+	if opts.baseTree != nil {
+		found := len(files)
+		if files, deleted, err = opts.baseTree.changes(files); err != nil {
 			return err
 		}
-		totalBytes += int64(len(data))
-		nameBytes := []byte(filepath.ToSlash(f.relPath))
-		if len(nameBytes) > 65535 {
-			return fmt.Errorf("filename too long: %s", f.relPath)
+		verbosef("%d unchanged since %s, %d deleted.", found-len(files), opts.base, len(deleted))
+	}
+	linkOf, totalBytes := resolveHardlinks(files)
+
+	// Key and header: a random master key, wrapped in a key slot for the
+	// password, one for the key file, one per recipient, one for a FIDO2
+	// token and one for a recovery key. There are at least defaultKeySlots
+	// slots, to leave room for "ghzip slot add".
+	master := make([]byte, masterKeySize)
+	if _, err := rand.Read(master); err != nil {
+		return err
+	}
+	defer clear(master)
+	aead, err := newAEAD(opts.cipher, master)
+	if err != nil {
+		return err
+	}
+	withPassword := password != "" || opts.keyfile == "" && len(opts.recipients) == 0 && !opts.fido2
+	used := len(opts.recipients)
+	for _, slot := range []bool{withPassword, opts.keyfile != "", opts.fido2, opts.recoveryKey != ""} {
+		if slot {
+			used++
 		}
-		if err := binary.Write(&payload, binary.LittleEndian, uint16(len(nameBytes))); err != nil {
+	}
+	if used > maxKeySlots {
+		return fmt.Errorf("too many recipients (an archive has at most %d key slots)", maxKeySlots)
+	}
+	meta, err := newArchiveMeta()
+	if err != nil {
+		return err
+	}
+	nslots := byte(max(used, defaultKeySlots))
+	table := slotTable{
+		cipher: opts.cipher,
+		slots:  make([]keySlot, nslots),
+		fixed:  append([]byte{magic[0], magic[1], magic[2], magic[3], version, opts.cipher, nslots}, meta.id[:]...),
+	}
+	next := 0
+	if withPassword {
+		if table.slots[next], err = newKeySlot(slotPassword, password, opts.kdf, opts.cipher, master, table.fixed); err != nil {
 			return err
 		}
-		if _, err := payload.Write(nameBytes); err != nil {
+		next++
+	}
+	if opts.keyfile != "" {
+		if table.slots[next], err = newKeySlot(slotKeyfile, opts.keyfile, opts.kdf, opts.cipher, master, table.fixed); err != nil {
 			return err
 		}
-		if err := binary.Write(&payload, binary.LittleEndian, uint64(len(data))); err != nil {
+		next++
+	}
+	for _, pub := range opts.recipients {
+		if table.slots[next], err = newRecipientSlot(pub, opts.cipher, master, table.fixed); err != nil {
 			return err
 		}
-		if _, err := payload.Write(data); err != nil {
+		next++
+	}
+	if opts.fido2 {
+		if table.slots[next], err = newFIDO2Slot(opts.fido2Device, opts.cipher, master, table.fixed); err != nil {
 			return err
 		}
-		if !quiet {
-			showProgress("Packing", int64(payload.Len()), totalBytes+int64(len(files))*10)
-		}
+		next++
 	}
-	if !quiet {
-		fmt.Printf("Payload size (bytes): %d\n", payload.Len())
+	if opts.recoveryKey != "" {
+		secret, ok := parseRecoveryKey(opts.recoveryKey)
+		if !ok {
+			return errors.New("malformed recovery key")
+		}
+		if table.slots[next], err = newKeySlot(slotRecovery, secret, opts.kdf, opts.cipher, master, table.fixed); err != nil {
+			return err
+		}
 	}
-
-	// Frequency table
-	dataBytes := payload.Bytes()
-	var freq [256]uint64
-	for _, b := range dataBytes {
-		freq[b]++
+	// Archive metadata is sealed separately (own nonce) so it can be read
+	// without decrypting the payload.
+	meta.comment = opts.comment
+	meta.entries = uint64(len(files) + len(deleted))
+	meta.totalSize = uint64(totalBytes)
+	meta.hasTotals = true
+	if opts.baseTree != nil {
+		meta.baseID, meta.basePath = opts.baseTree.id, storedBasePath(opts.base, outArchive)
 	}
-
-	// Huffman compress
-	if !quiet {
-		fmt.Println("Building Huffman tree and compressing...")
+	if opts.dict != nil {
+		meta.dictID = dictID(opts.dict)
 	}
-	compressed, err := huffmanCompress(dataBytes, freq)
+	meta.exec = strings.Join(argv, " ")
+	meta.fips = opts.fips
+	header, authHeader, err := sealHeader(aead, table.fixed, table.encodeSlots(), meta)
 	if err != nil {
 		return err
 	}
-	if !quiet {
-		fmt.Printf("Compressed size: %d bytes (ratio %.2f%%)\n", len(compressed), 100.0*float64(len(compressed))/float64(len(dataBytes)))
-	}
 
-	// Encrypt compressed bytes with AES-GCM
-	key := sha256.Sum256([]byte(password))
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
+	// Write archive file
+	outf := stdout
+	if outArchive != "-" {
+		if outf, err = os.Create(outArchive); err != nil {
+			return err
+		}
+		// a partial archive is of no use; closed first for Windows
+		defer func() {
+			if err != nil {
+				os.Remove(outArchive)
+			}
+		}()
+		defer outf.Close()
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
+	cw := &countingWriter{w: outf}
+	if _, err := cw.Write(header); err != nil {
 		return err
 	}
-	if !quiet {
-		fmt.Println("Encrypting payload...")
-	}
-	ciphertext := gcm.Seal(nil, nonce, compressed, nil)
 
-	// Write archive file
-	outf, err := os.Create(outArchive)
+	// Build payload straight into compressed, encrypted blocks
+	var payloadFlags byte
+	if opts.perFile {
+		payloadFlags |= payloadPerFile
+	}
+	bw, err := newBlockWriter(cw, aead, p.blockSize, payloadFlags, authHeader)
 	if err != nil {
 		return err
 	}
-	defer outf.Close()
-
-	if _, err := outf.Write([]byte(magic)); err != nil {
-		return err
+	bw.coding = blockCoding{method: p.method, effort: p.effort, dict: opts.dict, exec: argv}
+	if inFlight > 0 {
+		bw.workers = min(bw.workers, inFlight)
 	}
-	if _, err := outf.Write([]byte{version}); err != nil {
-    return err
+	debugf("%s, effort %d, %d-byte blocks, %d compressed at once; %s, %d of %d key slot(s) used",
+		methodName(p.method), p.effort, p.blockSize, bw.workers, cipherNames[opts.cipher], used, nslots)
+	if err := writeEntries(bw, files, linkOf, totalBytes, opts); err != nil {
+		return err
 	}
-	if _, err := outf.Write(nonce); err != nil {
+	if err := writeDeleted(bw, deleted, opts.perFile); err != nil {
 		return err
 	}
-	for i := 0; i < 256; i++ {
-		if err := binary.Write(outf, binary.LittleEndian, freq[i]); err != nil {
-			return err
-		}
+	return finishArchive(outf, cw, bw, outArchive, opts)
+}
+
+// blockPreset resolves the level, method and dictionary options into how
+// blocks are compressed, and the external compressor's command, if any.
+func blockPreset(opts createOptions) (preset, []string, error) {
+	p, err := levelPreset(opts.level)
+	if err != nil {
+		return p, nil, err
 	}
-	if err := binary.Write(outf, binary.LittleEndian, uint64(len(ciphertext))); err != nil {
-		return err
+	argv, isExec, err := parseExecMethod(opts.method)
+	if err != nil {
+		return p, nil, err
 	}
-	if _, err := outf.Write(ciphertext); err != nil {
-		return err
+	if isExec {
+		p.method = methodExec
+	} else if opts.method != "" {
+		if p.method, err = parseMethod(opts.method); err != nil {
+			return p, nil, err
+		}
 	}
-	if !quiet {
-		fmt.Println("Write completed.")
+	if opts.dict != nil {
+		if _, ok := tunedCodecs[p.method]; !ok {
+			if opts.method != "" {
+				return p, nil, fmt.Errorf("method %s cannot use a dictionary (use deflate or lz77)", opts.method)
+			}
+			// deflate has no per-block tables, which suits small files best
+			p.method = methodDeflate
+		}
 	}
-	return nil
+	return p, argv, nil
 }
 
-func listArchive(archivePath, password string) ([]string, error) {
-	payload, err := readAndDecryptArchive(archivePath, password)
+// walkInput lists inputPath and, for a directory, everything below it,
+// with names relative to the directory (or the file's own name). Entries
+// matching an exclude pattern are left out, directories with everything
+// in them. found, if not nil, gets every entry as it is listed.
+func walkInput(inputPath string, exclude []string, symlinks string, found func(inputFile)) ([]inputFile, error) {
+	files := []inputFile{}
+	add := func(f inputFile) {
+		files = append(files, f)
+		if found != nil {
+			found(f)
+		}
+	}
+	fi, err := os.Stat(inputPath)
 	if err != nil {
 		return nil, err
 	}
-	var names []string
-	r := bytes.NewReader(payload)
-	for {
-		var nameLen uint16
-		 if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
-			if err == io.EOF {
-				break
-			}
+	if fi.IsDir() {
+		if err := walkTree(inputPath, "", exclude, symlinks, nil, add); err != nil {
 			return nil, err
 		}
-		nb := make([]byte, nameLen)
-		if _, err := io.ReadFull(r, nb); err != nil {
-			return nil, err
+	} else {
+		add(inputFile{relPath: filepath.Base(inputPath), absPath: inputPath, info: fi})
+	}
+	return files, nil
+}
+
+// walkTree passes everything below the directory root to add, named
+// prefix joined with the path relative to root, and leaves out what
+// matches an exclude pattern. Symlinks are treated as the symlinks policy
+// says; chain is for followSymlink.
+func walkTree(root, prefix string, exclude []string, symlinks string, chain []string, add func(inputFile)) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
 		}
-		var origSize uint64
-		if err := binary.Read(r, binary.LittleEndian, &origSize); err != nil {
-			return nil, err
+		if d.IsDir() && path == root {
+			return nil
 		}
-		// skip file bytes
-		if _, err := r.Seek(int64(origSize), io.SeekCurrent); err != nil {
-			return nil, err
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.Join(prefix, rel)
+		if excluded(exclude, filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isSymlink(info) && symlinks == symlinkSkip {
+			return nil
+		}
+		if isSymlink(info) && symlinks == symlinkFollow {
+			return followSymlink(path, rel, exclude, chain, add)
+		}
+		add(inputFile{relPath: rel, absPath: path, info: info})
+		return nil
+	})
+}
+
+// resolveHardlinks finds the files that are hard links to an earlier one:
+// linkOf[i] names the entry files[i] links to. totalBytes sums the data of
+// the others, so the header can carry exact totals.
+func resolveHardlinks(files []inputFile) (linkOf []string, totalBytes int64) {
+	linkOf = make([]string, len(files))
+	linkNames := make(map[[2]uint64]string)
+	for i, f := range files {
+		if f.imported != nil && f.imported.link != "" {
+			linkOf[i] = nfc(filepath.ToSlash(f.imported.link))
+			continue
+		}
+		if !f.info.Mode().IsRegular() {
+			continue
 		}
-		names = append(names, string(nb))
+		if id, linked := fileID(f.info); linked {
+			if first, ok := linkNames[id]; ok {
+				linkOf[i] = first
+				continue
+			}
+			linkNames[id] = nfc(filepath.ToSlash(f.relPath))
+		}
+		totalBytes += f.info.Size()
 	}
-	return names, nil
+	return linkOf, totalBytes
 }
 
-func extractArchive(archivePath, destDir, password string, quiet bool) error {
-	payload, err := readAndDecryptArchive(archivePath, password)
-	if err != nil {
-		return err
+// sealHeader seals meta with the archive's cipher and returns the v2 header
+// (fixed fields, key slots, sealed metadata) and the part of it that the
+// blocks authenticate, which leaves out the key slots.
+func sealHeader(aead cipher.AEAD, fixed, slots []byte, meta archiveMeta) (header, authHeader []byte, err error) {
+	metaNonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(metaNonce); err != nil {
+		return nil, nil, err
 	}
-	r := bytes.NewReader(payload)
-	var extracted int
-	var totalBytes int64
-	// first pass to compute total for progress (sum of sizes)
-	{
-		r2 := bytes.NewReader(payload)
-		for {
-			var nameLen uint16
-			if err := binary.Read(r2, binary.LittleEndian, &nameLen); err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+	// The fixed header fields are authenticated as additional data of the
+	// metadata, and the whole header but the key slots (via its hash) as
+	// part of every block's additional data, so tampering with any of it
+	// fails to open while slots can still be changed later.
+	metaCipher := aead.Seal(nil, metaNonce, meta.encode(), fixed)
+	authHeader = append([]byte(nil), fixed...)
+	authHeader = append(authHeader, metaNonce...)
+	authHeader = binary.LittleEndian.AppendUint32(authHeader, uint32(len(metaCipher)))
+	authHeader = append(authHeader, metaCipher...)
+	header = append(append([]byte(nil), fixed...), slots...)
+	header = append(header, authHeader[len(fixed):]...)
+	return header, authHeader, nil
+}
+
+// writeEntries packs files into bw, each as an entry header followed by
+// its data; linkOf and totalBytes come from resolveHardlinks.
+func writeEntries(bw *blockWriter, files []inputFile, linkOf []string, totalBytes int64, opts createOptions) error {
+	var doneBytes int64
+	seen := make(map[string]string)    // NFC name -> original name
+	firstOf := make(map[string]string) // checksum -> name of the first file with it
+	chunks := make(chunkIndex)
+	if opts.baseTree != nil && !opts.noDedup {
+		opts.baseTree.seed(firstOf, chunks)
+	}
+	for i, f := range files {
+		if err := interrupted(); err != nil {
+			return err
+		}
+		typ := entryFile
+		var data []byte
+		var big *largeFile // streamed instead of read into data
+		var err error
+		if linkOf[i] != "" {
+			typ = entryHardlink
+			data = []byte(linkOf[i])
+		} else if f.info.IsDir() {
+			typ = entryDir
+		} else if f.info.Mode()&fs.ModeSymlink != 0 {
+			typ = entrySymlink
+			if f.imported != nil {
+				data, err = f.imported.read()
+			} else {
+				var target string
+				target, err = os.Readlink(f.absPath)
+				data = []byte(filepath.ToSlash(target))
 			}
-			if _, err := r2.Seek(int64(nameLen), io.SeekCurrent); err != nil {
+			if err != nil {
 				return err
 			}
-			var origSize uint64
-			if err := binary.Read(r2, binary.LittleEndian, &origSize); err != nil {
+		} else if f.imported == nil && f.info.Size() > streamFileMin {
+			if big, err = opts.readAhead.scan(f); err != nil {
 				return err
 			}
-			totalBytes += int64(origSize)
-			if _, err := r2.Seek(int64(origSize), io.SeekCurrent); err != nil {
+		} else {
+			if f.imported != nil {
+				data, err = f.imported.read()
+			} else {
+				data, err = opts.readAhead.read(f)
+			}
+			if err != nil {
 				return err
 			}
+			doneBytes += int64(len(data))
 		}
-	}
-
-	var doneBytes int64
-	for {
-		var nameLen uint16
-		if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
-			if err == io.EOF {
-				break
+		name := filepath.ToSlash(f.relPath)
+		h := entryHeader{typ: typ, name: nfc(name), size: uint64(len(data))}
+		if big != nil {
+			h.size = uint64(big.size)
+		}
+		if h.name != name {
+			h.origName = name
+		}
+		if typ == entrySymlink || typ == entryHardlink {
+			h.linkTarget = string(data)
+		}
+		if prev, ok := seen[h.name]; ok {
+			fmt.Fprintf(os.Stderr, "warning: %q and %q are the same name after NFC normalization\n", prev, name)
+		}
+		seen[h.name] = name
+		if f.imported != nil {
+			h.uid, h.gid, h.hasOwner = f.imported.uid, f.imported.gid, f.imported.hasOwner
+		} else if opts.owner {
+			h.uid, h.gid, h.hasOwner = fileOwner(f.info)
+		}
+		h.comment = opts.entryComments[h.name]
+		if typ != entryHardlink { // a hard link has its target's
+			h.mtime = f.info.ModTime()
+			if typ != entrySymlink {
+				h.mode, h.hasMode = unixMode(f.info.Mode()), true
 			}
-			return err
 		}
-		nb := make([]byte, nameLen)
-		if _, err := io.ReadFull(r, nb); err != nil {
-			return err
+		if big != nil {
+			h.sum = big.sum
+		} else if typ == entryFile {
+			sum := sha256.Sum256(data)
+			h.sum = sum[:]
 		}
-		var origSize uint64
-		if err := binary.Read(r, binary.LittleEndian, &origSize); err != nil {
-			return err
+		if typ == entryFile && !opts.noDedup {
+			if first, ok := firstOf[string(h.sum)]; ok {
+				typ, h.typ = entryCopy, entryCopy
+				if big != nil {
+					doneBytes += big.size
+					big = nil
+				}
+				data = []byte(first)
+				h.size, h.linkTarget = uint64(len(data)), first
+			}
 		}
-		data := make([]byte, origSize)
-		if _, err := io.ReadFull(r, data); err != nil {
-			return err
+		if big != nil && !opts.noDedup && chunks.share(big) {
+			typ, h.typ = entryChunks, entryChunks
+			h.size, h.fileSize = big.chunkListSize(), uint64(big.size)
 		}
-		target := filepath.Join(destDir, filepath.FromSlash(string(nb)))
-		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-			return err
+		if opts.baseTree != nil {
+			opts.baseTree.forget(h.name, firstOf, chunks)
 		}
-		if err := os.WriteFile(target, data, 0o644); err != nil {
-			return err
+		if (typ == entryFile || typ == entryChunks) && !opts.noDedup {
+			firstOf[string(h.sum)] = h.name
 		}
-		extracted++
-		doneBytes += int64(len(data))
-		if !quiet {
-			showProgress("Extracting", doneBytes, totalBytes)
+		if typ != entrySymlink && typ != entryHardlink {
+			if f.imported != nil {
+				h.xattrs = f.imported.xattrs
+			} else if opts.xattrs {
+				if h.xattrs, err = readXattrs(f.absPath); err != nil {
+					return fmt.Errorf("%s: reading xattrs: %w", f.relPath, err)
+				}
+			}
+			for name, val := range h.xattrs {
+				if len(name) > 255 || len(val) > 65535 {
+					return fmt.Errorf("%s: xattr %s too large", f.relPath, name)
+				}
+			}
 		}
-	}
-	if !quiet {
-		fmt.Printf("Extracted %d files.\n", extracted)
-	}
-	return nil
+		compressed := typ == entryFile && knownCompressed(data)
+		if big != nil {
+			compressed = knownCompressed(big.head)
+		}
+		if typ == entryFile && !compressed {
+			if filt, ok := matchFilter(opts.filters, h.name); ok {
+				h.filter = filt
+				if big == nil {
+					filt.apply(data)
+				}
+			}
+		}
+		if opts.perFile {
+			if err := bw.startEntry(); err != nil {
+				return err
+			}
+		}
+		if err := writeEntryHeader(bw, h); err != nil {
+			return err
+		}
+		bw.incompressible = compressed
+		if big != nil {
+			if typ == entryChunks {
+				err = big.writeChunks(bw, h.name, doneBytes, totalBytes)
+			} else {
+				err = big.copyTo(bw, h.filter, h.name, doneBytes, totalBytes)
+			}
+			if err != nil {
+				return err
+			}
+			if !opts.noDedup {
+				chunks.add(h.name, big)
+			}
+			doneBytes += big.size
+		} else if _, err := bw.Write(data); err != nil {
+			return err
+		}
+		clear(data) // the block writer has its own copy
+		bw.incompressible = false
+		verbosef("%s", displayName(h))
+		showProgress("Packing", h.name, doneBytes, totalBytes)
+	}
+	return nil
+}
+
+// finishArchive closes bw and adds the signature and recovery record that
+// opts ask for to the archive being written to outf.
+func finishArchive(outf *os.File, cw *countingWriter, bw *blockWriter, outArchive string, opts createOptions) error {
+	if err := bw.Close(); err != nil {
+		return err
+	}
+	if opts.signKey != nil {
+		rec, err := signRecord(outf, cw.n, opts.signKey)
+		if err != nil {
+			return fmt.Errorf("signing archive: %w", err)
+		}
+		if opts.detachedSig {
+			err = os.WriteFile(outArchive+".sig", rec, 0o644)
+		} else {
+			_, err = cw.Write(rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.recovery > 0 {
+		if err := addRecoveryRecord(outf, cw.n, opts.recovery); err != nil {
+			return fmt.Errorf("writing recovery record: %w", err)
+		}
+	}
+	ratio := 0.0
+	if bw.rawTotal > 0 {
+		ratio = 100.0 * float64(bw.compTotal) / float64(bw.rawTotal)
+	}
+	verbosef("Payload size (bytes): %d", bw.rawTotal)
+	verbosef("Compressed size: %d bytes in %d block(s) (ratio %.2f%%)", bw.compTotal, len(bw.index), ratio)
+	verbosef("Write completed.")
+	return nil
+}
+
+// entryHeader is the per-entry header that precedes each entry's data in the payload.
+type entryHeader struct {
+	typ  byte
+	name string
+	size uint64
+
+	// optional fields carried in the v2 extension block
+	hasOwner bool
+	uid, gid uint32
+	xattrs   map[string][]byte
+	comment  string
+	origName string // original name bytes when they differ from the NFC name
+	filter   entryFilter
+	hasMode  bool
+	mode     uint32    // Unix permission bits, with setuid, setgid and sticky
+	mtime    time.Time // modification time (zero = not recorded)
+	sum      []byte    // SHA-256 of a file's contents, before any filter
+	fileSize uint64    // size of a chunked entry's or listed copy's contents; size is that of its records
+
+	linkTarget string // filled in when reading or writing symlink/hardlink entries
+
+	// known when listing per-file archives, where every entry owns its blocks
+	method    byte  // compression method
+	stored    int64 // archive bytes taken by the entry's blocks
+	hasMethod bool
+
+	copySized bool // a listed copy's fileSize is known
+}
+
+// Tags of the records in an entry's extension block. Each record is
+// [1 byte tag][2 bytes length uint16][value]; readers skip unknown tags.
+const (
+	extOwner    byte = 1 // uid uint32, gid uint32
+	extXattrs   byte = 2 // repeated [1 byte name length][name][2 bytes value length][value]
+	extComment  byte = 3 // UTF-8 text
+	extOrigName byte = 4 // original name bytes, when not already NFC
+	extFilter   byte = 5 // filter kind, stride (filter.go)
+	extMode     byte = 6 // Unix mode bits uint32 (07777)
+	extMtime    byte = 7 // modification time, Unix nanoseconds int64
+	extSHA256   byte = 8 // SHA-256 of the file's contents (32 bytes)
+	extFileSize byte = 9 // size of a chunked file's contents uint64
+)
+
+// unixMode returns the Unix permission bits of m, as recorded in extMode.
+// fileMode turns them back.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
+
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode) & fs.ModePerm
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// readEntryHeader reads the next entry header from a decrypted payload.
+// It returns io.EOF only when the payload ends cleanly between entries.
+func readEntryHeader(r io.Reader, ver byte) (entryHeader, error) {
+	h := entryHeader{typ: entryFile}
+	if ver >= 2 {
+		var typ [1]byte
+		if _, err := io.ReadFull(r, typ[:]); err != nil {
+			return h, err
+		}
+		h.typ = typ[0]
+	}
+	var nameLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+		if err == io.EOF && ver >= 2 {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, err
+	}
+	nb := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nb); err != nil {
+		return h, err
+	}
+	h.name = string(nb)
+	if ver >= 2 {
+		var extLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &extLen); err != nil {
+			return h, err
+		}
+		ext := make([]byte, extLen)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return h, err
+		}
+		if err := h.parseExtensions(ext); err != nil {
+			return h, err
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h.size); err != nil {
+		return h, err
+	}
+	if h.typ > entryDeleted {
+		return h, fmt.Errorf("unknown entry type %d for %s", h.typ, h.name)
+	}
+	if h.refers() && h.size > maxLinkTarget {
+		return h, fmt.Errorf("%s: link target of %d bytes", h.name, h.size)
+	}
+	return h, nil
+}
+
+// nextEntry reads the next entry header from r, a part of ar's payload,
+// and counts it against the limits given to prepare. Only a differential
+// archive has deleted entries: there is nothing else for them to delete.
+func (ar *archiveReader) nextEntry(r io.Reader) (entryHeader, error) {
+	h, err := readEntryHeader(r, ar.version)
+	if err == nil && h.typ == entryDeleted && ar.meta.basePath == "" {
+		err = fmt.Errorf("%s: deleted entry in an archive without a base", h.name)
+	}
+	if err == nil {
+		err = ar.limits.check(h)
+	}
+	return h, err
+}
+
+func (h *entryHeader) parseExtensions(ext []byte) error {
+	err := parseRecords(ext, func(tag byte, val []byte) error {
+		switch tag {
+		case extOwner:
+			if len(val) != 8 {
+				return errors.New("bad owner record")
+			}
+			h.hasOwner = true
+			h.uid = binary.LittleEndian.Uint32(val[0:4])
+			h.gid = binary.LittleEndian.Uint32(val[4:8])
+		case extXattrs:
+			h.xattrs = make(map[string][]byte)
+			for len(val) > 0 {
+				nl := int(val[0])
+				if len(val) < 1+nl+2 {
+					return errors.New("bad xattr record")
+				}
+				name := string(val[1 : 1+nl])
+				vl := int(binary.LittleEndian.Uint16(val[1+nl:]))
+				val = val[1+nl+2:]
+				if len(val) < vl {
+					return errors.New("bad xattr record")
+				}
+				h.xattrs[name] = val[:vl]
+				val = val[vl:]
+			}
+		case extComment:
+			h.comment = string(val)
+		case extOrigName:
+			h.origName = string(val)
+		case extFilter:
+			if len(val) != 2 || filterNames[val[0]] == "" || val[1] == 0 {
+				return errors.New("unsupported filter")
+			}
+			h.filter = entryFilter{kind: val[0], stride: val[1]}
+		case extMode:
+			if len(val) != 4 {
+				return errors.New("bad mode record")
+			}
+			h.hasMode, h.mode = true, binary.LittleEndian.Uint32(val)
+		case extMtime:
+			if len(val) != 8 {
+				return errors.New("bad mtime record")
+			}
+			h.mtime = time.Unix(0, int64(binary.LittleEndian.Uint64(val)))
+		case extSHA256:
+			if len(val) != sha256.Size {
+				return errors.New("bad checksum record")
+			}
+			h.sum = val
+		case extFileSize:
+			if len(val) != 8 {
+				return errors.New("bad file size record")
+			}
+			h.fileSize = binary.LittleEndian.Uint64(val)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("corrupt extension block for %s: %w", h.name, err)
+	}
+	return nil
+}
+
+// parseRecords walks a sequence of [1 byte tag][2 bytes length][value]
+// records, calling fn for each one.
+func parseRecords(b []byte, fn func(tag byte, val []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("truncated record")
+		}
+		tag := b[0]
+		n := int(binary.LittleEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return errors.New("truncated record")
+		}
+		if err := fn(tag, b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+func (h *entryHeader) extensions() []byte {
+	var ext []byte
+	if h.hasOwner {
+		var v [8]byte
+		binary.LittleEndian.PutUint32(v[0:4], h.uid)
+		binary.LittleEndian.PutUint32(v[4:8], h.gid)
+		ext = appendExtension(ext, extOwner, v[:])
+	}
+	if len(h.xattrs) > 0 {
+		names := make([]string, 0, len(h.xattrs))
+		for name := range h.xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var v []byte
+		for _, name := range names {
+			v = append(v, byte(len(name)))
+			v = append(v, name...)
+			v = binary.LittleEndian.AppendUint16(v, uint16(len(h.xattrs[name])))
+			v = append(v, h.xattrs[name]...)
+		}
+		ext = appendExtension(ext, extXattrs, v)
+	}
+	if h.comment != "" {
+		ext = appendExtension(ext, extComment, []byte(h.comment))
+	}
+	if h.origName != "" {
+		ext = appendExtension(ext, extOrigName, []byte(h.origName))
+	}
+	if h.filter.kind != filterNone {
+		ext = appendExtension(ext, extFilter, []byte{h.filter.kind, h.filter.stride})
+	}
+	if h.hasMode {
+		ext = appendExtension(ext, extMode, binary.LittleEndian.AppendUint32(nil, h.mode))
+	}
+	if !h.mtime.IsZero() {
+		ext = appendExtension(ext, extMtime, binary.LittleEndian.AppendUint64(nil, uint64(h.mtime.UnixNano())))
+	}
+	if h.sum != nil {
+		ext = appendExtension(ext, extSHA256, h.sum)
+	}
+	if h.typ == entryChunks {
+		ext = appendExtension(ext, extFileSize, binary.LittleEndian.AppendUint64(nil, h.fileSize))
+	}
+	return ext
+}
+
+func appendExtension(ext []byte, tag byte, val []byte) []byte {
+	ext = append(ext, tag)
+	ext = binary.LittleEndian.AppendUint16(ext, uint16(len(val)))
+	return append(ext, val...)
+}
+
+// writeEntryHeader writes h in the current (v2) payload format.
+func writeEntryHeader(w io.Writer, h entryHeader) error {
+	nameBytes := []byte(h.name)
+	if len(nameBytes) > 65535 {
+		return fmt.Errorf("filename too long: %s", h.name)
+	}
+	ext := h.extensions()
+	if len(ext) > 65535 {
+		return fmt.Errorf("too much metadata for %s", h.name)
+	}
+	var b []byte
+	b = append(b, h.typ)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(nameBytes)))
+	b = append(b, nameBytes...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(ext)))
+	b = append(b, ext...)
+	b = binary.LittleEndian.AppendUint64(b, h.size)
+	_, err := w.Write(b)
+	return err
+}
+
+func listArchive(archivePath, password string, ro readOptions) ([]entryHeader, archiveMeta, error) {
+	ar, err := openArchive(archivePath, password)
+	if err != nil {
+		return nil, archiveMeta{}, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(ro); err != nil {
+		return nil, ar.meta, err
+	}
+	if ar.blocks != nil && ar.blocks.flags&payloadPerFile != 0 {
+		entries, err := listPerFile(ar)
+		copySizes(entries)
+		return entries, ar.meta, err
+	}
+	var entries []entryHeader
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, ar.meta, err
+		}
+		if h.refers() {
+			target := make([]byte, h.size)
+			if _, err := io.ReadFull(ar.payload, target); err != nil {
+				return nil, ar.meta, err
+			}
+			h.linkTarget = string(target)
+		} else if _, err := io.CopyN(io.Discard, ar.payload, int64(h.size)); err != nil {
+			// skip file bytes
+			return nil, ar.meta, err
+		}
+		entries = append(entries, h)
+	}
+	copySizes(entries)
+	return entries, ar.meta, nil
+}
+
+// listPerFile lists a non-solid archive by decoding only the blocks that
+// start an entry; the data of large files is never decompressed. Which
+// blocks those are the block index says, which the index tag vouches for.
+func listPerFile(ar *archiveReader) ([]entryHeader, error) {
+	var entries []entryHeader
+	for i, b := range ar.index {
+		if b.flags&blockEntryStart == 0 {
+			continue
+		}
+		end := ar.blocksEnd
+		for j := i + 1; j < len(ar.index); j++ {
+			if ar.index[j].flags&blockEntryStart != 0 {
+				end = ar.index[j].offset
+				break
+			}
+		}
+		raw, method, err := ar.blocks.readAt(ar.r, ar.index, i)
+		if err != nil {
+			return nil, err
+		}
+		r := bytes.NewReader(raw)
+		h, err := ar.nextEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		if h.refers() {
+			target := make([]byte, h.size)
+			if _, err := io.ReadFull(r, target); err != nil {
+				return nil, err
+			}
+			h.linkTarget = string(target)
+		}
+		// the entry owns its blocks, so the first block's method is the entry's
+		h.method, h.stored, h.hasMethod = method, end-b.offset, true
+		entries = append(entries, h)
+	}
+	// the index of archives without an index tag is not authenticated
+	if ar.meta.hasTotals && uint64(len(entries)) != ar.meta.entries {
+		return nil, fmt.Errorf("the block index lists %d entries, the header says %d", len(entries), ar.meta.entries)
+	}
+	return entries, nil
+}
+
+// entryReader reads the payload of a non-solid archive as ar.payload
+// does, but decodes the blocks of an entry only as they are read:
+// skipEntry leaves the rest of the entry undecoded, so an entry -files
+// leaves out costs its first block, as in listPerFile, however large it
+// is.
+type entryReader struct {
+	ar     *archiveReader
+	starts []int // the blocks that start entries
+	next   int   // the entry of starts to open next
+
+	buf      []byte       // the unread rest of the entry's first block
+	block    []byte       // that block, wiped once read
+	rest     *blockReader // its other blocks, once they are read
+	from, to int          // the blocks of rest, to for none
+}
+
+func newEntryReader(ar *archiveReader) *entryReader {
+	er := &entryReader{ar: ar}
+	for i, b := range ar.index {
+		if b.flags&blockEntryStart != 0 {
+			er.starts = append(er.starts, i)
+		}
+	}
+	return er
+}
+
+func (er *entryReader) Read(p []byte) (int, error) {
+	for {
+		if len(er.buf) > 0 {
+			n := copy(p, er.buf)
+			er.buf = er.buf[n:]
+			return n, nil
+		}
+		if er.rest == nil && er.from < er.to {
+			off := er.ar.index[er.from].offset
+			er.rest = er.ar.blocks.reopen(bufio.NewReader(io.NewSectionReader(er.ar.r, off, er.ar.r.Size()-off)), uint64(er.from))
+			er.rest.stop = uint64(er.to)
+		}
+		if er.rest != nil {
+			n, err := er.rest.Read(p)
+			if err == io.EOF {
+				er.skipEntry()
+				continue
+			}
+			return n, err
+		}
+		if er.next == len(er.starts) {
+			return 0, io.EOF
+		}
+		first := er.starts[er.next]
+		er.next++
+		er.from, er.to = first+1, len(er.ar.index)
+		if er.next < len(er.starts) {
+			er.to = er.starts[er.next]
+		}
+		raw, _, err := er.ar.blocks.readAt(er.ar.r, er.ar.index, first)
+		if err != nil {
+			return 0, err
+		}
+		er.block, er.buf = raw, raw
+	}
+}
+
+// skipEntry drops the rest of the entry being read.
+func (er *entryReader) skipEntry() {
+	clear(er.block)
+	er.block, er.buf = nil, nil
+	if er.rest != nil {
+		er.rest.Close()
+		er.rest = nil
+	}
+	er.from = er.to
+}
+
+// displayName formats an entry name for listings: directories get a
+// trailing slash and links show what they point to.
+func displayName(h entryHeader) string {
+	switch h.typ {
+	case entryDir:
+		return h.name + "/"
+	case entrySymlink:
+		return h.name + " -> " + h.linkTarget
+	case entryHardlink:
+		return h.name + " => " + h.linkTarget
+	case entryCopy:
+		return h.name + " == " + h.linkTarget
+	case entryDeleted:
+		return h.name + " (deleted)"
+	}
+	return h.name
+}
+
+// printListing prints the result of listArchive; verbose adds one line
+// per entry with its mode, size, modification time, checksum and comment
+// and, for per-file archives, its compressed size, ratio and compression
+// method.
+func printListing(entries []entryHeader, meta archiveMeta, verbose bool) {
+	fmt.Println()
+	if id := meta.idString(); id != "" {
+		fmt.Println("Archive ID:", id)
+		fmt.Printf("Created:    %s by %s on %s\n", meta.created.Format(time.RFC3339), meta.tool, meta.host)
+	}
+	if meta.comment != "" {
+		fmt.Println("Comment:", meta.comment)
+	}
+	if meta.dictID != nil {
+		fmt.Printf("Dictionary: %x\n", meta.dictID)
+	}
+	if meta.exec != "" {
+		fmt.Println("Compressor:", meta.exec)
+	}
+	if meta.fips {
+		fmt.Println("FIPS mode:  yes (AES-GCM, PBKDF2)")
+	}
+	if meta.basePath != "" {
+		fmt.Printf("Base:       %s (%s)\n", meta.basePath, formatUUID(meta.baseID))
+	}
+	if meta.hasTotals {
+		fmt.Printf("Entries:    %d (%d bytes)\n", meta.entries, meta.totalSize)
+	}
+	fmt.Println("Files in archive:")
+	if !verbose {
+		for _, h := range entries {
+			fmt.Println("  -", displayName(h))
+		}
+		return
+	}
+	const row = "  %-10s %12s %12s %7s  %-16s  %-12s  %s\n"
+	fmt.Printf(row, "Mode", "Original", "Compressed", "Ratio", "Modified", "SHA-256", "Name")
+	var total, stored int64
+	perFile := false
+	for _, h := range entries {
+		var tags []string
+		if h.hasMethod && (h.typ == entryFile || h.typ == entryChunks) {
+			tags = append(tags, methodName(h.method))
+		}
+		if h.filter.kind != filterNone {
+			tags = append(tags, h.filter.String())
+		}
+		if h.typ == entryChunks {
+			tags = append(tags, "shared chunks")
+		}
+		name := displayName(h)
+		if len(tags) > 0 {
+			name += "  [" + strings.Join(tags, ", ") + "]"
+		}
+		orig, comp, ratio, mtime, sum := "-", "-", "-", "-", "-"
+		if size, ok := h.listedSize(); ok {
+			orig = strconv.FormatUint(size, 10)
+			total += int64(size)
+		}
+		if h.hasMethod {
+			// the stored size includes the entry header and block framing
+			comp = strconv.FormatInt(h.stored, 10)
+			if (h.typ == entryFile || h.typ == entryChunks) && h.contentSize() > 0 {
+				ratio = formatRatio(h.stored, h.contentSize())
+			}
+			stored += h.stored
+			perFile = true
+		}
+		if !h.mtime.IsZero() {
+			mtime = h.mtime.Local().Format("2006-01-02 15:04")
+		}
+		if h.sum != nil {
+			sum = fmt.Sprintf("%x", h.sum[:6]) // -json prints all of it
+		}
+		fmt.Printf(row, modeString(h), orig, comp, ratio, mtime, sum, name)
+		if h.comment != "" {
+			fmt.Printf("  %-10s %12s %12s %7s  %-16s  %-12s    # %s\n", "", "", "", "", "", "", h.comment)
+		}
+	}
+	if perFile && total > 0 {
+		fmt.Printf(row, "", strconv.FormatInt(total, 10), strconv.FormatInt(stored, 10), formatRatio(stored, uint64(total)), "", "", "(total)")
+	}
+}
+
+// formatRatio formats stored bytes as a percentage of size, to fit the
+// Ratio column: tiny files can take many times their size to store.
+func formatRatio(stored int64, size uint64) string {
+	ratio := 100 * float64(stored) / float64(size)
+	if ratio >= 9999.95 {
+		return ">9999%"
+	}
+	return fmt.Sprintf("%.1f%%", ratio)
+}
+
+// Keys of -sort.
+const (
+	sortName  = "name"
+	sortSize  = "size"
+	sortMtime = "mtime"
+)
+
+func checkSortKey(key string) error {
+	switch key {
+	case "", sortName, sortSize, sortMtime:
+		return nil
+	}
+	return fmt.Errorf("-sort %s: not one of name, size or mtime", key)
+}
+
+// selectEntries keeps the entries matching one of patterns (all of them
+// if patterns is nil).
+func selectEntries(entries []entryHeader, patterns []string) []entryHeader {
+	if patterns == nil {
+		return entries
+	}
+	var selected []entryHeader
+	for _, h := range entries {
+		if selectedBy(patterns, h.name) {
+			selected = append(selected, h)
+		}
+	}
+	return selected
+}
+
+// sortEntries sorts entries by key: names in byte order, the largest files
+// or the most recently modified entries first. Ties, and "" for key, keep
+// the archive's order; entries without a recorded time come last.
+func sortEntries(entries []entryHeader, key string) {
+	switch key {
+	case sortName:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	case sortSize:
+		size := func(h entryHeader) uint64 {
+			size, _ := h.listedSize()
+			return size
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return size(entries[i]) > size(entries[j]) })
+	case sortMtime:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].mtime.After(entries[j].mtime) })
+	}
+}
+
+// modeString formats the type and mode of h the way ls -l does, e.g.
+// "drwxr-xr-x", with dashes for the permissions of entries that have
+// none recorded.
+func modeString(h entryHeader) string {
+	b := []byte("----------")
+	switch h.typ {
+	case entryDir:
+		b[0] = 'd'
+	case entrySymlink:
+		b[0] = 'l'
+		copy(b[1:], "rwxrwxrwx")
+	case entryHardlink:
+		b[0] = 'h'
+	}
+	if !h.hasMode {
+		return string(b)
+	}
+	for i, c := range "rwxrwxrwx" {
+		if h.mode&(1<<(8-i)) != 0 {
+			b[1+i] = byte(c)
+		}
+	}
+	for i, special := range []struct {
+		bit      uint32
+		set, off byte
+	}{{0o4000, 's', 'S'}, {0o2000, 's', 'S'}, {0o1000, 't', 'T'}} {
+		if h.mode&special.bit != 0 {
+			if x := 3 + 3*i; b[x] == 'x' {
+				b[x] = special.set
+			} else {
+				b[x] = special.off
+			}
+		}
+	}
+	return string(b)
+}
+
+// readOptions supply what decoding some archives needs.
+type readOptions struct {
+	dict      []byte // the dictionary the archive was compressed with
+	allowExec bool   // run the external compressor the archive names
+	maxMemory int64  // refuse blocks needing more memory (0 = no limit)
+
+	// limits.go; 0 = no limit
+	maxExtractSize, maxEntrySize, maxEntries int64
+}
+
+// extractOptions holds the optional behaviour of extractArchive.
+type extractOptions struct {
+	readOptions
+
+	restoreOwner bool // chown entries to their recorded uid/gid (canChown)
+	xattrs       bool // restore recorded extended attributes
+	noPerms      bool // leave the recorded modes unapplied
+	noTimes      bool // leave the recorded modification times unapplied
+	unsafeLinks  bool // extract absolute symlinks and ones leading out of the destination
+
+	// nameForm selects how names are written: nameNFC (default, ""),
+	// nameNFD (macOS) or nameOriginal (the bytes given at create time).
+	nameForm string
+
+	// files limits extraction to the entries matching these patterns
+	// (glob.go); nil extracts everything.
+	files []string
+
+	// existing is what to do with files already there (existing.go).
+	existing string
+
+	// strip drops this many leading components of entry names, as tar's
+	// --strip-components; entries with no more than that are left out.
+	strip int
+
+	// transform renames entries after strip (transform.go).
+	transform []nameRule
+
+	// toStdout writes the contents of the selected files to stdout, one
+	// after the other, instead of extracting anything.
+	toStdout bool
+
+	// resume continues an interrupted extraction (resume.go).
+	resume bool
+
+	// verify reads every file back after writing it to check its
+	// checksum (verify.go); it is always checked as it is written.
+	verify bool
+
+	// collisions is what to do with names differing only by case on
+	// case-insensitive file systems (collide.go).
+	collisions string
+
+	// jobs is how many small files are written at once (parallel.go).
+	jobs int
+
+	// layers is shared by a differential archive and its bases while
+	// they are extracted one over the other (base.go).
+	layers *layers
+}
+
+func extractArchive(archivePath, destDir, password string, opts extractOptions) (err error) {
+	start := time.Now()
+	if opts.restoreOwner && !canChown() {
+		return errors.New("restoring ownership requires running as root or with CAP_CHOWN")
+	}
+	ar, err := openArchive(archivePath, password)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+	if err := ar.prepare(opts.readOptions); err != nil {
+		return err
+	}
+	top := opts.layers == nil // not extracting the base of another archive
+	if ar.meta.basePath != "" && !opts.toStdout {
+		if err := extractBase(archivePath, destDir, password, ar.meta, &opts); err != nil {
+			return err
+		}
+	}
+	payload := ar.payload
+	var entries *entryReader // skips what -files leaves out undecoded
+	if opts.files != nil && ar.blocks != nil && ar.blocks.flags&payloadPerFile != 0 && ar.index != nil {
+		entries = newEntryReader(ar)
+		defer entries.skipEntry()
+		payload = entries
+	}
+	r := interruptReader{payload}
+	src := newArchiveSource(archivePath, password, ar, opts.readOptions) // what copies and chunks name
+	defer src.Close()
+	// progress counts file data against the header total; v1 archives have
+	// none, so fall back to the payload size
+	total := int64(ar.meta.totalSize)
+	if !ar.meta.hasTotals {
+		total = ar.total
+	}
+	var doneBytes int64
+	var extracted int
+	names := make(map[string]string) // stored name -> name written
+	matched := make([]bool, len(opts.files))
+	conflicts := newConflicts(opts.existing)
+	if opts.layers != nil {
+		matched, conflicts, names = opts.layers.matched, opts.layers.conflicts, opts.layers.names
+	}
+	var dirs []dirToFinish
+	var deleted []string     // what deleted entries name
+	var bad mismatches       // files failing their checksum
+	var unsafeLinks []string // symlinks skipped (extractSymlink)
+	var cases *caseFolder    // nil unless the destination ignores case
+
+	// selected reports whether -files selects h, noting the patterns it
+	// matches; place returns where h goes ("" for nowhere)
+	selected := func(h entryHeader) bool {
+		if opts.files == nil {
+			return true
+		}
+		sel := false
+		for i, p := range opts.files {
+			if matchPattern(p, h.name) {
+				matched[i], sel = true, true
+			}
+		}
+		return sel
+	}
+	place := func(h entryHeader) (string, error) {
+		name, err := cases.resolve(opts.targetName(h), h.typ == entryDir)
+		if name == "" || err != nil {
+			return "", err
+		}
+		names[h.name] = name
+		return safeJoin(destDir, name)
+	}
+	// linked returns the name written for first, which hard link h links
+	// to
+	linked := func(h entryHeader, first string) (string, error) {
+		if n, ok := names[first]; ok {
+			return n, nil
+		} else if opts.files != nil {
+			return "", fmt.Errorf("%s is a hard link to %s, which -files leaves out", h.name, first)
+		} else if opts.strip > 0 || opts.transform != nil {
+			return "", fmt.Errorf("%s is a hard link to %s, which -strip or -transform leaves out", h.name, first)
+		} else if cases != nil {
+			return "", fmt.Errorf("%s is a hard link to %s, which -case-collisions skip leaves out", h.name, first)
+		}
+		return first, nil
+	}
+	// wrote returns the name first was written as, if this extraction
+	// wrote the file for the last entry of that name, for a copy or
+	// shared chunks to read it back; otherwise they read it from src
+	wrote := func(first string) (string, bool) {
+		n, ok := names[first]
+		if !ok {
+			return "", false
+		}
+		path, err := safeJoin(destDir, n)
+		return n, err == nil && conflicts.written[path]
+	}
+	// copyFrom hands write the contents of first, which a copy is a copy
+	// of, and their size
+	copyFrom := func(first string, write func(io.Reader, int64) error) (int64, error) {
+		n, ok := wrote(first)
+		if !ok {
+			from, size, err := src.open(first)
+			if err != nil {
+				return 0, err
+			}
+			return size, write(from, size)
+		}
+		f, size, err := openExtracted(destDir, n)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return size, write(f, size)
+	}
+	skip := func(h entryHeader) error {
+		if h.typ == entryFile || h.typ == entryChunks {
+			doneBytes += int64(h.contentSize())
+		}
+		if entries != nil {
+			entries.skipEntry()
+			return nil
+		}
+		_, err := io.CopyN(io.Discard, r, int64(h.size))
+		return err
+	}
+
+	var progress *progressLog
+	var written map[int]bool // entries written before -resume
+	if !opts.toStdout {
+		if progress, written, err = openProgress(destDir, ar.meta, opts.resume); err != nil {
+			return err
+		}
+		defer func() { progress.close(err) }()
+		if cases, err = newCaseFolder(destDir, opts.collisions); err != nil {
+			return err
+		}
+	}
+	// files written by goroutines are counted as they are finished
+	writes := newFileWriter(opts.jobs, func(pw *pendingWrite) error {
+		if err := bad.add(pw.h, pw.err); err != nil {
+			return fmt.Errorf("%s: %w", pw.h.name, err)
+		}
+		extracted++
+		doneBytes += int64(pw.h.size)
+		verbosef("%s", displayName(pw.h))
+		showProgress("Extracting", pw.h.name, doneBytes, total)
+		return nil
+	})
+	defer writes.abandon()
+	var prev string // the entry before num, done once num is reached
+	queued := false // unless a goroutine writes it, which notes it itself
+	for num := 0; ; num++ {
+		if num > 0 && !queued {
+			if err := progress.add(num-1, prev); err != nil {
+				return err
+			}
+		}
+		if num > 0 {
+			src.add(prev)
+		}
+		queued = false
+		h, err := ar.nextEntry(r)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		prev = h.name
+		last, hadLast := names[h.name] // what a deleted entry deletes
+		delete(names, h.name)          // until written for this entry
+		if !selected(h) {
+			if err := skip(h); err != nil {
+				return err
+			}
+			continue
+		}
+		if opts.toStdout {
+			lr := &io.LimitedReader{R: r, N: int64(h.size)}
+			data, size, err := src.contents(h, lr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", h.name, err)
+			}
+			if data != nil {
+				sum := sha256.New()
+				if _, err := io.CopyN(io.MultiWriter(stdout, sum), data, size); err != nil {
+					return fmt.Errorf("%s: %w", h.name, noEOF(err))
+				}
+				if err := bad.add(h, checkWritten("", h, sum.Sum(nil), false)); err != nil {
+					return err
+				}
+				extracted++
+				doneBytes += size
+			}
+			if _, err := io.Copy(io.Discard, lr); err != nil {
+				return fmt.Errorf("%s: %w", h.name, err)
+			}
+			if lr.N > 0 {
+				return fmt.Errorf("%s: %w", h.name, io.ErrUnexpectedEOF)
+			}
+			continue
+		}
+		target, err := place(h)
+		if err != nil {
+			return err
+		}
+		if target == "" || written[num] {
+			if target != "" && h.typ == entryDir {
+				dirs = append(dirs, dirToFinish{target, h})
+			}
+			if err := skip(h); err != nil {
+				return err
+			}
+			continue
+		}
+		name := names[h.name]
+		if h.typ == entryDeleted {
+			// only what this extraction wrote: a file kept by
+			// -skip-existing, -freshen or a rename is the user's
+			if path, err := safeJoin(destDir, last); hadLast && err == nil && conflicts.written[path] {
+				deleted = append(deleted, path)
+			}
+			delete(names, h.name)
+			verbosef("%s", displayName(h))
+			continue
+		}
+		if h.typ == entryDir {
+			if opts.existing == existingFreshen {
+				if _, err := os.Stat(target); err != nil {
+					continue // only what exists is freshened
+				}
+			}
+			// an existing symlink here would take the directory's
+			// mode and time out of the destination
+			if _, err := resolveBelow(destDir, target); err != nil {
+				return err
+			}
+			if _, err := os.Lstat(target); errors.Is(err, fs.ErrNotExist) {
+				conflicts.written[target] = true // a deleted entry may remove it
+			}
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirToFinish{target, h})
+			verbosef("%s", displayName(h))
+			continue
+		}
+		if conflicts.written[target] || h.typ != entryFile {
+			// links need what they point to, and a later copy replaces
+			// the earlier one
+			if err := writes.flush(); err != nil {
+				return err
+			}
+		}
+		path, err := conflicts.resolve(target, h)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			if err := skip(h); err != nil {
+				return err
+			}
+			continue
+		}
+		if path != target { // renamed
+			names[h.name] = name + path[len(target):]
+			target = path
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if h.refers() {
+			data := make([]byte, h.size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			h.linkTarget = string(data)
+			if h.typ == entrySymlink {
+				err = extractSymlink(destDir, target, opts.linkTarget(h, string(data)), opts.unsafeLinks)
+				if errors.Is(err, errUnsafeLink) {
+					fmt.Fprintf(os.Stderr, "warning: %v; skipped (-allow-unsafe-links extracts it)\n", err)
+					unsafeLinks = append(unsafeLinks, h.name)
+					delete(names, h.name)
+					continue
+				}
+				if err == nil {
+					err = restoreOwner(target, h, opts)
+				}
+			} else if h.typ == entryHardlink {
+				var first string
+				if first, err = linked(h, string(data)); err != nil {
+					return err
+				}
+				err = extractHardlink(destDir, target, first)
+			} else {
+				var size int64
+				if size, err = copyFrom(string(data), func(from io.Reader, size int64) error {
+					return extractCopy(target, from, size, h, opts, &ar.limits, &bad)
+				}); err != nil {
+					return fmt.Errorf("%s: %w", h.name, err)
+				}
+				doneBytes += size
+			}
+			if err != nil {
+				return err
+			}
+			extracted++
+			verbosef("%s", displayName(h))
+			if h.typ == entryCopy {
+				showProgress("Extracting", h.name, doneBytes, total)
+			}
+			continue
+		}
+		if h.typ == entryChunks {
+			lr := &io.LimitedReader{R: r, N: int64(h.size)}
+			cr := src.chunks(lr)
+			archived := cr.open
+			cr.open = func(p chunkPlace, size int64) (io.Reader, error) {
+				first, ok := wrote(p.name)
+				if !ok {
+					return archived(p, size)
+				}
+				path, err := sourceJoin(destDir, first)
+				if err != nil {
+					return nil, err
+				}
+				return openSection(path, p.off, size)
+			}
+			data := &progressReader{r: cr, prefix: "Extracting", name: h.name, base: doneBytes, total: total}
+			sum := sha256.New()
+			err := writeEntryFile(target, io.TeeReader(data, sum), int64(h.fileSize))
+			cr.Close()
+			if err != nil {
+				return err
+			}
+			if lr.N > 0 {
+				return fmt.Errorf("%s: chunks beyond its size", h.name)
+			}
+			if err := bad.add(h, checkWritten(target, h, sum.Sum(nil), opts.verify)); err != nil {
+				return err
+			}
+			if err := restoreMetadata(target, h, opts); err != nil {
+				return err
+			}
+			extracted++
+			doneBytes += int64(h.fileSize)
+			verbosef("%s", displayName(h))
+			showProgress("Extracting", h.name, doneBytes, total)
+			continue
+		}
+		var data io.Reader = r
+		if h.filter.kind != filterNone {
+			data = &unfilterReader{r: r, f: h.filter}
+		}
+		if opts.jobs > 1 && h.size <= parallelFileMax {
+			buf, err := appendRead(nil, data, h.size)
+			if err != nil {
+				return err
+			}
+			err = writes.write(h, func() error {
+				err := writeRestored(target, h, buf, opts)
+				if err == nil || errors.Is(err, errChecksum) {
+					if perr := progress.add(num, h.name); perr != nil {
+						return perr
+					}
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			queued = true
+			continue
+		}
+		data = &progressReader{r: data, prefix: "Extracting", name: h.name, base: doneBytes, total: total}
+		sum := sha256.New()
+		if err := writeEntryFile(target, io.TeeReader(data, sum), int64(h.size)); err != nil {
+			return err
+		}
+		if err := bad.add(h, checkWritten(target, h, sum.Sum(nil), opts.verify)); err != nil {
+			return err
+		}
+		if err := restoreMetadata(target, h, opts); err != nil {
+			return err
+		}
+		extracted++
+		doneBytes += int64(h.size)
+		verbosef("%s", displayName(h))
+		showProgress("Extracting", h.name, doneBytes, total)
+	}
+	if err := writes.flush(); err != nil {
+		return err
+	}
+	// once nothing reads from them any more
+	if err := deleteEntries(deleted); err != nil {
+		return err
+	}
+	// last, deepest first: writing into a directory changes its time, and
+	// a read-only one, or one given away, could not be written into
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreMetadata(dirs[i].path, dirs[i].h, opts); err != nil {
+			return err
+		}
+	}
+	if err := progress.finish(); err != nil {
+		return err
+	}
+	if doneBytes < total {
+		showProgress("Extracting", "", total, total)
+	}
+	verbosef("Extracted %d files.", extracted)
+	debugf("extracted in %v", time.Since(start).Round(time.Millisecond))
+	for i, ok := range matched {
+		if !ok && top {
+			return fmt.Errorf("no entry matches -files %q", opts.files[i])
+		}
+	}
+	if len(unsafeLinks) > 0 {
+		return errors.Join(fmt.Errorf("%d symlink(s) absolute or leading out of the destination skipped: %s", len(unsafeLinks), strings.Join(unsafeLinks, ", ")), bad.err())
+	}
+	return bad.err()
+}
+
+// targetName returns the name entry h is extracted as, "" if -strip or
+// -transform leave it out, made valid for this system (localName).
+func (opts extractOptions) targetName(h entryHeader) string {
+	return localName(opts.rename(extractName(h, opts.nameForm), h.typ == entryDir))
+}
+
+// rename applies -strip and -transform to name, that of a directory if
+// dir.
+func (opts extractOptions) rename(name string, dir bool) string {
+	name = stripComponents(name, opts.strip)
+	if name != "" && opts.transform != nil {
+		if dir { // so that dir/=new/ renames dir too
+			name += "/"
+		}
+		name = strings.TrimSuffix(transformName(opts.transform, name), "/")
+	}
+	return name
+}
+
+// stripComponents drops the first n slash-separated components of name,
+// returning "" if it has no more than n.
+func stripComponents(name string, n int) string {
+	for ; n > 0; n-- {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return ""
+		}
+		name = name[i+1:]
+	}
+	return name
+}
+
+// safeJoin joins an archive entry name onto destDir, rejecting names that
+// would land outside of it: absolute paths, ".." components, and names
+// whose parent directory on disk leads out through a symlink extracted
+// (or found) there before.
+func safeJoin(destDir, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if filepath.IsAbs(local) || !filepath.IsLocal(local) {
+		return "", fmt.Errorf("unsafe entry name: %s", name)
+	}
+	target := filepath.Join(destDir, local)
+	if _, err := resolveBelow(destDir, filepath.Dir(target)); err != nil {
+		return "", fmt.Errorf("unsafe entry name: %s: %w", name, err)
+	}
+	return target, nil
+}
+
+// sourceJoin returns the path of the extracted file named name, which a
+// hard link, copy or chunk is read from: a regular file, and not outside
+// destDir.
+func sourceJoin(destDir, name string) (string, error) {
+	src, err := safeJoin(destDir, name)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Lstat(src); err != nil {
+		return "", err
+	} else if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", src)
+	}
+	return src, nil
+}
+
+// maxLinkDepth is how many symlinks resolving a path may follow, as
+// Linux allows.
+const maxLinkDepth = 40
+
+// resolveBelow returns where path, destDir or below it, leads on disk,
+// following the symlinks in it as the file system would; what does not
+// exist yet is taken as named. It fails if that is not destDir or below.
+func resolveBelow(destDir, path string) (string, error) {
+	root, err := resolvePath(filepath.Abs(destDir))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(destDir, path)
+	if err != nil {
+		return "", err
+	}
+	return resolveIn(root, root, rel)
+}
+
+// resolvePath resolves the absolute path abs, as returned with err by
+// filepath.Abs.
+func resolvePath(abs string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	vol := filepath.VolumeName(abs)
+	return followPath(vol+string(filepath.Separator), abs[len(vol):], 0)
+}
+
+// resolveIn follows rel from dir, a resolved directory, and checks that
+// it leads to root or below.
+func resolveIn(root, dir, rel string) (string, error) {
+	real, err := followPath(dir, rel, 0)
+	if err != nil {
+		return "", err
+	}
+	if r, err := filepath.Rel(root, real); err != nil || r != "." && !filepath.IsLocal(r) {
+		return "", fmt.Errorf("%s leads out of the destination through a symlink", filepath.Join(dir, rel))
+	}
+	return real, nil
+}
+
+// followPath follows rel from the resolved directory dir component by
+// component: ".." steps out of where the symlinks before it led, not out
+// of their names. depth counts the symlinks followed.
+func followPath(dir, rel string, depth int) (string, error) {
+	cur := dir
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, part)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+			cur = next
+			continue
+		}
+		if depth >= maxLinkDepth {
+			return "", fmt.Errorf("%s: too many levels of symlinks", next)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if vol := filepath.VolumeName(link); filepath.IsAbs(link) {
+			cur, link = vol+string(filepath.Separator), link[len(vol):]
+		}
+		if cur, err = followPath(cur, link, depth+1); err != nil {
+			return "", err
+		}
+	}
+	return cur, nil
+}
+
+// errUnsafeLink marks symlinks that are absolute or lead out of the
+// destination, which extraction skips unless told to allow them.
+var errUnsafeLink = errors.New("unsafe symlink")
+
+// extractSymlink recreates a symlink at target. Unless allow is set,
+// link targets that would resolve outside destDir, from where target
+// really is and through the symlinks already there, are refused
+// (errUnsafeLink) so a crafted archive cannot plant links that later
+// writes follow out of the destination; with allow, safeJoin still
+// refuses those writes, as it checks where names really lead.
+func extractSymlink(destDir, target, linkTarget string, allow bool) error {
+	lt := filepath.FromSlash(linkTarget)
+	dir, err := resolveBelow(destDir, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if !allow {
+		if filepath.IsAbs(lt) || filepath.VolumeName(lt) != "" {
+			return fmt.Errorf("%w: %s points to absolute path %s", errUnsafeLink, target, linkTarget)
+		}
+		root, err := resolvePath(filepath.Abs(destDir))
+		if err != nil {
+			return err
+		}
+		if _, err := resolveIn(root, dir, lt); err != nil {
+			return fmt.Errorf("%w: %s escapes destination (-> %s)", errUnsafeLink, target, linkTarget)
+		}
+	}
+	// replace whatever is already there, as regular files are overwritten too
+	if _, err := os.Lstat(target); err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(lt, target)
+}
+
+// restoreOwner applies the recorded uid/gid to target when requested.
+// Lchown is used so symlinks themselves (not their targets) are changed.
+func restoreOwner(target string, h entryHeader, opts extractOptions) error {
+	if !opts.restoreOwner || !h.hasOwner {
+		return nil
+	}
+	return os.Lchown(target, int(h.uid), int(h.gid))
+}
+
+// restoreMetadata restores the recorded extended attributes, mode, time
+// and owner of the file or directory target. The owner comes last, as
+// with only CAP_CHOWN nothing else may be changed once the file is given
+// away; chown clears the setuid and setgid bits and file capabilities,
+// which are then set again where that is allowed.
+func restoreMetadata(target string, h entryHeader, opts extractOptions) error {
+	restoreXattrs(target, h, opts)
+	if err := restoreModeTime(target, h, opts); err != nil {
+		return err
+	}
+	if !opts.restoreOwner || !h.hasOwner {
+		return nil
+	}
+	if err := restoreOwner(target, h, opts); err != nil {
+		return err
+	}
+	if h.hasMode && !opts.noPerms && h.mode&0o6000 != 0 {
+		if err := os.Chmod(target, fileMode(h.mode)); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: setuid/setgid bits not restored: %v\n", h.name, err)
+		}
+	}
+	if c, ok := h.xattrs["security.capability"]; ok && opts.xattrs {
+		if err := writeXattrs(target, map[string][]byte{"security.capability": c}); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: file capabilities not restored: %v\n", h.name, err)
+		}
+	}
+	return nil
+}
+
+// dirToFinish is an extracted directory whose metadata is restored once
+// everything in it has been written.
+type dirToFinish struct {
+	path string
+	h    entryHeader
+}
+
+// restoreModeTime applies the recorded mode and modification time to the
+// file or directory target. Symlinks keep the time they are created at.
+func restoreModeTime(target string, h entryHeader, opts extractOptions) error {
+	if h.hasMode && !opts.noPerms {
+		if err := os.Chmod(target, fileMode(h.mode)); err != nil {
+			return err
+		}
+	}
+	if !h.mtime.IsZero() && !opts.noTimes {
+		return os.Chtimes(target, time.Time{}, h.mtime)
+	}
+	return nil
+}
+
+// restoreXattrs applies recorded extended attributes. Failures, e.g. a
+// filesystem without xattr support or missing privileges for security.*,
+// are reported but not fatal.
+func restoreXattrs(target string, h entryHeader, opts extractOptions) {
+	if !opts.xattrs || len(h.xattrs) == 0 {
+		return
+	}
+	if err := writeXattrs(target, h.xattrs); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s: restoring xattrs: %v\n", h.name, err)
+	}
+}
+
+// extractHardlink links target to the already extracted entry named first.
+func extractHardlink(destDir, target, first string) error {
+	src, err := sourceJoin(destDir, first)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return os.Link(src, target)
+}
+
+// archiveMeta is the archive-level metadata kept in its own encrypted header
+// section. It is encoded with the same tag/length records as entry extensions.
+type archiveMeta struct {
+	comment string
+
+	// provenance, filled in by newArchiveMeta
+	id      [16]byte // random (version 4) UUID; stored in the plain header
+	host    string
+	tool    string
+	created time.Time
+
+	// totals, so listings and progress bars need no pass over the payload
+	entries   uint64
+	totalSize uint64 // sum of file data sizes
+	hasTotals bool
+
+	dictID []byte // dictionary the payload was compressed with (nil = none)
+	exec   string // external compressor command line (method exec)
+	fips   bool   // created with -fips
+
+	// the archive a differential archive was made against (base.go);
+	// basePath is relative to the archive's directory unless absolute
+	baseID   [16]byte
+	basePath string
+}
+
+const (
+	metaComment byte = 1 // UTF-8 text
+	// 2 was the UUID, which is in the plain header now
+	metaHost    byte = 3  // creator hostname
+	metaTool    byte = 4  // creating tool and version
+	metaCreated byte = 5  // int64 unix nanoseconds
+	metaTotals  byte = 6  // entry count uint64, total file size uint64
+	metaDict    byte = 7  // 8 byte dictionary ID
+	metaExec    byte = 8  // external compressor command line
+	metaFIPS    byte = 9  // empty; created with approved algorithms only
+	metaBase    byte = 10 // base archive ID (16 bytes), then its path
+)
+
+// newArchiveMeta returns metadata for a new archive with a fresh random ID.
+func newArchiveMeta() (archiveMeta, error) {
+	m := archiveMeta{tool: toolVersion, created: time.Now()}
+	if _, err := rand.Read(m.id[:]); err != nil {
+		return m, err
+	}
+	m.id[6] = m.id[6]&0x0f | 0x40 // version 4
+	m.id[8] = m.id[8]&0x3f | 0x80 // RFC 4122 variant
+	m.host, _ = os.Hostname()
+	return m, nil
+}
+
+// idString formats the archive ID as a canonical UUID, or "" if unset.
+func (m archiveMeta) idString() string {
+	if m.id == [16]byte{} {
+		return ""
+	}
+	return formatUUID(m.id)
+}
+
+func formatUUID(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (m archiveMeta) encode() []byte {
+	var b []byte
+	if m.comment != "" {
+		b = appendExtension(b, metaComment, []byte(m.comment))
+	}
+	if m.host != "" {
+		b = appendExtension(b, metaHost, []byte(m.host))
+	}
+	if m.tool != "" {
+		b = appendExtension(b, metaTool, []byte(m.tool))
+	}
+	if !m.created.IsZero() {
+		b = appendExtension(b, metaCreated, binary.LittleEndian.AppendUint64(nil, uint64(m.created.UnixNano())))
+	}
+	if m.hasTotals {
+		v := binary.LittleEndian.AppendUint64(nil, m.entries)
+		v = binary.LittleEndian.AppendUint64(v, m.totalSize)
+		b = appendExtension(b, metaTotals, v)
+	}
+	if m.dictID != nil {
+		b = appendExtension(b, metaDict, m.dictID)
+	}
+	if m.exec != "" {
+		b = appendExtension(b, metaExec, []byte(m.exec))
+	}
+	if m.fips {
+		b = appendExtension(b, metaFIPS, nil)
+	}
+	if m.basePath != "" {
+		b = appendExtension(b, metaBase, append(m.baseID[:], m.basePath...))
+	}
+	return b
+}
+
+func decodeArchiveMeta(b []byte) (archiveMeta, error) {
+	var m archiveMeta
+	err := parseRecords(b, func(tag byte, val []byte) error {
+		switch tag {
+		case metaComment:
+			m.comment = string(val)
+		case metaHost:
+			m.host = string(val)
+		case metaTool:
+			m.tool = string(val)
+		case metaCreated:
+			if len(val) != 8 {
+				return errors.New("bad creation time")
+			}
+			m.created = time.Unix(0, int64(binary.LittleEndian.Uint64(val)))
+		case metaTotals:
+			if len(val) != 16 {
+				return errors.New("bad totals")
+			}
+			m.entries = binary.LittleEndian.Uint64(val[0:8])
+			m.totalSize = binary.LittleEndian.Uint64(val[8:16])
+			m.hasTotals = true
+		case metaDict:
+			if len(val) != 8 {
+				return errors.New("bad dictionary id")
+			}
+			m.dictID = val
+		case metaExec:
+			m.exec = string(val)
+		case metaFIPS:
+			m.fips = true
+		case metaBase:
+			if len(val) <= 16 {
+				return errors.New("bad base archive")
+			}
+			m.baseID, m.basePath = [16]byte(val[:16]), string(val[16:])
+		}
+		return nil
+	})
+	if err != nil {
+		return m, fmt.Errorf("corrupt archive metadata: %w", err)
+	}
+	return m, nil
+}
+
+// archiveReader is an opened archive whose payload is decrypted and
+// decompressed as it is read.
+type archiveReader struct {
+	f       *os.File
+	r       *io.SectionReader // the archive without any recovery section
+	version byte
+	meta    archiveMeta
+	payload io.Reader
+	total   int64  // payload size in bytes
+	plain   []byte // v1 only: the whole payload, wiped on Close
+
+	// v1 only: the payload as read, until prepare decodes it
+	comp []byte
+	freq [256]uint64
+
+	// v2 only
+	table       slotTable // the key slots, kept for rewriting the archive
+	blocks      *blockReader
+	index       []blockInfo
+	blocksStart int64 // file offset of the first block's length prefix
+	blocksEnd   int64 // file offset just past the last block
+
+	limits entryLimits // set by prepare
+}
+
+func (ar *archiveReader) Close() error {
+	clear(ar.plain)
+	clear(ar.comp)
+	if ar.blocks != nil {
+		ar.blocks.Close()
+	}
+	return ar.f.Close()
+}
+
+// reread returns a second reader of the payload, from its start, which
+// goes through it independently of ar.payload. One of a v2 archive is a
+// *blockReader, to be closed.
+func (ar *archiveReader) reread() io.Reader {
+	if ar.blocks == nil {
+		return bytes.NewReader(ar.plain)
+	}
+	return ar.blocks.reopen(bufio.NewReader(io.NewSectionReader(ar.r, ar.blocksStart, ar.r.Size()-ar.blocksStart)), 0)
+}
+
+// prepare hands the block reader what the archive needs for decoding: the
+// dictionary it was compressed with and, if allowed, its external
+// compressor. Options the archive does not need are ignored. It also sets
+// the limits nextEntry checks and holds the header's totals to them, and
+// decodes the payload of a v1 archive within them.
+func (ar *archiveReader) prepare(ro readOptions) error {
+	ar.limits = entryLimits{maxExtractSize: ro.maxExtractSize, maxEntrySize: ro.maxEntrySize, maxEntries: ro.maxEntries}
+	if err := ar.limits.checkTotals(ar.meta); err != nil {
+		return err
+	}
+	if ar.version == versionV1 {
+		if ar.comp == nil { // decoded already
+			return nil
+		}
+		return ar.decodeV1(ro)
+	}
+	if ro.dict != nil && ar.meta.dictID != nil {
+		if id := dictID(ro.dict); !bytes.Equal(id, ar.meta.dictID) {
+			return fmt.Errorf("dictionary %x does not match the archive's dictionary %x", id, ar.meta.dictID)
+		}
+		ar.blocks.coding.dict = ro.dict
+	}
+	if ro.allowExec && ar.meta.exec != "" {
+		ar.blocks.coding.exec = strings.Fields(ar.meta.exec)
+	}
+	ar.blocks.maxMemory = ro.maxMemory
+	if ro.maxMemory > 0 {
+		// blocks decoded in parallel share the limit; BWT needs the most
+		n := ro.maxMemory / blockMemory(methodBWT, ar.blocks.size, true)
+		ar.blocks.workers = int(max(1, min(n, int64(ar.blocks.workers))))
+	}
+	return nil
+}
+
+// Ciphers sealing the metadata and blocks of v2 archives.
+const (
+	// cipherAESGCM is AES-256-GCM with 12 byte nonces (v1 archives too).
+	cipherAESGCM byte = 0
+
+	// cipherXChaCha20 is XChaCha20-Poly1305 (chacha.go) with 24 byte
+	// nonces, which can be picked at random practically without limit.
+	cipherXChaCha20 byte = 1
+
+	// cipherAESGCMSIV is AES-256-GCM-SIV (gcmsiv.go), which stays safe
+	// if a nonce ever repeats.
+	cipherAESGCMSIV byte = 2
+)
+
+var cipherNames = map[byte]string{
+	cipherAESGCM:    "aes-gcm",
+	cipherXChaCha20: "xchacha20",
+	cipherAESGCMSIV: "aes-gcm-siv",
 }
 
-func readAndDecryptArchive(path, password string) ([]byte, error) {
+// parseCipher looks up a cipher by name.
+func parseCipher(name string) (byte, error) {
+	for id, n := range cipherNames {
+		if n == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q (available: aes-gcm, aes-gcm-siv, xchacha20)", name)
+}
+
+// newAEAD returns the cipher id stands for, keyed with a derived archive key.
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case cipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherXChaCha20:
+		return newXChaCha20Poly1305(key)
+	case cipherAESGCMSIV:
+		return newAESGCMSIV(key)
+	}
+	return nil, fmt.Errorf("unsupported cipher %d", id)
+}
+
+// openArchive checks the header, decrypts the metadata and prepares the
+// payload stream of the archive at path.
+func openArchive(path, password string) (*archiveReader, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	start, end, _, err := sfxRange(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sec := io.NewSectionReader(f, start, end-start)
+	size, err := archiveLength(sec, end-start)
+	if err == nil {
+		size, _, err = signatureLength(sec, size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ar, err := readArchiveHeader(io.NewSectionReader(f, start, size), password)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ar.f = f
+	return ar, nil
+}
+
+// errBadIndex is returned by readArchiveHeader, along with the archive
+// read so far, when the block index cannot be read, so that salvage can
+// rebuild it.
+var errBadIndex = errors.New("block index damaged")
+
+func readArchiveHeader(f *io.SectionReader, password string) (*archiveReader, error) {
 	m := make([]byte, len(magic))
 	if _, err := io.ReadFull(f, m); err != nil {
 		return nil, err
@@ -552,228 +3610,250 @@ func readAndDecryptArchive(path, password string) ([]byte, error) {
 	if _, err := io.ReadFull(f, ver); err != nil {
 		return nil, err
 	}
-	if ver[0] != version {
+	if ver[0] != version && ver[0] != versionV1 {
 		return nil, fmt.Errorf("unsupported version: %d", ver[0])
 	}
-	key := sha256.Sum256([]byte(password))
-	block, err := aes.NewCipher(key[:])
+	ar := &archiveReader{r: f, version: ver[0]}
+	if ar.version == versionV1 {
+		kdf := kdfParams{alg: kdfSHA256}
+		fmt.Fprintf(os.Stderr, "warning: weak key derivation: %s\n", kdf.weakness())
+		key, err := kdf.deriveKey(password)
+		if err != nil {
+			return nil, err
+		}
+		comp, freq, err := readPayloadV1(f, key)
+		clear(key)
+		if err != nil {
+			return nil, err
+		}
+		// decoded by prepare, once the limits are known
+		ar.comp, ar.freq = comp, freq
+		ar.total = int64(freqTotal(freq))
+		return ar, nil
+	}
+
+	table, err := readSlotTable(f)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	unlocking := time.Now()
+	master, slot, err := table.unlock(password)
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(f, nonce); err != nil {
+	debugf("version %d, %s, key slot %d of %d opened in %v", ar.version, cipherNames[table.cipher], slot, len(table.slots), time.Since(unlocking).Round(time.Millisecond))
+	ar.table = table
+	defer clear(master) // the AEAD keeps its own copy
+	if s := table.slots[slot]; s.hasKDF() {
+		if weak := s.kdf.weakness(); weak != "" {
+			fmt.Fprintf(os.Stderr, "warning: weak key derivation in key slot %d: %s\n", slot, weak)
+		}
+	}
+	aead, err := newAEAD(table.cipher, master)
+	if err != nil {
 		return nil, err
 	}
-	var freq [256]uint64
-	for i := 0; i < 256; i++ {
-		if err := binary.Read(f, binary.LittleEndian, &freq[i]); err != nil {
-			return nil, err
-		}
+	metaNonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(f, metaNonce); err != nil {
+		return nil, err
 	}
-	var clen uint64
-	if err := binary.Read(f, binary.LittleEndian, &clen); err != nil {
+	var mlen uint32
+	if err := binary.Read(f, binary.LittleEndian, &mlen); err != nil {
 		return nil, err
 	}
-	ciphertext := make([]byte, clen)
-	if _, err := io.ReadFull(f, ciphertext); err != nil {
+	if err := checkRemaining(f, uint64(mlen), "header"); err != nil {
 		return nil, err
 	}
-	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	metaCipher, err := appendRead(nil, f, uint64(mlen))
 	if err != nil {
 		return nil, err
 	}
-	data, err := huffmanDecompress(plain, freq)
+	start, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
-}
-
-// ---------------------- Huffman compression -----------------------
-
-// node and heap for building Huffman tree
-type node struct {
-	b     byte
-	freq  uint64
-	left  *node
-	right *node
-}
-
-type nodeHeap []*node
+	metaPlain, err := aead.Open(nil, metaNonce, metaCipher, table.fixed)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt header: %w", err)
+	}
+	// what the blocks authenticate: the header without the key slots
+	authHeader := append([]byte(nil), table.fixed...)
+	authHeader = append(authHeader, metaNonce...)
+	authHeader = binary.LittleEndian.AppendUint32(authHeader, mlen)
+	authHeader = append(authHeader, metaCipher...)
+	if ar.meta, err = decodeArchiveMeta(metaPlain); err != nil {
+		return nil, err
+	}
+	ar.meta.id = table.id
 
-func (h nodeHeap) Len() int           { return len(h) }
-func (h nodeHeap) Less(i, j int) bool { return h[i].freq < h[j].freq }
-func (h nodeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-func (h *nodeHeap) Push(x interface{}) {
-	*h = append(*h, x.(*node))
-}
-func (h *nodeHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[:n-1]
-	return x
+	// The index at the end serves progress and random access; sequential
+	// readers go through the blocks in order.
+	index, tag, blocksEnd, indexErr := readBlockIndex(f)
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br, err := newBlockReader(bufio.NewReader(f), aead, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	br.dictID = ar.meta.dictID
+	ar.payload, ar.blocks = br, br
+	ar.blocksStart = start + 5 + int64(aead.NonceSize())
+	if indexErr == nil {
+		indexErr = br.checkIndex(index, tag)
+	}
+	if indexErr != nil {
+		return ar, fmt.Errorf("%w: %v", errBadIndex, indexErr)
+	}
+	ar.index, ar.total, ar.blocksEnd = index, payloadSize(index), blocksEnd
+	debugf("%d block(s), %d bytes of payload", len(index), ar.total)
+	return ar, nil
 }
 
-func buildTree(freq [256]uint64) *node {
-	h := &nodeHeap{}
-	for b, f := range freq {
-		if f > 0 {
-			heap.Push(h, &node{b: byte(b), freq: f})
+// readPayloadV1 decrypts the single-message v1 payload, returning it still
+// compressed along with its frequency table.
+func readPayloadV1(f *io.SectionReader, key []byte) ([]byte, [256]uint64, error) {
+	var freq [256]uint64
+	gcm, err := newAEAD(cipherAESGCM, key)
+	if err != nil {
+		return nil, freq, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(f, nonce); err != nil {
+		return nil, freq, err
+	}
+	for i := 0; i < 256; i++ {
+		if err := binary.Read(f, binary.LittleEndian, &freq[i]); err != nil {
+			return nil, freq, err
 		}
 	}
-	if h.Len() == 0 {
-		return nil
+	var clen uint64
+	if err := binary.Read(f, binary.LittleEndian, &clen); err != nil {
+		return nil, freq, err
 	}
-	if h.Len() == 1 {
-		only := heap.Pop(h).(*node)
-		root := &node{freq: only.freq, left: only}
-		return root
+	if clen < uint64(gcm.Overhead()) {
+		return nil, freq, errors.New("corrupt archive (ciphertext too short)")
 	}
-	heap.Init(h)
-	for h.Len() > 1 {
-		a := heap.Pop(h).(*node)
-		b := heap.Pop(h).(*node)
-		parent := &node{freq: a.freq + b.freq, left: a, right: b}
-		heap.Push(h, parent)
+	if err := checkRemaining(f, clen, "ciphertext"); err != nil {
+		return nil, freq, err
 	}
-	return heap.Pop(h).(*node)
+	// The table is not authenticated; every symbol takes at least a bit.
+	if total := freqTotal(freq); total > 8*(clen-uint64(gcm.Overhead())) {
+		return nil, freq, fmt.Errorf("corrupt archive (%d symbols in %d bytes)", total, clen-uint64(gcm.Overhead()))
+	}
+	// Read and check the start first, so a wrong password does not wait
+	// for the whole ciphertext to be read.
+	ciphertext, err := appendRead(nil, f, min(clen, v1CheckSize))
+	if err != nil {
+		return nil, freq, err
+	}
+	if !plausibleV1(ciphertext[:min(len(ciphertext), int(clen)-gcm.Overhead())], key, nonce, freq) {
+		return nil, freq, errors.New("wrong password (or corrupt archive)")
+	}
+	if ciphertext, err = appendRead(ciphertext, f, clen-uint64(len(ciphertext))); err != nil {
+		return nil, freq, err
+	}
+	comp, err := gcm.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, freq, err
+	}
+	return comp, freq, nil
 }
 
-func buildCodes(root *node) map[byte]string {
-	codeMap := make(map[byte]string)
-	if root == nil {
-		return codeMap
+// decodeV1 decompresses the v1 payload, which is held in memory whole,
+// after checking its size against the limits.
+func (ar *archiveReader) decodeV1(ro readOptions) error {
+	size := uint64(ar.total)
+	if ro.maxExtractSize > 0 && size > uint64(ro.maxExtractSize) {
+		return fmt.Errorf("the archive holds %d bytes, more than -max-extract-size %d", size, ro.maxExtractSize)
 	}
-	var dfs func(n *node, prefix string)
-	dfs = func(n *node, prefix string) {
-		if n == nil {
-			return
-		}
-		if n.left == nil && n.right == nil {
-			codeMap[n.b] = prefix
-			return
-		}
-		dfs(n.left, prefix+"0")
-		dfs(n.right, prefix+"1")
+	if need := blockMemory(methodHuffman, int(size), true); ro.maxMemory > 0 && need > ro.maxMemory {
+		return fmt.Errorf("decoding this version 1 archive needs about %d bytes, more than -max-memory %d", need, ro.maxMemory)
 	}
-	// single-symbol special-case
-	if root.left != nil && root.right == nil && root.left.left == nil && root.left.right == nil {
-		codeMap[root.left.b] = "0"
-		return codeMap
+	payload, err := huffmanDecompressV1(ar.comp, ar.freq)
+	clear(ar.comp)
+	ar.comp = nil
+	if err != nil {
+		return err
 	}
-	dfs(root, "")
-	return codeMap
+	ar.plain = payload
+	ar.payload = bytes.NewReader(payload)
+	return nil
 }
 
-type bitWriter struct {
-	buf bytes.Buffer
-	cur byte
-	n   uint8
-}
+// readChunk is how much appendRead reads, and allocates, at a time.
+const readChunk = 1 << 20
 
-func (w *bitWriter) WriteBits(bitstr string) {
-	for i := 0; i < len(bitstr); i++ {
-		if bitstr[i] == '1' {
-			w.cur |= 1 << (7 - w.n)
+// appendRead reads n bytes from r and appends them to buf, which grows
+// with the data actually read, so a length taken from a damaged or
+// hostile file costs no more memory than the file holds.
+func appendRead(buf []byte, r io.Reader, n uint64) ([]byte, error) {
+	for n > 0 {
+		k := int(min(n, readChunk))
+		buf = slices.Grow(buf, k)
+		m, err := io.ReadFull(r, buf[len(buf):len(buf)+k])
+		buf = buf[:len(buf)+m]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		w.n++
-		if w.n == 8 {
-			w.buf.WriteByte(w.cur)
-			w.cur = 0
-			w.n = 0
+		if err != nil {
+			return buf, err
 		}
+		n -= uint64(k)
 	}
+	return buf, nil
 }
 
-func (w *bitWriter) Finish() []byte {
-	if w.n > 0 {
-		w.buf.WriteByte(w.cur)
-	}
-	return w.buf.Bytes()
-}
-
-func huffmanCompress(data []byte, freq [256]uint64) ([]byte, error) {
-	root := buildTree(freq)
-	if root == nil {
-		return nil, nil
+// checkRemaining fails if fewer than n bytes of f follow its current
+// offset, for the length n of what the archive says comes next.
+func checkRemaining(f *io.SectionReader, n uint64, what string) error {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
 	}
-	codes := buildCodes(root)
-	bw := &bitWriter{}
-	for _, b := range data {
-		bs, ok := codes[b]
-		if !ok {
-			return nil, fmt.Errorf("no code for byte %v", b)
-		}
-		bw.WriteBits(bs)
+	if left := f.Size() - pos; n > uint64(left) {
+		return fmt.Errorf("corrupt archive (%s of %d bytes, but only %d follow)", what, n, left)
 	}
-	return bw.Finish(), nil
-}
-
-type bitReader struct {
-	data []byte
-	pos  int
-	bit  uint8
+	return nil
 }
 
-func newBitReader(b []byte) *bitReader {
-	return &bitReader{data: b, pos: 0, bit: 0}
-}
+// v1CheckSize is how much of a v1 ciphertext plausibleV1 looks at.
+const v1CheckSize = 4 << 10
 
-func (r *bitReader) readBit() (int, error) {
-	if r.pos >= len(r.data) {
-		return 0, io.EOF
+// plausibleV1 reports whether the start of a v1 ciphertext (tag excluded)
+// could have been encrypted with key. v1 archives have no password
+// verifier and GCM authenticates only the whole message, but GCM is CTR
+// mode underneath: the start decrypts on its own, and under a wrong key
+// the first entry header decodes to a size that overruns the payload
+// (whose length the frequency table gives) or a name with a NUL byte.
+// A false result is certain; a true one still needs gcm.Open.
+func plausibleV1(start, key, nonce []byte, freq [256]uint64) bool {
+	symbols := 0
+	for _, v := range freq {
+		if v != 0 {
+			symbols++
+		}
 	}
-	cur := r.data[r.pos]
-	v := (cur >> (7 - r.bit)) & 1
-	r.bit++
-	if r.bit == 8 {
-		r.bit = 0
-		r.pos++
+	block, err := aes.NewCipher(key)
+	if err != nil || symbols < 2 { // one symbol would be decoded in full
+		return true
 	}
-	return int(v), nil
-}
-
-func huffmanDecompress(comp []byte, freq [256]uint64) ([]byte, error) {
-	root := buildTree(freq)
-	if root == nil {
-		return nil, nil
+	iv := append(append([]byte(nil), nonce...), 0, 0, 0, 2) // the counter after J0
+	plain := make([]byte, len(start))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, start)
+	head, err := huffmanDecompressV1(plain, freq)
+	if err != nil || len(head) < 2 {
+		return true
 	}
-	// single-symbol
-	if root.left != nil && root.right == nil && root.left.left == nil && root.left.right == nil {
-		only := root.left.b
-		var total uint64
-		for _, v := range freq {
-			total += v
-		}
-		out := bytes.Repeat([]byte{only}, int(total))
-		return out, nil
+	total := freqTotal(freq)
+	nameLen := uint64(binary.LittleEndian.Uint16(head))
+	name := head[2:min(uint64(len(head)), 2+nameLen)]
+	if bytes.IndexByte(name, 0) >= 0 || 2+nameLen+8 > total {
+		return false
 	}
-	br := newBitReader(comp)
-	var out bytes.Buffer
-	for {
-		n := root
-		for n.left != nil || n.right != nil {
-			bit, err := br.readBit()
-			if err != nil {
-				if err == io.EOF {
-					return out.Bytes(), nil
-				}
-				return nil, err
-			}
-			if bit == 0 {
-				n = n.left
-			} else {
-				n = n.right
-			}
-			if n == nil {
-				return nil, errors.New("corrupt compressed data (walked to nil)")
-			}
-		}
-		out.WriteByte(n.b)
+	if uint64(len(head)) < 2+nameLen+8 {
+		return true
 	}
+	size := binary.LittleEndian.Uint64(head[2+nameLen:])
+	return size <= total-2-nameLen-8
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs goZip itself when the tests start it as a command, so
+// exit statuses can be checked.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOZIP_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// ghzip runs goZip with args and returns its exit status.
+func ghzip(t *testing.T, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GOZIP_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	} else if err != nil {
+		t.Fatalf("ghzip %q: %v", args, err)
+	}
+	if testing.Verbose() {
+		t.Logf("ghzip %q:\n%s", args, out)
+	}
+	return 0
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	if err := os.Mkdir(in, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(in, "a.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "a.gha")
+	missing := filepath.Join(dir, "missing")
+	for _, tc := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"create", []string{"-c", "-in", in, "-out", archive, "-pass", "pw", "-kdf", "pbkdf2"}, 0},
+		{"create missing input", []string{"-c", "-in", missing, "-out", filepath.Join(dir, "b.gha"), "-pass", "pw"}, 1},
+		{"append to missing archive", []string{"-a", "-in", in, "-out", missing + ".gha", "-pass", "pw"}, 1},
+		{"append wrong password", []string{"-a", "-in", in, "-out", archive, "-pass", "wrong"}, 1},
+		{"create without -out", []string{"-c", "-in", in, "-pass", "pw"}, 1},
+		{"bad -strip", []string{"-x", "-in", archive, "-out", filepath.Join(dir, "x"), "-pass", "pw", "-strip", "-1"}, 1},
+		{"bad -jobs", []string{"-c", "-in", in, "-out", filepath.Join(dir, "c.gha"), "-pass", "pw", "-jobs", "-1"}, 1},
+		{"list", []string{"-l", "-in", archive, "-pass", "pw"}, 0},
+		{"list without -in", []string{"-l", "-pass", "pw"}, 2},
+		{"extract", []string{"-x", "-in", archive, "-out", filepath.Join(dir, "x"), "-pass", "pw"}, 0},
+	} {
+		if got := ghzip(t, tc.args...); got != tc.want {
+			t.Errorf("%s: exit status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnzKeepsFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("the only good copy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ghzip(t, "z", path, "-q", "-pass", "pw"); got != 0 {
+		t.Fatalf("z with flags after the file: exit status %d", got)
+	}
+	archive, err := os.ReadFile(path + singleSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[len(archive)-20] ^= 1
+	if err := os.WriteFile(path+singleSuffix, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ghzip(t, "unz", "-f", "-pass", "pw", path+singleSuffix); got != 1 {
+		t.Errorf("unz of a corrupt archive: exit status %d, want 1", got)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "the only good copy\n" {
+		t.Errorf("unz -f failing left %q, %v", b, err)
+	}
+	if m, _ := filepath.Glob(path + ".tmp-*"); len(m) > 0 {
+		t.Errorf("unz left %v", m)
+	}
+}
+
+func TestSalvageExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	if err := os.Mkdir(in, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(in, name), bytes.Repeat([]byte(name), 100000), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(dir, "a.gha")
+	if got := ghzip(t, "-c", "-per-file", "-store", "-in", in, "-out", archive, "-pass", "pw", "-kdf", "pbkdf2"); got != 0 {
+		t.Fatalf("create: exit status %d", got)
+	}
+	if got := ghzip(t, "repair", "-salvage", filepath.Join(dir, "intact"), "-in", archive, "-pass", "pw"); got != 0 {
+		t.Errorf("salvaging an intact archive: exit status %d, want 0", got)
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1 // in b's block
+	if err := os.WriteFile(archive, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := ghzip(t, "repair", "-salvage", filepath.Join(dir, "damaged"), "-in", archive, "-pass", "pw"); got != 1 {
+		t.Errorf("salvaging a damaged archive: exit status %d, want 1", got)
+	}
+	if got := ghzip(t, "repair", "-salvage", filepath.Join(dir, "wrong"), "-in", archive, "-pass", "wrong"); got != 2 {
+		t.Errorf("salvaging with the wrong password: exit status %d, want 2", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- Memory ceiling (-max-memory) ----------------
+//
+// -max-memory caps what coding blocks may take, for containers and NAS
+// boxes with little RAM. Creating, goZip first compresses fewer blocks in
+// parallel and then uses smaller blocks until the estimate fits. Reading,
+// the block size is fixed by the archive, so fewer blocks are decoded at
+// once and blocks that would not fit are refused instead of risking the
+// OOM killer. The limit also becomes
+// the Go runtime's soft memory limit (runtime/debug.SetMemoryLimit).
+
+// minLimitedBlock is the smallest block size -max-memory shrinks blocks to.
+const minLimitedBlock = 64 << 10
+
+// blockMemory estimates the bytes needed to code one block of size raw
+// bytes with method: the raw, coded and sealed copies of the block plus
+// what the codec allocates on top of them.
+func blockMemory(method byte, size int, decode bool) int64 {
+	n := int64(size)
+	mem := 3*n + 1<<20
+	switch {
+	case method == methodBWT && !decode:
+		mem += 16 * n // suffix array, ranks, scratch, buckets (int32 each)
+	case method == methodBWT:
+		mem += 5 * n // LF mapping (int32) and first column
+	case method == methodLZ77 && !decode:
+		mem += 5 * n // hash chain (int32 per byte), dictionary + block copy
+	case method == methodLZ77:
+		mem += n // dictionary + block window
+	case method == methodDeflate, method == methodLZW:
+		mem += 4 << 20 // fixed-size tables and windows
+	case method == methodZstd && !decode:
+		mem += n + 4<<20 // window and match tables
+	case method == methodZstd:
+		mem += n // window
+	case method == methodExec:
+		mem += 2 * n // pipe buffers
+	case method == methodHuffman && !decode, method == methodRLE:
+		mem += n // run-length trial or expanded runs
+	}
+	return mem
+}
+
+// fitMemory returns the largest block size up to size, and how many such
+// blocks may be compressed at once, that keep method under limit bytes.
+func fitMemory(limit int64, method byte, size int) (int, int, error) {
+	for ; size >= minLimitedBlock; size /= 2 {
+		// the block being filled comes on top of those being compressed
+		if n := (limit - int64(size)) / blockMemory(method, size, false); n >= 1 {
+			return size, int(min(n, 1<<16)), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("-max-memory %d is too small to compress with %s (needs %d)",
+		limit, methodName(method), minLimitedBlock+blockMemory(method, minLimitedBlock, false))
+}
+
+// checkBlockMemory refuses to decode a block whose method and raw length
+// (read from the decrypted block) would need more than limit bytes.
+func checkBlockMemory(plain []byte, limit int64) error {
+	if limit <= 0 || len(plain) < 5 {
+		return nil
+	}
+	rawLen := int(binary.LittleEndian.Uint32(plain[1:5]))
+	if need := blockMemory(plain[0], rawLen, true); need > limit {
+		return fmt.Errorf("decoding this %s block needs about %d bytes, more than -max-memory %d",
+			methodName(plain[0]), need, limit)
+	}
+	return nil
+}
+
+// parseByteSize parses a size such as 512M, 2G or 1048576 (K, M and G are
+// powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("bad size %q (e.g. 512M or 2G)", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// localName returns name unchanged: any name safeJoin accepts can be
+// created here.
+func localName(name string) string {
+	return name
+}
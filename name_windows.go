@@ -0,0 +1,60 @@
+//go:build windows
+
+package main
+
+import "strings"
+
+// Names from Linux and macOS that Windows cannot create are changed on
+// extraction: device names (CON, NUL, COM1, ... also with an extension,
+// as in nul.txt) get a leading underscore, the characters <>:"\|?* and
+// control characters become underscores, and so do the dots and spaces
+// that Windows drops from the ends of names. Paths beyond MAX_PATH need
+// nothing here: the os package gives them the \\?\ prefix itself.
+
+// localName returns the name entry name can be created as on Windows.
+func localName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		if p != "." && p != ".." {
+			parts[i] = windowsComponent(p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// windowsComponent makes one path component valid on Windows.
+func windowsComponent(p string) string {
+	b := []byte(p)
+	for i, c := range b {
+		if c < 0x20 || strings.IndexByte(`<>:"\|?*`, c) >= 0 {
+			b[i] = '_'
+		}
+	}
+	for i := len(b) - 1; i >= 0 && (b[i] == '.' || b[i] == ' '); i-- {
+		b[i] = '_'
+	}
+	base, _, _ := strings.Cut(string(b), ".")
+	if isDeviceName(strings.TrimRight(base, " ")) {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// isDeviceName reports whether s names a DOS device.
+func isDeviceName(s string) bool {
+	s = strings.ToUpper(s)
+	switch s {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(s) == 4 && (strings.HasPrefix(s, "COM") || strings.HasPrefix(s, "LPT")) {
+		return s[3] >= '0' && s[3] <= '9'
+	}
+	// COM¹, COM², COM³ and the LPT equivalents
+	for _, sup := range []string{"¹", "²", "³"} {
+		if s == "COM"+sup || s == "LPT"+sup {
+			return true
+		}
+	}
+	return false
+}
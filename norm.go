@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"unicode/utf8"
+)
+
+//go:generate go run gen_norm.go
+
+// ---------------------- Unicode filename normalization --------------
+//
+// Entry names are stored in NFC, so "é" written as one code point (most
+// systems) and as "e" + combining acute (macOS HFS+) end up as the same
+// name. When the original bytes differ from the stored NFC form they are
+// kept in an extension record, and extraction can write names as NFC, NFD
+// or the original bytes (see nameForm).
+
+// Name forms for extraction.
+const (
+	nameNFC      = "nfc"
+	nameNFD      = "nfd"
+	nameOriginal = "original"
+)
+
+// checkNameForm validates an extraction name form ("" means NFC).
+func checkNameForm(form string) error {
+	switch form {
+	case "", nameNFC, nameNFD, nameOriginal:
+		return nil
+	}
+	return fmt.Errorf("unknown name form %q (want nfc, nfd or original)", form)
+}
+
+// Hangul syllables decompose algorithmically.
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = 19 * hangulNCount
+)
+
+var (
+	compOnce      sync.Once
+	canonicalComp map[[2]rune]rune
+)
+
+// compose returns the primary composite of a and b, if there is one.
+func compose(a, b rune) (rune, bool) {
+	if l := a - hangulLBase; l >= 0 && l < 19 {
+		if v := b - hangulVBase; v >= 0 && v < hangulVCount {
+			return hangulSBase + (l*hangulVCount+v)*hangulTCount, true
+		}
+	}
+	if s := a - hangulSBase; s >= 0 && s < hangulSCount && s%hangulTCount == 0 {
+		if t := b - hangulTBase; t > 0 && t < hangulTCount {
+			return a + t, true
+		}
+	}
+	compOnce.Do(func() {
+		canonicalComp = make(map[[2]rune]rune)
+		for r, d := range canonicalDecomp {
+			if compositionExcluded[r] {
+				continue
+			}
+			rs := []rune(d)
+			canonicalComp[[2]rune{rs[0], rs[1]}] = r
+		}
+	})
+	c, ok := canonicalComp[[2]rune{a, b}]
+	return c, ok
+}
+
+func decomposeRune(r rune, out []rune) []rune {
+	if s := r - hangulSBase; s >= 0 && s < hangulSCount {
+		out = append(out, hangulLBase+s/hangulNCount, hangulVBase+(s%hangulNCount)/hangulTCount)
+		if t := s % hangulTCount; t != 0 {
+			out = append(out, hangulTBase+t)
+		}
+		return out
+	}
+	if d, ok := canonicalDecomp[r]; ok {
+		for _, c := range d {
+			out = decomposeRune(c, out)
+		}
+		return out
+	}
+	return append(out, r)
+}
+
+// decompose returns the canonical decomposition of s in canonical order.
+func decompose(s string) []rune {
+	var rs []rune
+	for _, r := range s {
+		rs = decomposeRune(r, rs)
+	}
+	// stable sort every run of non-starters by combining class
+	for i := 1; i < len(rs); i++ {
+		cc := combiningClass[rs[i]]
+		if cc == 0 {
+			continue
+		}
+		for j := i; j > 0; j-- {
+			prev := combiningClass[rs[j-1]]
+			if prev <= cc {
+				break
+			}
+			rs[j-1], rs[j] = rs[j], rs[j-1]
+		}
+	}
+	return rs
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// nfd returns s in Unicode Normalization Form D. Invalid UTF-8 is returned
+// unchanged.
+func nfd(s string) string {
+	if isASCII(s) || !utf8.ValidString(s) {
+		return s
+	}
+	return string(decompose(s))
+}
+
+// nfc returns s in Unicode Normalization Form C. Invalid UTF-8 is returned
+// unchanged.
+func nfc(s string) string {
+	if isASCII(s) || !utf8.ValidString(s) {
+		return s
+	}
+	rs := decompose(s)
+	if len(rs) == 0 {
+		return s
+	}
+	out := rs[:1]
+	starter := 0
+	last := int(combiningClass[rs[0]])
+	if last != 0 {
+		last = 256 // no starter to compose with yet
+	}
+	for _, r := range rs[1:] {
+		cc := int(combiningClass[r])
+		if last < cc || last == 0 {
+			if c, ok := compose(out[starter], r); ok {
+				out[starter] = c
+				continue
+			}
+		}
+		if cc == 0 {
+			starter = len(out)
+		}
+		last = cc
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// extractName returns the name an entry is written under for the given
+// name form.
+func extractName(h entryHeader, form string) string {
+	switch form {
+	case nameNFD:
+		return nfd(h.name)
+	case nameOriginal:
+		if h.origName != "" {
+			return h.origName
+		}
+	}
+	return h.name
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+	"testing"
+)
+
+func TestNormalizationForms(t *testing.T) {
+	for _, tc := range []struct{ in, nfd, nfc string }{
+		{"abc", "abc", "abc"},
+		{"\u00e9", "e\u0301", "\u00e9"},
+		{"e\u0301", "e\u0301", "\u00e9"},
+		{"s\u0323\u0307", "s\u0323\u0307", "\u1e69"},
+		{"s\u0307\u0323", "s\u0323\u0307", "\u1e69"},           // canonical ordering
+		{"\u212b", "A\u030a", "\u00c5"},                        // singleton
+		{"\u1100\u1161", "\u1100\u1161", "\uac00"},             // Hangul LV
+		{"\u1100\u1161\u11a8", "\u1100\u1161\u11a8", "\uac01"}, // Hangul LVT
+		{"\uac00\u11a8", "\u1100\u1161\u11a8", "\uac01"},
+		{"\u0301e", "\u0301e", "\u0301e"}, // no starter to compose with
+		{"a\u0328\u0301", "a\u0328\u0301", "\u0105\u0301"},
+		{"a\u0301\u0301", "a\u0301\u0301", "\u00e1\u0301"}, // blocked by the same class
+		{"\u0958", "\u0915\u093c", "\u0915\u093c"},         // composition exclusion
+		{"\xffe\u0301", "\xffe\u0301", "\xffe\u0301"},      // invalid UTF-8 is left alone
+	} {
+		if got := nfd(tc.in); got != tc.nfd {
+			t.Errorf("nfd(%+q) = %+q, want %+q", tc.in, got, tc.nfd)
+		}
+		if got := nfc(tc.in); got != tc.nfc {
+			t.Errorf("nfc(%+q) = %+q, want %+q", tc.in, got, tc.nfc)
+		}
+	}
+}
+
+// The digests below were made with Python's unicodedata, which is at
+// Unicode 14.0.0 like normtables.go, hashing each normalized string
+// followed by a NUL byte.
+
+// TestNormalizationCodePoints normalizes every code point on its own.
+func TestNormalizationCodePoints(t *testing.T) {
+	d, c := sha256.New(), sha256.New()
+	for r := rune(0); r <= 0x10ffff; r++ {
+		if r >= 0xd800 && r <= 0xdfff {
+			continue
+		}
+		writeNUL(d, nfd(string(r)))
+		writeNUL(c, nfc(string(r)))
+	}
+	if got, want := hex.EncodeToString(d.Sum(nil)), "e47f86d7e3d5f5990095fdb2c04515348d94089ee40333d9c45f403bfe89014b"; got != want {
+		t.Errorf("NFD digest = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(c.Sum(nil)), "6e0aaa17a82be5b6f410942f1f99ae77832fb630e98780c6eaf6779ab278235d"; got != want {
+		t.Errorf("NFC digest = %s, want %s", got, want)
+	}
+}
+
+// TestNormalizationSequences normalizes short strings drawn by a PCG
+// style generator from letters, precomposed letters, combining marks,
+// Hangul jamo and syllables, and Devanagari, Hebrew, kana, Tibetan and
+// musical symbols.
+func TestNormalizationSequences(t *testing.T) {
+	var pool []rune
+	for _, rg := range [][2]rune{
+		{0x41, 0x5a}, {0xc0, 0x17f}, {0x300, 0x36f}, {0x1100, 0x1112}, {0x1161, 0x1175}, {0x11a8, 0x11c2},
+		{0xac00, 0xac20}, {0x900, 0x97f}, {0x591, 0x5c7}, {0x1e00, 0x1eff}, {0x304b, 0x3094}, {0x3099, 0x309a},
+		{0xf40, 0xf84}, {0x1d15e, 0x1d164},
+	} {
+		for r := rg[0]; r <= rg[1]; r++ {
+			pool = append(pool, r)
+		}
+	}
+	x := uint64(1)
+	next := func() uint64 {
+		x = x*6364136223846793005 + 1442695040888963407
+		return x >> 33
+	}
+	d, c := sha256.New(), sha256.New()
+	var b strings.Builder
+	for range 20000 {
+		b.Reset()
+		for n := 1 + next()%8; n > 0; n-- {
+			b.WriteRune(pool[next()%uint64(len(pool))])
+		}
+		writeNUL(d, nfd(b.String()))
+		writeNUL(c, nfc(b.String()))
+	}
+	if got, want := hex.EncodeToString(d.Sum(nil)), "0dc13b51d6bcdc6ab586efa7bcc3ce5ddad48ad536eade16cdcb37f3230e9e45"; got != want {
+		t.Errorf("NFD digest = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(c.Sum(nil)), "77a97427953c6b691b35b56dd8b6544edaa1910d044a625cd61fe8254abee058"; got != want {
+		t.Errorf("NFC digest = %s, want %s", got, want)
+	}
+}
+
+func writeNUL(h hash.Hash, s string) {
+	h.Write([]byte(s))
+	h.Write([]byte{0})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ---------------------- Order-1 context coding (method order1) ------
+//
+// Every byte is Huffman coded with a table chosen by the byte before it
+// (the context; 0 for the first byte). Contexts seen often enough to pay
+// for their own table get one; the rest share a fallback table built from
+// their combined statistics. Method data:
+//
+//   [32 bytes]   bitmap of contexts that have their own table
+//   [128 bytes]  fallback code lengths, two 4-bit lengths per byte
+//   [128 bytes]  per own-table context, in ascending order
+//   [bits]       the coded bytes
+
+// o1TableBits is what storing one packed table costs.
+const o1TableBits = 128 * 8
+
+func packLengths(l [256]uint8) []byte {
+	b := make([]byte, 128)
+	for i := range b {
+		b[i] = l[2*i]<<4 | l[2*i+1]
+	}
+	return b
+}
+
+func unpackLengths(b []byte) [256]uint8 {
+	var l [256]uint8
+	for i := 0; i < 128; i++ {
+		l[2*i], l[2*i+1] = b[i]>>4, b[i]&15
+	}
+	return l
+}
+
+func codeCost(freq [256]uint64, lengths [256]uint8) uint64 {
+	var bits uint64
+	for s, f := range freq {
+		bits += f * uint64(lengths[s])
+	}
+	return bits
+}
+
+func order1Encode(raw []byte) ([]byte, error) {
+	var freq [256][256]uint64
+	prev := byte(0)
+	for _, b := range raw {
+		freq[prev][b]++
+		prev = b
+	}
+	var all [256]uint64
+	for c := range freq {
+		for s, f := range freq[c] {
+			all[s] += f
+		}
+	}
+	// give a context its own table when that saves more than the table costs
+	fallback := codeLengths(all)
+	var own [256]bool
+	var tables [256][256]uint8
+	var rest [256]uint64
+	for c := range freq {
+		tables[c] = codeLengths(freq[c])
+		if codeCost(freq[c], tables[c])+o1TableBits < codeCost(freq[c], fallback) {
+			own[c] = true
+			continue
+		}
+		for s, f := range freq[c] {
+			rest[s] += f
+		}
+	}
+	fallback = codeLengths(rest)
+
+	out := make([]byte, 32, 32+128)
+	for c := range own {
+		if own[c] {
+			out[c/8] |= 1 << (c % 8)
+		}
+	}
+	out = append(out, packLengths(fallback)...)
+	var codes [256][256]huffCode
+	fbCodes := canonicalCodes(fallback)
+	for c := range own {
+		codes[c] = fbCodes
+		if own[c] {
+			out = append(out, packLengths(tables[c])...)
+			codes[c] = canonicalCodes(tables[c])
+		}
+	}
+	buf := bytes.NewBuffer(out)
+	w := newBitWriter(buf)
+	prev = 0
+	for _, b := range raw {
+		c := codes[prev][b]
+		w.WriteBits(c.bits, c.len)
+		prev = b
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func order1Decode(data []byte, rawLen int) ([]byte, error) {
+	if len(data) < 32+128 {
+		return nil, errors.New("corrupt order1 block (too short)")
+	}
+	bitmap := data[:32]
+	fbLengths := unpackLengths(data[32:160])
+	if !validLengths(fbLengths) {
+		return nil, errors.New("corrupt order1 block (code lengths)")
+	}
+	fb := canonicalTree(fbLengths)
+	data = data[160:]
+	var trees [256]*node
+	for c := range trees {
+		trees[c] = fb
+		if bitmap[c/8]&(1<<(c%8)) == 0 {
+			continue
+		}
+		if len(data) < 128 {
+			return nil, errors.New("corrupt order1 block (too short)")
+		}
+		l := unpackLengths(data[:128])
+		if !validLengths(l) {
+			return nil, errors.New("corrupt order1 block (code lengths)")
+		}
+		trees[c] = canonicalTree(l)
+		data = data[128:]
+	}
+	r := newBitReader(bytes.NewReader(data))
+	out := make([]byte, 0, rawLen)
+	prev := byte(0)
+	for len(out) < rawLen {
+		n := trees[prev]
+		for n.left != nil || n.right != nil {
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, errors.New("order1 data truncated")
+			}
+			if bit == 0 {
+				n = n.left
+			} else {
+				n = n.right
+			}
+			if n == nil {
+				return nil, errors.New("corrupt order1 data")
+			}
+		}
+		if n == trees[prev] {
+			return nil, errors.New("corrupt order1 data (empty code table)")
+		}
+		out = append(out, n.b)
+		prev = n.b
+	}
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// ---------------------- Parallel extraction (-jobs) ----------------
+//
+// Decoding is a single stream, but writing a file (creating it, renaming
+// it into place, restoring its mode, times and owner) is mostly waiting on
+// the file system, and for many small files on SSDs or network file
+// systems that is where extraction spends its time. Files up to
+// parallelFileMax are therefore read into memory and written by up to
+// -jobs goroutines while the entries after them are decoded; larger ones
+// are written as they are decoded. Each file is noted for -resume once
+// it is in place, and counted and reported in archive order. Links, and
+// a second copy of a file, wait for the writes before them. -jobs 1
+// writes one file at a time.
+
+// parallelFileMax is the largest file written by a goroutine.
+const parallelFileMax = 1 << 20
+
+// pendingWrite is a file being written by a goroutine.
+type pendingWrite struct {
+	h    entryHeader
+	done chan struct{}
+	err  error
+}
+
+// fileWriter runs the writes, up to jobs at a time, and finishes them in
+// order.
+type fileWriter struct {
+	jobs    int
+	pending []*pendingWrite // oldest first
+	finish  func(*pendingWrite) error
+}
+
+func newFileWriter(jobs int, finish func(*pendingWrite) error) *fileWriter {
+	return &fileWriter{jobs: max(jobs, 1), finish: finish}
+}
+
+// write runs write for entry h in a goroutine.
+func (fw *fileWriter) write(h entryHeader, write func() error) error {
+	pw := &pendingWrite{h: h, done: make(chan struct{})}
+	go func() {
+		defer close(pw.done)
+		pw.err = write()
+	}()
+	fw.pending = append(fw.pending, pw)
+	return fw.reap(fw.jobs)
+}
+
+// reap finishes the writes at the front that are done, waiting for the
+// oldest while more than keep are pending.
+func (fw *fileWriter) reap(keep int) error {
+	for len(fw.pending) > 0 {
+		pw := fw.pending[0]
+		if len(fw.pending) <= keep {
+			select {
+			case <-pw.done:
+			default:
+				return nil
+			}
+		}
+		<-pw.done
+		fw.pending = fw.pending[1:]
+		if err := fw.finish(pw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush waits for every write and finishes it.
+func (fw *fileWriter) flush() error {
+	return fw.reap(0)
+}
+
+// abandon waits for the writes still running, so that nothing writes
+// into the destination once extraction has failed.
+func (fw *fileWriter) abandon() {
+	for _, pw := range fw.pending {
+		<-pw.done
+	}
+	fw.pending = nil
+}
+
+// writeRestored writes data, the contents of entry h, to target and
+// restores its metadata. A checksum mismatch is returned last, after the
+// file is complete.
+func writeRestored(target string, h entryHeader, data []byte, opts extractOptions) error {
+	sum := sha256.Sum256(data)
+	if err := writeEntryFile(target, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	bad := checkWritten(target, h, sum[:], opts.verify)
+	if bad != nil && !errors.Is(bad, errChecksum) {
+		return bad
+	}
+	if err := restoreMetadata(target, h, opts); err != nil {
+		return err
+	}
+	return bad
+}
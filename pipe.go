@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------- Pipes (-in -, -out -) ----------------------
+//
+// "-" as a path stands for stdin or stdout, so goZip fits in pipelines:
+//
+//	ghzip -c -in dir -out - | ssh host 'cat > backup.gha'
+//	tar c dir | ghzip -c -in - -out dir.tar.gha
+//	ssh host 'cat backup.gha' | ghzip -x -in - -out restore
+//
+// An archive is written to stdout as it is produced; everything goZip
+// says goes to stderr then. Creating from stdin archives the stream as
+// one file named "stdin". Its size is part of the entry header and the
+// archive totals, which come before the data, and reading an archive
+// starts at its index at the end, so both are first copied to a temporary
+// file, removed afterwards.
+
+// stdout is the process's standard output, which receives the archive
+// with -out - after toStderr moved the messages away from it.
+var stdout = os.Stdout
+
+// toStderr sends what goZip prints to stderr, keeping stdout for data.
+func toStderr() {
+	os.Stdout = os.Stderr
+}
+
+// checkStdout refuses to write an archive to a terminal, where it would
+// only garble the screen.
+func checkStdout() error {
+	fi, err := stdout.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		return errors.New("-out -: not writing an archive to a terminal; redirect or pipe stdout")
+	}
+	return nil
+}
+
+// spoolStdin copies stdin to a file called name in a new temporary
+// directory and returns the file's path and the directory, which the
+// caller removes when done.
+func spoolStdin(name string) (path, dir string, err error) {
+	dir, err = os.MkdirTemp("", "ghzip-stdin-*")
+	if err != nil {
+		return "", "", err
+	}
+	path = filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err == nil {
+		_, err = io.Copy(f, os.Stdin)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return path, dir, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ---------------------- Progress display ---------------------------
+//
+// showProgress draws one status line, redrawn in place:
+//
+//	Extracting [=============                 ]  42%  87.3 MB/s  0:12, 0:17 left  src/big.iso
+//
+// with the throughput and the time remaining at that rate once a second
+// has passed, and the entry being worked on, also while a large file is
+// being written. It is redrawn at most ten times a second however often
+// it is called, and once more when done; only at the default verbosity
+// and on a terminal (verbosity.go), and not for -progress-json, which
+// gets the same updates as events (progressjson.go).
+
+// progressInterval is the least time between two redraws.
+const progressInterval = 100 * time.Millisecond
+
+// bar is the state of the status line being drawn.
+var bar struct {
+	prefix   string
+	start    time.Time
+	drawn    time.Time
+	done     int64
+	finished bool
+	shown    bool // barsShown, at the start
+}
+
+// showProgress shows that done of total bytes are through, name being the
+// entry at hand ("" for none).
+func showProgress(prefix, name string, done, total int64) {
+	now := time.Now()
+	if prefix != bar.prefix || done < bar.done {
+		// a new operation
+		bar.prefix, bar.start, bar.drawn, bar.finished = prefix, now, time.Time{}, false
+		bar.shown = barsShown() && progressEvents == nil
+	}
+	bar.done = done
+	final := done >= total
+	if bar.finished || !final && now.Sub(bar.drawn) < progressInterval {
+		return
+	}
+	bar.drawn = now
+	if progressEvents != nil {
+		if final {
+			name = ""
+		}
+		sendProgress(prefix, name, done, total)
+	}
+	if !bar.shown {
+		bar.finished = final
+		return
+	}
+
+	const width = 30
+	pct := 0
+	if total > 0 {
+		pct = int(min(done*100/total, 100))
+	}
+	filled := pct * width / 100
+	line := fmt.Sprintf("%s [%s%s] %3d%%", prefix, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), pct)
+	elapsed := now.Sub(bar.start)
+	if elapsed >= time.Second {
+		rate := float64(done) / elapsed.Seconds()
+		line += fmt.Sprintf("  %5.1f MB/s  %s", rate/(1<<20), clockTime(elapsed))
+		if !final && rate > 0 {
+			line += ", " + clockTime(time.Duration(float64(total-done)/rate*float64(time.Second))) + " left"
+		}
+	}
+	if name != "" && !final {
+		line += "  " + shortName(name, 40)
+	}
+	// \033[K clears what is left of a longer line before
+	fmt.Printf("\r%s\033[K", line)
+	if final {
+		fmt.Println()
+		bar.finished = true
+	}
+}
+
+// progressReader shows the progress of reading entry name, which starts
+// base bytes into the total, while it is read; showProgress keeps that
+// from costing more than a clock reading per call.
+type progressReader struct {
+	r            io.Reader
+	prefix, name string
+	base, total  int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.base += int64(n)
+	showProgress(pr.prefix, pr.name, pr.base, pr.total)
+	return n, err
+}
+
+// clockTime formats d as m:ss, or h:mm:ss from an hour on.
+func clockTime(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// shortName returns name cut to its last n characters.
+func shortName(name string, n int) string {
+	r := []rune(name)
+	if len(r) <= n {
+		return name
+	}
+	return "..." + string(r[len(r)-n+3:])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ---------------------- Progress events (-progress-json) -----------
+//
+// For front-ends that draw their own progress bar, -progress-json writes
+// what the bar would show as one JSON object per line, to stderr or to
+// file descriptor -progress-fd:
+//
+//	{"phase":"extracting","file":"src/big.iso","bytes":1048576,"total":8388608}
+//
+// phase is "packing" (-c), "copying" (the blocks kept by -a), then
+// "packing", or "extracting" (-x); bytes and total count file data. There
+// are at most ten events a second and a last one with bytes equal to
+// total and no file when the phase is done. The progress bar is then not
+// drawn; the other output is as usual, and -q silences it without
+// affecting the events.
+
+// progressEvents receives the events, if not nil.
+var progressEvents io.Writer
+
+// progressEvent is one line of -progress-json.
+type progressEvent struct {
+	Phase string `json:"phase"`
+	File  string `json:"file,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total"`
+}
+
+// openProgressEvents sends the events to file descriptor fd.
+func openProgressEvents(fd int) error {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return fmt.Errorf("-progress-fd %d: not a file descriptor", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("-progress-fd %d: %w", fd, err)
+	}
+	progressEvents = f
+	return nil
+}
+
+// sendProgress writes one event. A front-end that stopped reading does
+// not stop the work, so write errors are ignored.
+func sendProgress(prefix, name string, done, total int64) {
+	line, _ := json.Marshal(progressEvent{Phase: strings.ToLower(prefix), File: name, Bytes: done, Total: total})
+	progressEvents.Write(append(line, '\n'))
+}
@@ -0,0 +1,161 @@
+package main
+
+import "errors"
+
+// ---------------------- Range coder (method range) ------------------
+//
+// A binary adaptive range coder (the LZMA flavour) in place of Huffman:
+// it spends fractional bits per symbol, so it does not lose up to a bit
+// per byte to code-length rounding. Each byte is coded as 8 binary
+// decisions down a bit tree whose probabilities are chosen by the
+// preceding byte (order-1 context) and adapt as data goes by, so no table
+// is stored. Method data is the range coder output.
+
+const (
+	rcProbBits  = 11
+	rcProbInit  = 1 << (rcProbBits - 1)
+	rcMoveBits  = 5
+	rcTopValue  = 1 << 24
+	rcModelSize = 256 * 256
+)
+
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func newRangeEncoder() *rangeEncoder {
+	return &rangeEncoder{rng: 0xFFFFFFFF, cacheSize: 1}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.out = append(e.out, temp+carry)
+			temp = 0xFF
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = (e.low & 0x00FFFFFF) << 8
+}
+
+func (e *rangeEncoder) encodeBit(p *uint16, bit int) {
+	bound := (e.rng >> rcProbBits) * uint32(*p)
+	if bit == 0 {
+		e.rng = bound
+		*p += (1<<rcProbBits - *p) >> rcMoveBits
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*p -= *p >> rcMoveBits
+	}
+	for e.rng < rcTopValue {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) finish() []byte {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+type rangeDecoder struct {
+	code uint32
+	rng  uint32
+	in   []byte
+	pos  int
+}
+
+func newRangeDecoder(in []byte) (*rangeDecoder, error) {
+	if len(in) < 5 || in[0] != 0 {
+		return nil, errors.New("corrupt range coded data")
+	}
+	d := &rangeDecoder{rng: 0xFFFFFFFF, in: in, pos: 5}
+	for _, b := range in[1:5] {
+		d.code = d.code<<8 | uint32(b)
+	}
+	return d, nil
+}
+
+func (d *rangeDecoder) decodeBit(p *uint16) int {
+	bound := (d.rng >> rcProbBits) * uint32(*p)
+	var bit int
+	if d.code < bound {
+		d.rng = bound
+		*p += (1<<rcProbBits - *p) >> rcMoveBits
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*p -= *p >> rcMoveBits
+		bit = 1
+	}
+	for d.rng < rcTopValue {
+		d.rng <<= 8
+		var b byte
+		if d.pos < len(d.in) {
+			b = d.in[d.pos]
+		}
+		d.pos++
+		d.code = d.code<<8 | uint32(b)
+	}
+	return bit
+}
+
+// newRangeModel returns order-1 bit-tree probabilities, all at one half.
+func newRangeModel() []uint16 {
+	probs := make([]uint16, rcModelSize)
+	for i := range probs {
+		probs[i] = rcProbInit
+	}
+	return probs
+}
+
+func rangeEncode(raw []byte) ([]byte, error) {
+	probs := newRangeModel()
+	e := newRangeEncoder()
+	prev := 0
+	for _, b := range raw {
+		tree := probs[prev<<8 : prev<<8+256]
+		m := 1
+		for i := 7; i >= 0; i-- {
+			bit := int(b>>i) & 1
+			e.encodeBit(&tree[m], bit)
+			m = m<<1 | bit
+		}
+		prev = int(b)
+	}
+	return e.finish(), nil
+}
+
+func rangeDecode(data []byte, rawLen int) ([]byte, error) {
+	d, err := newRangeDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	probs := newRangeModel()
+	out := make([]byte, rawLen)
+	prev := 0
+	for k := range out {
+		tree := probs[prev<<8 : prev<<8+256]
+		m := 1
+		for m < 256 {
+			m = m<<1 | d.decodeBit(&tree[m])
+		}
+		out[k] = byte(m)
+		prev = int(out[k])
+	}
+	// the encoder flushes 5 bytes; reading further means corrupt data
+	if d.pos > len(data)+4 {
+		return nil, errors.New("range coded data truncated")
+	}
+	return out, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// ---------------------- Read-ahead (create) ------------------------
+//
+// Creating read a file, handed it to the block writer and only then
+// opened the next, so the disk sat idle while blocks were compressed and
+// the compressors while a file was read. Files are now read by up to -jobs
+// goroutines ahead of the entry being written, starting as soon as the
+// walk finds them: the walk still ends before anything is written, since
+// the header carries the entry count and total size, but the first files
+// are in memory by then. Large files (largefile.go) get their hashing and
+// chunking pass ahead instead, and are streamed when their entry is
+// written. Blocks are compressed and sealed in goroutines of their own and
+// written out by another (blocks.go), so walking, reading, compressing,
+// encrypting and writing all overlap.
+//
+// Read-ahead holds at most readAheadMax bytes of file data, or what
+// -max-memory leaves over from the blocks, with a large file counting as
+// streamFileMin; a file larger than that is read when nothing else is
+// held. Entries go into the archive in the order walked, and an error
+// reading a file comes up when its entry is reached, as before.
+
+// readAheadMax is the most file data read ahead at once.
+const readAheadMax = 64 << 20
+
+// readJob is a file read ahead.
+type readJob struct {
+	f    inputFile
+	size int64      // counted against the budget
+	data []byte     // contents of a small file
+	big  *largeFile // or the first pass over a large one
+	err  error
+	done chan struct{}
+}
+
+func (j *readJob) read() {
+	defer close(j.done)
+	if j.f.info.Size() > streamFileMin {
+		j.big, j.err = scanLargeFile(j.f.absPath)
+	} else {
+		j.data, j.err = os.ReadFile(j.f.absPath)
+	}
+}
+
+// readAhead reads the files writeEntries will read, in the order found.
+type readAhead struct {
+	budget int64
+	base   *baseTree // files unchanged since -base are not read
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	queue   []*readJob          // found and not taken yet, in order
+	started int                 // how many of queue are being read or were
+	held    int64               // bytes counted for those
+	byName  map[string]*readJob // queue by relPath
+	links   map[[2]uint64]bool  // inodes queued, for hard links
+	stopped bool
+}
+
+// newReadAhead starts jobs goroutines (0 = one per CPU) that read what
+// add queues, holding up to budget bytes.
+func newReadAhead(jobs int, budget int64, base *baseTree) *readAhead {
+	ra := &readAhead{
+		budget: budget,
+		base:   base,
+		byName: make(map[string]*readJob),
+		links:  make(map[[2]uint64]bool),
+	}
+	ra.wake = sync.NewCond(&ra.mu)
+	if jobs == 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	for range jobs {
+		go ra.run()
+	}
+	return ra
+}
+
+// readAheadBudget returns how much file data read-ahead may hold when up
+// to inFlight blocks of blockSize bytes are compressed with method at
+// once under -max-memory limit (0 = no limit).
+func readAheadBudget(limit int64, method byte, blockSize, inFlight int) int64 {
+	if limit <= 0 {
+		return readAheadMax
+	}
+	left := limit - int64(blockSize) - int64(inFlight)*blockMemory(method, blockSize, false)
+	return min(max(left, 0), readAheadMax)
+}
+
+// add queues f, as the walk finds it, if writeEntries reads it: a regular
+// file that is neither a further hard link to one queued nor the same as
+// in -base.
+func (ra *readAhead) add(f inputFile) {
+	if f.imported != nil || !f.info.Mode().IsRegular() {
+		return
+	}
+	if ra.base != nil {
+		if same, err := ra.base.unchanged(nfc(filepath.ToSlash(f.relPath)), f); same && err == nil {
+			return
+		}
+	}
+	if id, linked := fileID(f.info); linked {
+		if ra.links[id] {
+			return
+		}
+		ra.links[id] = true
+	}
+	j := &readJob{f: f, size: min(f.info.Size(), streamFileMin), done: make(chan struct{})}
+	ra.mu.Lock()
+	ra.queue = append(ra.queue, j)
+	ra.byName[f.relPath] = j
+	ra.mu.Unlock()
+	ra.wake.Broadcast()
+}
+
+// run reads the queued files in order while the budget allows.
+func (ra *readAhead) run() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for {
+		for !ra.stopped && !ra.ready() {
+			ra.wake.Wait()
+		}
+		if ra.stopped {
+			return
+		}
+		j := ra.queue[ra.started]
+		ra.started++
+		ra.held += j.size
+		ra.mu.Unlock()
+		j.read()
+		ra.mu.Lock()
+	}
+}
+
+// ready reports whether the next queued file may be read.
+func (ra *readAhead) ready() bool {
+	if ra.started == len(ra.queue) {
+		return false
+	}
+	return ra.held == 0 || ra.held+ra.queue[ra.started].size <= ra.budget
+}
+
+// take returns the job for f, waiting for it to be read, or nil if f was
+// not queued. The files queued before f are not archived after all, and
+// are dropped.
+func (ra *readAhead) take(f inputFile) *readJob {
+	if ra == nil {
+		return nil
+	}
+	ra.mu.Lock()
+	j := ra.byName[f.relPath]
+	if j == nil || j.f.absPath != f.absPath {
+		ra.mu.Unlock()
+		return nil
+	}
+	n := slices.Index(ra.queue, j) + 1
+	started := n <= ra.started
+	for i, d := range ra.queue[:n] {
+		delete(ra.byName, d.f.relPath)
+		if i < ra.started {
+			ra.held -= d.size
+		}
+	}
+	ra.queue, ra.started = ra.queue[n:], max(ra.started-n, 0)
+	ra.mu.Unlock()
+	ra.wake.Broadcast()
+	if started {
+		<-j.done
+	} else {
+		j.read()
+	}
+	return j
+}
+
+// read returns the contents of f, read ahead or now.
+func (ra *readAhead) read(f inputFile) ([]byte, error) {
+	if j := ra.take(f); j != nil {
+		return j.data, j.err
+	}
+	return os.ReadFile(f.absPath)
+}
+
+// scan returns the first pass over large file f, made ahead or now.
+func (ra *readAhead) scan(f inputFile) (*largeFile, error) {
+	if j := ra.take(f); j != nil {
+		return j.big, j.err
+	}
+	return scanLargeFile(f.absPath)
+}
+
+// stop ends the reads; the files being read are dropped.
+func (ra *readAhead) stop() {
+	ra.mu.Lock()
+	ra.stopped = true
+	ra.mu.Unlock()
+	ra.wake.Broadcast()
+}
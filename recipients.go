@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------------- Public-key recipients ----------------------
+//
+// Besides passwords and key files, a key slot can wrap the master key for
+// an X25519 public key, the way age does: a fresh ephemeral key pair is
+// generated per slot, and the key wrapping the master key is
+//
+//   HKDF-SHA256(X25519(ephemeral, recipient), salt = ephemeral || recipient)
+//
+// The slot stores only the ephemeral public key, so it does not reveal
+// who the recipient is. Whoever holds the matching identity (secret key)
+// file opens the archive with it like with a key file.
+
+const (
+	recipientPrefix = "ghzip1"            // public keys, lower case
+	identityPrefix  = "GHZIP-SECRET-KEY-" // secret keys, upper case
+
+	x25519KeySize = 32
+)
+
+const recipientInfo = "ghzip x25519 key slot"
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// errNoIdentity is returned for an identity file without a secret key.
+var errNoIdentity = errors.New("no " + identityPrefix + "... line in the identity file")
+
+// parseRecipient decodes a public key written as ghzip1....
+func parseRecipient(s string) (*ecdh.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	enc, ok := strings.CutPrefix(s, recipientPrefix)
+	if !ok {
+		return nil, fmt.Errorf("recipient %q: public keys start with %s", s, recipientPrefix)
+	}
+	b, err := keyEncoding.DecodeString(strings.ToUpper(enc))
+	if err != nil || len(b) != x25519KeySize {
+		return nil, fmt.Errorf("recipient %q: malformed public key", s)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+func formatRecipient(pub *ecdh.PublicKey) string {
+	return recipientPrefix + strings.ToLower(keyEncoding.EncodeToString(pub.Bytes()))
+}
+
+func formatIdentity(priv *ecdh.PrivateKey) string {
+	return identityPrefix + keyEncoding.EncodeToString(priv.Bytes())
+}
+
+// parseIdentities returns the secret keys in the contents of an identity
+// file: one per line, other lines (comments) are ignored. It returns nil
+// for anything else, e.g. a password.
+func parseIdentities(contents string) []*ecdh.PrivateKey {
+	var ids []*ecdh.PrivateKey
+	for _, line := range strings.Split(contents, "\n") {
+		enc, ok := strings.CutPrefix(strings.TrimSpace(line), identityPrefix)
+		if !ok {
+			continue
+		}
+		b, err := keyEncoding.DecodeString(enc)
+		if err != nil || len(b) != x25519KeySize {
+			continue
+		}
+		if priv, err := ecdh.X25519().NewPrivateKey(b); err == nil {
+			ids = append(ids, priv)
+		}
+	}
+	return ids
+}
+
+// recipientKey derives the key wrapping the master key from the shared
+// secret of an ephemeral and a recipient key.
+func recipientKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, recipientInfo, masterKeySize)
+}
+
+// newRecipientSlot wraps master for the X25519 public key pub.
+func newRecipientSlot(pub *ecdh.PublicKey, cipherID byte, master, aad []byte) (keySlot, error) {
+	s := keySlot{kind: slotX25519}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return s, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return s, err
+	}
+	s.ephemeral = eph.PublicKey().Bytes()
+	kek, err := recipientKey(shared, s.ephemeral, pub.Bytes())
+	clear(shared)
+	if err != nil {
+		return s, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return s, err
+	}
+	s.nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.nonce); err != nil {
+		return s, err
+	}
+	s.wrapped = aead.Seal(nil, s.nonce, master, aad)
+	return s, nil
+}
+
+// unwrapIdentity returns the master key if the slot was made for the
+// public key of priv.
+func (s keySlot) unwrapIdentity(priv *ecdh.PrivateKey, cipherID byte, aad []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().NewPublicKey(s.ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := recipientKey(shared, s.ephemeral, priv.PublicKey().Bytes())
+	clear(shared)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(kek)
+	aead, err := newAEAD(cipherID, kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, s.nonce, s.wrapped, aad)
+}
+
+// runKeygen implements "ghzip keygen": it writes a new identity file and
+// prints its public key.
+func runKeygen(args []string) {
+	cmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	outPath := cmd.String("out", "", "write the identity to `file` (default: standard output)")
+	parseCommandVerbose(cmd, args, "verbose: no effect; keygen always prints the public key")
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	pub := formatRecipient(priv.PublicKey())
+	contents := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), pub, formatIdentity(priv))
+	if *outPath == "" {
+		fmt.Print(contents)
+		return
+	}
+	f, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		fail("%v", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		fail("%v", err)
+		return
+	}
+	fmt.Println("Public key:", pub)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- Recovery records ---------------------------
+//
+// An optional recovery section may follow the archive. It protects the
+// archive bytes (which are ciphertext, so no password is needed to repair
+// them) with Reed-Solomon parity:
+//
+//   header:  ["GHR1"][8 protected size][4 slice size][4 data slices]
+//            [4 stripes][2 parity slices per stripe]
+//            [4 CRC-32 per data slice, then per parity slice][32 SHA-256]
+//   parity:  stripes * parity slices, slice size bytes each
+//   header copy
+//   trailer: [8 header offset][8 header copy offset]["GHRR"]
+//
+// The archive is cut into fixed-size slices (the last one zero padded).
+// Data slice i belongs to stripe i % stripes, so a contiguous damaged
+// region is spread over all stripes; each stripe can rebuild as many lost
+// slices as it has intact parity slices.
+
+const (
+	recoveryMagic   = "GHR1"
+	recoveryTrailer = "GHRR"
+
+	recoveryTrailerSize = 20
+	minSliceSize        = 512
+	maxSliceSize        = 64 << 10 // grown only for very large archives
+	maxStripeData       = 128      // data slices per stripe
+	maxDataSlices       = 1 << 16
+)
+
+// recoveryHeader describes the geometry of a recovery section.
+type recoveryHeader struct {
+	size    int64 // protected archive bytes
+	slice   int
+	slices  int // data slices
+	stripes int
+	parity  int      // parity slices per stripe
+	sums    []uint32 // data slice CRCs followed by parity slice CRCs
+}
+
+// newRecoveryHeader picks the geometry for protecting size bytes with about
+// pct percent of parity.
+func newRecoveryHeader(size int64, pct float64) recoveryHeader {
+	l := int64(minSliceSize)
+	for l < maxSliceSize && (size+l-1)/l > maxStripeData {
+		l *= 2
+	}
+	for (size+l-1)/l > maxDataSlices {
+		l *= 2
+	}
+	n := int(max(1, (size+l-1)/l))
+	g := (n + maxStripeData - 1) / maxStripeData
+	k := (n + g - 1) / g
+	m := int(float64(k)*pct/100 + 0.999999)
+	m = min(max(m, 1), 256-k)
+	return recoveryHeader{size: size, slice: int(l), slices: n, stripes: g, parity: m}
+}
+
+// parseRecoveryPercent parses a -recovery value such as "5%" or "5".
+func parseRecoveryPercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid recovery size %q (want a percentage like 5%%)", s)
+	}
+	return p, nil
+}
+
+// stripeSlices returns the data slice numbers of stripe s.
+func (rh recoveryHeader) stripeSlices(s int) []int {
+	var idx []int
+	for i := s; i < rh.slices; i += rh.stripes {
+		idx = append(idx, i)
+	}
+	return idx
+}
+
+func (rh recoveryHeader) headerLen() int64 {
+	return int64(4 + 8 + 4 + 4 + 4 + 2 + 4*(rh.slices+rh.stripes*rh.parity) + sha256.Size)
+}
+
+func (rh recoveryHeader) parityLen() int64 {
+	return int64(rh.stripes*rh.parity) * int64(rh.slice)
+}
+
+// sectionLen is the size of the whole recovery section.
+func (rh recoveryHeader) sectionLen() int64 {
+	return 2*rh.headerLen() + rh.parityLen() + recoveryTrailerSize
+}
+
+// parityOffset is the file offset of parity slice p of stripe s.
+func (rh recoveryHeader) parityOffset(s, p int) int64 {
+	return rh.size + rh.headerLen() + int64(s*rh.parity+p)*int64(rh.slice)
+}
+
+func (rh recoveryHeader) encode() []byte {
+	b := []byte(recoveryMagic)
+	b = binary.LittleEndian.AppendUint64(b, uint64(rh.size))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rh.slice))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rh.slices))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rh.stripes))
+	b = binary.LittleEndian.AppendUint16(b, uint16(rh.parity))
+	for _, c := range rh.sums {
+		b = binary.LittleEndian.AppendUint32(b, c)
+	}
+	sum := sha256.Sum256(b)
+	return append(b, sum[:]...)
+}
+
+// readRecoveryHeader parses and checks the recovery header at off.
+func readRecoveryHeader(r io.ReaderAt, off int64) (recoveryHeader, error) {
+	var rh recoveryHeader
+	var fixed [26]byte
+	if _, err := r.ReadAt(fixed[:], off); err != nil {
+		return rh, err
+	}
+	if string(fixed[:4]) != recoveryMagic {
+		return rh, errors.New("recovery header not found")
+	}
+	rh.size = int64(binary.LittleEndian.Uint64(fixed[4:12]))
+	rh.slice = int(binary.LittleEndian.Uint32(fixed[12:16]))
+	rh.slices = int(binary.LittleEndian.Uint32(fixed[16:20]))
+	rh.stripes = int(binary.LittleEndian.Uint32(fixed[20:24]))
+	rh.parity = int(binary.LittleEndian.Uint16(fixed[24:26]))
+	if rh.size < 0 || rh.slice < minSliceSize || rh.slices < 1 || rh.slices > maxDataSlices ||
+		rh.stripes < 1 || rh.stripes > rh.slices || rh.parity < 1 ||
+		rh.parity+(rh.slices+rh.stripes-1)/rh.stripes > 256 ||
+		int64(rh.slices-1)*int64(rh.slice) >= max(rh.size, 1) {
+		return rh, errors.New("corrupt recovery header")
+	}
+	b := make([]byte, rh.headerLen())
+	if _, err := r.ReadAt(b, off); err != nil {
+		return rh, err
+	}
+	body := b[:len(b)-sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], b[len(body):]) {
+		return rh, errors.New("recovery header checksum mismatch")
+	}
+	rh.sums = make([]uint32, rh.slices+rh.stripes*rh.parity)
+	for i := range rh.sums {
+		rh.sums[i] = binary.LittleEndian.Uint32(body[26+4*i:])
+	}
+	return rh, nil
+}
+
+// readSlice reads data slice i, zero padding whatever lies beyond the
+// protected size or the end of the file.
+func (rh recoveryHeader) readSlice(r io.ReaderAt, i int, buf []byte) error {
+	clear(buf)
+	off := int64(i) * int64(rh.slice)
+	n := min(int64(rh.slice), rh.size-off)
+	_, err := r.ReadAt(buf[:n], off)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// addRecoveryRecord appends a recovery section protecting the first size
+// bytes of f, with about pct percent of parity.
+func addRecoveryRecord(f *os.File, size int64, pct float64) error {
+	rh := newRecoveryHeader(size, pct)
+	return writeRecovery(f, rh)
+}
+
+// writeRecovery computes parity and checksums for the geometry in rh and
+// writes the recovery section right after rh.size bytes of f.
+func writeRecovery(f *os.File, rh recoveryHeader) error {
+	if err := f.Truncate(rh.size); err != nil {
+		return err
+	}
+	rh.sums = make([]uint32, rh.slices+rh.stripes*rh.parity)
+	parity := make([][]byte, rh.parity)
+	for p := range parity {
+		parity[p] = make([]byte, rh.slice)
+	}
+	for s := 0; s < rh.stripes; s++ {
+		idx := rh.stripeSlices(s)
+		data := make([][]byte, len(idx))
+		for j, i := range idx {
+			data[j] = make([]byte, rh.slice)
+			if err := rh.readSlice(f, i, data[j]); err != nil {
+				return err
+			}
+			rh.sums[i] = crc32.ChecksumIEEE(data[j])
+		}
+		rsEncode(data, parity)
+		for p, buf := range parity {
+			rh.sums[rh.slices+s*rh.parity+p] = crc32.ChecksumIEEE(buf)
+			if _, err := f.WriteAt(buf, rh.parityOffset(s, p)); err != nil {
+				return err
+			}
+		}
+	}
+	hdr := rh.encode()
+	copyOff := rh.size + rh.headerLen() + rh.parityLen()
+	if _, err := f.WriteAt(hdr, rh.size); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(hdr, copyOff); err != nil {
+		return err
+	}
+	trailer := binary.LittleEndian.AppendUint64(nil, uint64(rh.size))
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(copyOff))
+	trailer = append(trailer, recoveryTrailer...)
+	_, err := f.WriteAt(trailer, copyOff+rh.headerLen())
+	return err
+}
+
+// archiveLength returns how many of the size bytes in r belong to the
+// archive proper, leaving out a recovery section if there is one.
+func archiveLength(r io.ReaderAt, size int64) (int64, error) {
+	if size < recoveryTrailerSize {
+		return size, nil
+	}
+	var trailer [recoveryTrailerSize]byte
+	if _, err := r.ReadAt(trailer[:], size-recoveryTrailerSize); err != nil {
+		return 0, err
+	}
+	if string(trailer[16:]) != recoveryTrailer {
+		return size, nil
+	}
+	off := int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if off < 0 || off >= size {
+		return size, nil
+	}
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil {
+		return size, nil
+	}
+	if string(hdr[:4]) != recoveryMagic || int64(binary.LittleEndian.Uint64(hdr[4:])) != off {
+		return size, nil
+	}
+	return off, nil
+}
+
+// findRecovery locates an intact recovery header in f: through the trailer
+// if it survived, otherwise by scanning for the header magic.
+func findRecovery(f *os.File, fileSize int64) (recoveryHeader, error) {
+	if fileSize >= recoveryTrailerSize {
+		var trailer [recoveryTrailerSize]byte
+		if _, err := f.ReadAt(trailer[:], fileSize-recoveryTrailerSize); err == nil &&
+			string(trailer[16:]) == recoveryTrailer {
+			for _, o := range []uint64{binary.LittleEndian.Uint64(trailer[:8]), binary.LittleEndian.Uint64(trailer[8:16])} {
+				if rh, err := readRecoveryHeader(f, int64(o)); err == nil {
+					return rh, nil
+				}
+			}
+		}
+	}
+	// Scan for a header whose position matches what it describes.
+	const chunk = 1 << 20
+	buf := make([]byte, chunk+len(recoveryMagic)-1)
+	for base := int64(0); base < fileSize; base += chunk {
+		n, err := f.ReadAt(buf, base)
+		if err != nil && err != io.EOF {
+			return recoveryHeader{}, err
+		}
+		for i := 0; ; {
+			j := bytes.Index(buf[i:n], []byte(recoveryMagic))
+			if j < 0 {
+				break
+			}
+			off := base + int64(i+j)
+			if rh, err := readRecoveryHeader(f, off); err == nil &&
+				(off == rh.size || off == rh.size+rh.headerLen()+rh.parityLen()) {
+				return rh, nil
+			}
+			i += j + 1
+		}
+	}
+	return recoveryHeader{}, errors.New("no recovery record found")
+}
+
+// repairReport summarises a repair run.
+type repairReport struct {
+	slices        int // data slices checked
+	damaged       int // damaged data slices
+	repaired      int
+	parityDamaged int // damaged parity slices
+	rewritten     bool
+}
+
+// repairArchive checks the archive at path against its recovery record and
+// rebuilds damaged slices in place. A damaged or truncated recovery section
+// is regenerated once the archive itself is intact.
+func repairArchive(path string) (repairReport, error) {
+	var rep repairReport
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return rep, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return rep, err
+	}
+	rh, err := findRecovery(f, st.Size())
+	if err != nil {
+		return rep, err
+	}
+	rep.slices = rh.slices
+	if st.Size() < rh.size {
+		return rep, fmt.Errorf("archive is truncated inside the protected data (%d of %d bytes)", st.Size(), rh.size)
+	}
+	unrecoverable := 0
+	for s := 0; s < rh.stripes; s++ {
+		idx := rh.stripeSlices(s)
+		data := make([][]byte, len(idx))
+		var lost []int
+		for j, i := range idx {
+			data[j] = make([]byte, rh.slice)
+			if err := rh.readSlice(f, i, data[j]); err != nil {
+				return rep, err
+			}
+			if crc32.ChecksumIEEE(data[j]) != rh.sums[i] {
+				lost = append(lost, j)
+			}
+		}
+		parity := make([][]byte, rh.parity)
+		var good []int
+		for p := range parity {
+			parity[p] = make([]byte, rh.slice)
+			off := rh.parityOffset(s, p)
+			if _, err := f.ReadAt(parity[p], off); err == nil &&
+				crc32.ChecksumIEEE(parity[p]) == rh.sums[rh.slices+s*rh.parity+p] {
+				good = append(good, p)
+			} else {
+				rep.parityDamaged++
+			}
+		}
+		rep.damaged += len(lost)
+		if len(lost) == 0 {
+			continue
+		}
+		if len(lost) > len(good) {
+			unrecoverable += len(lost)
+			continue
+		}
+		if err := rsReconstruct(data, parity, lost, good); err != nil {
+			return rep, err
+		}
+		for _, j := range lost {
+			i := idx[j]
+			if crc32.ChecksumIEEE(data[j]) != rh.sums[i] {
+				return rep, fmt.Errorf("slice %d failed verification after repair", i)
+			}
+			off := int64(i) * int64(rh.slice)
+			n := min(int64(rh.slice), rh.size-off)
+			if _, err := f.WriteAt(data[j][:n], off); err != nil {
+				return rep, err
+			}
+			rep.repaired++
+		}
+	}
+	if unrecoverable > 0 {
+		return rep, fmt.Errorf("%d damaged slice(s) exceed the recovery record and could not be repaired", unrecoverable)
+	}
+	// Regenerate the recovery section if any part of it is missing or damaged.
+	intact := rep.parityDamaged == 0 && st.Size() == rh.size+rh.sectionLen()
+	if intact {
+		copyOff := rh.size + rh.headerLen() + rh.parityLen()
+		if _, err := readRecoveryHeader(f, rh.size); err != nil {
+			intact = false
+		} else if _, err := readRecoveryHeader(f, copyOff); err != nil {
+			intact = false
+		} else if l, err := archiveLength(f, st.Size()); err != nil || l != rh.size {
+			intact = false
+		}
+	}
+	if !intact {
+		if err := writeRecovery(f, rh); err != nil {
+			return rep, err
+		}
+		rep.rewritten = true
+	}
+	return rep, f.Sync()
+}
@@ -0,0 +1,144 @@
+package main
+
+import "errors"
+
+// ---------------------- Reed-Solomon over GF(2^8) -------------------
+//
+// A small systematic erasure code used by recovery records. Parity shard i
+// is sum_j c[i][j] * data_j with a Cauchy matrix c[i][j] = 1/(x_i + y_j),
+// x_i = 255-i and y_j = j; every square submatrix of a Cauchy matrix is
+// invertible, so any e lost data shards can be rebuilt from any e parity
+// shards as long as data+parity shards stay within the 256 field elements.
+
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// rsCoef is the coefficient of data shard j in parity shard i.
+func rsCoef(i, j int) byte {
+	return gfInv(byte(255-i) ^ byte(j))
+}
+
+// rsMulAdd adds c*src to dst element-wise.
+func rsMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for v := 1; v < 256; v++ {
+		table[v] = gfMul(byte(v), c)
+	}
+	for k, v := range src {
+		dst[k] ^= table[v]
+	}
+}
+
+// rsEncode computes len(parity) parity shards over the data shards. All
+// shards have the same length.
+func rsEncode(data, parity [][]byte) {
+	for i, p := range parity {
+		clear(p)
+		for j, d := range data {
+			rsMulAdd(p, d, rsCoef(i, j))
+		}
+	}
+}
+
+// rsReconstruct rebuilds the data shards listed in lost (whose contents are
+// ignored) from intact data shards and the intact parity shards listed in
+// good. It needs at least len(lost) good parity shards.
+func rsReconstruct(data, parity [][]byte, lost, good []int) error {
+	e := len(lost)
+	if e == 0 {
+		return nil
+	}
+	if len(good) < e {
+		return errors.New("not enough parity to reconstruct")
+	}
+	rows := good[:e]
+	isLost := make(map[int]bool, e)
+	for _, j := range lost {
+		isLost[j] = true
+	}
+	// syndromes: parity minus the contribution of the intact data shards
+	syn := make([][]byte, e)
+	for r, i := range rows {
+		syn[r] = append([]byte(nil), parity[i]...)
+		for j, d := range data {
+			if !isLost[j] {
+				rsMulAdd(syn[r], d, rsCoef(i, j))
+			}
+		}
+	}
+	// invert the e x e Cauchy submatrix (Gauss-Jordan)
+	a := make([][]byte, e)
+	inv := make([][]byte, e)
+	for r, i := range rows {
+		a[r] = make([]byte, e)
+		inv[r] = make([]byte, e)
+		inv[r][r] = 1
+		for c, j := range lost {
+			a[r][c] = rsCoef(i, j)
+		}
+	}
+	for c := 0; c < e; c++ {
+		p := c
+		for p < e && a[p][c] == 0 {
+			p++
+		}
+		if p == e {
+			return errors.New("singular recovery matrix")
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		f := gfInv(a[c][c])
+		for k := 0; k < e; k++ {
+			a[c][k] = gfMul(a[c][k], f)
+			inv[c][k] = gfMul(inv[c][k], f)
+		}
+		for r := 0; r < e; r++ {
+			if r == c || a[r][c] == 0 {
+				continue
+			}
+			f := a[r][c]
+			for k := 0; k < e; k++ {
+				a[r][k] ^= gfMul(f, a[c][k])
+				inv[r][k] ^= gfMul(f, inv[c][k])
+			}
+		}
+	}
+	for c, j := range lost {
+		clear(data[j])
+		for r := 0; r < e; r++ {
+			rsMulAdd(data[j], syn[r], inv[c][r])
+		}
+	}
+	return nil
+}
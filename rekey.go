@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------- Password change (rekey) --------------------
+//
+// "ghzip rekey" changes the password of an archive without recompressing
+// it. In v2 archives only the key slot the old password opens is
+// replaced: the master key, and with it the payload, stays the same. v1
+// archives have no master key, so their single AES-GCM message is
+// decrypted and sealed again under the new password; that is still much
+// cheaper than re-archiving, since nothing is decompressed.
+
+// runRekey implements "ghzip rekey".
+func runRekey(args []string) {
+	cmd := flag.NewFlagSet("rekey", flag.ExitOnError)
+	inPath := cmd.String("in", "", "the `archive`")
+	pass := cmd.String("pass", "", "current password (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the current password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the current password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "current key `file`")
+	newPass := cmd.String("new-pass", "", "new password (prompted if neither it nor -new-keyfile is given)")
+	newKeyfilePath := cmd.String("new-keyfile", "", "new key `file` (v2)")
+	kdfName := cmd.String("kdf", "argon2id", "key derivation for the new password: argon2id, scrypt or pbkdf2 (v2)")
+	fips := cmd.Bool("fips", false, "use approved algorithms only: the archive must be, and the new password is, PBKDF2 based (v2)")
+	parseCommand(cmd, args)
+	if *inPath == "" && cmd.NArg() == 1 {
+		*inPath = cmd.Arg(0)
+	}
+	if *inPath == "" {
+		fmt.Println("usage: ghzip rekey [-pass p | -keyfile f] [-new-pass p | -new-keyfile f] [-kdf name] [-fips] -in <archive>")
+		return
+	}
+	if *fips {
+		if err := checkFIPSFlags(cmd); err != nil {
+			fail("%v", err)
+			return
+		}
+		applyFIPS(cmd)
+		if err := checkFIPSArchive(*inPath); err != nil {
+			fail("%v", err)
+			return
+		}
+	}
+	alg, err := parseKDF(*kdfName)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	ver, err := archiveVersion(*inPath)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	if ver == versionV1 && *newKeyfilePath != "" {
+		fail("version 1 archives take a password, not a key file")
+		return
+	}
+	if *pass == "" && *keyfilePath == "" {
+		if *pass, err = readPassword(*passFd, *passFile); err != nil {
+			fail("%v", err)
+			return
+		}
+	}
+	secret, err := slotSecret(*pass, *keyfilePath, "Current password: ")
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	newSecret, err := slotSecret(*newPass, *newKeyfilePath, "New password: ")
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	showBox("Changing password", fmt.Sprintf("Archive: %s", *inPath))
+	if ver == versionV1 {
+		if err := rekeyV1(*inPath, secret, newSecret); err != nil {
+			fail("Rekey failed: %v", err)
+			return
+		}
+		showOK("Version 1 archive re-encrypted: %s", *inPath)
+		return
+	}
+
+	sf, err := openSlotFile(*inPath, true)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	defer sf.Close()
+	master, i, err := sf.unlock(secret)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	defer clear(master)
+	kind := slotPassword
+	if *newKeyfilePath != "" {
+		kind = slotKeyfile
+	}
+	if sf.slots[i].kind == slotRecovery {
+		// Keep the recovery key; the new password goes into a free slot
+		// and the forgotten one can be removed with "slot remove".
+		for i = 0; i < len(sf.slots) && sf.slots[i].kind != slotEmpty; i++ {
+		}
+		if i == len(sf.slots) {
+			fail("opened with the recovery key, but all %d key slots are in use; remove one first", len(sf.slots))
+			return
+		}
+	}
+	if sf.slots[i], err = newKeySlot(kind, newSecret, kdfOptions{alg: alg}, sf.cipher, master, sf.fixed); err != nil {
+		fail("%v", err)
+		return
+	}
+	warning, err := sf.writeSlot(i)
+	if err != nil {
+		fail("Rekey failed: %v", err)
+		return
+	}
+	if warning != "" {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	others := 0
+	for j, s := range sf.slots {
+		if j != i && s.kind != slotEmpty {
+			others++
+		}
+	}
+	if others > 0 {
+		infof("%d other key slot(s) still open the archive (see ghzip slot list).", others)
+	}
+	showOK("Key slot %d re-wrapped: %s", i, *inPath)
+}
+
+// archiveVersion reads the format version of the archive at path.
+func archiveVersion(path string) (byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	start, _, _, err := sfxRange(f)
+	if err != nil {
+		return 0, err
+	}
+	hdr := make([]byte, len(magic)+1)
+	if _, err := f.ReadAt(hdr, start); err != nil {
+		return 0, err
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return 0, fmt.Errorf("not a ghzip archive (magic mismatch)")
+	}
+	return hdr[len(magic)], nil
+}
+
+// rekeyV1 seals the payload of the v1 archive at path under newPassword,
+// writing a new file and renaming it over the old one.
+func rekeyV1(path, password, newPassword string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// magic, version, nonce, frequency table, ciphertext length
+	const fixed = len(magic) + 1 + 12 + 256*8 + 8
+	if len(data) < fixed {
+		return errors.New("truncated version 1 archive")
+	}
+	if string(data[:len(magic)]) != magic {
+		return errors.New("self-extracting version 1 archives cannot be rekeyed")
+	}
+	clen := binary.LittleEndian.Uint64(data[fixed-8 : fixed])
+	if clen != uint64(len(data)-fixed) {
+		return errors.New("corrupt version 1 archive (ciphertext length)")
+	}
+	kdf := kdfParams{alg: kdfSHA256}
+	oldKey, err := kdf.deriveKey(password)
+	if err != nil {
+		return err
+	}
+	defer clear(oldKey)
+	newKey, err := kdf.deriveKey(newPassword)
+	if err != nil {
+		return err
+	}
+	defer clear(newKey)
+	oldGCM, err := newAEAD(cipherAESGCM, oldKey)
+	if err != nil {
+		return err
+	}
+	newGCM, err := newAEAD(cipherAESGCM, newKey)
+	if err != nil {
+		return err
+	}
+	plain, err := oldGCM.Open(nil, data[len(magic)+1:len(magic)+13], data[fixed:], nil)
+	if err != nil {
+		return fmt.Errorf("wrong password or corrupt archive: %w", err)
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append([]byte(nil), data[:fixed]...)
+	copy(out[len(magic)+1:], nonce)
+	out = newGCM.Seal(out, nonce, plain, nil)
+	clear(plain)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".rekey-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
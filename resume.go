@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------------------- Resuming extraction (-resume) --------------
+//
+// While extracting, goZip notes every finished entry in .ghzip-resume in
+// the destination directory, a line with the entry's number and name
+// after one naming the archive ID; files written in parallel (-jobs) are
+// noted as each is complete, so the lines need not be in order. The file
+// is removed when extraction succeeds, or fails with an error; only an
+// interruption (SIGINT or SIGTERM, interrupt.go) or a crash leaves it
+// behind, so a later extraction does not warn of one that never was.
+// After one, "ghzip -x -resume" with the same archive and destination
+// writes the entries not noted, from the start. The others are decoded,
+// as hard links and directory times need their headers, but not written
+// again. Version 1 archives have no ID and cannot be resumed.
+
+// resumeFile is the name of the progress record in the destination.
+const resumeFile = ".ghzip-resume"
+
+// progressLog appends finished entries to the progress record.
+type progressLog struct {
+	path string
+	mu   sync.Mutex // add is called by file writers too
+	f    *os.File
+}
+
+// openProgress starts the progress record in destDir for the archive
+// meta describes or, with resume, reads the one left there and returns
+// the numbers of the entries it lists as done.
+func openProgress(destDir string, meta archiveMeta, resume bool) (*progressLog, map[int]bool, error) {
+	id := meta.idString()
+	if id == "" {
+		if resume {
+			return nil, nil, errors.New("-resume: version 1 archives cannot be resumed")
+		}
+		return nil, nil, nil
+	}
+	path := filepath.Join(destDir, resumeFile)
+	head := "ghzip-resume " + id + "\n"
+	var lines []string
+	done := make(map[int]bool)
+	data, err := os.ReadFile(path)
+	switch {
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, nil, err
+	case resume && err != nil:
+		return nil, nil, fmt.Errorf("-resume: %s has no %s; nothing to resume", destDir, resumeFile)
+	case resume:
+		rest, ok := bytes.CutPrefix(data, []byte(head))
+		if !ok {
+			return nil, nil, fmt.Errorf("-resume: %s was left by another archive", path)
+		}
+		// only whole lines count
+		for _, line := range strings.SplitAfter(string(rest), "\n") {
+			n, _, ok := strings.Cut(line, "\t")
+			num, err := strconv.Atoi(n)
+			if !strings.HasSuffix(line, "\n") || !ok || err != nil || num < 0 {
+				break
+			}
+			lines = append(lines, line)
+			done[num] = true
+		}
+	case err == nil:
+		fmt.Fprintf(os.Stderr, "warning: an interrupted extraction left %s; starting over (-resume continues it)\n", path)
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Create(path)
+	if err == nil {
+		_, err = io.WriteString(f, head+strings.Join(lines, ""))
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, nil, err
+	}
+	return &progressLog{path: path, f: f}, done, nil
+}
+
+// add notes entry num, named name, as done.
+func (l *progressLog) add(num int, name string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintf(l.f, "%d\t%s\n", num, strconv.Quote(name))
+	return err
+}
+
+// finish removes the record of a completed extraction.
+func (l *progressLog) finish() error {
+	if l == nil {
+		return nil
+	}
+	l.f.Close()
+	return os.Remove(l.path)
+}
+
+// close ends the record of an extraction that returned err: it is kept
+// if a signal stopped it, for -resume, and removed after other errors.
+func (l *progressLog) close(err error) {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	if err != nil && interrupted() == nil {
+		os.Remove(l.path)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ---------------------- Run-length pre-pass (method rle) -----------
+//
+// Long runs of one byte (bitmaps, disk images, zero padding) cost Huffman
+// at least one bit per byte. The rle method first collapses runs: after
+// four equal bytes comes a count byte (0-255) of further repeats. The
+// result is then Huffman coded. Method data:
+//
+//   [4 bytes length of the run-length coded data][code lengths + bits]
+//
+// Blocks for the huffman method switch to rle by themselves when runs make
+// up a good part of the block and the result is smaller (see encodeBlock).
+
+const rleMinRun = 4
+
+func rleCompress(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/rleMinRun+1)
+	for i := 0; i < len(raw); {
+		b := raw[i]
+		n := 1
+		for i+n < len(raw) && raw[i+n] == b && n < rleMinRun+255 {
+			n++
+		}
+		if n < rleMinRun {
+			out = append(out, raw[i:i+n]...)
+		} else {
+			for k := 0; k < rleMinRun; k++ {
+				out = append(out, b)
+			}
+			out = append(out, byte(n-rleMinRun))
+		}
+		i += n
+	}
+	return out
+}
+
+func rleExpand(data []byte, rawLen int) ([]byte, error) {
+	out := make([]byte, 0, rawLen)
+	run := 0
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if len(out) == rawLen {
+			return nil, errors.New("corrupt rle block (too long)")
+		}
+		out = append(out, b)
+		if len(out) > 1 && out[len(out)-2] == b {
+			run++
+		} else {
+			run = 1
+		}
+		if run == rleMinRun {
+			i++
+			if i == len(data) {
+				return nil, errors.New("corrupt rle block (missing count)")
+			}
+			n := int(data[i])
+			if len(out)+n > rawLen {
+				return nil, errors.New("corrupt rle block (too long)")
+			}
+			for ; n > 0; n-- {
+				out = append(out, b)
+			}
+			run = 0
+		}
+	}
+	if len(out) != rawLen {
+		return nil, errors.New("corrupt rle block (too short)")
+	}
+	return out, nil
+}
+
+// hasLongRuns reports whether at least an eighth of raw sits in runs long
+// enough for rleCompress to shorten.
+func hasLongRuns(raw []byte) bool {
+	inRuns := 0
+	for i := 0; i < len(raw); {
+		n := 1
+		for i+n < len(raw) && raw[i+n] == raw[i] {
+			n++
+		}
+		if n > rleMinRun {
+			inRuns += n
+		}
+		i += n
+	}
+	return inRuns >= len(raw)/8 && inRuns > 0
+}
+
+func rleEncode(raw []byte) ([]byte, error) {
+	r := rleCompress(raw)
+	coded, err := huffmanEncodeBlock(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(r))), coded...), nil
+}
+
+func rleDecode(data []byte, rawLen int) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("corrupt rle block (truncated)")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if int64(n) > int64(rawLen)+int64(rawLen)/rleMinRun+1 {
+		return nil, errors.New("corrupt rle block (length)")
+	}
+	r, err := huffmanDecodeBlock(data[4:], int(n))
+	if err != nil {
+		return nil, err
+	}
+	return rleExpand(r, rawLen)
+}
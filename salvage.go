@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ---------------------- Salvage (repair -salvage) ------------------
+//
+// "ghzip repair -salvage out/ -in damaged.gha" extracts what is left of an
+// archive the recovery record cannot fix (or that has none). Every block
+// is authenticated on its own, so a damaged block costs only the entries
+// whose data or header lies in it: an entry is written only if all of its
+// blocks open, and one that touches a damaged block is removed again and
+// reported as lost. Reading goes on at the next entry whose position is
+// known, which is right after a lost entry's data, or else the next block
+// that starts an entry in a per-file archive. In a solid archive, a
+// damaged entry header loses the entries after it up to the end.
+//
+// The header, key slots and metadata must be readable. A damaged block
+// index is rebuilt by following the blocks' length prefixes, assuming that
+// blocks which do not open hold a full block size of payload.
+
+// salvageReport sums up what salvageArchive recovered.
+type salvageReport struct {
+	recovered int
+	lost      []string // names of entries lost with damaged blocks
+	unknown   int      // entries lost without their name (-1 = unknown)
+	damaged   int      // damaged blocks
+	rebuilt   bool     // the block index was rebuilt
+}
+
+// errDamagedBlock is returned by salvageReader reads that reach a block
+// which does not open.
+var errDamagedBlock = errors.New("damaged block")
+
+// salvageArchive extracts every entry of the archive at path that can be
+// read intact into destDir.
+func salvageArchive(path, destDir, password string, ro readOptions) (salvageReport, error) {
+	rep := salvageReport{unknown: -1}
+	ar, err := openSalvage(path, password)
+	if err != nil {
+		return rep, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(ro); err != nil {
+		return rep, err
+	}
+	if ar.index == nil {
+		if ar.index, err = scanBlocks(ar); err != nil {
+			return rep, err
+		}
+		rep.rebuilt = true
+	}
+	sr := &salvageReader{ar: ar, total: payloadSize(ar.index), num: -1, bad: make(map[int]bool)}
+	names := make(map[string]string) // stored name -> name written, for hard links and copies
+	entries := 0                     // headers read, recovered or not
+	for pos := int64(0); pos < sr.total; {
+		sr.pos = pos
+		h, err := ar.nextEntry(sr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, errDamagedBlock) {
+				return rep, err
+			}
+			next, ok := sr.nextEntryStart(pos)
+			if !ok {
+				break
+			}
+			pos = next
+			continue
+		}
+		entries++
+		pos = sr.pos + int64(h.size)
+		if err := salvageEntry(sr, h, destDir, names); errors.Is(err, errDamagedBlock) {
+			fmt.Printf("lost: %s\n", h.name)
+			rep.lost = append(rep.lost, h.name)
+		} else if err != nil {
+			return rep, fmt.Errorf("%s: %w", h.name, err)
+		} else {
+			rep.recovered++
+		}
+	}
+	rep.damaged = len(sr.bad)
+	if ar.meta.hasTotals {
+		rep.unknown = max(0, int(ar.meta.entries)-entries)
+	}
+	return rep, nil
+}
+
+// salvageEntry extracts entry h, whose data sr reads next. A file that
+// runs into a damaged block is removed again.
+func salvageEntry(sr *salvageReader, h entryHeader, destDir string, names map[string]string) error {
+	name := extractName(h, "")
+	target, err := safeJoin(destDir, name)
+	if err != nil {
+		return err
+	}
+	if h.typ == entryDir {
+		if _, err := resolveBelow(destDir, target); err != nil {
+			return err
+		}
+		return os.MkdirAll(target, 0o755)
+	}
+	if h.typ == entryDeleted {
+		return nil // salvage reads no base to delete from
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if h.refers() {
+		data := make([]byte, h.size)
+		if _, err := io.ReadFull(sr, data); err != nil {
+			return err
+		}
+		if h.typ == entrySymlink {
+			err := extractSymlink(destDir, target, string(data), false)
+			if errors.Is(err, errUnsafeLink) {
+				fmt.Fprintf(os.Stderr, "warning: %v; not salvaged\n", err)
+				return nil
+			}
+			return err
+		}
+		first, ok := names[string(data)]
+		if !ok {
+			return fmt.Errorf("%w (hard link or copy target %s)", errDamagedBlock, data)
+		}
+		if h.typ == entryCopy {
+			f, size, err := openExtracted(destDir, first)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return extractCopy(target, f, size, h, extractOptions{}, &entryLimits{}, &mismatches{})
+		}
+		return extractHardlink(destDir, target, first)
+	}
+	var data io.Reader = sr
+	size := int64(h.size)
+	if h.filter.kind != filterNone {
+		data = &unfilterReader{r: sr, f: h.filter}
+	}
+	if h.typ == entryChunks {
+		cr := &chunkReader{r: io.LimitReader(sr, size), open: func(p chunkPlace, size int64) (io.Reader, error) {
+			first, ok := names[p.name]
+			if !ok {
+				return nil, fmt.Errorf("%w (chunks shared with %s)", errDamagedBlock, p.name)
+			}
+			path, err := sourceJoin(destDir, first)
+			if err != nil {
+				return nil, err
+			}
+			return openSection(path, p.off, size)
+		}}
+		defer cr.Close()
+		data, size = cr, int64(h.fileSize)
+	}
+	if err := writeEntryFile(target, data, size); err != nil {
+		os.Remove(target)
+		return err
+	}
+	names[h.name] = name
+	return restoreModeTime(target, h, extractOptions{})
+}
+
+// openSalvage opens the archive at path like openArchive, but carries on
+// when the trailers after the blocks or the block index are damaged; the
+// index is nil then.
+func openSalvage(path, password string) (*archiveReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	start, end, _, err := sfxRange(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sec := io.NewSectionReader(f, start, end-start)
+	size, err := archiveLength(sec, end-start)
+	if err == nil {
+		size, _, err = signatureLength(sec, size)
+	}
+	if err != nil {
+		size = end - start
+	}
+	ar, err := readArchiveHeader(io.NewSectionReader(f, start, size), password)
+	if errors.Is(err, errBadIndex) {
+		fmt.Fprintf(os.Stderr, "warning: %v; rebuilding it\n", err)
+		err = nil
+	}
+	if err == nil && ar.version == versionV1 {
+		err = errors.New("version 1 archives are sealed in one piece; nothing can be salvaged")
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ar.f = f
+	return ar, nil
+}
+
+// scanBlocks rebuilds the block index by following the length prefixes
+// from the first block. Blocks that do not open are taken to hold a full
+// block. The flags marking entry starts are lost with the index, so
+// nothing after a damaged entry header is found.
+func scanBlocks(ar *archiveReader) ([]blockInfo, error) {
+	br := ar.blocks
+	var index []blockInfo
+	off, rawOff := ar.blocksStart, int64(0)
+	for num := uint64(0); ; num++ {
+		var prefix [4]byte
+		if _, err := ar.r.ReadAt(prefix[:], off); err != nil {
+			break
+		}
+		slen := binary.LittleEndian.Uint32(prefix[:])
+		if slen == 0 || int64(slen) > int64(br.size)+1024 || off+4+int64(slen) > ar.r.Size() {
+			break
+		}
+		sealed := make([]byte, slen)
+		if _, err := ar.r.ReadAt(sealed, off+4); err != nil {
+			break
+		}
+		b := blockInfo{offset: off, rawOffset: rawOff, rawLen: uint32(br.size)}
+		for _, final := range []bool{false, true} {
+			if plain, err := br.decrypt(sealed, num, final); err == nil {
+				b.rawLen = binary.LittleEndian.Uint32(plain[1:5])
+				clear(plain)
+				break
+			}
+		}
+		index = append(index, b)
+		off += 4 + int64(slen)
+		rawOff += int64(b.rawLen)
+	}
+	if len(index) == 0 {
+		return nil, errors.New("no blocks found")
+	}
+	return index, nil
+}
+
+// salvageReader reads the payload at pos from the blocks of the index,
+// failing with errDamagedBlock where a block does not open.
+type salvageReader struct {
+	ar    *archiveReader
+	total int64
+	pos   int64
+	num   int    // the block in raw (-1 = none)
+	raw   []byte // decoded block num
+	bad   map[int]bool
+}
+
+func (sr *salvageReader) Read(p []byte) (int, error) {
+	if sr.pos >= sr.total {
+		return 0, io.EOF
+	}
+	index := sr.ar.index
+	num := sort.Search(len(index), func(i int) bool {
+		return index[i].rawOffset+int64(index[i].rawLen) > sr.pos
+	})
+	if err := sr.load(num); err != nil {
+		return 0, err
+	}
+	n := copy(p, sr.raw[sr.pos-index[num].rawOffset:])
+	sr.pos += int64(n)
+	return n, nil
+}
+
+// load decodes block num into raw, unless it is damaged.
+func (sr *salvageReader) load(num int) error {
+	if sr.bad[num] {
+		return fmt.Errorf("%w %d", errDamagedBlock, num)
+	}
+	if num == sr.num {
+		return nil
+	}
+	clear(sr.raw)
+	sr.num, sr.raw = -1, nil
+	raw, _, err := sr.ar.blocks.readAt(sr.ar.r, sr.ar.index, num)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		sr.bad[num] = true
+		return fmt.Errorf("%w %d", errDamagedBlock, num)
+	}
+	sr.num, sr.raw = num, raw
+	return nil
+}
+
+// nextEntryStart finds the first intact block after pos that begins with
+// an entry header.
+func (sr *salvageReader) nextEntryStart(pos int64) (int64, bool) {
+	for i, b := range sr.ar.index {
+		if b.rawOffset > pos && b.flags&blockEntryStart != 0 && sr.load(i) == nil {
+			return b.rawOffset, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+// ---------------------- scrypt (RFC 7914) ---------------------------
+//
+// scrypt stretches the password through PBKDF2-HMAC-SHA256 and a
+// sequential memory-hard mix (ROMix) of N blocks of 128*r bytes each, p
+// times. It is the alternative to Argon2id for users whose other tools
+// only speak scrypt.
+
+// scryptKey derives keyLen bytes; N = 1<<logN.
+func scryptKey(password, salt []byte, logN uint8, r, p uint32, keyLen int) ([]byte, error) {
+	n := 1 << logN
+	blockLen := 128 * int(r)
+	b, err := pbkdf2.Key(sha256.New, string(password), salt, 1, int(p)*blockLen)
+	if err != nil {
+		return nil, err
+	}
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*int(r))
+	for i := 0; i < int(p); i++ {
+		scryptROMix(b[i*blockLen:(i+1)*blockLen], int(r), n, v, xy)
+	}
+	defer func() { clear(b); clear(v); clear(xy) }()
+	return pbkdf2.Key(sha256.New, string(password), b, 1, keyLen)
+}
+
+// scryptROMix mixes one block b of 128*r bytes in place.
+func scryptROMix(b []byte, r, n int, v, xy []uint32) {
+	words := 32 * r
+	x, y := xy[:words], xy[words:]
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	var tmp [16]uint32
+	for i := 0; i < n; i += 2 {
+		copy(v[i*words:], x)
+		scryptBlockMix(&tmp, x, y, r)
+		copy(v[(i+1)*words:], y)
+		scryptBlockMix(&tmp, y, x, r)
+	}
+	for i := 0; i < n; i += 2 {
+		// Integerify: the first word of the last 64-byte chunk picks a block
+		j := int(x[words-16]) & (n - 1)
+		for k, w := range v[j*words : (j+1)*words] {
+			x[k] ^= w
+		}
+		scryptBlockMix(&tmp, x, y, r)
+		j = int(y[words-16]) & (n - 1)
+		for k, w := range v[j*words : (j+1)*words] {
+			y[k] ^= w
+		}
+		scryptBlockMix(&tmp, y, x, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+// scryptBlockMix runs Salsa20/8 over the 2*r chunks of in, writing the
+// even results to the first half of out and the odd ones to the second.
+func scryptBlockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsa208(tmp, in[i*16:])
+		copy(out[i*8:], tmp[:])
+		salsa208(tmp, in[i*16+16:])
+		copy(out[i*8+r*16:], tmp[:])
+	}
+}
+
+// salsa208 sets b to Salsa20/8(b xor in).
+func salsa208(b *[16]uint32, in []uint32) {
+	for i := range b {
+		b[i] ^= in[i]
+	}
+	x := *b
+	qr := func(a, b, c, d int) {
+		x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+		x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+		x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+		x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+	}
+	for i := 0; i < 8; i += 2 {
+		qr(0, 4, 8, 12) // columns
+		qr(5, 9, 13, 1)
+		qr(10, 14, 2, 6)
+		qr(15, 3, 7, 11)
+		qr(0, 1, 2, 3) // rows
+		qr(5, 6, 7, 4)
+		qr(10, 11, 8, 9)
+		qr(15, 12, 13, 14)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
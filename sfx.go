@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------- Self-extracting archives -------------------
+//
+// A self-extracting archive is a goZip binary (the stub) with an archive
+// appended to it:
+//
+//   [stub executable][archive][8 bytes archive offset]["GHSX"]
+//
+// On start-up the binary looks for the trailer at the end of its own file;
+// if it is there the binary extracts itself instead of running normally.
+// Any goZip build works as a stub, so bundles for other platforms use a
+// binary built with GOOS/GOARCH set (see -sfx-stub).
+
+const (
+	sfxTrailer     = "GHSX"
+	sfxTrailerSize = 12
+)
+
+// sfxRange returns where the archive in f starts and ends: the whole file
+// for plain archives, the appended part for self-extracting ones (sfx).
+func sfxRange(f *os.File) (start, end int64, sfx bool, err error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	end = st.Size()
+	if end < sfxTrailerSize {
+		return 0, end, false, nil
+	}
+	var trailer [sfxTrailerSize]byte
+	if _, err := f.ReadAt(trailer[:], end-sfxTrailerSize); err != nil {
+		return 0, 0, false, err
+	}
+	if string(trailer[8:]) != sfxTrailer {
+		return 0, end, false, nil
+	}
+	start = int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if start < 0 || start > end-sfxTrailerSize {
+		return 0, 0, false, errors.New("corrupt self-extracting archive trailer")
+	}
+	return start, end - sfxTrailerSize, true, nil
+}
+
+// buildSFX writes a self-extracting executable to outPath: the stub
+// (without any archive already appended to it) followed by the archive.
+func buildSFX(stubPath, archivePath, outPath string) error {
+	stub, err := os.Open(stubPath)
+	if err != nil {
+		return err
+	}
+	defer stub.Close()
+	stubLen, end, sfx, err := sfxRange(stub)
+	if err != nil {
+		return err
+	}
+	if !sfx {
+		stubLen = end // a plain binary: all of it is the stub
+	}
+	arc, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer arc.Close()
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: out}
+	if _, err := io.Copy(cw, io.NewSectionReader(stub, 0, stubLen)); err != nil {
+		out.Close()
+		return err
+	}
+	off := cw.n
+	if _, err := io.Copy(cw, arc); err != nil {
+		out.Close()
+		return err
+	}
+	trailer := binary.LittleEndian.AppendUint64(nil, uint64(off))
+	if _, err := cw.Write(append(trailer, sfxTrailer...)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// selfArchive reports whether the running executable carries an archive.
+func selfArchive() (string, bool) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", false
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	_, _, sfx, err := sfxRange(f)
+	return exe, err == nil && sfx
+}
+
+// runSFX extracts the archive appended to the executable exe, prompting
+// for whatever was not given on the command line.
+func runSFX(exe string, args []string) {
+	cmd := flag.NewFlagSet(filepath.Base(exe), flag.ExitOnError)
+	outPath := cmd.String("out", "", "destination directory (prompted for if empty)")
+	pass := cmd.String("pass", "", "password (prompted for if empty)")
+	parseCommand(cmd, args)
+
+	drawTitle("Self-extracting archive: " + filepath.Base(exe))
+	dest := *outPath
+	if dest == "" {
+		fmt.Print("Destination directory (default .): ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		dest = strings.TrimSpace(line)
+		if dest == "" {
+			dest = "."
+		}
+	}
+	pw := *pass
+	if pw == "" {
+		pw = promptPassword("Password: ")
+	}
+	stop := catchInterrupts()
+	defer stop()
+	if err := extractArchive(exe, dest, pw, extractOptions{}); err != nil {
+		fail("Extract failed: %v", err)
+		return
+	}
+	workDone()
+	showOK("Extracted to: %s", dest)
+}
+
+// createSFX creates an archive of inputPath and turns it into the
+// self-extracting executable outPath using stubPath (the running binary if
+// empty) as the extractor.
+func createSFX(inputPath, outPath, stubPath, password string, opts createOptions) error {
+	// the extractor has no way to be handed the dictionary, and must not
+	// run external programs
+	if opts.dict != nil {
+		return errors.New("self-extracting archives cannot use a dictionary")
+	}
+	if strings.HasPrefix(opts.method, "exec:") {
+		return errors.New("self-extracting archives cannot use an external compressor")
+	}
+	if stubPath == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("locating extractor stub: %w", err)
+		}
+		stubPath = exe
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(outPath), ".gozip-sfx-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := createArchive(inputPath, tmp.Name(), password, opts); err != nil {
+		return err
+	}
+	if opts.signKey != nil && opts.detachedSig {
+		// the signature covers the archive bytes, which the executable
+		// carries unchanged
+		if err := os.Rename(tmp.Name()+".sig", outPath+".sig"); err != nil {
+			return err
+		}
+	}
+	return buildSFX(stubPath, tmp.Name(), outPath)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ---------------------- Signatures ---------------------------------
+//
+// An archive can be signed with Ed25519 (Ed25519ph over the SHA-512 of the
+// archive bytes). The signature record is
+//
+//   [32 bytes public key][64 bytes signature]["GHSG"]
+//
+// and is either appended to the archive (before any recovery section, so
+// the recovery record protects it too) or written to "<archive>.sig".
+// Verification needs only the public key, not the password.
+
+const (
+	sigMagic      = "GHSG"
+	sigRecordSize = ed25519.PublicKeySize + ed25519.SignatureSize + len(sigMagic)
+)
+
+// loadSigningKey reads an Ed25519 private key from a PEM (PKCS #8) file,
+// as written by "openssl genpkey -algorithm ed25519".
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+	return priv, nil
+}
+
+// loadVerifyKey reads an Ed25519 public key from a PEM (PKIX) file, as
+// written by "openssl pkey -pubout".
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != typ {
+		return nil, fmt.Errorf("%s: no PEM %q block found", path, typ)
+	}
+	return blk.Bytes, nil
+}
+
+// keyFingerprint is a short printable identifier of a public key.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + hex.EncodeToString(sum[:8])
+}
+
+// archiveDigest hashes the first size bytes of r.
+func archiveDigest(r io.ReaderAt, size int64) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// signRecord signs the first size bytes of r and returns the signature record.
+func signRecord(r io.ReaderAt, size int64, key ed25519.PrivateKey) ([]byte, error) {
+	digest, err := archiveDigest(r, size)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(rand.Reader, digest, &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return nil, err
+	}
+	rec := append([]byte(nil), key.Public().(ed25519.PublicKey)...)
+	rec = append(rec, sig...)
+	return append(rec, sigMagic...), nil
+}
+
+// signatureLength returns how many of the size bytes in r belong to the
+// archive proper, leaving out an embedded signature record if there is one.
+func signatureLength(r io.ReaderAt, size int64) (int64, []byte, error) {
+	if size < int64(sigRecordSize) {
+		return size, nil, nil
+	}
+	rec := make([]byte, sigRecordSize)
+	if _, err := r.ReadAt(rec, size-int64(sigRecordSize)); err != nil {
+		return 0, nil, err
+	}
+	if string(rec[sigRecordSize-len(sigMagic):]) != sigMagic {
+		return size, nil, nil
+	}
+	return size - int64(sigRecordSize), rec, nil
+}
+
+// verifyArchiveSignature checks the embedded signature of the archive at
+// path, or the detached one in "<path>.sig", against pub.
+func verifyArchiveSignature(path string, pub ed25519.PublicKey) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, end, _, err := sfxRange(f)
+	if err != nil {
+		return err
+	}
+	sec := io.NewSectionReader(f, start, end-start)
+	size, err := archiveLength(sec, end-start)
+	if err != nil {
+		return err
+	}
+	size, rec, err := signatureLength(sec, size)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		if rec, err = os.ReadFile(path + ".sig"); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return errors.New("archive is not signed")
+			}
+			return err
+		}
+		if len(rec) != sigRecordSize || string(rec[sigRecordSize-len(sigMagic):]) != sigMagic {
+			return fmt.Errorf("%s.sig: not a signature file", path)
+		}
+	}
+	signer := ed25519.PublicKey(rec[:ed25519.PublicKeySize])
+	if !bytes.Equal(signer, pub) {
+		return fmt.Errorf("archive is signed by a different key (%s)", keyFingerprint(signer))
+	}
+	digest, err := archiveDigest(sec, size)
+	if err != nil {
+		return err
+	}
+	sig := rec[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	if err := ed25519.VerifyWithOptions(pub, digest, sig, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+		return errors.New("signature verification failed: archive was modified or the signature is corrupt")
+	}
+	return nil
+}
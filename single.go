@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ---------------------- ghzip z / unz ------------------------------
+//
+// "ghzip z notes.txt" and "ghzip unz notes.txt.gha" are gzip-like
+// shortcuts for one file: z encrypts and compresses notes.txt into
+// notes.txt.gha next to it, unz turns it back into notes.txt. Nothing is
+// asked but the password, and several files can be given at once, each
+// getting an archive of its own. As with gzip, unz gives the file back its
+// mode and modification time, and flags may come after the files; unlike
+// gzip, the input is kept, and an existing output is only replaced with
+// -f, once the file replacing it has been checked against its checksum.
+
+// singleSuffix is what z appends to a file name and unz removes.
+const singleSuffix = ".gha"
+
+func runZ(args []string) {
+	cmd := flag.NewFlagSet("z", flag.ExitOnError)
+	pass := cmd.String("pass", "", "password (prompted if not given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	force := cmd.Bool("f", false, "replace existing archives")
+	var levelFlags [10]*bool
+	for n := 1; n <= 9; n++ {
+		levelFlags[n] = cmd.Bool(strconv.Itoa(n), false, fmt.Sprintf("compression level %d, as for -c", n))
+	}
+	files := parseOperands(cmd, args)
+	if len(files) == 0 {
+		fmt.Println("usage: ghzip z [-1 ... -9] [-f] [-pass p] <file> ...")
+		return
+	}
+	var opts createOptions
+	for n, set := range levelFlags {
+		if set != nil && *set {
+			opts.level = n
+		}
+	}
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+		if !fi.Mode().IsRegular() {
+			fail("%s is not a regular file; use -c to archive directories", path)
+			exitCode = 1
+			return
+		}
+		if err := checkOutput(path+singleSuffix, *force); err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+	}
+	pw, err := singlePassword(*pass, *passFd, *passFile)
+	if err != nil {
+		fail("%v", err)
+		exitCode = 1
+		return
+	}
+	for _, path := range files {
+		if err := createArchive(path, path+singleSuffix, pw, opts); err != nil {
+			os.Remove(path + singleSuffix)
+			fail("%s: %v", path, err)
+			exitCode = 1
+			return
+		}
+		infof("%s -> %s", path, path+singleSuffix)
+	}
+}
+
+func runUnz(args []string) {
+	cmd := flag.NewFlagSet("unz", flag.ExitOnError)
+	pass := cmd.String("pass", "", "password (prompted if neither it nor -keyfile is given)")
+	passFd := cmd.Int("pass-fd", -1, "read the password from file descriptor `n`")
+	passFile := cmd.String("pass-file", "", "read the password from `file`")
+	keyfilePath := cmd.String("keyfile", "", "open the archives with a key `file` or X25519 identity file")
+	force := cmd.Bool("f", false, "replace existing files")
+	files := parseOperands(cmd, args)
+	if len(files) == 0 {
+		fmt.Println("usage: ghzip unz [-f] [-pass p | -keyfile f] <file.gha> ...")
+		return
+	}
+	for _, path := range files {
+		out, ok := strings.CutSuffix(path, singleSuffix)
+		if !ok || filepath.Base(path) == singleSuffix {
+			fail("%s does not end in %s", path, singleSuffix)
+			exitCode = 1
+			return
+		}
+		if err := checkOutput(out, *force); err != nil {
+			fail("%v", err)
+			exitCode = 1
+			return
+		}
+	}
+	var secret string
+	var err error
+	if *keyfilePath != "" {
+		secret, err = readKeyfile(*keyfilePath)
+	} else {
+		secret, err = singlePassword(*pass, *passFd, *passFile)
+	}
+	if err != nil {
+		fail("%v", err)
+		exitCode = 1
+		return
+	}
+	for _, path := range files {
+		out := strings.TrimSuffix(path, singleSuffix)
+		if err := extractSingle(path, out, secret); err != nil {
+			fail("%s: %v", path, err)
+			exitCode = 1
+			return
+		}
+		infof("%s -> %s", path, out)
+	}
+}
+
+// singlePassword returns the password from -pass, -pass-fd, -pass-file or
+// the environment, or else asks for it.
+func singlePassword(pass string, fd int, file string) (string, error) {
+	if pass != "" {
+		return pass, nil
+	}
+	pw, err := readPassword(fd, file)
+	if err != nil || pw != "" {
+		return pw, err
+	}
+	return promptPassword("Password: "), nil
+}
+
+// checkOutput refuses to overwrite path unless force is set.
+func checkOutput(path string, force bool) error {
+	if _, err := os.Lstat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists; use -f to replace it", path)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// extractSingle writes the one file in the archive at path to out. An
+// archive holding anything else is left to -x.
+func extractSingle(path, out, password string) error {
+	ar, err := openArchive(path, password)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+	if err := ar.prepare(readOptions{}); err != nil {
+		return err
+	}
+	h, err := readEntryHeader(ar.payload, ar.version)
+	if err == io.EOF || err == nil && h.typ != entryFile || ar.meta.hasTotals && ar.meta.entries != 1 {
+		return errors.New("not a single-file archive; extract it with -x")
+	}
+	if err != nil {
+		return err
+	}
+	var data io.Reader = ar.payload
+	if h.filter.kind != filterNone {
+		data = &unfilterReader{r: data, f: h.filter}
+	}
+	// out, which -f may let exist, is only replaced by a file that has
+	// passed every check
+	sum := sha256.New()
+	tmp, err := writeEntryTemp(out, io.TeeReader(data, sum), int64(h.size))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // gone already once renamed
+	if err := checkWritten(tmp, h, sum.Sum(nil), false); err != nil {
+		return err
+	}
+	if _, err := readEntryHeader(ar.payload, ar.version); err != io.EOF {
+		if err == nil {
+			err = errors.New("not a single-file archive; extract it with -x")
+		}
+		return err
+	}
+	if err := restoreModeTime(tmp, h, extractOptions{}); err != nil {
+		return err
+	}
+	return os.Rename(tmp, out)
+}
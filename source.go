@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ---------------------- Reading named entries back -----------------
+//
+// Copies and chunked entries (dedup.go, chunks.go) name earlier entries
+// for their data. Extraction reads that back from the files it wrote,
+// but grep, -to-stdout and export write no files, and -files, -strip,
+// -transform, -case-collisions skip or an existing file kept may leave
+// out the one named. They read it from the archive instead: an
+// archiveSource goes through the payload a second time, from the start
+// to the entry named, and starts over only for an entry behind it. A name
+// means the last entry of that name before the one naming it, as an
+// archive appended to (-a) may hold a name twice; one that is not in the
+// archive is looked up in its base (-base), opened with the same
+// password, and in that base's base in turn.
+
+// archiveSource reads back the contents of the entries of an archive.
+// Whatever reads through the archive adds each entry it has passed, so
+// that the entries after it can name it.
+type archiveSource struct {
+	path, password string
+	ar             *archiveReader
+	ro             readOptions
+	own            bool // ar was opened for the source, and is closed with it
+
+	names map[string][]int // the numbers of the entries of each name
+	count int              // entries added
+
+	base    *archiveSource // opened when first needed
+	baseErr error
+
+	// cursors[d] reads what is asked for at depth d: 0 for the caller,
+	// d+1 for the chunks that an entry read at depth d shares
+	cursors []*sourceCursor
+}
+
+func newArchiveSource(path, password string, ar *archiveReader, ro readOptions) *archiveSource {
+	return &archiveSource{path: path, password: password, ar: ar, ro: ro, names: make(map[string][]int)}
+}
+
+// add notes the next entry of the archive, named name.
+func (s *archiveSource) add(name string) {
+	s.names[name] = append(s.names[name], s.count)
+	s.count++
+}
+
+// open returns the contents of the file named name, the last entry of
+// that name added, and their size.
+func (s *archiveSource) open(name string) (io.Reader, int64, error) {
+	return s.section(0, name, s.count, 0, -1)
+}
+
+// chunks returns a reader of the contents of the chunked entry whose data
+// r reads: the entry after those added.
+func (s *archiveSource) chunks(r io.Reader) *chunkReader {
+	return s.chunkReader(0, r, s.count)
+}
+
+// contents returns a reader of the contents of entry h, the one after
+// those added, whose data r reads, and their size: a file's, a chunked
+// entry's or those of the file a copy is a copy of. Other entries have
+// none (nil).
+func (s *archiveSource) contents(h entryHeader, r io.Reader) (io.Reader, int64, error) {
+	switch h.typ {
+	case entryFile:
+		if h.filter.kind != filterNone {
+			r = &unfilterReader{r: r, f: h.filter}
+		}
+		return r, int64(h.size), nil
+	case entryChunks:
+		return s.chunks(r), int64(h.fileSize), nil
+	case entryCopy:
+		first, err := appendRead(nil, r, h.size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return s.open(string(first))
+	}
+	return nil, 0, nil
+}
+
+// chunkReader reads the contents of chunked entry number num from its
+// data in r, reading the chunks it shares at depth d.
+func (s *archiveSource) chunkReader(d int, r io.Reader, num int) *chunkReader {
+	return &chunkReader{r: r, open: func(p chunkPlace, size int64) (io.Reader, error) {
+		sec, _, err := s.section(d, p.name, num, p.off, size)
+		return sec, err
+	}}
+}
+
+// section returns size bytes (-1 for the rest) of the contents of the
+// file named name, the last entry of that name before entry number
+// before, from off on, and the size of the contents; d is the depth
+// reading it.
+func (s *archiveSource) section(d int, name string, before int, off, size int64) (io.Reader, int64, error) {
+	nums := s.names[name]
+	i := sort.SearchInts(nums, before) - 1
+	if i < 0 {
+		base, err := s.baseSource()
+		if err != nil {
+			return nil, 0, err
+		}
+		if base == nil {
+			return nil, 0, fmt.Errorf("%s is not in the archive", name)
+		}
+		return base.section(d, name, base.count, off, size)
+	}
+	num := nums[i]
+	for len(s.cursors) <= d {
+		s.cursors = append(s.cursors, &sourceCursor{num: -1})
+	}
+	c := s.cursors[d]
+	if c.num != num || c.off > off {
+		h, err := c.seek(s.ar, num)
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.name != name {
+			return nil, 0, fmt.Errorf("entry %d is %s, not %s", num, h.name, name)
+		}
+		switch h.typ {
+		case entryFile:
+			c.contents, c.size = c.data, int64(h.size)
+			if h.filter.kind != filterNone {
+				c.contents = &unfilterReader{r: c.data, f: h.filter}
+			}
+		case entryChunks:
+			cr := s.chunkReader(d+1, c.data, num)
+			c.contents, c.closer, c.size = cr, cr, int64(h.fileSize)
+		case entryCopy:
+			first, err := appendRead(nil, c.data, h.size)
+			if err != nil {
+				return nil, 0, err
+			}
+			c.num = -1
+			return s.section(d, string(first), num, off, size)
+		case entryDeleted:
+			return nil, 0, fmt.Errorf("%s is deleted in the archive", name)
+		default:
+			return nil, 0, fmt.Errorf("%s is not a file", name)
+		}
+		c.num = num
+	}
+	if _, err := io.CopyN(io.Discard, c, off-c.off); err != nil {
+		return nil, 0, noEOF(err)
+	}
+	if size < 0 {
+		size = c.size - off
+	}
+	return &sourceSection{c: c, n: size}, c.size, nil
+}
+
+// baseSource returns the source of the archive's base, nil if it has
+// none, reading through it once for the names of its entries.
+func (s *archiveSource) baseSource() (*archiveSource, error) {
+	if s.base != nil || s.baseErr != nil || s.ar.meta.basePath == "" {
+		return s.base, s.baseErr
+	}
+	path := basePath(s.path, s.ar.meta)
+	s.base, s.baseErr = openSource(path, s.password, s.ar.meta.baseID, s.ro)
+	if s.baseErr != nil {
+		s.baseErr = fmt.Errorf("base %s: %w", path, s.baseErr)
+	}
+	return s.base, s.baseErr
+}
+
+// openSource opens the archive at path, which must have the ID id, as a
+// source, adding all its entries.
+func openSource(path, password string, id [16]byte, ro readOptions) (*archiveSource, error) {
+	ar, err := openArchive(path, password)
+	if err != nil {
+		return nil, err
+	}
+	s := newArchiveSource(path, password, ar, ro)
+	s.own = true
+	if ar.meta.id != id {
+		s.Close()
+		return nil, fmt.Errorf("%s is not the base the archive was made against", path)
+	}
+	if err := ar.prepare(ro); err != nil {
+		s.Close()
+		return nil, err
+	}
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			return s, nil
+		}
+		if err == nil {
+			_, err = io.CopyN(io.Discard, ar.payload, int64(h.size))
+		}
+		if err != nil {
+			s.Close()
+			return nil, noEOF(err)
+		}
+		s.add(h.name)
+	}
+}
+
+// Close ends the passes through the archive and its bases.
+func (s *archiveSource) Close() error {
+	for _, c := range s.cursors {
+		c.close()
+	}
+	if s.base != nil {
+		s.base.Close()
+	}
+	if s.own {
+		return s.ar.Close()
+	}
+	return nil
+}
+
+// sourceCursor is a pass through the payload, reading the contents of an
+// entry.
+type sourceCursor struct {
+	r        io.Reader
+	next     int               // the number of the entry whose header is next
+	num      int               // the entry whose contents are read, -1 for none
+	data     *io.LimitedReader // the rest of its data
+	contents io.Reader         // its contents from off on
+	closer   io.Closer         // contents', if a chunked entry's
+	off      int64
+	size     int64 // of its contents
+}
+
+// seek moves to entry num, starting over from the first one if it was
+// passed, and returns its header.
+func (c *sourceCursor) seek(ar *archiveReader, num int) (entryHeader, error) {
+	c.closeContents()
+	if c.r == nil || c.next > num {
+		c.close()
+		c.r, c.next = ar.reread(), 0
+	} else if c.data != nil {
+		if _, err := io.Copy(io.Discard, c.data); err != nil {
+			return entryHeader{}, err
+		}
+	}
+	for {
+		h, err := readEntryHeader(c.r, ar.version)
+		if err != nil {
+			return h, noEOF(err)
+		}
+		c.next++
+		c.data = &io.LimitedReader{R: c.r, N: int64(h.size)}
+		if c.next > num {
+			return h, nil
+		}
+		if _, err := io.Copy(io.Discard, c.data); err != nil {
+			return h, err
+		}
+		if c.data.N > 0 {
+			return h, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func (c *sourceCursor) Read(p []byte) (int, error) {
+	n, err := c.contents.Read(p)
+	c.off += int64(n)
+	return n, err
+}
+
+// closeContents drops the contents being read.
+func (c *sourceCursor) closeContents() {
+	if c.closer != nil {
+		c.closer.Close()
+	}
+	c.num, c.contents, c.closer, c.off, c.size = -1, nil, nil, 0, 0
+}
+
+// close ends the pass.
+func (c *sourceCursor) close() {
+	c.closeContents()
+	if br, ok := c.r.(*blockReader); ok {
+		br.Close()
+	}
+	c.r, c.data = nil, nil
+}
+
+// sourceSection reads n bytes of the contents a cursor reads, failing if
+// they end sooner.
+type sourceSection struct {
+	c *sourceCursor
+	n int64
+}
+
+func (r *sourceSection) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	n, err := r.c.Read(p[:min(int64(len(p)), r.n)])
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileID reports no link information on platforms without inode numbers;
+// hard links are then archived as independent copies.
+func fileID(info fs.FileInfo) (id [2]uint64, linked bool) {
+	return id, false
+}
+
+// fileOwner reports no ownership information on platforms without uid/gid.
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the device/inode pair identifying the file behind info and
+// whether it has more than one hard link.
+func fileID(info fs.FileInfo) (id [2]uint64, linked bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, st.Nlink > 1
+}
+
+// fileOwner returns the uid/gid recorded in info.
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
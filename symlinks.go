@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ---------------------- Symlinks when creating ---------------------
+//
+// What goZip does with the symlinks it finds in -in or a -files-from list
+// is set by one of three flags. -store-symlinks, the default, archives
+// each as a link holding its target, which extraction recreates.
+// -follow-symlinks archives what a link points to under the link's name:
+// a file's contents, or a directory with everything below it. Links that
+// lead nowhere, and links to a directory the link is inside of, are left
+// out with a warning. -skip-symlinks leaves links out. -in itself is
+// always followed. A file reached along several paths is stored each
+// time, as tar -h does.
+
+const (
+	symlinkStore  = "store"
+	symlinkFollow = "follow"
+	symlinkSkip   = "skip"
+)
+
+// symlinkPolicy returns the policy the flags select; at most one may be
+// set.
+func symlinkPolicy(follow, skip, store bool) (string, error) {
+	policy := ""
+	for _, f := range []struct {
+		set    bool
+		policy string
+	}{{follow, symlinkFollow}, {skip, symlinkSkip}, {store, symlinkStore}} {
+		if f.set {
+			if policy != "" {
+				return "", errors.New("-follow-symlinks, -skip-symlinks and -store-symlinks exclude each other")
+			}
+			policy = f.policy
+		}
+	}
+	if policy == "" {
+		policy = symlinkStore
+	}
+	return policy, nil
+}
+
+// followSymlink adds what the symlink at path points to, named name, and
+// for a directory everything below it. chain holds the real directories
+// the links followed so far are in, to tell loops.
+func followSymlink(path, name string, exclude, chain []string, add func(inputFile)) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s: %v; not archived\n", name, err)
+		return nil
+	}
+	if !fi.IsDir() {
+		add(inputFile{relPath: name, absPath: path, info: fi})
+		return nil
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	chain = append(chain[:len(chain):len(chain)], dir)
+	for _, c := range chain {
+		if within(c, target) {
+			fmt.Fprintf(os.Stderr, "warning: %s: the symlink leads to a directory it is inside of; not followed\n", name)
+			return nil
+		}
+	}
+	add(inputFile{relPath: name, absPath: path, info: fi})
+	return walkTree(target, name, exclude, symlinkFollow, chain, add)
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isSymlink reports whether fi describes a symlink.
+func isSymlink(fi fs.FileInfo) bool {
+	return fi.Mode()&fs.ModeSymlink != 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ---------------------- Testing (-t) -------------------------------
+//
+// "ghzip -t -in backup.gha" checks an archive without extracting it:
+// every block is decrypted and decompressed, and the contents of each
+// file are hashed and compared with the SHA-256 recorded when it was
+// archived. Archives written before checksums were recorded are only
+// checked for damaged blocks, which fail authentication.
+
+// testResult is the outcome of testing one entry.
+type testResult struct {
+	h   entryHeader
+	err error // nil if the entry is intact
+}
+
+// testArchive reads every entry of the archive at archivePath. A damaged
+// block ends the test with an error; a file whose contents do not match
+// its checksum is reported in its result and the test goes on.
+func testArchive(archivePath, password string, ro readOptions) ([]testResult, archiveMeta, error) {
+	ar, err := openArchive(archivePath, password)
+	if err != nil {
+		return nil, archiveMeta{}, err
+	}
+	defer ar.Close()
+	if err := ar.prepare(ro); err != nil {
+		return nil, ar.meta, err
+	}
+	var results []testResult
+	sums := make(map[string][]byte) // file name -> checksum, for copies
+	chunks := make(chunkTable)
+	if ar.meta.basePath != "" {
+		// copies and shared chunks may name files of the base
+		base, err := readBase(basePath(archivePath, ar.meta), password)
+		if err != nil {
+			return nil, ar.meta, fmt.Errorf("base archive: %w", err)
+		}
+		if base.id != ar.meta.baseID {
+			return nil, ar.meta, fmt.Errorf("%s is not the base %s was made against", basePath(archivePath, ar.meta), archivePath)
+		}
+		for name, e := range base.entries {
+			sums[name] = e.h.sum
+			for _, c := range e.chunks {
+				chunks[chunkPlace{name, c.off}] = c
+			}
+		}
+	}
+	for {
+		h, err := ar.nextEntry(ar.payload)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return results, ar.meta, err
+		}
+		lr := &io.LimitedReader{R: ar.payload, N: int64(h.size)}
+		var data io.Reader = lr
+		var bad error
+		if h.refers() {
+			target, err := io.ReadAll(data)
+			if err != nil {
+				return results, ar.meta, err
+			}
+			h.linkTarget = string(target)
+			if h.typ == entryCopy {
+				if sum, ok := sums[h.linkTarget]; !ok {
+					bad = fmt.Errorf("copy of %s, which is not in the archive", h.linkTarget)
+				} else if h.sum != nil && !bytes.Equal(sum, h.sum) {
+					bad = errors.New("checksum mismatch")
+				}
+			}
+		} else if h.typ == entryChunks {
+			// the contents are not all here to hash, but each chunk is
+			if bad, err = chunks.check(h, data); err != nil {
+				return results, ar.meta, fmt.Errorf("%s: %w", h.name, err)
+			}
+			sums[h.name] = h.sum
+		} else {
+			if h.filter.kind != filterNone {
+				data = &unfilterReader{r: data, f: h.filter}
+			}
+			sum := sha256.New()
+			var w io.Writer = sum
+			finish := func() {}
+			if h.typ == entryFile && h.size > streamFileMin {
+				// later entries may share its chunks
+				var cw io.Writer
+				cw, finish = chunks.addFile(h.name)
+				w = io.MultiWriter(sum, cw)
+			}
+			if _, err := io.Copy(w, data); err != nil {
+				return results, ar.meta, fmt.Errorf("%s: %w", h.name, err)
+			}
+			finish()
+			if h.sum != nil && !bytes.Equal(sum.Sum(nil), h.sum) {
+				bad = errors.New("checksum mismatch")
+			}
+			sums[h.name] = h.sum
+		}
+		if lr.N > 0 {
+			return results, ar.meta, fmt.Errorf("%s: %w", h.name, io.ErrUnexpectedEOF)
+		}
+		results = append(results, testResult{h: h, err: bad})
+	}
+	if ar.meta.hasTotals && uint64(len(results)) != ar.meta.entries {
+		return results, ar.meta, fmt.Errorf("the archive holds %d entries, its header says %d", len(results), ar.meta.entries)
+	}
+	return results, ar.meta, nil
+}
+
+// printTest prints the results of testArchive, with -q only the failures,
+// and returns how many entries failed.
+func printTest(results []testResult) int {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Printf("  FAILED  %s: %v\n", displayName(r.h), r.err)
+		case logLevel == verbosityQuiet:
+		case r.h.typ == entryFile && r.h.sum == nil:
+			fmt.Printf("  OK      %s (no checksum recorded)\n", displayName(r.h))
+		default:
+			fmt.Printf("  OK      %s\n", displayName(r.h))
+		}
+	}
+	return failed
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ---------------------- Renaming on extract (-transform) -----------
+//
+// "-transform 'myapp-1.2/=myapp/'" restores the entries under myapp-1.2/
+// as myapp/. A rule is either such a prefix substitution, old=new, or a
+// sed-like s/regexp/replacement/ with the flags g (every match) and i
+// (ignore case); in the replacement, & is the match and \1 ... \9 its
+// groups, and any character may take the place of the slashes. Rules
+// apply in the order given, each to what the ones before made of the
+// name, after -strip; directory names end in a slash for them, so that
+// myapp-1.2/ itself is renamed too. An entry renamed to nothing is left
+// out, and one renamed out of the destination is refused as any such
+// name is. A symlink whose relative target is in the archive is pointed
+// at where the rules put that target; hard links and copies follow the
+// names written anyway.
+
+// nameRule is one -transform rule.
+type nameRule struct {
+	prefix, with string         // old=new
+	re           *regexp.Regexp // s/re/repl/
+	repl         string         // in regexp.Expand syntax
+	all          bool
+}
+
+// parseTransforms parses the -transform rules.
+func parseTransforms(rules []string) ([]nameRule, error) {
+	var parsed []nameRule
+	for _, r := range rules {
+		rule, err := parseTransform(r)
+		if err != nil {
+			return nil, fmt.Errorf("-transform %s: %w", r, err)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func parseTransform(r string) (nameRule, error) {
+	var parts []string
+	if len(r) >= 2 && r[0] == 's' && !isNameByte(r[1]) {
+		parts = splitUnescaped(r[2:], r[1])
+	}
+	if len(parts) != 3 { // not s/.../.../, so old=new
+		old, with, ok := strings.Cut(r, "=")
+		if !ok || old == "" {
+			return nameRule{}, errors.New("want old=new or s/regexp/replacement/")
+		}
+		return nameRule{prefix: old, with: with}, nil
+	}
+	expr, flags := parts[0], ""
+	rule := nameRule{repl: sedReplacement(parts[1])}
+	for _, f := range parts[2] {
+		switch f {
+		case 'g':
+			rule.all = true
+		case 'i':
+			flags = "(?i)"
+		default:
+			return nameRule{}, fmt.Errorf("unknown flag %q", f)
+		}
+	}
+	var err error
+	if rule.re, err = regexp.Compile(flags + expr); err != nil {
+		return nameRule{}, err
+	}
+	return rule, nil
+}
+
+// isNameByte reports whether c may follow an "s" in a prefix rule, rather
+// than being the delimiter of a sed rule.
+func isNameByte(c byte) bool {
+	return c == '=' || c == '.' || c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= 0x80
+}
+
+// splitUnescaped splits s at the delimiters d that are not preceded by a
+// backslash, removing the backslash from escaped ones.
+func splitUnescaped(s string, d byte) []string {
+	var parts []string
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == d:
+			cur.WriteByte(d)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			cur.WriteString(s[i : i+2])
+			i++
+		case s[i] == d:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// sedReplacement turns a sed replacement into regexp.Expand's template
+// syntax.
+func sedReplacement(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			fmt.Fprintf(&b, "${%c}", s[i+1])
+			i++
+		case c == '\\' && i+1 < len(s):
+			if s[i+1] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(s[i+1])
+			}
+			i++
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '$':
+			b.WriteString("$$")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// linkTarget returns the target symlink h gets with -transform: a
+// relative target leading to a name in the archive is renamed as that
+// entry is, and made relative to where h goes. Absolute targets, ones
+// leading out of the archive and ones the rules leave out stay as they
+// are.
+func (opts extractOptions) linkTarget(h entryHeader, target string) string {
+	if opts.transform == nil || target == "" || path.IsAbs(target) {
+		return target
+	}
+	name := extractName(h, opts.nameForm)
+	p := path.Join(path.Dir(name), target)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return target
+	}
+	to := opts.rename(p, false)
+	if to == stripComponents(p, opts.strip) { // the rules may rename it as a directory
+		to = opts.rename(p, true)
+	}
+	from := opts.rename(name, false)
+	if to == "" || from == "" {
+		return target
+	}
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(to))
+	if err != nil {
+		return target
+	}
+	if strings.HasSuffix(target, "/") {
+		rel += "/"
+	}
+	return filepath.ToSlash(rel)
+}
+
+// transformName applies rules to name.
+func transformName(rules []nameRule, name string) string {
+	for _, r := range rules {
+		if r.re == nil {
+			if rest, ok := strings.CutPrefix(name, r.prefix); ok {
+				name = r.with + rest
+			}
+			continue
+		}
+		if r.all {
+			name = r.re.ReplaceAllString(name, r.repl)
+			continue
+		}
+		if m := r.re.FindStringSubmatchIndex(name); m != nil {
+			name = name[:m[0]] + string(r.re.ExpandString(nil, r.repl, name, m)) + name[m[1]:]
+		}
+	}
+	return name
+}
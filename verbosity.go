@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ---------------------- Verbosity (-q, -v, -vv) --------------------
+//
+// Every command takes -q, -v and -vv. What a command is run for is always
+// printed: a listing, grep's matches, a diff, a new key, test failures,
+// errors and warnings. The rest depends on the level:
+//
+//	-q      nothing else
+//	        the boxes, summaries and "[ OK ]" lines, and a progress bar
+//	        when stdout is a terminal
+//	-v      a line per entry archived or extracted instead of the bar,
+//	        and entry details in listings
+//	-vv     also debug detail on stderr: methods, blocks, key slots and
+//	        timings
+
+// verbosity is how much goZip prints besides results.
+type verbosity int
+
+const (
+	verbosityQuiet verbosity = iota
+	verbosityNormal
+	verbosityVerbose
+	verbosityDebug
+)
+
+// logLevel is the verbosity set by the command line.
+var logLevel = verbosityNormal
+
+// parseCommand parses args into cmd after adding -q, -v and -vv to it,
+// and sets logLevel.
+func parseCommand(cmd *flag.FlagSet, args []string) {
+	parseCommandVerbose(cmd, args, verboseUsage)
+}
+
+// parseOperands is parseCommand for a command whose flags may also follow
+// its operands, as in "ghzip z notes.txt -q"; it returns the operands.
+// Everything after "--" is an operand.
+func parseOperands(cmd *flag.FlagSet, args []string) []string {
+	set := verbosityFlags(cmd, verboseUsage)
+	var operands []string
+	for {
+		cmd.Parse(args)
+		if used := len(args) - cmd.NArg(); used > 0 && args[used-1] == "--" || cmd.NArg() == 0 {
+			operands = append(operands, cmd.Args()...)
+			break
+		}
+		operands = append(operands, cmd.Arg(0))
+		args = cmd.Args()[1:]
+	}
+	if err := set(); err != nil {
+		fmt.Fprintln(cmd.Output(), err)
+		cmd.Usage()
+		os.Exit(2)
+	}
+	return operands
+}
+
+// parseCommandVerbose is parseCommand for a command whose -v does something
+// else than verboseUsage says.
+func parseCommandVerbose(cmd *flag.FlagSet, args []string, usage string) {
+	set := verbosityFlags(cmd, usage)
+	cmd.Parse(args)
+	if err := set(); err != nil {
+		fmt.Fprintln(cmd.Output(), err)
+		cmd.Usage()
+		os.Exit(2)
+	}
+}
+
+// verboseUsage is what -v does for most commands.
+const verboseUsage = "verbose: a line per entry archived or extracted, and entry details in listings"
+
+// verbosityFlags adds -q, -v and -vv to fs, with usage for -v; the function
+// returned sets logLevel from them once fs is parsed.
+func verbosityFlags(fs *flag.FlagSet, usage string) func() error {
+	q := fs.Bool("q", false, "quiet: print only results, warnings and errors")
+	v := fs.Bool("v", false, usage)
+	vv := fs.Bool("vv", false, "debug: -v, and methods, blocks, key slots and timings on stderr")
+	return func() error {
+		switch {
+		case *q && (*v || *vv):
+			return errors.New("-q conflicts with -v and -vv")
+		case *q:
+			logLevel = verbosityQuiet
+		case *vv:
+			logLevel = verbosityDebug
+		case *v:
+			logLevel = verbosityVerbose
+		}
+		return nil
+	}
+}
+
+// infof prints a summary line, unless -q.
+func infof(format string, args ...any) {
+	if logLevel >= verbosityNormal {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// verbosef prints a line about one entry, with -v.
+func verbosef(format string, args ...any) {
+	if logLevel >= verbosityVerbose {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// debugf prints debug detail to stderr, with -vv.
+func debugf(format string, args ...any) {
+	if logLevel >= verbosityDebug {
+		fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
+	}
+}
+
+// barsShown reports whether progress bars are drawn: at the default
+// level, on a terminal.
+func barsShown() bool {
+	if logLevel != verbosityNormal {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ---------------------- Checksums on extract -----------------------
+//
+// Extracted files are hashed as they are written and the SHA-256 is
+// compared with the one recorded for the entry; with -verify every file
+// is read back from disk once written and hashed again, which catches
+// what went wrong on the way to the disk rather than in decoding.
+// Mismatching files are kept, reported as they occur and once more at
+// the end, where extraction fails. Entries of archives made before
+// checksums were recorded go unchecked.
+
+// errChecksum marks files whose contents do not match their checksum.
+var errChecksum = errors.New("checksum mismatch")
+
+// checkWritten compares sum, the SHA-256 of the data written to path for
+// entry h, with the recorded one and, if reread, hashes path once more.
+func checkWritten(path string, h entryHeader, sum []byte, reread bool) error {
+	if h.sum == nil {
+		return nil
+	}
+	if !bytes.Equal(sum, h.sum) {
+		return fmt.Errorf("%s: %w", h.name, errChecksum)
+	}
+	if !reread {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), h.sum) {
+		return fmt.Errorf("%s: %w (as read back from %s)", h.name, errChecksum, path)
+	}
+	return nil
+}
+
+// mismatches collects the files that failed checkWritten.
+type mismatches []string
+
+// add notes err if it is a checksum mismatch and returns any other error.
+func (m *mismatches) add(h entryHeader, err error) error {
+	if !errors.Is(err, errChecksum) {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	*m = append(*m, h.name)
+	return nil
+}
+
+func (m mismatches) err() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d file(s) do not match their checksums: %s", len(m), strings.Join(m, ", "))
+}
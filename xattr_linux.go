@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+)
+
+// xattrPrefixes are the namespaces archived with -xattrs. trusted.* and
+// system.* are left out: they are either root-only internals or derived
+// from other metadata (ACLs) that the archive does not model.
+var xattrPrefixes = []string{"user.", "security."}
+
+// readXattrs returns the archivable extended attributes of path.
+// Symlinks are skipped since syscall has no l*xattr variants.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		if err == syscall.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		n := string(name)
+		if !hasXattrPrefix(n) {
+			continue
+		}
+		vsize, err := syscall.Getxattr(path, n, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = syscall.Getxattr(path, n, val); err != nil {
+				return nil, err
+			}
+		}
+		attrs[n] = val[:vsize]
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the given attributes on path.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, val := range attrs {
+		if err := syscall.Setxattr(path, name, val, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasXattrPrefix(name string) bool {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// readXattrs archives no extended attributes on this platform.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs cannot restore extended attributes on this platform.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -0,0 +1,54 @@
+//go:build zstd
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ---------------------- zstd (optional) -----------------------------
+//
+// Builds with -tags zstd add the zstd method, backed by
+// github.com/klauspost/compress. Default builds stay stdlib-only; they
+// refuse "-method zstd" and report zstd blocks as needing this build.
+// Every block is one zstd frame (with its content size, which the encoder
+// leaves out of the tiniest). A frame may not keep a window larger than
+// the block, and decodes into no more than the block's raw length, so the
+// memory it takes is what blockMemory counts and -max-memory checks, as
+// for the other methods.
+
+var (
+	zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+)
+
+func init() {
+	codecs[methodZstd] = codec{"zstd", zstdEncode, zstdDecode}
+}
+
+func zstdEncode(raw []byte) ([]byte, error) {
+	return zstdEnc.EncodeAll(raw, nil), nil
+}
+
+func zstdDecode(data []byte, rawLen int) ([]byte, error) {
+	var h zstd.Header
+	if err := h.Decode(data); err != nil {
+		return nil, fmt.Errorf("corrupt zstd block: %w", err)
+	}
+	if h.HasFCS && h.FrameContentSize != uint64(rawLen) {
+		return nil, fmt.Errorf("corrupt zstd block (frame size %d, want %d)", h.FrameContentSize, rawLen)
+	}
+	if !h.SingleSegment && h.WindowSize > max(uint64(rawLen), zstd.MinWindowSize) {
+		return nil, fmt.Errorf("corrupt zstd block (window %d for %d bytes)", h.WindowSize, rawLen)
+	}
+	raw, err := zstdDec.DecodeAll(data, make([]byte, 0, rawLen))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt zstd block: %w", err)
+	}
+	if len(raw) != rawLen {
+		return nil, fmt.Errorf("corrupt zstd block (%d bytes, want %d)", len(raw), rawLen)
+	}
+	return raw, nil
+}